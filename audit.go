@@ -0,0 +1,106 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// AuditRecord describes a client registration attempt.
+type AuditRecord struct {
+	// Time is when the attempt finished.
+	Time time.Time `json:"time"`
+	// Identifier is the client identifier, it's empty if client
+	// certificate could not be obtained.
+	Identifier id.ID `json:"client_id"`
+	// Fingerprint is hex encoded SHA-256 fingerprint of client
+	// certificate.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// RemoteAddr is the client address.
+	RemoteAddr string `json:"remote_addr"`
+	// Hosts are hosts and addresses of the requested tunnels.
+	Hosts []string `json:"hosts,omitempty"`
+	// Accepted is true if client got connected.
+	Accepted bool `json:"accepted"`
+	// Reason describes why client was rejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditSink receives audit records, it must be safe for concurrent use.
+type AuditSink interface {
+	Audit(r *AuditRecord)
+}
+
+// AuditSinkFunc is an adapter allowing use of ordinary functions as
+// AuditSink.
+type AuditSinkFunc func(r *AuditRecord)
+
+// Audit calls f(r).
+func (f AuditSinkFunc) Audit(r *AuditRecord) {
+	f(r)
+}
+
+// NewWriterAuditSink returns AuditSink writing records to w as JSON lines, it
+// can be used with files and syslog.Writer.
+func NewWriterAuditSink(w io.Writer) AuditSink {
+	var mu sync.Mutex
+	return AuditSinkFunc(func(r *AuditRecord) {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return
+		}
+		b = append(b, '\n')
+
+		mu.Lock()
+		w.Write(b)
+		mu.Unlock()
+	})
+}
+
+// MultiAuditSink returns AuditSink passing records to all sinks.
+func MultiAuditSink(sinks ...AuditSink) AuditSink {
+	return AuditSinkFunc(func(r *AuditRecord) {
+		for _, s := range sinks {
+			s.Audit(r)
+		}
+	})
+}
+
+// audit sends record to ServerConfig.AuditSink if set.
+func (s *Server) audit(r *AuditRecord) {
+	if s.config.AuditSink == nil {
+		return
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	if r.Identifier != (id.ID{}) {
+		// identifier is SHA-256 of the certificate
+		r.Fingerprint = hex.EncodeToString(r.Identifier[:])
+	}
+	s.config.AuditSink.Audit(r)
+}
+
+// tunnelHosts returns sorted hosts and addresses of tunnels.
+func tunnelHosts(tunnels map[string]*proto.Tunnel) []string {
+	var hosts []string
+	for _, t := range tunnels {
+		if t.Host != "" {
+			hosts = append(hosts, t.Host)
+		} else {
+			hosts = append(hosts, t.Addr)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -0,0 +1,231 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// benchSizes are payload sizes of throughput benchmarks.
+var benchSizes = []int{1 << 10, 64 << 10, 1 << 20}
+
+// benchTunnel is a server and a client with HTTP and TCP tunnels to echo
+// services, logging is disabled so that it does not skew results.
+type benchTunnel struct {
+	httpAddr net.Addr
+	tcpAddr  net.Addr
+	closers  []func()
+}
+
+func startBenchTunnel(b *testing.B) *benchTunnel {
+	bt := &benchTunnel{}
+
+	// local services
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// HTTP/1 server cannot read body after response is flushed
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	bt.closers = append(bt.closers, local.Close)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go echoTCP(tcp)
+	bt.closers = append(bt.closers, func() { tcp.Close() })
+
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          "127.0.0.1:0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewNopLogger(),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	go s.Start()
+	bt.closers = append(bt.closers, s.Stop)
+	h := httptest.NewServer(s)
+	bt.closers = append(bt.closers, h.Close)
+	bt.httpAddr = h.Listener.Addr()
+	bt.tcpAddr = freeAddr()
+
+	// client
+	u, _ := url.Parse(local.URL)
+	httpProxy := tunnel.NewHTTPProxy(u, log.NewNopLogger())
+	tcpProxy := tunnel.NewTCPProxy(tcp.Addr().String(), log.NewNopLogger())
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.HTTP: {
+				Protocol: proto.HTTP,
+				Host:     "localhost",
+			},
+			proto.TCP: {
+				Protocol: proto.TCP,
+				Addr:     bt.tcpAddr.String(),
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			HTTP: httpProxy.Proxy,
+			TCP:  tcpProxy.Proxy,
+		}),
+		Logger: log.NewNopLogger(),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	go c.Start()
+	bt.closers = append(bt.closers, c.Stop)
+	waitConnected(b, c)
+
+	return bt
+}
+
+func (bt *benchTunnel) close() {
+	for i := len(bt.closers) - 1; i >= 0; i-- {
+		bt.closers[i]()
+	}
+}
+
+func (bt *benchTunnel) url() string {
+	return fmt.Sprintf("http://localhost:%s/", port(bt.httpAddr))
+}
+
+// BenchmarkHTTPThroughput measures echo of request bodies of different sizes
+// through HTTP tunnel.
+func BenchmarkHTTPThroughput(b *testing.B) {
+	bt := startBenchTunnel(b)
+	defer bt.close()
+
+	for _, size := range benchSizes {
+		payload := randBytes(size)
+		b.Run(byteSize(size), func(b *testing.B) {
+			b.SetBytes(int64(2 * size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Post(bt.url(), "application/octet-stream", bytes.NewReader(payload))
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != int64(size) {
+					b.Fatalf("expected %d bytes got %d", size, n)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHTTPLatency measures round trip of small requests through HTTP
+// tunnel, ns/op is the request latency.
+func BenchmarkHTTPLatency(b *testing.B) {
+	bt := startBenchTunnel(b)
+	defer bt.close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := http.Get(bt.url())
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b.Fatal("unexpected status code", resp.StatusCode)
+		}
+	}
+}
+
+// BenchmarkTCPThroughput measures echo of data written in chunks of different
+// sizes over a single TCP tunnel connection.
+func BenchmarkTCPThroughput(b *testing.B) {
+	bt := startBenchTunnel(b)
+	defer bt.close()
+
+	for _, size := range benchSizes {
+		payload := randBytes(size)
+		b.Run(byteSize(size), func(b *testing.B) {
+			conn, err := net.Dial("tcp", bt.tcpAddr.String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := io.CopyN(ioutil.Discard, conn, int64(b.N)*int64(size))
+				done <- err
+			}()
+
+			b.SetBytes(int64(2 * size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := <-done; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkTCPLatency measures round trip of a single byte over TCP tunnel
+// connection, ns/op is the round trip latency.
+func BenchmarkTCPLatency(b *testing.B) {
+	bt := startBenchTunnel(b)
+	defer bt.close()
+
+	conn, err := net.Dial("tcp", bt.tcpAddr.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func byteSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// CertificateHosts returns hostnames a client certificate authorizes, these
+// are DNS names of subject alternative names and organizational units of
+// subject. Names may be wildcards i.e. *.example.com.
+func CertificateHosts(cert *x509.Certificate) []string {
+	var hosts []string
+	for _, names := range [][]string{cert.DNSNames, cert.Subject.OrganizationalUnit} {
+		for _, h := range names {
+			if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts
+}
+
+// matchHost checks if host matches pattern, wildcard *.example.com matches
+// a single label i.e. a.example.com but not example.com or a.b.example.com.
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(host)
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+	i := strings.IndexByte(host, '.')
+	return i > 0 && host[i:] == pattern[1:]
+}
+
+// certHosts maps clients to hostnames authorized by their certificates.
+type certHosts struct {
+	clients map[id.ID][]string
+	mu      sync.Mutex
+}
+
+func newCertHosts() *certHosts {
+	return &certHosts{
+		clients: make(map[id.ID][]string),
+	}
+}
+
+// assign restricts client to hosts of cert, if cert is nil client is not
+// restricted.
+func (c *certHosts) assign(identifier id.ID, cert *x509.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cert == nil {
+		delete(c.clients, identifier)
+		return
+	}
+	c.clients[identifier] = CertificateHosts(cert)
+}
+
+// check returns error if client is restricted and host is not authorized by
+// its certificate.
+func (c *certHosts) check(identifier id.ID, host string) error {
+	c.mu.Lock()
+	hosts, ok := c.clients[identifier]
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	for _, p := range hosts {
+		if matchHost(p, trimPort(host)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q not in client certificate", host)
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"reflect"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestCertificateHosts(t *testing.T) {
+	t.Parallel()
+
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "client",
+			OrganizationalUnit: []string{"*.Team.example.com", " "},
+		},
+		DNSNames: []string{"app.example.com"},
+	}
+	expected := []string{"app.example.com", "*.team.example.com"}
+	if hosts := CertificateHosts(cert); !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %v got %v", expected, hosts)
+	}
+
+	c := newCertHosts()
+	restricted := id.New([]byte("restricted"))
+	c.assign(restricted, cert)
+
+	tests := []struct {
+		identifier id.ID
+		host       string
+		err        bool
+	}{
+		{restricted, "app.example.com", false},
+		{restricted, "APP.example.com:443", false},
+		{restricted, "a.team.example.com", false},
+		{restricted, "team.example.com", true},
+		{restricted, "a.b.team.example.com", true},
+		{restricted, "other.example.com", true},
+		{restricted, "", true},
+		{id.New([]byte("other")), "other.example.com", false},
+	}
+
+	for i, tt := range tests {
+		if err := c.check(tt.identifier, tt.host); (err != nil) != tt.err {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+	}
+
+	c.assign(restricted, nil)
+	if err := c.check(restricted, "other.example.com"); err != nil {
+		t.Error(err)
+	}
+}
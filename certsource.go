@@ -0,0 +1,306 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+)
+
+// Default certificate source settings.
+const (
+	DefaultCertRefreshInterval = time.Hour
+	DefaultVaultCertField      = "certificate"
+	DefaultVaultKeyField       = "private_key"
+)
+
+// CertSource fetches PEM encoded certificate chain and private key, it's an
+// alternative to files for keys that may not be stored on disk.
+type CertSource interface {
+	FetchCertificate(ctx context.Context) (certPEM, keyPEM []byte, err error)
+}
+
+// ExecCertSource runs Command and reads PEM certificate chain and private key
+// from its standard output, certificates and key may appear in any order.
+type ExecCertSource struct {
+	// Command specifies program and arguments printing the PEM data.
+	Command []string
+	// Timeout specifies how long the command may run, if 0 DefaultTimeout
+	// is used.
+	Timeout time.Duration
+}
+
+// FetchCertificate implements CertSource.
+func (s *ExecCertSource) FetchCertificate(ctx context.Context) ([]byte, []byte, error) {
+	if len(s.Command) == 0 {
+		return nil, nil, errors.New("missing Command")
+	}
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, nil, fmt.Errorf("%s: %s", err, msg)
+		}
+		return nil, nil, err
+	}
+
+	return splitPEM(out)
+}
+
+// splitPEM separates certificate blocks from private key block.
+func splitPEM(b []byte) (certPEM, keyPEM []byte, err error) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	if certPEM == nil {
+		return nil, nil, errors.New("no certificate found")
+	}
+	if keyPEM == nil {
+		return nil, nil, errors.New("no private key found")
+	}
+	return certPEM, keyPEM, nil
+}
+
+// VaultCertSource reads PEM certificate chain and private key from fields of
+// HashiCorp Vault secret, KV version 1 and 2 secret engines are supported.
+type VaultCertSource struct {
+	// Addr specifies Vault address i.e. https://vault:8200.
+	Addr string
+	// Token specifies Vault token.
+	Token string
+	// Path specifies secret path, for KV version 2 it includes data
+	// segment i.e. secret/data/tunnel.
+	Path string
+	// CertField and KeyField specify secret fields holding PEM data, if
+	// empty DefaultVaultCertField and DefaultVaultKeyField are used.
+	CertField string
+	KeyField  string
+	// Client specifies optional HTTP client, if nil http.DefaultClient is
+	// used.
+	Client *http.Client
+	// Timeout specifies how long the request may take, if 0 DefaultTimeout
+	// is used.
+	Timeout time.Duration
+}
+
+// FetchCertificate implements CertSource.
+func (s *VaultCertSource) FetchCertificate(ctx context.Context) ([]byte, []byte, error) {
+	if s.Addr == "" {
+		return nil, nil, errors.New("missing Addr")
+	}
+	if s.Path == "" {
+		return nil, nil, errors.New("missing Path")
+	}
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(s.Addr, "/")+"/v1/"+strings.TrimPrefix(s.Path, "/"), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	if s.Token != "" {
+		req.Header.Set("X-Vault-Token", s.Token)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, nil, fmt.Errorf("vault: %s %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&secret); err != nil {
+		return nil, nil, fmt.Errorf("vault: %s", err)
+	}
+
+	// KV version 2 nests secret data in data field
+	data := secret.Data
+	if _, ok := data["metadata"]; ok {
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(data["data"], &nested); err == nil {
+			data = nested
+		}
+	}
+
+	certField, keyField := s.CertField, s.KeyField
+	if certField == "" {
+		certField = DefaultVaultCertField
+	}
+	if keyField == "" {
+		keyField = DefaultVaultKeyField
+	}
+
+	var certPEM, keyPEM string
+	if err := json.Unmarshal(data[certField], &certPEM); err != nil || certPEM == "" {
+		return nil, nil, fmt.Errorf("vault: missing field %q", certField)
+	}
+	if err := json.Unmarshal(data[keyField], &keyPEM); err != nil || keyPEM == "" {
+		return nil, nil, fmt.Errorf("vault: missing field %q", keyField)
+	}
+
+	return []byte(certPEM), []byte(keyPEM), nil
+}
+
+// CertReloader holds certificate fetched from CertSource and refreshes it
+// periodically, it's used with tls.Config GetCertificate or
+// GetClientCertificate. If refresh fails the previous certificate is kept.
+// It's safe for concurrent use.
+type CertReloader struct {
+	// OnChange is optional function called by Run when refreshed
+	// certificate differs from the previous one i.e. client identifier,
+	// derived from the certificate, changes. It must be set before Run is
+	// invoked.
+	OnChange func(cert *tls.Certificate)
+
+	source   CertSource
+	interval time.Duration
+	logger   log.Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertReloader fetches certificate from source and returns reloader
+// refreshing it every interval, if interval is 0 DefaultCertRefreshInterval
+// is used. Caller must invoke Run to start refreshing.
+func NewCertReloader(source CertSource, interval time.Duration, logger log.Logger) (*CertReloader, error) {
+	if interval == 0 {
+		interval = DefaultCertRefreshInterval
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	r := &CertReloader{
+		source:   source,
+		interval: interval,
+		logger:   logger,
+	}
+	if err := r.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload fetches certificate from source and replaces the current one if
+// it's valid. Built-in sources bound the fetch with their Timeout.
+func (r *CertReloader) Reload(ctx context.Context) error {
+	certPEM, keyPEM, err := r.source.FetchCertificate(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch certificate: %s", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %s", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Run refreshes certificate until ctx is done.
+func (r *CertReloader) Run(ctx context.Context) {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+
+		prev := r.Certificate()
+		if err := r.Reload(ctx); err != nil {
+			r.logger.Log(
+				"level", 0,
+				"msg", "certificate refresh failed",
+				"err", err,
+			)
+			continue
+		}
+		r.logger.Log(
+			"level", 2,
+			"action", "certificate refreshed",
+		)
+
+		if cert := r.Certificate(); !bytes.Equal(cert.Certificate[0], prev.Certificate[0]) && r.OnChange != nil {
+			r.OnChange(cert)
+		}
+	}
+}
+
+// Certificate returns the current certificate.
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// GetCertificate returns the current certificate, it can be used as
+// tls.Config GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate returns the current certificate, it can be used as
+// tls.Config GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
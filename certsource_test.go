@@ -0,0 +1,170 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func readKeyPair(t *testing.T) (certPEM, keyPEM []byte) {
+	certPEM, err := ioutil.ReadFile("./testdata/selfsigned.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err = ioutil.ReadFile("./testdata/selfsigned.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, keyPEM
+}
+
+func TestExecCertSource(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		command []string
+		err     bool
+	}{
+		{[]string{"cat", "./testdata/selfsigned.key", "./testdata/selfsigned.crt"}, false},
+		{[]string{"cat", "./testdata/selfsigned.crt"}, true},
+		{[]string{"cat", "./testdata/selfsigned.key"}, true},
+		{[]string{"sh", "-c", "echo denied >&2; exit 1"}, true},
+		{nil, true},
+	}
+
+	for i, tt := range tests {
+		s := &ExecCertSource{Command: tt.command}
+		certPEM, keyPEM, err := s.FetchCertificate(context.Background())
+		if (err != nil) != tt.err {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+		if err == nil && (len(certPEM) == 0 || len(keyPEM) == 0) {
+			t.Errorf("[%d] missing PEM data", i)
+		}
+	}
+}
+
+func TestVaultCertSource(t *testing.T) {
+	t.Parallel()
+
+	certPEM, keyPEM := readKeyPair(t)
+	fields := map[string]string{
+		"certificate": string(certPEM),
+		"private_key": string(keyPEM),
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/tunnel":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": fields})
+		case "/v1/kv/slow":
+			<-r.Context().Done()
+		case "/v1/secret/data/tunnel":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     fields,
+					"metadata": map[string]interface{}{"version": 1},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		source *VaultCertSource
+		err    bool
+	}{
+		{&VaultCertSource{Addr: s.URL, Token: "token", Path: "kv/tunnel"}, false},
+		{&VaultCertSource{Addr: s.URL + "/", Token: "token", Path: "/secret/data/tunnel"}, false},
+		{&VaultCertSource{Addr: s.URL, Token: "token", Path: "kv/tunnel", CertField: "crt"}, true},
+		{&VaultCertSource{Addr: s.URL, Token: "token", Path: "kv/missing"}, true},
+		{&VaultCertSource{Addr: s.URL, Token: "bad", Path: "kv/tunnel"}, true},
+		{&VaultCertSource{Addr: s.URL, Token: "token"}, true},
+		{&VaultCertSource{Addr: s.URL, Token: "token", Path: "kv/slow", Timeout: 10 * time.Millisecond}, true},
+	}
+
+	for i, tt := range tests {
+		c, k, err := tt.source.FetchCertificate(context.Background())
+		if (err != nil) != tt.err {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+		if err == nil && (string(c) != string(certPEM) || string(k) != string(keyPEM)) {
+			t.Errorf("[%d] unexpected PEM data", i)
+		}
+	}
+}
+
+type certSourceFunc func(ctx context.Context) ([]byte, []byte, error)
+
+func (f certSourceFunc) FetchCertificate(ctx context.Context) ([]byte, []byte, error) {
+	return f(ctx)
+}
+
+func TestCertReloader(t *testing.T) {
+	t.Parallel()
+
+	certPEM, keyPEM := readKeyPair(t)
+	var fail error
+	source := certSourceFunc(func(ctx context.Context) ([]byte, []byte, error) {
+		if fail != nil {
+			return nil, nil, fail
+		}
+		return certPEM, keyPEM, nil
+	})
+
+	r, err := NewCertReloader(source, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := r.Certificate()
+	if cert == nil {
+		t.Fatal("missing certificate")
+	}
+	if c, _ := r.GetCertificate(nil); c != cert {
+		t.Error("GetCertificate returned different certificate")
+	}
+	if c, _ := r.GetClientCertificate(nil); c != cert {
+		t.Error("GetClientCertificate returned different certificate")
+	}
+
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r.Certificate() == cert {
+		t.Error("certificate not replaced")
+	}
+
+	// failed refresh keeps certificate
+	cert = r.Certificate()
+	fail = errors.New("unavailable")
+	if err := r.Reload(context.Background()); err == nil {
+		t.Error("expected error")
+	}
+	fail = nil
+	keyPEM = certPEM
+	if err := r.Reload(context.Background()); err == nil {
+		t.Error("expected error")
+	}
+	if r.Certificate() != cert {
+		t.Error("certificate replaced")
+	}
+
+	if _, err := NewCertReloader(source, 0, nil); err == nil {
+		t.Error("expected error")
+	}
+}
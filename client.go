@@ -5,12 +5,16 @@
 package tunnel
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -20,6 +24,14 @@ import (
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
+const (
+	// defaultStreamBuffer is the default ClientConfig.StreamBuffer.
+	defaultStreamBuffer = 1 << 20
+	// streamBuffersPerConn specifies how many stream buffers are buffered
+	// per connection.
+	streamBuffersPerConn = 16
+)
+
 // ClientConfig is configuration of the Client.
 type ClientConfig struct {
 	// ServerAddr specifies TCP address of the tunnel server.
@@ -30,14 +42,34 @@ type ClientConfig struct {
 	// DialTLS specifies an optional dial function that creates a tls
 	// connection to the server. If DialTLS is nil, tls.Dial is used.
 	DialTLS func(network, addr string, config *tls.Config) (net.Conn, error)
+	// Transport specifies how the client connects to the server,
+	// TransportTCP if empty. With TransportWebSocket ServerAddr is an HTTPS
+	// address of the server, the connection looks like a regular HTTPS
+	// WebSocket to proxies and firewalls. DialTLS is not used with
+	// TransportWebSocket.
+	Transport string
+	// StreamBuffer specifies how many bytes sent by the server and not yet
+	// consumed by local service are buffered per stream, when the buffer is
+	// full HTTP/2 flow control blocks the server and in turn the public
+	// caller. If zero 1MB is used. The connection buffers 16 times as much
+	// so that a few slow streams do not block the others.
+	StreamBuffer int32
 	// Backoff specifies backoff policy on server connection retry. If nil
 	// when dial fails it will not be retried.
 	Backoff Backoff
-	// Tunnels specifies the tunnels client requests to be opened on server.
+	// Tunnels specifies the tunnels client requests to be opened on server,
+	// they can be replaced with Client.SetTunnels.
 	Tunnels map[string]*proto.Tunnel
 	// Proxy is ProxyFunc responsible for transferring data between server
 	// and local services.
 	Proxy ProxyFunc
+	// ProxyContext is like Proxy but it's given a context canceled when
+	// the stream is closed. If set Proxy is ignored.
+	ProxyContext ProxyFuncContext
+	// OnTunnelRegistered is called for each tunnel registered by the server
+	// on every connection, tunnels with empty host are given host assigned by
+	// the server.
+	OnTunnelRegistered func(name string, t *proto.Tunnel)
 	// Logger is optional logger. If nil logging is disabled.
 	Logger log.Logger
 }
@@ -48,12 +80,41 @@ type ClientConfig struct {
 type Client struct {
 	config *ClientConfig
 
-	conn           net.Conn
+	conn           *tunnelConn
 	connMu         sync.Mutex
-	httpServer     *http2.Server
 	serverErr      error
 	lastDisconnect time.Time
+	proxy          ProxyFuncContext
 	logger         log.Logger
+
+	// draining holds connections replaced by SetTunnels that still serve
+	// proxied streams
+	draining map[*tunnelConn]struct{}
+	// cancelDial interrupts dial and backoff in progress
+	cancelDial context.CancelFunc
+	// stopping is set when client is stopped with StopContext
+	stopping bool
+	// wake is signaled when tunnels are set or client is stopping
+	wake chan struct{}
+
+	// statusMu guards tunnels, counters, sched, sent, connectedAt,
+	// connects, lastErr, lastErrAt, registered and version, tunnels and
+	// counters maps are replaced not modified
+	statusMu sync.Mutex
+	// tunnels holds tunnels requested from the server
+	tunnels map[string]*proto.Tunnel
+	// counters holds traffic counters of tunnels by name
+	counters map[string]*tunnelCounters
+	// sched schedules writes if tunnels have different priorities
+	sched *scheduler
+	// sent is true if tunnels were sent to the server on this connection
+	sent        bool
+	connectedAt time.Time
+	connects    int64
+	lastErr     error
+	lastErrAt   time.Time
+	registered  map[string]*proto.Tunnel
+	version     int
 }
 
 // NewClient creates a new unconnected Client based on configuration. Caller
@@ -68,87 +129,256 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	if len(config.Tunnels) == 0 {
 		return nil, errors.New("missing Tunnels")
 	}
-	if config.Proxy == nil {
+	if config.Proxy == nil && config.ProxyContext == nil {
 		return nil, errors.New("missing Proxy")
 	}
+	switch config.Transport {
+	case "", TransportTCP, TransportWebSocket:
+	default:
+		return nil, fmt.Errorf("invalid Transport %q", config.Transport)
+	}
+	if config.StreamBuffer < 0 {
+		return nil, errors.New("invalid StreamBuffer")
+	}
 
 	logger := config.Logger
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
+	proxy := config.ProxyContext
+	if proxy == nil {
+		proxy = ProxyFuncWithContext(config.Proxy)
+	}
+
 	c := &Client{
-		config:     config,
-		httpServer: &http2.Server{},
-		logger:     logger,
+		config:   config,
+		proxy:    proxy,
+		logger:   logger,
+		draining: make(map[*tunnelConn]struct{}),
+		wake:     make(chan struct{}, 1),
 	}
+	c.tunnels, c.counters = copyTunnels(config.Tunnels, nil)
+	c.sched = c.scheduler(nil)
 
 	return c, nil
 }
 
+// tunnelConn is connection to the server served by its own HTTP/2 server, so
+// that it can be drained independently of other connections.
+type tunnelConn struct {
+	conn       net.Conn
+	httpServer *http2.Server
+	baseServer *http.Server
+	// served is closed when serving conn is done
+	served chan struct{}
+	// replaced is closed when conn is replaced by SetTunnels
+	replaced chan struct{}
+}
+
+func (c *Client) newTunnelConn(conn net.Conn) (*tunnelConn, error) {
+	tc := &tunnelConn{
+		conn: conn,
+		httpServer: &http2.Server{
+			MaxUploadBufferPerStream:     c.config.StreamBuffer,
+			MaxUploadBufferPerConnection: connBuffer(c.config.StreamBuffer),
+		},
+		baseServer: &http.Server{},
+		served:     make(chan struct{}),
+		replaced:   make(chan struct{}),
+	}
+	// shutdown of base server sends GOAWAY to the server
+	if err := http2.ConfigureServer(tc.baseServer, tc.httpServer); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// drain sends GOAWAY to the server, server stops sending new requests and
+// connections and streams in flight continue until they are done.
+func (tc *tunnelConn) drain(ctx context.Context) {
+	tc.baseServer.Shutdown(ctx)
+}
+
 // Start connects client to the server, it returns error if there is a
 // connection error, or server cannot open requested tunnels. On connection
 // error a backoff policy is used to reestablish the connection. When connected
 // HTTP/2 server is started to handle ControlMessages.
 func (c *Client) Start() error {
+	return c.StartContext(context.Background())
+}
+
+// StartContext is like Start but when ctx is canceled dialing, handshake and
+// backoff are interrupted, connection to the server is closed aborting all
+// proxied streams, and ctx.Err() is returned.
+func (c *Client) StartContext(ctx context.Context) error {
 	c.logger.Log(
 		"level", 1,
 		"action", "start",
 	)
 
 	for {
-		conn, err := c.connect()
+		if err := c.waitTunnels(ctx); err != nil {
+			return err
+		}
+
+		tc, err := c.connect(ctx)
+		if err == errClientStopped {
+			return nil
+		}
 		if err != nil {
+			c.setStatus(time.Time{}, err)
 			return err
 		}
+		c.setStatus(time.Now(), nil)
 
-		c.httpServer.ServeConn(conn, &http2.ServeConnOpts{
-			Handler: http.HandlerFunc(c.serveHTTP),
-		})
+		go c.serve(ctx, tc)
+		select {
+		case <-tc.served:
+		case <-tc.replaced:
+		}
+
+		c.connMu.Lock()
+		// replaced connection is drained in background, reconnect to
+		// register the new tunnels
+		if c.conn != tc {
+			c.connMu.Unlock()
+			c.setStatus(time.Time{}, nil)
+			continue
+		}
 
 		c.logger.Log(
 			"level", 1,
 			"action", "disconnected",
 		)
 
-		c.connMu.Lock()
 		now := time.Now()
 		err = c.serverErr
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
 
 		// detect disconnect hiccup
 		if err == nil && now.Sub(c.lastDisconnect).Seconds() < 5 {
 			err = fmt.Errorf("connection is being cut")
 		}
 
+		stopping := c.stopping
 		c.conn = nil
 		c.serverErr = nil
 		c.lastDisconnect = now
 		c.connMu.Unlock()
 
+		c.setStatus(time.Time{}, err)
+
+		if stopping {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func (c *Client) connect() (net.Conn, error) {
+// serve serves HTTP/2 on tc until the connection is closed, or drained if
+// it's replaced.
+func (c *Client) serve(ctx context.Context, tc *tunnelConn) {
+	stop := closeOnDone(ctx, tc.conn)
+	tc.httpServer.ServeConn(tc.conn, &http2.ServeConnOpts{
+		BaseConfig: tc.baseServer,
+		Handler:    http.HandlerFunc(c.serveHTTP),
+	})
+	stop()
+
 	c.connMu.Lock()
-	defer c.connMu.Unlock()
+	if _, ok := c.draining[tc]; ok {
+		delete(c.draining, tc)
+		c.logger.Log(
+			"level", 1,
+			"action", "drained",
+		)
+	}
+	c.connMu.Unlock()
 
-	if c.conn != nil {
+	close(tc.served)
+}
+
+// waitTunnels blocks until there are tunnels to request from the server,
+// client is stopping or ctx is done.
+func (c *Client) waitTunnels(ctx context.Context) error {
+	for logged := false; ; logged = true {
+		c.connMu.Lock()
+		stopping := c.stopping
+		c.connMu.Unlock()
+		c.statusMu.Lock()
+		n := len(c.tunnels)
+		c.statusMu.Unlock()
+
+		if n > 0 || stopping {
+			return nil
+		}
+
+		if !logged {
+			c.logger.Log(
+				"level", 1,
+				"action", "wait for tunnels",
+			)
+		}
+
+		select {
+		case <-c.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// connect dials the server, connMu is not held while dialing so that Stop and
+// StopContext can interrupt dial and backoff with cancelDial.
+func (c *Client) connect(ctx context.Context) (*tunnelConn, error) {
+	c.connMu.Lock()
+	if c.stopping {
+		c.connMu.Unlock()
+		return nil, errClientStopped
+	}
+	if c.conn != nil || c.cancelDial != nil {
+		c.connMu.Unlock()
 		return nil, fmt.Errorf("already connected")
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.cancelDial = cancel
+	c.connMu.Unlock()
+
+	conn, err := c.dial(ctx)
 
-	conn, err := c.dial()
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	c.cancelDial = nil
+	if c.stopping {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, errClientStopped
+	}
 	if err != nil {
+		if err == ctx.Err() {
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to connect to server: %s", err)
 	}
-	c.conn = conn
+	tc, err := c.newTunnelConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.conn = tc
 
-	return conn, nil
+	return tc, nil
 }
 
-func (c *Client) dial() (net.Conn, error) {
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
 	var (
 		network   = "tcp"
 		addr      = c.config.ServerAddr
@@ -163,13 +393,15 @@ func (c *Client) dial() (net.Conn, error) {
 			"addr", addr,
 		)
 
-		if c.config.DialTLS != nil {
+		if c.config.Transport == TransportWebSocket {
+			conn, err = dialWebSocket(ctx, addr, tlsConfig)
+		} else if c.config.DialTLS != nil {
 			conn, err = c.config.DialTLS(network, addr, tlsConfig)
 		} else {
 			d := &net.Dialer{
 				Timeout: DefaultTimeout,
 			}
-			conn, err = d.Dial(network, addr)
+			conn, err = d.DialContext(ctx, network, addr)
 
 			if err == nil {
 				err = keepAlive(conn)
@@ -178,9 +410,12 @@ func (c *Client) dial() (net.Conn, error) {
 				conn = tls.Client(conn, tlsConfig)
 			}
 			if err == nil {
-				err = conn.(*tls.Conn).Handshake()
+				err = handshake(ctx, conn.(*tls.Conn))
 			}
 		}
+		if err == nil {
+			err = ctx.Err()
+		}
 
 		if err != nil {
 			if conn != nil {
@@ -188,6 +423,8 @@ func (c *Client) dial() (net.Conn, error) {
 				conn = nil
 			}
 
+			c.setStatus(time.Time{}, err)
+
 			c.logger.Log(
 				"level", 0,
 				"msg", "dial failed",
@@ -214,6 +451,11 @@ func (c *Client) dial() (net.Conn, error) {
 			return conn, err
 		}
 
+		// canceled
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
 		// failure
 		d := b.NextBackOff()
 		if d < 0 {
@@ -226,15 +468,43 @@ func (c *Client) dial() (net.Conn, error) {
 			"action", "backoff",
 			"sleep", d,
 		)
-		time.Sleep(d)
+
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// handshake runs TLS handshake on conn, if ctx is canceled before handshake is
+// done conn is closed.
+func handshake(ctx context.Context, conn *tls.Conn) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- conn.Handshake()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		conn.Close()
+		<-errc
+		return ctx.Err()
 	}
 }
 
 func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodConnect {
-		if r.Header.Get(proto.HeaderError) != "" {
+		switch {
+		case r.Header.Get(proto.HeaderError) != "":
 			c.handleHandshakeError(w, r)
-		} else {
+		case r.Header.Get(proto.HeaderRegistered) != "":
+			c.handleRegistered(w, r)
+		default:
 			c.handleHandshake(w, r)
 		}
 		return
@@ -257,14 +527,23 @@ func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 	switch msg.Action {
 	case proto.ActionProxy:
-		c.config.Proxy(w, r.Body, msg)
+		counters := c.countersFor(msg)
+		counters.begin()
+		c.statusMu.Lock()
+		sched := c.sched
+		c.statusMu.Unlock()
+		c.proxy(r.Context(), &tunnelResponseWriter{
+			priorityResponseWriter: newPriorityResponseWriter(w, sched, msg.Priority),
+			counters:               counters,
+		}, &tunnelReadCloser{r.Body, counters}, msg)
+		counters.end()
 	default:
 		c.logger.Log(
 			"level", 0,
 			"msg", "unknown action",
 			"ctrlMsg", msg,
 		)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		proxyError(w, proto.ErrorCodeProxyFailed, fmt.Errorf("unknown action %q", msg.Action))
 	}
 	c.logger.Log(
 		"level", 2,
@@ -295,9 +574,30 @@ func (c *Client) handleHandshake(w http.ResponseWriter, r *http.Request) {
 		"addr", r.RemoteAddr,
 	)
 
+	var version int
+	proto.WriteVersion(w.Header(), proto.MinVersion, proto.Version)
+	min, max, err := proto.ReadVersion(r.Header)
+	if err == nil {
+		version, err = proto.NegotiateVersion(proto.MinVersion, proto.Version, min, max)
+	}
+	if err != nil {
+		c.logger.Log(
+			"level", 0,
+			"msg", "handshake failed",
+			"err", err,
+		)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.statusMu.Lock()
+	c.version = version
+	c.sent = true
+	b, err := json.Marshal(c.tunnels)
+	c.statusMu.Unlock()
+
 	w.WriteHeader(http.StatusOK)
 
-	b, err := json.Marshal(c.config.Tunnels)
 	if err != nil {
 		c.logger.Log(
 			"level", 0,
@@ -309,6 +609,150 @@ func (c *Client) handleHandshake(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func (c *Client) handleRegistered(w http.ResponseWriter, r *http.Request) {
+	var tunnels map[string]*proto.Tunnel
+	if err := json.NewDecoder(&io.LimitedReader{R: r.Body, N: 126976}).Decode(&tunnels); err != nil {
+		c.logger.Log(
+			"level", 1,
+			"msg", "invalid registered tunnels",
+			"err", err,
+		)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	names := make([]string, 0, len(tunnels))
+	for name := range tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c.statusMu.Lock()
+	c.registered = tunnels
+	c.statusMu.Unlock()
+
+	for _, name := range names {
+		t := tunnels[name]
+		if t == nil {
+			continue
+		}
+		c.logger.Log(
+			"level", 1,
+			"action", "tunnel registered",
+			"name", name,
+			"proto", t.Protocol,
+			"host", t.Host,
+			"addr", t.Addr,
+		)
+		if c.config.OnTunnelRegistered != nil {
+			c.config.OnTunnelRegistered(name, t)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// setStatus sets connection time, zero if disconnected, and the last error if
+// err is not nil. Connections are counted.
+func (c *Client) setStatus(connectedAt time.Time, err error) {
+	c.statusMu.Lock()
+	c.connectedAt = connectedAt
+	if connectedAt.IsZero() {
+		c.registered = nil
+		c.version = 0
+		c.sent = false
+	} else {
+		c.connects++
+	}
+	if err != nil {
+		c.lastErr = err
+		c.lastErrAt = time.Now()
+	}
+	c.statusMu.Unlock()
+}
+
+// SetTunnels replaces tunnels requested from the server. If the tunnels were
+// already sent to the server client reconnects to register the new ones, the
+// old connection is drained like with StopContext, streams proxied on it
+// continue until they are done. Traffic counters of tunnels that remain are
+// kept. If tunnels is empty client disconnects and waits until tunnels are
+// set.
+func (c *Client) SetTunnels(tunnels map[string]*proto.Tunnel) {
+	c.statusMu.Lock()
+	c.tunnels, c.counters = copyTunnels(tunnels, c.counters)
+	c.sched = c.scheduler(c.sched)
+	c.statusMu.Unlock()
+
+	c.logger.Log(
+		"level", 1,
+		"action", "set tunnels",
+		"tunnels", len(tunnels),
+	)
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	// sent is reset after conn is cleared, if set tunnels were sent on conn
+	c.statusMu.Lock()
+	sent := c.sent
+	c.statusMu.Unlock()
+
+	if !sent || c.conn == nil {
+		return
+	}
+
+	tc := c.conn
+	c.conn = nil
+	c.draining[tc] = struct{}{}
+	tc.drain(context.Background())
+	close(tc.replaced)
+}
+
+// connBuffer returns how many bytes are buffered per connection with
+// streamBuffer bytes buffered per stream.
+func connBuffer(streamBuffer int32) int32 {
+	if streamBuffer == 0 {
+		streamBuffer = defaultStreamBuffer
+	}
+	if streamBuffer > math.MaxInt32/streamBuffersPerConn {
+		return math.MaxInt32
+	}
+	return streamBuffer * streamBuffersPerConn
+}
+
+// scheduler returns write scheduler for tunnels, sched is reused if writes
+// are still scheduled. Caller must hold statusMu.
+func (c *Client) scheduler(sched *scheduler) *scheduler {
+	if !prioritized(c.tunnels) {
+		return nil
+	}
+	if sched == nil {
+		sched = newScheduler()
+	}
+	return sched
+}
+
+// copyTunnels returns copy of tunnels and their counters, counters of
+// tunnels present in old are reused.
+func copyTunnels(tunnels map[string]*proto.Tunnel, old map[string]*tunnelCounters) (map[string]*proto.Tunnel, map[string]*tunnelCounters) {
+	t := make(map[string]*proto.Tunnel, len(tunnels))
+	counters := make(map[string]*tunnelCounters, len(tunnels))
+	for name, tunnel := range tunnels {
+		t[name] = tunnel
+		if tc, ok := old[name]; ok {
+			counters[name] = tc
+		} else {
+			counters[name] = &tunnelCounters{}
+		}
+	}
+	return t, counters
+}
+
 // Stop disconnects client from server.
 func (c *Client) Stop() {
 	c.connMu.Lock()
@@ -319,8 +763,66 @@ func (c *Client) Stop() {
 		"action", "stop",
 	)
 
+	if c.cancelDial != nil {
+		c.cancelDial()
+	}
+	for _, tc := range c.conns() {
+		tc.conn.Close()
+	}
+}
+
+// conns returns the current and draining connections. Caller must hold
+// connMu.
+func (c *Client) conns() []*tunnelConn {
+	conns := make([]*tunnelConn, 0, len(c.draining)+1)
 	if c.conn != nil {
-		c.conn.Close()
+		conns = append(conns, c.conn)
 	}
-	c.conn = nil
+	for tc := range c.draining {
+		conns = append(conns, tc)
+	}
+	return conns
+}
+
+// StopContext gracefully disconnects client from server. Server stops sending
+// new requests and connections to the client and withdraws its tunnels, the
+// proxied streams continue until they are done or ctx is done, then the
+// connections are closed. Client does not reconnect after StopContext is
+// called, Start returns nil. If ctx is done before the streams it returns
+// ctx.Err().
+func (c *Client) StopContext(ctx context.Context) error {
+	c.connMu.Lock()
+	c.stopping = true
+	conns := c.conns()
+	if c.cancelDial != nil {
+		c.cancelDial()
+	}
+	c.connMu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+
+	c.logger.Log(
+		"level", 1,
+		"action", "drain",
+	)
+
+	for _, tc := range conns {
+		tc.drain(ctx)
+	}
+
+	for _, tc := range conns {
+		select {
+		case <-tc.served:
+		case <-ctx.Done():
+			c.Stop()
+			for _, tc := range conns {
+				<-tc.served
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
 }
@@ -5,8 +5,10 @@
 package tunnel
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"math"
 	"net"
 	"net/http/httptest"
 	"testing"
@@ -35,7 +37,7 @@ func TestClient_Dial(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	conn, err := c.dial()
+	conn, err := c.dial(context.Background())
 	if err != nil {
 		t.Fatal("Dial error", err)
 	}
@@ -74,7 +76,7 @@ func TestClient_DialBackoff(t *testing.T) {
 	}
 
 	start := time.Now()
-	_, err = c.dial()
+	_, err = c.dial(context.Background())
 
 	if time.Since(start) < 100*time.Millisecond {
 		t.Fatal("Wait mismatch", err)
@@ -84,3 +86,120 @@ func TestClient_DialBackoff(t *testing.T) {
 		t.Fatal("Error mismatch", err)
 	}
 }
+
+func TestClient_StartContextCancel(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	b := tunnelmock.NewMockBackoff(ctrl)
+	b.EXPECT().NextBackOff().Return(time.Hour).AnyTimes()
+
+	d := func(network, addr string, config *tls.Config) (net.Conn, error) {
+		return nil, errors.New("foobar")
+	}
+
+	c, err := NewClient(&ClientConfig{
+		ServerAddr:      "8.8.8.8",
+		TLSClientConfig: &tls.Config{},
+		DialTLS:         d,
+		Backoff:         b,
+		Tunnels:         map[string]*proto.Tunnel{"test": {}},
+		Proxy:           Proxy(ProxyFuncs{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.StartContext(ctx)
+	}()
+
+	select {
+	case err := <-errc:
+		if err != context.DeadlineExceeded {
+			t.Fatal("Error mismatch", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start not interrupted")
+	}
+}
+
+func TestClient_StopContextBackoff(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	b := tunnelmock.NewMockBackoff(ctrl)
+	b.EXPECT().NextBackOff().Return(time.Hour).AnyTimes()
+
+	dialed := make(chan struct{}, 1)
+	d := func(network, addr string, config *tls.Config) (net.Conn, error) {
+		select {
+		case dialed <- struct{}{}:
+		default:
+		}
+		return nil, errors.New("foobar")
+	}
+
+	c, err := NewClient(&ClientConfig{
+		ServerAddr:      "8.8.8.8",
+		TLSClientConfig: &tls.Config{},
+		DialTLS:         d,
+		Backoff:         b,
+		Tunnels:         map[string]*proto.Tunnel{"test": {}},
+		Proxy:           Proxy(ProxyFuncs{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Start()
+	}()
+
+	// wait for client to back off
+	<-dialed
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.StopContext(ctx); err != nil {
+		t.Fatal("Stop error", err)
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal("Start error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start not interrupted")
+	}
+}
+
+func TestConnBuffer(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		stream int32
+		conn   int32
+	}{
+		{0, 16 << 20},
+		{64 << 10, 1 << 20},
+		{1 << 30, math.MaxInt32},
+	}
+
+	for i, tt := range tests {
+		if actual := connBuffer(tt.stream); actual != tt.conn {
+			t.Errorf("[%d] expected %d got %d", i, tt.conn, actual)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	// Identifier is the client identifier.
+	Identifier id.ID `json:"id"`
+	// RemoteAddr is the address of client control connection.
+	RemoteAddr string `json:"remote_addr"`
+	// ConnectedAt is when the client connected.
+	ConnectedAt time.Time `json:"connected_at"`
+	// Tunnels are registered tunnels in form of protocol://host or
+	// protocol://addr.
+	Tunnels []string `json:"tunnels"`
+	// BytesIn is the number of bytes sent from users to the client.
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the number of bytes sent from the client to users.
+	BytesOut int64 `json:"bytes_out"`
+	// ProtocolVersion is the protocol version negotiated with the client.
+	ProtocolVersion int `json:"protocol_version"`
+}
+
+// clientStats holds traffic counters of a client connection.
+type clientStats struct {
+	// bytesIn and bytesOut are accessed atomically and must be 64-bit
+	// aligned
+	bytesIn     int64
+	bytesOut    int64
+	version     int32
+	remoteAddr  string
+	connectedAt time.Time
+}
+
+func newClientStats(addr net.Addr) *clientStats {
+	s := &clientStats{
+		connectedAt: time.Now(),
+	}
+	if addr != nil {
+		s.remoteAddr = addr.String()
+	}
+	return s
+}
+
+// addIn counts bytes sent to client, it's safe to call on nil.
+func (s *clientStats) addIn(n int64) {
+	if s != nil {
+		atomic.AddInt64(&s.bytesIn, n)
+	}
+}
+
+// addOut counts bytes received from client, it's safe to call on nil.
+func (s *clientStats) addOut(n int64) {
+	if s != nil {
+		atomic.AddInt64(&s.bytesOut, n)
+	}
+}
+
+// setVersion sets negotiated protocol version, it's safe to call on nil.
+func (s *clientStats) setVersion(v int) {
+	if s != nil {
+		atomic.StoreInt32(&s.version, int32(v))
+	}
+}
+
+// protocolVersion returns negotiated protocol version, it's safe to call on
+// nil.
+func (s *clientStats) protocolVersion() int {
+	if s == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&s.version))
+}
+
+// countReadCloser counts bytes read from client.
+type countReadCloser struct {
+	io.ReadCloser
+	stats *clientStats
+}
+
+func (r *countReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.stats.addOut(int64(n))
+	return
+}
+
+// Clients returns information about connected clients sorted by identifier.
+func (s *Server) Clients() []*ClientInfo {
+	stats := s.connPool.clients()
+
+	s.registry.mu.RLock()
+	defer s.registry.mu.RUnlock()
+
+	clients := make([]*ClientInfo, 0, len(stats))
+	for identifier, st := range stats {
+		c := &ClientInfo{
+			Identifier:      identifier,
+			RemoteAddr:      st.remoteAddr,
+			ConnectedAt:     st.connectedAt,
+			Tunnels:         []string{},
+			BytesIn:         atomic.LoadInt64(&st.bytesIn),
+			BytesOut:        atomic.LoadInt64(&st.bytesOut),
+			ProtocolVersion: st.protocolVersion(),
+		}
+		if i := s.registry.items[identifier]; i != nil {
+			for _, h := range i.Hosts {
+				c.Tunnels = append(c.Tunnels, httpTunnelName(h.Host))
+			}
+			for _, l := range i.Listeners {
+				c.Tunnels = append(c.Tunnels, listenerName(l))
+			}
+			sort.Strings(c.Tunnels)
+		}
+		clients = append(clients, c)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Identifier.String() < clients[j].Identifier.String()
+	})
+
+	return clients
+}
+
+// httpTunnelName returns protocol://host of HTTP tunnel.
+func httpTunnelName(host string) string {
+	return fmt.Sprint(proto.HTTP, "://", host)
+}
+
+// listenerName returns protocol://host for SNI listeners and
+// network://addr for others.
+func listenerName(l net.Listener) string {
+	if v, ok := l.(interface {
+		Name() string
+	}); ok {
+		return fmt.Sprint(proto.SNI, "://", v.Name())
+	}
+	return fmt.Sprint(l.Addr().Network(), "://", l.Addr())
+}
@@ -0,0 +1,281 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// ClientStatus describes client connection to the server and its tunnels.
+type ClientStatus struct {
+	// ServerAddr is the address of the tunnel server.
+	ServerAddr string `json:"server_addr"`
+	// Connected is true if client is connected to the server.
+	Connected bool `json:"connected"`
+	// ConnectedAt is when the client connected, zero if not connected.
+	ConnectedAt time.Time `json:"connected_at"`
+	// LastError is the last connection or server error.
+	LastError string `json:"last_error,omitempty"`
+	// ProtocolVersion is the protocol version negotiated with the server,
+	// zero if not connected.
+	ProtocolVersion int `json:"protocol_version,omitempty"`
+	// Tunnels are the client tunnels sorted by name.
+	Tunnels []*TunnelStatus `json:"tunnels"`
+}
+
+// TunnelStatus describes a client tunnel.
+type TunnelStatus struct {
+	// Name is the tunnel name.
+	Name string `json:"name"`
+	// Protocol is the tunnel protocol.
+	Protocol string `json:"proto"`
+	// Public is the tunnel address on the server in form of protocol://host
+	// or protocol://addr, empty if the tunnel is not registered.
+	Public string `json:"public,omitempty"`
+	// Streams is the number of proxied HTTP requests and TCP connections.
+	Streams int64 `json:"streams"`
+	// ActiveStreams is the number of streams in progress.
+	ActiveStreams int64 `json:"active_streams"`
+	// BytesIn is the number of bytes sent from the server to local service.
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the number of bytes sent from local service to the server.
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// ClientStats is a snapshot of client counters for monitoring, it's
+// published with expvar by Client.Var.
+type ClientStats struct {
+	// Connected is true if client is connected to the server.
+	Connected bool `json:"connected"`
+	// Connects is the number of connections to the server.
+	Connects int64 `json:"connects"`
+	// Reconnects is the number of connections after the first one.
+	Reconnects int64 `json:"reconnects"`
+	// LastError is the last connection or server error and LastErrorAt
+	// is when it occurred.
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+	// Tunnels holds counters of tunnels by name.
+	Tunnels map[string]*ClientTunnelStats `json:"tunnels"`
+}
+
+// ClientTunnelStats holds traffic counters of a client tunnel.
+type ClientTunnelStats struct {
+	// Streams is the number of proxied HTTP requests and TCP connections.
+	Streams int64 `json:"streams"`
+	// ActiveStreams is the number of streams in progress.
+	ActiveStreams int64 `json:"active_streams"`
+	// BytesIn is the number of bytes sent from the server to local service.
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the number of bytes sent from local service to the server.
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// tunnelCounters holds traffic counters of a client tunnel, fields are
+// accessed atomically and must be 64-bit aligned.
+type tunnelCounters struct {
+	streams  int64
+	active   int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+// begin counts a new stream, it's safe to call on nil.
+func (c *tunnelCounters) begin() {
+	if c != nil {
+		atomic.AddInt64(&c.streams, 1)
+		atomic.AddInt64(&c.active, 1)
+	}
+}
+
+// end counts stream end, it's safe to call on nil.
+func (c *tunnelCounters) end() {
+	if c != nil {
+		atomic.AddInt64(&c.active, -1)
+	}
+}
+
+// addIn counts bytes read from server, it's safe to call on nil.
+func (c *tunnelCounters) addIn(n int) {
+	if c != nil {
+		atomic.AddInt64(&c.bytesIn, int64(n))
+	}
+}
+
+// addOut counts bytes written to server, it's safe to call on nil.
+func (c *tunnelCounters) addOut(n int) {
+	if c != nil {
+		atomic.AddInt64(&c.bytesOut, int64(n))
+	}
+}
+
+// tunnelReadCloser counts bytes of stream read from server.
+type tunnelReadCloser struct {
+	io.ReadCloser
+	counters *tunnelCounters
+}
+
+func (r *tunnelReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.counters.addIn(n)
+	return
+}
+
+// tunnelResponseWriter counts bytes of stream written to server.
+type tunnelResponseWriter struct {
+	*priorityResponseWriter
+	counters *tunnelCounters
+}
+
+func (w *tunnelResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.priorityResponseWriter.Write(p)
+	w.counters.addOut(n)
+	return n, err
+}
+
+// Status returns information about client connection and tunnels.
+func (c *Client) Status() *ClientStatus {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	s := &ClientStatus{
+		ServerAddr:      c.config.ServerAddr,
+		Connected:       !c.connectedAt.IsZero(),
+		ConnectedAt:     c.connectedAt,
+		ProtocolVersion: c.version,
+		Tunnels:         make([]*TunnelStatus, 0, len(c.tunnels)),
+	}
+	if c.lastErr != nil {
+		s.LastError = c.lastErr.Error()
+	}
+
+	for name, t := range c.tunnels {
+		tc := c.counters[name]
+		ts := &TunnelStatus{
+			Name:          name,
+			Protocol:      t.Protocol,
+			Streams:       atomic.LoadInt64(&tc.streams),
+			ActiveStreams: atomic.LoadInt64(&tc.active),
+			BytesIn:       atomic.LoadInt64(&tc.bytesIn),
+			BytesOut:      atomic.LoadInt64(&tc.bytesOut),
+		}
+		if r := c.registered[name]; r != nil {
+			ts.Public = publicName(r)
+		}
+		s.Tunnels = append(s.Tunnels, ts)
+	}
+	sort.Slice(s.Tunnels, func(i, j int) bool {
+		return s.Tunnels[i].Name < s.Tunnels[j].Name
+	})
+
+	return s
+}
+
+// Stats returns snapshot of client counters.
+func (c *Client) Stats() *ClientStats {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	s := &ClientStats{
+		Connected:   !c.connectedAt.IsZero(),
+		Connects:    c.connects,
+		LastErrorAt: c.lastErrAt,
+		Tunnels:     make(map[string]*ClientTunnelStats, len(c.counters)),
+	}
+	if c.connects > 1 {
+		s.Reconnects = c.connects - 1
+	}
+	if c.lastErr != nil {
+		s.LastError = c.lastErr.Error()
+	}
+	for name, tc := range c.counters {
+		s.Tunnels[name] = &ClientTunnelStats{
+			Streams:       atomic.LoadInt64(&tc.streams),
+			ActiveStreams: atomic.LoadInt64(&tc.active),
+			BytesIn:       atomic.LoadInt64(&tc.bytesIn),
+			BytesOut:      atomic.LoadInt64(&tc.bytesOut),
+		}
+	}
+
+	return s
+}
+
+// Var returns expvar variable with client Stats, publish it with
+// expvar.Publish to expose client counters under /debug/vars.
+func (c *Client) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		return c.Stats()
+	})
+}
+
+// countersFor returns counters of tunnel msg is sent to, or nil if there is
+// no such tunnel.
+func (c *Client) countersFor(msg *proto.ControlMessage) *tunnelCounters {
+	c.statusMu.Lock()
+	tunnels := c.registered
+	if tunnels == nil {
+		tunnels = c.tunnels
+	}
+	counters := c.counters
+	c.statusMu.Unlock()
+
+	for name, t := range tunnels {
+		if t != nil && matchTunnel(t, msg) {
+			return counters[name]
+		}
+	}
+	return nil
+}
+
+// matchTunnel returns true if msg is sent to tunnel t, hosts are matched with
+// and without port and addresses are matched by port.
+func matchTunnel(t *proto.Tunnel, msg *proto.ControlMessage) bool {
+	hostPort := msg.ForwardedHost
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+
+	switch t.Protocol {
+	case proto.HTTP:
+		if msg.ForwardedProto != proto.HTTP && msg.ForwardedProto != proto.HTTPS {
+			return false
+		}
+		return t.Host == hostPort || t.Host == host
+	case proto.SNI:
+		return t.Host == hostPort
+	case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
+		if msg.ForwardedProto == proto.CONNECT {
+			return false
+		}
+		if t.Addr == hostPort {
+			return true
+		}
+		_, p, err := net.SplitHostPort(t.Addr)
+		return err == nil && p == port && p != "0"
+	case proto.CONNECT:
+		return msg.ForwardedProto == proto.CONNECT
+	}
+	return false
+}
+
+// publicName returns protocol://host or protocol://addr of registered
+// tunnel.
+func publicName(t *proto.Tunnel) string {
+	switch t.Protocol {
+	case proto.HTTP, proto.SNI:
+		return fmt.Sprint(t.Protocol, "://", t.Host)
+	default:
+		return fmt.Sprint(t.Protocol, "://", t.Addr)
+	}
+}
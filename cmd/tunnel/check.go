@@ -0,0 +1,166 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// checkConfig verifies that TLS certificates and backend CAs load and that
+// server and backend addresses resolve, on success normalized configuration
+// is written to w with credentials redacted, see redactConfig.
+func checkConfig(config *ClientConfig, w io.Writer) error {
+	if len(config.Tunnels) == 0 {
+		return fmt.Errorf("tunnels: missing")
+	}
+
+	var certs *tunnel.CertReloader
+	if config.TLSSource != nil {
+		var err error
+		if certs, err = config.TLSSource.certReloader(nil); err != nil {
+			return fmt.Errorf("tls_source: %s", err)
+		}
+	}
+	if _, err := tlsConfig(config, certs); err != nil {
+		return fmt.Errorf("tls: %s", err)
+	}
+
+	if err := resolve(config.ServerAddr); err != nil {
+		return fmt.Errorf("server_addr: %s", err)
+	}
+
+	var names []string
+	for n := range config.Tunnels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		// CONNECT gateway targets are requested by users
+		if config.Tunnels[n].Protocol == proto.CONNECT {
+			continue
+		}
+		if _, err := backendTLSConfig(config.Tunnels[n]); err != nil {
+			return fmt.Errorf("%s backend_tls: %s", n, err)
+		}
+		addr, err := backendAddr(config.Tunnels[n])
+		if err != nil {
+			return fmt.Errorf("%s addr: %s", n, err)
+		}
+		if err := resolve(addr); err != nil {
+			return fmt.Errorf("%s addr: %s", n, err)
+		}
+	}
+
+	b, err := redactConfig(config)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+
+	return err
+}
+
+// redactConfig returns YAML encoded configuration with tunnel auth, values of
+// credential request headers and strings containing values of environment
+// variables replaced with tunnel.RedactedValue. Request headers are
+// redacted as in request logs, see tunnel.RedactHeader.
+func redactConfig(config *ClientConfig) ([]byte, error) {
+	c := *config
+	c.Tunnels = make(map[string]*Tunnel, len(config.Tunnels))
+	for name, t := range config.Tunnels {
+		t2 := *t
+		if t2.Auth != "" {
+			t2.Auth = tunnel.RedactedValue
+		}
+		if len(t2.RequestHeaders) != 0 {
+			h := make(http.Header, len(t2.RequestHeaders))
+			for k, v := range t2.RequestHeaders {
+				h.Set(k, v)
+			}
+			t2.RequestHeaders = make(map[string]string, len(h))
+			for k, v := range tunnel.RedactHeader(h, config.RedactHeaders...) {
+				t2.RequestHeaders[k] = v[0]
+			}
+		}
+		c.Tunnels[name] = &t2
+	}
+
+	b, err := yaml.Marshal(&c)
+	if err != nil || len(config.env) == 0 {
+		return b, err
+	}
+
+	var m yaml.MapSlice
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redactValues(m, config.env))
+}
+
+// redactValues replaces strings in v, decoded YAML, containing any of values
+// with tunnel.RedactedValue.
+func redactValues(v interface{}, values []string) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			v[i].Value = redactValues(v[i].Value, values)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValues(v[i], values)
+		}
+	case string:
+		for _, s := range values {
+			if strings.Contains(v, s) {
+				return tunnel.RedactedValue
+			}
+		}
+	}
+	return v
+}
+
+// backendAddr returns host:port of local service of tunnel.
+func backendAddr(t *Tunnel) (string, error) {
+	if t.Protocol != proto.HTTP {
+		return t.Addr, nil
+	}
+
+	u, err := url.Parse(t.Addr)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+	return net.JoinHostPort(u.Hostname(), "80"), nil
+}
+
+// resolve checks that host of addr can be resolved.
+func resolve(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+	_, err = net.LookupHost(host)
+	return err
+}
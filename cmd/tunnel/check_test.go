@@ -0,0 +1,226 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestCheckConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		config *ClientConfig
+		err    string
+	}{
+		{
+			config: &ClientConfig{
+				ServerAddr: "127.0.0.1:5223",
+				TLSCrt:     "../../testdata/selfsigned.crt",
+				TLSKey:     "../../testdata/selfsigned.key",
+				Tunnels: map[string]*Tunnel{
+					"www": {Protocol: proto.HTTP, Addr: "http://127.0.0.1/", Host: "www.example.com"},
+					"ssh": {Protocol: proto.TCP, Addr: "127.0.0.1:22", RemoteAddr: "0.0.0.0:22"},
+					"gw":  {Protocol: proto.CONNECT, RemoteAddr: "0.0.0.0:3128", Allow: []string{"*.internal:443"}},
+				},
+			},
+		},
+		{
+			config: &ClientConfig{
+				ServerAddr: "127.0.0.1:5223",
+				TLSCrt:     "../../testdata/selfsigned.crt",
+				TLSKey:     "../../testdata/selfsigned.crt",
+				Tunnels: map[string]*Tunnel{
+					"ssh": {Protocol: proto.TCP, Addr: "127.0.0.1:22"},
+				},
+			},
+			err: "tls:",
+		},
+		{
+			config: &ClientConfig{
+				ServerAddr: "127.0.0.1:5223",
+				TLSCrt:     "../../testdata/selfsigned.crt",
+				TLSKey:     "../../testdata/selfsigned.key",
+				Tunnels: map[string]*Tunnel{
+					"ssh": {Protocol: proto.TCP, Addr: "backend.invalid:22"},
+				},
+			},
+			err: "ssh addr:",
+		},
+		{
+			config: &ClientConfig{
+				ServerAddr: "127.0.0.1:5223",
+				TLSCrt:     "../../testdata/selfsigned.crt",
+				TLSKey:     "../../testdata/selfsigned.key",
+				Tunnels: map[string]*Tunnel{
+					"ssh": {Protocol: proto.TCP, Addr: "127.0.0.1:22", BackendTLS: &BackendTLSConfig{CA: "missing.crt"}},
+				},
+			},
+			err: "ssh backend_tls:",
+		},
+		{
+			config: &ClientConfig{
+				ServerAddr: "127.0.0.1:5223",
+				TLSCrt:     "../../testdata/selfsigned.crt",
+				TLSKey:     "../../testdata/selfsigned.key",
+			},
+			err: "tunnels: missing",
+		},
+		{
+			config: &ClientConfig{
+				ServerAddr: "127.0.0.1:5223",
+				TLSSource: &TLSSourceConfig{
+					Exec: []string{"cat", "../../testdata/selfsigned.crt", "../../testdata/selfsigned.key"},
+				},
+				Tunnels: map[string]*Tunnel{
+					"www": {Protocol: proto.HTTP, Addr: "http://127.0.0.1/", Host: "www.example.com"},
+				},
+			},
+		},
+		{
+			config: &ClientConfig{
+				ServerAddr: "127.0.0.1:5223",
+				TLSSource: &TLSSourceConfig{
+					Exec: []string{"cat", "../../testdata/selfsigned.crt"},
+				},
+				Tunnels: map[string]*Tunnel{
+					"www": {Protocol: proto.HTTP, Addr: "http://127.0.0.1/", Host: "www.example.com"},
+				},
+			},
+			err: "tls_source:",
+		},
+	}
+
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		err := checkConfig(tt.config, &buf)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("[%d] unexpected error %s", i, err)
+			}
+			if !strings.Contains(buf.String(), "www.example.com") {
+				t.Errorf("[%d] config not printed: %s", i, buf.String())
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("[%d] expected error %q got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestBackendAddr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		tunnel *Tunnel
+		addr   string
+	}{
+		{&Tunnel{Protocol: proto.HTTP, Addr: "http://localhost/"}, "localhost:80"},
+		{&Tunnel{Protocol: proto.HTTP, Addr: "https://localhost/"}, "localhost:443"},
+		{&Tunnel{Protocol: proto.HTTP, Addr: "http://localhost:8080/"}, "localhost:8080"},
+		{&Tunnel{Protocol: proto.TCP, Addr: "127.0.0.1:22"}, "127.0.0.1:22"},
+	}
+
+	for i, tt := range tests {
+		addr, err := backendAddr(tt.tunnel)
+		if err != nil {
+			t.Errorf("[%d] unexpected error %s", i, err)
+		}
+		if addr != tt.addr {
+			t.Errorf("[%d] expected %q got %q", i, tt.addr, addr)
+		}
+	}
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		tunnel     *Tunnel
+		serverName string
+		roots      bool
+	}{
+		{&Tunnel{Protocol: proto.HTTP, Addr: "https://localhost/", BackendTLS: &BackendTLSConfig{}}, "", false},
+		{&Tunnel{Protocol: proto.TCP, Addr: "localhost:993", BackendTLS: &BackendTLSConfig{}}, "localhost", false},
+		{&Tunnel{Protocol: proto.TCP, Addr: "localhost:993", BackendTLS: &BackendTLSConfig{ServerName: "foo.com"}}, "foo.com", false},
+		{&Tunnel{Protocol: proto.TCP, Addr: "localhost:993", BackendTLS: &BackendTLSConfig{CA: "../../testdata/selfsigned.crt"}}, "localhost", true},
+	}
+
+	for i, tt := range tests {
+		c, err := backendTLSConfig(tt.tunnel)
+		if err != nil {
+			t.Errorf("[%d] unexpected error %s", i, err)
+			continue
+		}
+		if c.ServerName != tt.serverName {
+			t.Errorf("[%d] expected server name %q got %q", i, tt.serverName, c.ServerName)
+		}
+		if (c.RootCAs != nil) != tt.roots {
+			t.Errorf("[%d] expected root CAs %v", i, tt.roots)
+		}
+	}
+
+	if c, err := backendTLSConfig(&Tunnel{Protocol: proto.TCP, Addr: "localhost:22"}); c != nil || err != nil {
+		t.Error("Unexpected config", c, err)
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	os.Setenv("TUNNEL_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("TUNNEL_TEST_SECRET")
+
+	f, err := ioutil.TempFile("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`server_addr: 127.0.0.1:5223
+redact_headers: [X-Api-Key]
+tunnels:
+  www:
+    proto: http
+    addr: http://127.0.0.1/
+    host: www.example.com
+    auth: user:password
+    request_headers:
+      authorization: Bearer token
+      x-api-key: key
+      x-foo: bar
+  ssh:
+    proto: tcp
+    addr: 127.0.0.1:22
+    remote_addr: 0.0.0.0:22
+    on_demand:
+      command: [backend, --password=${TUNNEL_TEST_SECRET}]
+`)
+	f.Close()
+
+	config, err := loadClientConfigFromFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := redactConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"user:password", "Bearer", ": key", "s3cret"} {
+		if strings.Contains(string(b), s) {
+			t.Errorf("%q not redacted: %s", s, b)
+		}
+	}
+	for _, s := range []string{"www.example.com", "X-Foo: bar", "- backend\n"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("%q missing: %s", s, b)
+		}
+	}
+}
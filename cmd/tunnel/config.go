@@ -5,13 +5,25 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/internal/envsubst"
+	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
@@ -23,6 +35,10 @@ const (
 	DefaultBackoffMaxTime     = 15 * time.Minute
 )
 
+// DefaultDrainTimeout specifies how long proxied streams may run after the
+// client is signaled to stop.
+const DefaultDrainTimeout = 30 * time.Second
+
 // BackoffConfig defines behavior of staggering reconnection retries.
 type BackoffConfig struct {
 	Interval    time.Duration `yaml:"interval"`
@@ -31,23 +47,128 @@ type BackoffConfig struct {
 	MaxTime     time.Duration `yaml:"max_time"`
 }
 
+// TLSConfig defines TLS protocol versions, cipher suites and elliptic curves
+// allowed on the connection to the server.
+type TLSConfig struct {
+	MinVersion       string   `yaml:"min_version,omitempty"`
+	MaxVersion       string   `yaml:"max_version,omitempty"`
+	CipherSuites     []string `yaml:"cipher_suites,omitempty"`
+	CurvePreferences []string `yaml:"curve_preferences,omitempty"`
+}
+
+// OnDemandConfig defines a command starting local backend on the first
+// connection, the backend is stopped when idle.
+type OnDemandConfig struct {
+	Command      []string      `yaml:"command"`
+	StartTimeout time.Duration `yaml:"start_timeout,omitempty"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout,omitempty"`
+}
+
+// BackendTLSConfig defines TLS connection to local backend.
+type BackendTLSConfig struct {
+	CA                 string `yaml:"ca,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// PathRewriteConfig defines a rule replacing request path matching regular
+// expression From with To, To may refer to submatches i.e. $1.
+type PathRewriteConfig struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// TLSSourceConfig defines external source of client certificate and key used
+// instead of tls_crt and tls_key files, either Exec command printing PEM data
+// or Vault secret. Certificate is fetched again every Refresh.
+type TLSSourceConfig struct {
+	Exec    []string      `yaml:"exec,omitempty"`
+	Vault   *VaultConfig  `yaml:"vault,omitempty"`
+	Refresh time.Duration `yaml:"refresh,omitempty"`
+}
+
+// VaultConfig defines Vault secret holding PEM certificate and key, Addr
+// defaults to VAULT_ADDR environment variable, token is read from VAULT_TOKEN
+// environment variable. CA is optional path to PEM file with CA certificates
+// of Vault server.
+type VaultConfig struct {
+	Addr      string `yaml:"addr,omitempty"`
+	Path      string `yaml:"path"`
+	CertField string `yaml:"cert_field,omitempty"`
+	KeyField  string `yaml:"key_field,omitempty"`
+	CA        string `yaml:"ca,omitempty"`
+}
+
+// TimeoutsConfig defines timeouts of connections to local services, zero
+// DialTimeout means default timeout, zero ResponseHeaderTimeout means no
+// timeout.
+type TimeoutsConfig struct {
+	DialTimeout           time.Duration `yaml:"dial_timeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout,omitempty"`
+}
+
 // Tunnel defines a tunnel.
 type Tunnel struct {
-	Protocol   string `yaml:"proto,omitempty"`
-	Addr       string `yaml:"addr,omitempty"`
-	Auth       string `yaml:"auth,omitempty"`
-	Host       string `yaml:"host,omitempty"`
-	RemoteAddr string `yaml:"remote_addr,omitempty"`
+	Protocol             string               `yaml:"proto,omitempty"`
+	Addr                 string               `yaml:"addr,omitempty"`
+	Auth                 string               `yaml:"auth,omitempty"`
+	Host                 string               `yaml:"host,omitempty"`
+	RemoteAddr           string               `yaml:"remote_addr,omitempty"`
+	RequestHeaders       map[string]string    `yaml:"request_headers,omitempty"`
+	ClientIPHeader       string               `yaml:"client_ip_header,omitempty"`
+	StripResponseHeaders []string             `yaml:"strip_response_headers,omitempty"`
+	FlushInterval        time.Duration        `yaml:"flush_interval,omitempty"`
+	Priority             int                  `yaml:"priority,omitempty"`
+	MaxBodySize          int64                `yaml:"max_body_size,omitempty"`
+	HTTPSOnly            bool                 `yaml:"https_only,omitempty"`
+	OnDemand             *OnDemandConfig      `yaml:"on_demand,omitempty"`
+	BackendTLS           *BackendTLSConfig    `yaml:"backend_tls,omitempty"`
+	HostHeader           string               `yaml:"host_header,omitempty"`
+	PathRewrite          []*PathRewriteConfig `yaml:"path_rewrite,omitempty"`
+	Allow                []string             `yaml:"allow,omitempty"`
+	MaxConns             int                  `yaml:"max_conns,omitempty"`
+	ConnRate             float64              `yaml:"conn_rate,omitempty"`
+}
+
+// InspectorConfig defines web UI recording requests of HTTP tunnels, Size
+// and MaxBodySize limit the number of records and recorded body bytes. Addr
+// is unix socket path or loopback address as the web UI is not
+// authenticated.
+type InspectorConfig struct {
+	Addr        string `yaml:"addr"`
+	Size        int    `yaml:"size,omitempty"`
+	MaxBodySize int64  `yaml:"max_body_size,omitempty"`
+}
+
+// KubernetesConfig defines discovery of tunnels from annotated Kubernetes
+// services and ingresses, empty Namespace means all namespaces.
+type KubernetesConfig struct {
+	Namespace    string        `yaml:"namespace,omitempty"`
+	PollInterval time.Duration `yaml:"poll_interval,omitempty"`
 }
 
 // ClientConfig is a tunnel client configuration.
 type ClientConfig struct {
-	ServerAddr string             `yaml:"server_addr"`
-	TLSCrt     string             `yaml:"tls_crt"`
-	TLSKey     string             `yaml:"tls_key"`
-	RootCA     string             `yaml:"root_ca"`
-	Backoff    BackoffConfig      `yaml:"backoff"`
-	Tunnels    map[string]*Tunnel `yaml:"tunnels"`
+	ServerAddr      string             `yaml:"server_addr"`
+	ServerTransport string             `yaml:"server_transport,omitempty"`
+	StreamBuffer    int32              `yaml:"stream_buffer,omitempty"`
+	TLSCrt          string             `yaml:"tls_crt"`
+	TLSKey          string             `yaml:"tls_key"`
+	TLSSource       *TLSSourceConfig   `yaml:"tls_source,omitempty"`
+	RootCA          string             `yaml:"root_ca"`
+	TLS             TLSConfig          `yaml:"tls,omitempty"`
+	Backoff         BackoffConfig      `yaml:"backoff"`
+	Timeouts        TimeoutsConfig     `yaml:"timeouts,omitempty"`
+	DrainTimeout    time.Duration      `yaml:"drain_timeout,omitempty"`
+	ControlAddr     string             `yaml:"control_addr,omitempty"`
+	Inspector       *InspectorConfig   `yaml:"inspector,omitempty"`
+	Kubernetes      *KubernetesConfig  `yaml:"kubernetes,omitempty"`
+	RedactHeaders   []string           `yaml:"redact_headers,omitempty"`
+	Tunnels         map[string]*Tunnel `yaml:"tunnels"`
+
+	// env holds values of environment variables expanded in configuration
+	// file, they are redacted when configuration is printed
+	env []string
 }
 
 func loadClientConfigFromFile(file string) (*ClientConfig, error) {
@@ -55,6 +176,10 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file %q: %s", file, err)
 	}
+	env := envsubst.Values(buf)
+	if buf, err = envsubst.Expand(buf); err != nil {
+		return nil, fmt.Errorf("failed to expand file %q: %s", file, err)
+	}
 
 	c := ClientConfig{
 		TLSCrt: filepath.Join(filepath.Dir(file), "client.crt"),
@@ -65,6 +190,9 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 			MaxInterval: DefaultBackoffMaxInterval,
 			MaxTime:     DefaultBackoffMaxTime,
 		},
+		DrainTimeout: DefaultDrainTimeout,
+		ControlAddr:  filepath.Join(filepath.Dir(file), "tunnel.sock"),
+		env:          env,
 	}
 
 	if err = yaml.Unmarshal(buf, &c); err != nil {
@@ -77,13 +205,70 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 	if c.ServerAddr, err = normalizeAddress(c.ServerAddr); err != nil {
 		return nil, fmt.Errorf("server_addr: %s", err)
 	}
+	switch c.ServerTransport {
+	case "", tunnel.TransportTCP, tunnel.TransportWebSocket:
+	default:
+		return nil, fmt.Errorf("server_transport: invalid transport %q, choose %s or %s", c.ServerTransport, tunnel.TransportTCP, tunnel.TransportWebSocket)
+	}
+	if c.StreamBuffer < 0 {
+		return nil, fmt.Errorf("stream_buffer: negative")
+	}
+	if c.DrainTimeout < 0 {
+		return nil, fmt.Errorf("drain_timeout: negative")
+	}
+	if c.ControlAddr != "" {
+		if err := validateControlAddr(c.ControlAddr); err != nil {
+			return nil, fmt.Errorf("control_addr: %s", err)
+		}
+	}
+	if i := c.Inspector; i != nil {
+		if i.Addr == "" {
+			return nil, fmt.Errorf("inspector.addr: missing")
+		}
+		if err := validateControlAddr(i.Addr); err != nil {
+			return nil, fmt.Errorf("inspector.addr: %s", err)
+		}
+		if i.Size < 0 {
+			return nil, fmt.Errorf("inspector.size: negative")
+		}
+		if i.MaxBodySize < 0 {
+			return nil, fmt.Errorf("inspector.max_body_size: negative")
+		}
+	}
+	for i, name := range c.RedactHeaders {
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			return nil, fmt.Errorf("redact_headers[%d]: invalid header name %q", i, name)
+		}
+	}
+	if k := c.Kubernetes; k != nil && k.PollInterval < 0 {
+		return nil, fmt.Errorf("kubernetes.poll_interval: negative")
+	}
+	if c.Timeouts.DialTimeout < 0 {
+		return nil, fmt.Errorf("timeouts.dial_timeout: negative")
+	}
+	if c.Timeouts.ResponseHeaderTimeout < 0 {
+		return nil, fmt.Errorf("timeouts.response_header_timeout: negative")
+	}
+
+	if err := c.TLS.policy().Apply(&tls.Config{}); err != nil {
+		return nil, fmt.Errorf("tls: %s", err)
+	}
+	if c.TLSSource != nil {
+		if err := c.TLSSource.validate(); err != nil {
+			return nil, fmt.Errorf("tls_source.%s", err)
+		}
+	}
 
+	assigned := 0
 	for name, t := range c.Tunnels {
 		switch t.Protocol {
 		case proto.HTTP:
 			if err := validateHTTP(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
+			if t.Host == "" {
+				assigned++
+			}
 		case proto.TCP, proto.TCP4, proto.TCP6:
 			if err := validateTCP(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
@@ -92,31 +277,146 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 			if err := validateSNI(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
+		case proto.CONNECT:
+			if err := validateConnect(t); err != nil {
+				return nil, fmt.Errorf("%s %s", name, err)
+			}
 		default:
 			return nil, fmt.Errorf("%s invalid protocol %q", name, t.Protocol)
 		}
+		if t.Protocol != proto.CONNECT && len(t.Allow) != 0 {
+			return nil, fmt.Errorf("%s allow: unexpected", name)
+		}
+		if t.Priority != 0 && (t.Priority < proto.MinPriority || t.Priority > proto.MaxPriority) {
+			return nil, fmt.Errorf("%s priority: must be in range %d-%d", name, proto.MinPriority, proto.MaxPriority)
+		}
+	}
+	if assigned > 1 {
+		return nil, fmt.Errorf("host: only one http tunnel may have empty host")
 	}
 
 	return &c, nil
 }
 
+func (c TLSConfig) policy() *tunnel.TLSPolicy {
+	return &tunnel.TLSPolicy{
+		MinVersion:       c.MinVersion,
+		MaxVersion:       c.MaxVersion,
+		CipherSuites:     c.CipherSuites,
+		CurvePreferences: c.CurvePreferences,
+	}
+}
+
+func (c *TLSSourceConfig) validate() error {
+	if len(c.Exec) == 0 && c.Vault == nil {
+		return fmt.Errorf("exec: missing, set exec or vault")
+	}
+	if len(c.Exec) != 0 && c.Vault != nil {
+		return fmt.Errorf("vault: unexpected, set exec or vault")
+	}
+	if len(c.Exec) != 0 && c.Exec[0] == "" {
+		return fmt.Errorf("exec: missing command")
+	}
+	if v := c.Vault; v != nil {
+		if v.Path == "" {
+			return fmt.Errorf("vault.path: missing")
+		}
+		if v.Addr != "" {
+			if _, err := url.ParseRequestURI(v.Addr); err != nil {
+				return fmt.Errorf("vault.addr: %s", err)
+			}
+		}
+	}
+	if c.Refresh < 0 {
+		return fmt.Errorf("refresh: negative")
+	}
+	return nil
+}
+
+// certReloader returns reloader of certificate from the source.
+func (c *TLSSourceConfig) certReloader(logger log.Logger) (*tunnel.CertReloader, error) {
+	var source tunnel.CertSource
+	if len(c.Exec) != 0 {
+		source = &tunnel.ExecCertSource{
+			Command: c.Exec,
+		}
+	} else {
+		v := &tunnel.VaultCertSource{
+			Addr:      c.Vault.Addr,
+			Token:     os.Getenv("VAULT_TOKEN"),
+			Path:      c.Vault.Path,
+			CertField: c.Vault.CertField,
+			KeyField:  c.Vault.KeyField,
+		}
+		if v.Addr == "" {
+			v.Addr = os.Getenv("VAULT_ADDR")
+		}
+		if v.Addr == "" {
+			return nil, fmt.Errorf("vault.addr: missing and VAULT_ADDR is not set")
+		}
+		if c.Vault.CA != "" {
+			roots := x509.NewCertPool()
+			caPEM, err := ioutil.ReadFile(c.Vault.CA)
+			if err != nil {
+				return nil, fmt.Errorf("vault.ca: %s", err)
+			}
+			if ok := roots.AppendCertsFromPEM(caPEM); !ok {
+				return nil, fmt.Errorf("vault.ca: no certificates found in %q", c.Vault.CA)
+			}
+			v.Client = &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: &tls.Config{RootCAs: roots},
+				},
+				Timeout: tunnel.DefaultTimeout,
+			}
+		}
+		source = v
+	}
+
+	return tunnel.NewCertReloader(source, c.Refresh, logger)
+}
+
 func validateHTTP(t *Tunnel) error {
 	var err error
-	if t.Host == "" {
-		return fmt.Errorf("host: missing")
-	}
 	if t.Addr == "" {
 		return fmt.Errorf("addr: missing")
 	}
 	if t.Addr, err = normalizeURL(t.Addr); err != nil {
 		return fmt.Errorf("addr: %s", err)
 	}
+	if t.FlushInterval < 0 {
+		return fmt.Errorf("flush_interval: negative")
+	}
+	if t.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size: negative")
+	}
+	if t.BackendTLS != nil && !strings.HasPrefix(t.Addr, "https://") {
+		return fmt.Errorf("backend_tls: requires https addr")
+	}
+	if _, _, err := parseHostHeader(t.HostHeader); err != nil {
+		return fmt.Errorf("host_header: %s", err)
+	}
+	for i, r := range t.PathRewrite {
+		if _, err := regexp.Compile(r.From); err != nil {
+			return fmt.Errorf("path_rewrite[%d].from: %s", i, err)
+		}
+	}
 
 	// unexpected
 
 	if t.RemoteAddr != "" {
 		return fmt.Errorf("remote_addr: unexpected")
 	}
+	if t.OnDemand != nil {
+		return fmt.Errorf("on_demand: unexpected")
+	}
+	if t.MaxConns != 0 {
+		return fmt.Errorf("max_conns: unexpected")
+	}
+	if t.ConnRate != 0 {
+		return fmt.Errorf("conn_rate: unexpected")
+	}
 
 	return nil
 }
@@ -133,6 +433,13 @@ func validateTCP(t *Tunnel) error {
 		return fmt.Errorf("addr: %s", err)
 	}
 
+	if err := validateOnDemand(t.OnDemand); err != nil {
+		return err
+	}
+	if err := validateConnLimits(t); err != nil {
+		return err
+	}
+
 	// unexpected
 
 	if t.Host != "" {
@@ -141,6 +448,9 @@ func validateTCP(t *Tunnel) error {
 	if t.Auth != "" {
 		return fmt.Errorf("auth: unexpected")
 	}
+	if err := validateNoHTTPOptions(t); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -157,6 +467,13 @@ func validateSNI(t *Tunnel) error {
 		return fmt.Errorf("addr: %s", err)
 	}
 
+	if err := validateOnDemand(t.OnDemand); err != nil {
+		return err
+	}
+	if err := validateConnLimits(t); err != nil {
+		return err
+	}
+
 	// unexpected
 
 	if t.RemoteAddr != "" {
@@ -165,6 +482,130 @@ func validateSNI(t *Tunnel) error {
 	if t.Auth != "" {
 		return fmt.Errorf("auth: unexpected")
 	}
+	if t.BackendTLS != nil {
+		return fmt.Errorf("backend_tls: unexpected")
+	}
+	if err := validateNoHTTPOptions(t); err != nil {
+		return err
+	}
 
 	return nil
 }
+
+func validateConnect(t *Tunnel) error {
+	var err error
+	if t.RemoteAddr == "" {
+		return fmt.Errorf("remote_addr: missing")
+	}
+	if t.RemoteAddr, err = normalizeAddress(t.RemoteAddr); err != nil {
+		return fmt.Errorf("remote_addr: %s", err)
+	}
+	if len(t.Allow) == 0 {
+		return fmt.Errorf("allow: missing")
+	}
+	for i, p := range t.Allow {
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			return fmt.Errorf("allow[%d]: %s", i, err)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("allow[%d]: %s", i, err)
+		}
+	}
+	if err := validateConnLimits(t); err != nil {
+		return err
+	}
+
+	// unexpected
+
+	if t.Addr != "" {
+		return fmt.Errorf("addr: unexpected")
+	}
+	if t.Host != "" {
+		return fmt.Errorf("host: unexpected")
+	}
+	if t.OnDemand != nil {
+		return fmt.Errorf("on_demand: unexpected")
+	}
+	if t.BackendTLS != nil {
+		return fmt.Errorf("backend_tls: unexpected")
+	}
+	if err := validateNoHTTPOptions(t); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateOnDemand(c *OnDemandConfig) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return fmt.Errorf("on_demand.command: missing")
+	}
+	if c.StartTimeout < 0 {
+		return fmt.Errorf("on_demand.start_timeout: negative")
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("on_demand.idle_timeout: negative")
+	}
+
+	return nil
+}
+
+func validateConnLimits(t *Tunnel) error {
+	if t.MaxConns < 0 {
+		return fmt.Errorf("max_conns: negative")
+	}
+	if t.ConnRate < 0 {
+		return fmt.Errorf("conn_rate: negative")
+	}
+
+	return nil
+}
+
+func validateNoHTTPOptions(t *Tunnel) error {
+	if len(t.RequestHeaders) != 0 {
+		return fmt.Errorf("request_headers: unexpected")
+	}
+	if t.ClientIPHeader != "" {
+		return fmt.Errorf("client_ip_header: unexpected")
+	}
+	if len(t.StripResponseHeaders) != 0 {
+		return fmt.Errorf("strip_response_headers: unexpected")
+	}
+	if t.FlushInterval != 0 {
+		return fmt.Errorf("flush_interval: unexpected")
+	}
+	if t.MaxBodySize != 0 {
+		return fmt.Errorf("max_body_size: unexpected")
+	}
+	if t.HTTPSOnly {
+		return fmt.Errorf("https_only: unexpected")
+	}
+	if t.HostHeader != "" {
+		return fmt.Errorf("host_header: unexpected")
+	}
+	if len(t.PathRewrite) != 0 {
+		return fmt.Errorf("path_rewrite: unexpected")
+	}
+
+	return nil
+}
+
+// parseHostHeader parses host_header option, it's either "preserve" or
+// "rewrite:<value>".
+func parseHostHeader(s string) (preserve bool, value string, err error) {
+	switch {
+	case s == "":
+	case s == "preserve":
+		preserve = true
+	case strings.HasPrefix(s, "rewrite:"):
+		if value = strings.TrimPrefix(s, "rewrite:"); value == "" {
+			err = fmt.Errorf("missing rewrite value")
+		}
+	default:
+		err = fmt.Errorf("expected preserve or rewrite:<value> got %q", s)
+	}
+	return
+}
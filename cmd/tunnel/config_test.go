@@ -0,0 +1,36 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseHostHeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		s        string
+		preserve bool
+		value    string
+		err      bool
+	}{
+		{"", false, "", false},
+		{"preserve", true, "", false},
+		{"rewrite:app.local", false, "app.local", false},
+		{"rewrite:", false, "", true},
+		{"app.local", false, "", true},
+	}
+
+	for i, tt := range tests {
+		preserve, value, err := parseHostHeader(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+		if preserve != tt.preserve || value != tt.value {
+			t.Errorf("[%d] expected %v %q got %v %q", i, tt.preserve, tt.value, preserve, value)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel"
+)
+
+// controlHandler returns handler of control socket, it exposes:
+//
+//	GET /status    JSON client status
+func controlHandler(client *tunnel.Client) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client.Status())
+	})
+	return mux
+}
+
+// controlNetwork returns unix for socket paths and tcp for host:port
+// addresses.
+func controlNetwork(addr string) string {
+	if strings.Contains(addr, "/") || !strings.Contains(addr, ":") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// validateControlAddr checks that addr is a unix socket path or a loopback
+// address.
+func validateControlAddr(addr string) error {
+	if controlNetwork(addr) == "unix" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("must be unix socket path or loopback address")
+}
+
+// listenControl listens on control socket, socket left by a client that
+// exited without cleanup is removed. Unix socket is accessible only by the
+// owner.
+func listenControl(addr string) (net.Listener, error) {
+	network := controlNetwork(addr)
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	if conn, err := net.Dial(network, addr); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s in use", addr)
+	}
+	if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+
+	l, err := listenUnix(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// printStatus fetches client status from control socket listening on addr
+// and writes it to w.
+func printStatus(addr string, w io.Writer) error {
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, controlNetwork(addr), addr)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+	resp, err := c.Get("http://tunnel/status")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var s tunnel.ClientStatus
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return fmt.Errorf("invalid response: %s", err)
+	}
+
+	return writeStatus(w, &s, time.Now())
+}
+
+// writeStatus writes connection state followed by a table of tunnels.
+func writeStatus(w io.Writer, s *tunnel.ClientStatus, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "SERVER\t%s\n", s.ServerAddr)
+	if s.Connected {
+		fmt.Fprintf(tw, "STATE\tconnected %s\n", now.Sub(s.ConnectedAt).Truncate(time.Second))
+	} else {
+		fmt.Fprintf(tw, "STATE\tdisconnected\n")
+	}
+	if s.LastError != "" {
+		fmt.Fprintf(tw, "ERROR\t%s\n", s.LastError)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPROTO\tPUBLIC\tSTREAMS\tACTIVE\tIN\tOUT")
+	for _, t := range s.Tunnels {
+		public := t.Public
+		if public == "" {
+			public = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+			t.Name,
+			t.Protocol,
+			public,
+			t.Streams,
+			t.ActiveStreams,
+			t.BytesIn,
+			t.BytesOut,
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestValidateControlAddr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr    string
+		network string
+		err     bool
+	}{
+		{".tunnel/tunnel.sock", "unix", false},
+		{"tunnel.sock", "unix", false},
+		{"localhost:5225", "tcp", false},
+		{"127.0.0.1:5225", "tcp", false},
+		{"[::1]:5225", "tcp", false},
+		{"0.0.0.0:5225", "tcp", true},
+		{":5225", "tcp", true},
+	}
+
+	for i, tt := range tests {
+		if n := controlNetwork(tt.addr); n != tt.network {
+			t.Errorf("[%d] expected network %s got %s", i, tt.network, n)
+		}
+		if err := validateControlAddr(tt.addr); (err != nil) != tt.err {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	s := &tunnel.ClientStatus{
+		ServerAddr:  "tunnel.com:5223",
+		Connected:   true,
+		ConnectedAt: now.Add(-90 * time.Second),
+		Tunnels: []*tunnel.TunnelStatus{
+			{Name: "ssh", Protocol: "tcp", Streams: 1, BytesIn: 10, BytesOut: 20},
+			{Name: "www", Protocol: "http", Public: "http://www.tunnel.com", Streams: 5, ActiveStreams: 2},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeStatus(&buf, s, now); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `SERVER  tunnel.com:5223
+STATE   connected 1m30s
+
+NAME  PROTO  PUBLIC                 STREAMS  ACTIVE  IN  OUT
+ssh   tcp    -                      1        0       10  20
+www   http   http://www.tunnel.com  5        2       0   0
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      "tunnel.com:5223",
+		TLSClientConfig: &tls.Config{},
+		Tunnels: map[string]*proto.Tunnel{
+			"www": {Protocol: proto.HTTP, Host: "www.tunnel.com"},
+		},
+		Proxy: func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := filepath.Join(dir, "tunnel.sock")
+	l, err := listenControl(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, controlHandler(client))
+
+	fi, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 got %o", fi.Mode().Perm())
+	}
+
+	if _, err := listenControl(addr); err == nil {
+		t.Error("expected in use error")
+	}
+
+	var buf bytes.Buffer
+	if err := printStatus(addr, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "STATE   disconnected") || !strings.Contains(buf.String(), "www   http") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,538 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Kubernetes annotations of services and ingresses exposed with tunnels,
+// only objects with expose annotation set to true are exposed.
+//
+// Service is exposed with a single tunnel to port given by port annotation,
+// service name or number, or to the first service port. Proto annotation
+// selects http (default), tcp or sni tunnel, http and sni tunnels require
+// host annotation and tcp tunnels remote-addr annotation.
+//
+// Ingress is exposed with an http tunnel for every rule host, requests are
+// sent to the service backend of the rule root path.
+const (
+	annotationExpose     = "tunnel.mmatczuk.io/expose"
+	annotationProto      = "tunnel.mmatczuk.io/proto"
+	annotationHost       = "tunnel.mmatczuk.io/host"
+	annotationRemoteAddr = "tunnel.mmatczuk.io/remote-addr"
+	annotationPort       = "tunnel.mmatczuk.io/port"
+)
+
+// DefaultKubernetesPollInterval specifies how often Kubernetes API is polled
+// for annotated services and ingresses.
+const DefaultKubernetesPollInterval = 10 * time.Second
+
+// In-cluster service account files.
+const (
+	kubeTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+type kubeObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type kubeServicePort struct {
+	Name string `json:"name"`
+	Port int32  `json:"port"`
+}
+
+type kubeService struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Ports []kubeServicePort `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubeServiceBackend struct {
+	Name string `json:"name"`
+	Port struct {
+		Name   string `json:"name"`
+		Number int32  `json:"number"`
+	} `json:"port"`
+}
+
+type kubeIngressPath struct {
+	Path    string `json:"path"`
+	Backend struct {
+		Service *kubeServiceBackend `json:"service"`
+	} `json:"backend"`
+}
+
+type kubeIngressRule struct {
+	Host string `json:"host"`
+	HTTP *struct {
+		Paths []kubeIngressPath `json:"paths"`
+	} `json:"http"`
+}
+
+type kubeIngress struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Rules []kubeIngressRule `json:"rules"`
+	} `json:"spec"`
+}
+
+// kubeClient is a minimal Kubernetes API client listing services and
+// ingresses.
+type kubeClient struct {
+	url    string
+	token  func() (string, error)
+	client *http.Client
+}
+
+// inClusterKubeClient returns client using service account of the pod, the
+// token is read on every request as it's rotated by kubelet.
+func inClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	roots := x509.NewCertPool()
+	caPEM, err := ioutil.ReadFile(kubeCAFile)
+	if err != nil {
+		return nil, err
+	}
+	if ok := roots.AppendCertsFromPEM(caPEM); !ok {
+		return nil, fmt.Errorf("no certificates found in %q", kubeCAFile)
+	}
+
+	token := func() (string, error) {
+		b, err := ioutil.ReadFile(kubeTokenFile)
+		return strings.TrimSpace(string(b)), err
+	}
+
+	return newKubeClient("https://"+net.JoinHostPort(host, port), token, &tls.Config{RootCAs: roots}), nil
+}
+
+func newKubeClient(url string, token func() (string, error), tlsconf *tls.Config) *kubeClient {
+	return &kubeClient{
+		url:   url,
+		token: token,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsconf,
+			},
+			Timeout: tunnel.DefaultTimeout,
+		},
+	}
+}
+
+// list gets list of resource objects in namespace or in all namespaces if
+// namespace is empty.
+func (k *kubeClient) list(group, resource, namespace string, items interface{}) error {
+	path := "/api/v1"
+	if group != "" {
+		path = "/apis/" + group
+	}
+	if namespace != "" {
+		path += "/namespaces/" + namespace
+	}
+	path += "/" + resource
+
+	req, err := http.NewRequest(http.MethodGet, k.url+path, nil)
+	if err != nil {
+		return err
+	}
+	token, err := k.token()
+	if err != nil {
+		return fmt.Errorf("failed to read token: %s", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("list %s: %s %s", resource, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	list := struct {
+		Items interface{} `json:"items"`
+	}{items}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("list %s: %s", resource, err)
+	}
+	return nil
+}
+
+// kubeTunnels returns tunnels of annotated services and ingresses, objects
+// with invalid annotations are logged and skipped. Tunnels are named
+// service/namespace/name and ingress/namespace/name/host.
+func kubeTunnels(services []kubeService, ingresses []kubeIngress, logger log.Logger) map[string]*Tunnel {
+	m := make(map[string]*Tunnel)
+
+	invalid := func(kind string, meta kubeObjectMeta, err error) {
+		logger.Log(
+			"level", 0,
+			"msg", "invalid kubernetes annotations",
+			"kind", kind,
+			"namespace", meta.Namespace,
+			"name", meta.Name,
+			"err", err,
+		)
+	}
+
+	ports := make(map[string]kubeService)
+	for _, s := range services {
+		ports[s.Metadata.Namespace+"/"+s.Metadata.Name] = s
+
+		if !exposed(s.Metadata) {
+			continue
+		}
+		t, err := serviceTunnel(s)
+		if err != nil {
+			invalid("service", s.Metadata, err)
+			continue
+		}
+		m["service/"+s.Metadata.Namespace+"/"+s.Metadata.Name] = t
+	}
+
+	for _, ing := range ingresses {
+		if !exposed(ing.Metadata) {
+			continue
+		}
+		for _, r := range ing.Spec.Rules {
+			t, err := ingressTunnel(ing.Metadata.Namespace, r, ports)
+			if err != nil {
+				invalid("ingress", ing.Metadata, err)
+				continue
+			}
+			m["ingress/"+ing.Metadata.Namespace+"/"+ing.Metadata.Name+"/"+r.Host] = t
+		}
+	}
+
+	return m
+}
+
+func exposed(meta kubeObjectMeta) bool {
+	v, _ := strconv.ParseBool(meta.Annotations[annotationExpose])
+	return v
+}
+
+func serviceTunnel(s kubeService) (*Tunnel, error) {
+	a := s.Metadata.Annotations
+
+	port, err := servicePort(s, a[annotationPort])
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(s.Metadata.Name+"."+s.Metadata.Namespace+".svc", strconv.Itoa(int(port)))
+
+	t := &Tunnel{
+		Protocol:   a[annotationProto],
+		Host:       a[annotationHost],
+		RemoteAddr: a[annotationRemoteAddr],
+	}
+	if t.Protocol == "" {
+		t.Protocol = proto.HTTP
+	}
+
+	switch t.Protocol {
+	case proto.HTTP:
+		t.Addr = "http://" + addr
+		if t.Host == "" {
+			return nil, fmt.Errorf("%s: missing", annotationHost)
+		}
+		err = validateHTTP(t)
+	case proto.TCP, proto.TCP4, proto.TCP6:
+		t.Addr = addr
+		if t.RemoteAddr == "" {
+			return nil, fmt.Errorf("%s: missing", annotationRemoteAddr)
+		}
+		err = validateTCP(t)
+	case proto.SNI:
+		t.Addr = addr
+		err = validateSNI(t)
+	default:
+		return nil, fmt.Errorf("%s: invalid protocol %q", annotationProto, t.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// servicePort returns service port by name or number, or the first port if
+// port is empty.
+func servicePort(s kubeService, port string) (int32, error) {
+	if len(s.Spec.Ports) == 0 {
+		return 0, fmt.Errorf("service has no ports")
+	}
+	if port == "" {
+		return s.Spec.Ports[0].Port, nil
+	}
+	for _, p := range s.Spec.Ports {
+		if p.Name == port || strconv.Itoa(int(p.Port)) == port {
+			return p.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: no such port %q", annotationPort, port)
+}
+
+func ingressTunnel(namespace string, r kubeIngressRule, services map[string]kubeService) (*Tunnel, error) {
+	if r.Host == "" {
+		return nil, fmt.Errorf("rule without host")
+	}
+	if r.HTTP == nil {
+		return nil, fmt.Errorf("rule %s: no paths", r.Host)
+	}
+
+	var backend *kubeServiceBackend
+	for _, p := range r.HTTP.Paths {
+		if p.Path == "" || p.Path == "/" {
+			backend = p.Backend.Service
+			break
+		}
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("rule %s: no service backend of root path", r.Host)
+	}
+
+	port := backend.Port.Number
+	if port == 0 {
+		s, ok := services[namespace+"/"+backend.Name]
+		if !ok {
+			return nil, fmt.Errorf("rule %s: no such service %q", r.Host, backend.Name)
+		}
+		var err error
+		if port, err = servicePort(s, backend.Port.Name); err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.Host, err)
+		}
+	}
+
+	t := &Tunnel{
+		Protocol: proto.HTTP,
+		Host:     r.Host,
+		Addr:     "http://" + net.JoinHostPort(backend.Name+"."+namespace+".svc", strconv.Itoa(int(port))),
+	}
+	if err := validateHTTP(t); err != nil {
+		return nil, fmt.Errorf("rule %s: %s", r.Host, err)
+	}
+
+	return t, nil
+}
+
+// kubeWatcher polls Kubernetes API for annotated services and ingresses,
+// their tunnels are merged with tunnels from configuration file.
+type kubeWatcher struct {
+	client    *kubeClient
+	namespace string
+	interval  time.Duration
+	static    map[string]*Tunnel
+	logger    log.Logger
+
+	mu      sync.Mutex
+	current map[string]*Tunnel
+}
+
+func newKubeWatcher(client *kubeClient, config *ClientConfig, logger log.Logger) *kubeWatcher {
+	w := &kubeWatcher{
+		client:   client,
+		interval: DefaultKubernetesPollInterval,
+		static:   config.Tunnels,
+		logger:   log.NewContext(logger).WithPrefix("watch", "kubernetes"),
+	}
+	if c := config.Kubernetes; c != nil {
+		w.namespace = c.Namespace
+		if c.PollInterval > 0 {
+			w.interval = c.PollInterval
+		}
+	}
+	return w
+}
+
+// poll lists services and ingresses and returns tunnels, tunnels that
+// conflict with tunnels from configuration file or a tunnel with lower name
+// are skipped.
+func (w *kubeWatcher) poll() (map[string]*Tunnel, error) {
+	var (
+		services  []kubeService
+		ingresses []kubeIngress
+	)
+	if err := w.client.list("", "services", w.namespace, &services); err != nil {
+		return nil, err
+	}
+	if err := w.client.list("networking.k8s.io/v1", "ingresses", w.namespace, &ingresses); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]*Tunnel, len(w.static))
+	used := make(map[string]string)
+	for name, t := range w.static {
+		m[name] = t
+		used[tunnelKey(t)] = name
+	}
+
+	discovered := kubeTunnels(services, ingresses, w.logger)
+	names := make([]string, 0, len(discovered))
+	for name := range discovered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := discovered[name]
+		if other, ok := used[tunnelKey(t)]; ok {
+			w.logger.Log(
+				"level", 0,
+				"msg", "tunnel conflict",
+				"name", name,
+				"with", other,
+			)
+			continue
+		}
+		if _, ok := m[name]; ok {
+			continue
+		}
+		m[name] = t
+		used[tunnelKey(t)] = name
+	}
+
+	return m, nil
+}
+
+// tunnelKey identifies public endpoint of tunnel.
+func tunnelKey(t *Tunnel) string {
+	switch t.Protocol {
+	case proto.HTTP, proto.SNI:
+		return t.Protocol + "://" + t.Host
+	default:
+		return "tcp://" + t.RemoteAddr
+	}
+}
+
+// wait polls until there are tunnels to start.
+func (w *kubeWatcher) wait() map[string]*Tunnel {
+	for {
+		m, err := w.poll()
+		if err != nil {
+			w.logger.Log(
+				"level", 0,
+				"msg", "poll failed",
+				"err", err,
+			)
+		} else if len(m) > 0 {
+			w.set(m)
+			return m
+		} else {
+			w.logger.Log(
+				"level", 1,
+				"action", "wait for tunnels",
+			)
+		}
+		time.Sleep(w.interval)
+	}
+}
+
+// run polls until ctx is done and calls update when tunnels change.
+func (w *kubeWatcher) run(ctx context.Context, update func(map[string]*Tunnel)) {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+
+		m, err := w.poll()
+		if err != nil {
+			w.logger.Log(
+				"level", 0,
+				"msg", "poll failed",
+				"err", err,
+			)
+			continue
+		}
+
+		w.mu.Lock()
+		changed := !reflect.DeepEqual(m, w.current)
+		w.mu.Unlock()
+		if !changed {
+			continue
+		}
+
+		w.logger.Log(
+			"level", 1,
+			"action", "tunnels changed",
+			"tunnels", len(m),
+		)
+		w.set(m)
+		update(m)
+	}
+}
+
+func (w *kubeWatcher) set(m map[string]*Tunnel) {
+	w.mu.Lock()
+	w.current = m
+	w.mu.Unlock()
+}
+
+// tunnel returns current tunnel by name.
+func (w *kubeWatcher) tunnel(name string) (*Tunnel, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t, ok := w.current[name]
+	return t, ok
+}
+
+// switchProxy is a ProxyFuncContext that can be replaced while in use.
+type switchProxy struct {
+	mu    sync.RWMutex
+	proxy tunnel.ProxyFuncContext
+}
+
+func (p *switchProxy) set(proxy tunnel.ProxyFuncContext) {
+	p.mu.Lock()
+	p.proxy = proxy
+	p.mu.Unlock()
+}
+
+func (p *switchProxy) ProxyContext(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+	p.mu.RLock()
+	proxy := p.proxy
+	p.mu.RUnlock()
+
+	proxy(ctx, w, r, msg)
+}
@@ -0,0 +1,167 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+const kubeServicesJSON = `{"items": [
+	{"metadata": {"name": "web", "namespace": "default", "annotations": {
+		"tunnel.mmatczuk.io/expose": "true",
+		"tunnel.mmatczuk.io/host": "web.example.com"}},
+	 "spec": {"ports": [{"name": "http", "port": 8080}]}},
+	{"metadata": {"name": "db", "namespace": "data", "annotations": {
+		"tunnel.mmatczuk.io/expose": "true",
+		"tunnel.mmatczuk.io/proto": "tcp",
+		"tunnel.mmatczuk.io/remote-addr": "0.0.0.0:5432",
+		"tunnel.mmatczuk.io/port": "pg"}},
+	 "spec": {"ports": [{"name": "metrics", "port": 9187}, {"name": "pg", "port": 5432}]}},
+	{"metadata": {"name": "tls", "namespace": "default", "annotations": {
+		"tunnel.mmatczuk.io/expose": "1",
+		"tunnel.mmatczuk.io/proto": "sni",
+		"tunnel.mmatczuk.io/host": "tls.example.com"}},
+	 "spec": {"ports": [{"port": 443}]}},
+	{"metadata": {"name": "api", "namespace": "default"},
+	 "spec": {"ports": [{"name": "http", "port": 80}]}},
+	{"metadata": {"name": "nohost", "namespace": "default", "annotations": {
+		"tunnel.mmatczuk.io/expose": "true"}},
+	 "spec": {"ports": [{"port": 80}]}},
+	{"metadata": {"name": "noport", "namespace": "default", "annotations": {
+		"tunnel.mmatczuk.io/expose": "true",
+		"tunnel.mmatczuk.io/host": "noport.example.com",
+		"tunnel.mmatczuk.io/port": "grpc"}},
+	 "spec": {"ports": [{"port": 80}]}},
+	{"metadata": {"name": "udp", "namespace": "default", "annotations": {
+		"tunnel.mmatczuk.io/expose": "true",
+		"tunnel.mmatczuk.io/proto": "udp"}},
+	 "spec": {"ports": [{"port": 53}]}},
+	{"metadata": {"name": "conflict", "namespace": "default", "annotations": {
+		"tunnel.mmatczuk.io/expose": "true",
+		"tunnel.mmatczuk.io/host": "static.example.com"}},
+	 "spec": {"ports": [{"port": 80}]}}
+]}`
+
+const kubeIngressesJSON = `{"items": [
+	{"metadata": {"name": "site", "namespace": "default", "annotations": {
+		"tunnel.mmatczuk.io/expose": "true"}},
+	 "spec": {"rules": [
+		{"host": "a.example.com", "http": {"paths": [
+			{"path": "/", "backend": {"service": {"name": "api", "port": {"name": "http"}}}}]}},
+		{"host": "b.example.com", "http": {"paths": [
+			{"path": "/docs", "backend": {"service": {"name": "docs", "port": {"number": 8000}}}},
+			{"path": "/", "backend": {"service": {"name": "web", "port": {"number": 8080}}}}]}},
+		{"host": "c.example.com", "http": {"paths": [
+			{"path": "/docs", "backend": {"service": {"name": "docs", "port": {"number": 8000}}}}]}},
+		{"host": "d.example.com", "http": {"paths": [
+			{"path": "/", "backend": {"service": {"name": "missing", "port": {"name": "http"}}}}]}}
+	 ]}},
+	{"metadata": {"name": "internal", "namespace": "default"},
+	 "spec": {"rules": [
+		{"host": "internal.example.com", "http": {"paths": [
+			{"path": "/", "backend": {"service": {"name": "api", "port": {"number": 80}}}}]}}
+	 ]}}
+]}`
+
+func TestKubeWatcherPoll(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/services":
+			w.Write([]byte(kubeServicesJSON))
+		case "/apis/networking.k8s.io/v1/ingresses":
+			w.Write([]byte(kubeIngressesJSON))
+		case "/api/v1/namespaces/empty/services", "/apis/networking.k8s.io/v1/namespaces/empty/ingresses":
+			w.Write([]byte(`{"items": []}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	token := func() (string, error) {
+		return "token", nil
+	}
+	config := &ClientConfig{
+		Tunnels: map[string]*Tunnel{
+			"static": {Protocol: proto.HTTP, Addr: "http://127.0.0.1:80", Host: "static.example.com"},
+		},
+	}
+	w := newKubeWatcher(newKubeClient(s.URL, token, s.Client().Transport.(*http.Transport).TLSClientConfig), config, log.NewNopLogger())
+
+	m, err := w.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]*Tunnel{
+		"static": {
+			Protocol: proto.HTTP,
+			Addr:     "http://127.0.0.1:80",
+			Host:     "static.example.com",
+		},
+		"service/default/web": {
+			Protocol: proto.HTTP,
+			Addr:     "http://web.default.svc:8080",
+			Host:     "web.example.com",
+		},
+		"service/data/db": {
+			Protocol:   proto.TCP,
+			Addr:       "db.data.svc:5432",
+			RemoteAddr: "0.0.0.0:5432",
+		},
+		"service/default/tls": {
+			Protocol: proto.SNI,
+			Addr:     "tls.default.svc:443",
+			Host:     "tls.example.com",
+		},
+		"ingress/default/site/a.example.com": {
+			Protocol: proto.HTTP,
+			Addr:     "http://api.default.svc:80",
+			Host:     "a.example.com",
+		},
+		"ingress/default/site/b.example.com": {
+			Protocol: proto.HTTP,
+			Addr:     "http://web.default.svc:8080",
+			Host:     "b.example.com",
+		},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		a, _ := json.MarshalIndent(m, "", "  ")
+		e, _ := json.MarshalIndent(expected, "", "  ")
+		t.Errorf("expected %s got %s", e, a)
+	}
+
+	// namespaced
+	w.namespace = "empty"
+	m, err = w.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m["static"] == nil {
+		t.Errorf("expected static tunnel got %v", m)
+	}
+
+	// unauthorized
+	w.namespace = ""
+	w.client.token = func() (string, error) {
+		return "", nil
+	}
+	if _, err := w.poll(); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// Key types supported by id new command.
+const (
+	keyTypeECDSA = "ecdsa"
+	keyTypeRSA   = "rsa"
+)
+
+// certValidity specifies how long generated certificates are valid.
+const certValidity = 10 * 365 * 24 * time.Hour
+
+// newKeyPair generates a key and a self-signed client certificate, writes
+// them to keyFile and crtFile and returns the client identifier. Existing
+// files are not overwritten.
+func newKeyPair(keyType, crtFile, keyFile string) (id.ID, error) {
+	var (
+		key      crypto.Signer
+		keyBlock *pem.Block
+		usage    = x509.KeyUsageDigitalSignature
+	)
+
+	switch keyType {
+	case keyTypeECDSA:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return id.ID{}, err
+		}
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return id.ID{}, err
+		}
+		key, keyBlock = k, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	case keyTypeRSA:
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return id.ID{}, err
+		}
+		key, keyBlock = k, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		usage |= x509.KeyUsageKeyEncipherment
+	default:
+		return id.ID{}, fmt.Errorf("unsupported key type %q", keyType)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return id.ID{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "tunnel client"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              usage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return id.ID{}, err
+	}
+
+	if err := writePEM(keyFile, keyBlock, 0600); err != nil {
+		return id.ID{}, err
+	}
+	if err := writePEM(crtFile, &pem.Block{Type: "CERTIFICATE", Bytes: der}, 0644); err != nil {
+		os.Remove(keyFile)
+		return id.ID{}, err
+	}
+
+	return id.New(der), nil
+}
+
+// writePEM writes block to a new file, it fails if the file exists.
+func writePEM(file string, b *pem.Block, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, b); err != nil {
+		f.Close()
+		os.Remove(file)
+		return err
+	}
+	return f.Close()
+}
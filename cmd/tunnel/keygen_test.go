@@ -0,0 +1,59 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestNewKeyPair(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, keyType := range []string{keyTypeECDSA, keyTypeRSA} {
+		crtFile := filepath.Join(dir, keyType, "client.crt")
+		keyFile := filepath.Join(dir, keyType, "client.key")
+
+		identifier, err := newKeyPair(keyType, crtFile, keyFile)
+		if err != nil {
+			t.Fatalf("[%d] unexpected error %s", i, err)
+		}
+
+		cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+		if err != nil {
+			t.Fatalf("[%d] failed to load key pair: %s", i, err)
+		}
+		if id.New(cert.Certificate[0]) != identifier {
+			t.Errorf("[%d] identifier mismatch", i)
+		}
+
+		fi, err := os.Stat(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("[%d] unexpected key file mode %s", i, fi.Mode())
+		}
+
+		if _, err := newKeyPair(keyType, crtFile, keyFile); err == nil {
+			t.Errorf("[%d] expected error on existing files", i)
+		}
+	}
+
+	if _, err := newKeyPair("dsa", filepath.Join(dir, "c"), filepath.Join(dir, "k")); err == nil {
+		t.Error("expected error on unsupported key type")
+	}
+}
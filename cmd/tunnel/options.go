@@ -17,14 +17,22 @@ options:
 const usage2 string = `
 Commands:
 	tunnel id                      Show client identifier
+	tunnel id new [ecdsa|rsa]      Generate client key and self-signed certificate, ecdsa by default, and show client identifier
+	tunnel config check            Validate config file, certificates and backend addresses and print normalized config
 	tunnel list                    List tunnel names from config file
+	tunnel status                  Show connection state, registered tunnels and their traffic of running client
 	tunnel start [tunnel] [...]    Start tunnels by name from config file
 	tunnel start-all               Start all tunnels defined in config file
+	tunnel k8s                     Start all tunnels defined in config file and tunnels of annotated Kubernetes services and ingresses, runs in cluster
 
 Examples:
 	tunnel start www ssh
 	tunnel -config config.yaml -log-level 2 start ssh
 	tunnel start-all
+	tunnel status
+	tunnel -config config.yaml config check
+	tunnel -config .tunnel/tunnel.yml id new
+	tunnel -debug-addr 127.0.0.1:6060 start-all
 
 config.yaml:
 	server_addr: SERVER_IP:5223
@@ -59,39 +67,67 @@ func init() {
 }
 
 type options struct {
-	config   string
-	logLevel int
-	version  bool
-	command  string
-	args     []string
+	config    string
+	logLevel  int
+	debugAddr string
+	version   bool
+	command   string
+	args      []string
 }
 
 func parseArgs() (*options, error) {
 	config := flag.String("config", "tunnel.yml", "Path to tunnel configuration file")
 	logLevel := flag.Int("log-level", 1, "Level of messages to log, 0-3")
+	debugAddr := flag.String("debug-addr", "", "Unix socket path or loopback address serving pprof profiles and expvar client counters, empty string to disable")
 	version := flag.Bool("version", false, "Prints tunnel version")
 	flag.Parse()
 
 	opts := &options{
-		config:   *config,
-		logLevel: *logLevel,
-		version:  *version,
-		command:  flag.Arg(0),
+		config:    *config,
+		logLevel:  *logLevel,
+		debugAddr: *debugAddr,
+		version:   *version,
+		command:   flag.Arg(0),
 	}
 
 	if opts.version {
 		return opts, nil
 	}
 
+	if opts.debugAddr != "" {
+		if err := validateControlAddr(opts.debugAddr); err != nil {
+			return nil, fmt.Errorf("-debug-addr: %s", err)
+		}
+	}
+
 	switch opts.command {
 	case "":
 		flag.Usage()
 		os.Exit(2)
-	case "id", "list":
+	case "id":
+		opts.args = flag.Args()[1:]
+		switch {
+		case len(opts.args) == 0:
+		case opts.args[0] != "new" || len(opts.args) > 2:
+			return nil, fmt.Errorf("id takes no arguments or new [ecdsa|rsa]")
+		case len(opts.args) == 2 && opts.args[1] != keyTypeECDSA && opts.args[1] != keyTypeRSA:
+			return nil, fmt.Errorf("unsupported key type %q", opts.args[1])
+		}
+	case "list":
 		opts.args = flag.Args()[1:]
 		if len(opts.args) > 0 {
 			return nil, fmt.Errorf("list takes no arguments")
 		}
+	case "status":
+		opts.args = flag.Args()[1:]
+		if len(opts.args) > 0 {
+			return nil, fmt.Errorf("status takes no arguments")
+		}
+	case "config":
+		opts.args = flag.Args()[1:]
+		if len(opts.args) != 1 || opts.args[0] != "check" {
+			return nil, fmt.Errorf("config takes one argument: check")
+		}
 	case "start":
 		opts.args = flag.Args()[1:]
 		if len(opts.args) == 0 {
@@ -102,6 +138,11 @@ func parseArgs() (*options, error) {
 		if len(opts.args) > 0 {
 			return nil, fmt.Errorf("start-all takes no arguments")
 		}
+	case "k8s":
+		opts.args = flag.Args()[1:]
+		if len(opts.args) > 0 {
+			return nil, fmt.Errorf("k8s takes no arguments")
+		}
 	default:
 		return nil, fmt.Errorf("unknown command %q", opts.command)
 	}
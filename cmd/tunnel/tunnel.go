@@ -5,20 +5,29 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"syscall"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/cenkalti/backoff"
 	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/internal/debug"
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
@@ -36,6 +45,26 @@ func main() {
 
 	logger := log.NewFilterLogger(log.NewStdLogger(), opts.logLevel)
 
+	// generate key pair, configuration file may not exist yet
+	if opts.command == "id" && len(opts.args) > 0 {
+		crtFile, keyFile, err := keyPairFiles(opts.config)
+		if err != nil {
+			fatal("configuration error: %s", err)
+		}
+		keyType := keyTypeECDSA
+		if len(opts.args) > 1 {
+			keyType = opts.args[1]
+		}
+		identifier, err := newKeyPair(keyType, crtFile, keyFile)
+		if err != nil {
+			fatal("failed to generate key pair: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "written %s and %s\n", keyFile, crtFile)
+		fmt.Println(identifier)
+
+		return
+	}
+
 	// read configuration file
 	config, err := loadClientConfigFromFile(opts.config)
 	if err != nil {
@@ -44,9 +73,19 @@ func main() {
 
 	switch opts.command {
 	case "id":
-		cert, err := tls.LoadX509KeyPair(config.TLSCrt, config.TLSKey)
-		if err != nil {
-			fatal("failed to load key pair: %s", err)
+		var cert *tls.Certificate
+		if config.TLSSource != nil {
+			certs, err := config.TLSSource.certReloader(logger)
+			if err != nil {
+				fatal("failed to load tls certificate: %s", err)
+			}
+			cert = certs.Certificate()
+		} else {
+			c, err := tls.LoadX509KeyPair(config.TLSCrt, config.TLSKey)
+			if err != nil {
+				fatal("failed to load key pair: %s", err)
+			}
+			cert = &c
 		}
 		x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
 		if err != nil {
@@ -54,6 +93,21 @@ func main() {
 		}
 		fmt.Println(id.New(x509Cert.Raw))
 
+		return
+	case "config":
+		if err := checkConfig(config, os.Stdout); err != nil {
+			fatal("configuration error: %s", err)
+		}
+
+		return
+	case "status":
+		if config.ControlAddr == "" {
+			fatal("status requires control_addr")
+		}
+		if err := printStatus(config.ControlAddr, os.Stdout); err != nil {
+			fatal("failed to get status: %s", err)
+		}
+
 		return
 	case "list":
 		var names []string
@@ -80,11 +134,39 @@ func main() {
 		config.Tunnels = tunnels
 	}
 
+	var watcher *kubeWatcher
+	if opts.command == "k8s" {
+		k, err := inClusterKubeClient()
+		if err != nil {
+			fatal("failed to configure kubernetes client: %s", err)
+		}
+		watcher = newKubeWatcher(k, config, logger)
+		config.Tunnels = watcher.wait()
+	}
+
 	if len(config.Tunnels) == 0 {
 		fatal("no tunnels")
 	}
 
-	tlsconf, err := tlsConfig(config)
+	// certificate from external source is refreshed while running
+	var certs *tunnel.CertReloader
+	if config.TLSSource != nil {
+		certs, err = config.TLSSource.certReloader(logger)
+		if err != nil {
+			fatal("failed to load tls certificate: %s", err)
+		}
+		// client identifier is derived from the certificate
+		certs.OnChange = func(cert *tls.Certificate) {
+			logger.Log(
+				"level", 0,
+				"msg", "client identifier changed, server must trust the new one i.e. in -clients",
+				"identifier", id.New(cert.Certificate[0]),
+			)
+		}
+		go certs.Run(context.Background())
+	}
+
+	tlsconf, err := tlsConfig(config, certs)
 	if err != nil {
 		fatal("failed to configure tls: %s", err)
 	}
@@ -95,29 +177,163 @@ func main() {
 	}
 	logger.Log("config", string(b))
 
+	if opts.debugAddr != "" {
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start debug",
+				"addr", opts.debugAddr,
+			)
+
+			l, err := listenControl(opts.debugAddr)
+			if err != nil {
+				fatal("failed to start debug endpoints: %s", err)
+			}
+			fatal("failed to start debug endpoints: %s", http.Serve(l, debug.Handler()))
+		}()
+	}
+
+	var inspector *tunnel.Inspector
+	if c := config.Inspector; c != nil {
+		inspector = &tunnel.Inspector{
+			Size:          c.Size,
+			MaxBodySize:   c.MaxBodySize,
+			RedactHeaders: config.RedactHeaders,
+		}
+	}
+	proxyFunc := proxy(config.Tunnels, config.Timeouts, config.RedactHeaders, inspector, logger)
+
+	// tunnels of kubernetes services are replaced while running
+	var sp *switchProxy
+	if watcher != nil {
+		sp = &switchProxy{proxy: proxyFunc}
+		proxyFunc = sp.ProxyContext
+	}
+
+	if inspector != nil {
+		inspector.Proxy = proxyFunc
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start inspector",
+				"addr", config.Inspector.Addr,
+			)
+
+			l, err := listenControl(config.Inspector.Addr)
+			if err != nil {
+				fatal("failed to start inspector: %s", err)
+			}
+			fatal("failed to start inspector: %s", http.Serve(l, inspector))
+		}()
+	}
+
 	client, err := tunnel.NewClient(&tunnel.ClientConfig{
 		ServerAddr:      config.ServerAddr,
 		TLSClientConfig: tlsconf,
+		Transport:       config.ServerTransport,
+		StreamBuffer:    config.StreamBuffer,
 		Backoff:         expBackoff(config.Backoff),
 		Tunnels:         tunnels(config.Tunnels),
-		Proxy:           proxy(config.Tunnels, logger),
+		ProxyContext:    proxyFunc,
 		Logger:          logger,
+		OnTunnelRegistered: func(name string, t *proto.Tunnel) {
+			c, ok := config.Tunnels[name]
+			if watcher != nil {
+				c, ok = watcher.tunnel(name)
+			}
+			if ok && c.Host == "" {
+				logger.Log(
+					"level", 0,
+					"msg", "tunnel host assigned",
+					"name", name,
+					"host", t.Host,
+				)
+			}
+		},
 	})
 	if err != nil {
 		fatal("failed to create client: %s", err)
 	}
 
+	// client counters are exposed by debug endpoints
+	if opts.debugAddr != "" {
+		expvar.Publish("tunnel", client.Var())
+	}
+
+	if config.ControlAddr != "" {
+		l, err := listenControl(config.ControlAddr)
+		if err != nil {
+			logger.Log(
+				"level", 0,
+				"msg", "failed to start control socket",
+				"err", err,
+			)
+		} else {
+			logger.Log(
+				"level", 1,
+				"action", "start control",
+				"addr", config.ControlAddr,
+			)
+			go http.Serve(l, controlHandler(client))
+			defer l.Close()
+		}
+	}
+
+	if watcher != nil {
+		go watcher.run(context.Background(), func(m map[string]*Tunnel) {
+			sp.set(proxy(m, config.Timeouts, config.RedactHeaders, inspector, logger))
+			client.SetTunnels(tunnels(m))
+		})
+	}
+
+	go drainOnSignal(client, config.DrainTimeout, logger)
+
 	if err := client.Start(); err != nil {
 		fatal("failed to start tunnels: %s", err)
 	}
 }
 
-func tlsConfig(config *ClientConfig) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(config.TLSCrt, config.TLSKey)
+// drainOnSignal stops client gracefully on interrupt or terminate signal,
+// proxied streams may run for timeout, second signal stops client
+// immediately.
+func drainOnSignal(client *tunnel.Client, timeout time.Duration, logger log.Logger) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := client.StopContext(ctx); err != nil {
+		logger.Log(
+			"level", 0,
+			"msg", "drain failed",
+			"err", err,
+		)
+	}
+}
+
+// keyPairFiles returns paths of certificate and key files from configuration
+// file, if it does not exist default paths are returned.
+func keyPairFiles(file string) (crtFile, keyFile string, err error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return filepath.Join(filepath.Dir(file), "client.crt"), filepath.Join(filepath.Dir(file), "client.key"), nil
+	}
+
+	config, err := loadClientConfigFromFile(file)
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
+	return config.TLSCrt, config.TLSKey, nil
+}
 
+// tlsConfig returns configuration of connection to the server, certificate is
+// loaded from files unless certs is set.
+func tlsConfig(config *ClientConfig, certs *tunnel.CertReloader) (*tls.Config, error) {
 	var roots *x509.CertPool
 	if config.RootCA != "" {
 		roots = x509.NewCertPool()
@@ -126,7 +342,7 @@ func tlsConfig(config *ClientConfig) (*tls.Config, error) {
 			return nil, err
 		}
 		if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
-			return nil, err
+			return nil, fmt.Errorf("no certificates found in %q", config.RootCA)
 		}
 	}
 
@@ -135,11 +351,60 @@ func tlsConfig(config *ClientConfig) (*tls.Config, error) {
 		return nil, err
 	}
 
-	return &tls.Config{
+	c := &tls.Config{
 		ServerName:         host,
-		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: roots == nil,
 		RootCAs:            roots,
+	}
+	if certs != nil {
+		c.GetClientCertificate = certs.GetClientCertificate
+	} else {
+		cert, err := tls.LoadX509KeyPair(config.TLSCrt, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if err := config.TLS.policy().Apply(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// backendTLSConfig returns TLS configuration for connecting to tunnel local
+// backend, if backend does not use TLS nil is returned.
+func backendTLSConfig(t *Tunnel) (*tls.Config, error) {
+	c := t.BackendTLS
+	if c == nil {
+		return nil, nil
+	}
+
+	var roots *x509.CertPool
+	if c.CA != "" {
+		roots = x509.NewCertPool()
+		caPEM, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		if ok := roots.AppendCertsFromPEM(caPEM); !ok {
+			return nil, fmt.Errorf("no certificates found in %q", c.CA)
+		}
+	}
+
+	serverName := c.ServerName
+	if serverName == "" && t.Protocol != proto.HTTP {
+		host, _, err := net.SplitHostPort(t.Addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+
+	return &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            roots,
+		InsecureSkipVerify: c.InsecureSkipVerify,
 	}, nil
 }
 
@@ -158,38 +423,104 @@ func tunnels(m map[string]*Tunnel) map[string]*proto.Tunnel {
 
 	for name, t := range m {
 		p[name] = &proto.Tunnel{
-			Protocol: t.Protocol,
-			Host:     t.Host,
-			Auth:     t.Auth,
-			Addr:     t.RemoteAddr,
+			Protocol:    t.Protocol,
+			Host:        t.Host,
+			Auth:        t.Auth,
+			Addr:        t.RemoteAddr,
+			Priority:    t.Priority,
+			MaxBodySize: t.MaxBodySize,
+			HTTPSOnly:   t.HTTPSOnly,
+			MaxConns:    t.MaxConns,
+			ConnRate:    t.ConnRate,
 		}
 	}
 
 	return p
 }
 
-func proxy(m map[string]*Tunnel, logger log.Logger) tunnel.ProxyFunc {
+func proxy(m map[string]*Tunnel, timeouts TimeoutsConfig, redactHeaders []string, inspector *tunnel.Inspector, logger log.Logger) tunnel.ProxyFuncContext {
 	httpURL := make(map[string]*url.URL)
+	httpOptions := make(map[string]*tunnel.HTTPProxyOptions)
 	tcpAddr := make(map[string]string)
+	backends := make(map[string]*tunnel.OnDemandBackend)
+	tcpTLS := make(map[string]*tls.Config)
+	var allow []string
+
+	for name, t := range m {
+		tlsconf, err := backendTLSConfig(t)
+		if err != nil {
+			fatal("failed to configure backend tls of %s: %s", name, err)
+		}
 
-	for _, t := range m {
 		switch t.Protocol {
 		case proto.HTTP:
 			u, err := url.Parse(t.Addr)
 			if err != nil {
 				fatal("invalid tunnel address: %s", err)
 			}
+			preserveHost, hostHeader, err := parseHostHeader(t.HostHeader)
+			if err != nil {
+				fatal("invalid host header: %s", err)
+			}
+			var rewrites []*tunnel.PathRewrite
+			for _, r := range t.PathRewrite {
+				rewrites = append(rewrites, &tunnel.PathRewrite{
+					Pattern:     regexp.MustCompile(r.From),
+					Replacement: r.To,
+				})
+			}
 			httpURL[t.Host] = u
+			httpOptions[t.Host] = &tunnel.HTTPProxyOptions{
+				RequestHeaders:        t.RequestHeaders,
+				ClientIPHeader:        t.ClientIPHeader,
+				StripResponseHeaders:  t.StripResponseHeaders,
+				FlushInterval:         t.FlushInterval,
+				TLSClientConfig:       tlsconf,
+				DialTimeout:           timeouts.DialTimeout,
+				ResponseHeaderTimeout: timeouts.ResponseHeaderTimeout,
+				PreserveHost:          preserveHost,
+				HostHeader:            hostHeader,
+				PathRewrites:          rewrites,
+			}
 		case proto.TCP, proto.TCP4, proto.TCP6:
 			tcpAddr[t.RemoteAddr] = t.Addr
+			if tlsconf != nil {
+				tcpTLS[t.Addr] = tlsconf
+			}
 		case proto.SNI:
 			tcpAddr[t.Host] = t.Addr
+		case proto.CONNECT:
+			allow = append(allow, t.Allow...)
+		}
+		if c := t.OnDemand; c != nil {
+			backends[t.Addr] = &tunnel.OnDemandBackend{
+				Command:      c.Command,
+				StartTimeout: c.StartTimeout,
+				IdleTimeout:  c.IdleTimeout,
+				Stdout:       os.Stdout,
+				Stderr:       os.Stderr,
+				Logger:       log.NewContext(logger).WithPrefix("backend", t.Addr),
+			}
 		}
 	}
 
-	return tunnel.Proxy(tunnel.ProxyFuncs{
-		HTTP: tunnel.NewMultiHTTPProxy(httpURL, log.NewContext(logger).WithPrefix("proxy", "HTTP")).Proxy,
-		TCP:  tunnel.NewMultiTCPProxy(tcpAddr, log.NewContext(logger).WithPrefix("proxy", "TCP")).Proxy,
+	httpProxy := tunnel.NewMultiHTTPProxy(httpURL, log.NewContext(logger).WithPrefix("proxy", "HTTP"))
+	httpProxy.OptionsMap = httpOptions
+	httpProxy.Inspector = inspector
+	httpProxy.RedactHeaders = redactHeaders
+
+	tcpProxy := tunnel.NewMultiTCPProxy(tcpAddr, log.NewContext(logger).WithPrefix("proxy", "TCP"))
+	tcpProxy.Backends = backends
+	tcpProxy.TLSClientConfigs = tcpTLS
+	tcpProxy.DialTimeout = timeouts.DialTimeout
+
+	connectProxy := tunnel.NewConnectProxy(allow, log.NewContext(logger).WithPrefix("proxy", "CONNECT"))
+	connectProxy.DialTimeout = timeouts.DialTimeout
+
+	return tunnel.ProxyContext(tunnel.ProxyFuncsContext{
+		HTTP:    httpProxy.ProxyContext,
+		TCP:     tcpProxy.ProxyContext,
+		Connect: connectProxy.ProxyContext,
 	})
 }
 
@@ -0,0 +1,21 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on unix socket accessible only by the owner from the
+// start, umask is process wide so it's restored right after the socket is
+// created.
+func listenUnix(addr string) (net.Listener, error) {
+	mask := syscall.Umask(0077)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", addr)
+}
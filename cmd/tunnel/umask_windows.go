@@ -0,0 +1,13 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+)
+
+func listenUnix(addr string) (net.Listener, error) {
+	return net.Listen("unix", addr)
+}
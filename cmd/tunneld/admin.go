@@ -0,0 +1,88 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel"
+)
+
+// adminHandler returns handler of admin API, it exposes:
+//
+//	GET /clients    JSON list of connected clients
+//	GET /tunnels    JSON list of tunnel traffic stats
+//	GET /metrics    tunnel traffic stats in Prometheus text format
+func adminHandler(server *tunnel.Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", onlyGet(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.Clients())
+	}))
+	mux.HandleFunc("/tunnels", onlyGet(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.TunnelStats())
+	}))
+	mux.HandleFunc("/metrics", onlyGet(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, server.TunnelStats())
+	}))
+	return mux
+}
+
+// onlyGet rejects requests with methods other than GET.
+func onlyGet(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// printClients fetches connected clients from admin API listening on addr
+// and writes them to w as a table.
+func printClients(addr string, w io.Writer) error {
+	c := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := c.Get(fmt.Sprint("http://", addr, "/clients"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var clients []*tunnel.ClientInfo
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		return fmt.Errorf("invalid response: %s", err)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tADDR\tUPTIME\tIN\tOUT\tTUNNELS")
+	for _, ci := range clients {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n",
+			ci.Identifier,
+			ci.RemoteAddr,
+			now.Sub(ci.ConnectedAt).Truncate(time.Second),
+			ci.BytesIn,
+			ci.BytesOut,
+			strings.Join(ci.Tunnels, ","),
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,827 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/internal/envsubst"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Default server configuration.
+const (
+	DefaultHTTPAddr      = ":80"
+	DefaultHTTPSAddr     = ":443"
+	DefaultTunnelAddr    = ":5223"
+	DefaultTLSCrt        = "server.crt"
+	DefaultTLSKey        = "server.key"
+	DefaultTLSMinVersion = "1.2"
+	DefaultLogLevel      = 1
+)
+
+// DefaultTLSCipherSuites are TLS 1.2 cipher suites used if none are
+// configured.
+var DefaultTLSCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+}
+
+// ListenersConfig defines addresses the server listens on, empty address
+// disables the listener. Network is tcp, tcp4 or tcp6, it applies to all
+// listeners, with tcp addresses without host are dual-stack. If WebSocket is
+// enabled clients may connect over WebSocket on HTTPS listeners. Admin API is
+// not authenticated, its address must be loopback unless AdminPublic is set,
+// Debug address must always be loopback.
+type ListenersConfig struct {
+	Network     string `yaml:"network,omitempty"`
+	HTTP        string `yaml:"http_addr"`
+	HTTPS       string `yaml:"https_addr"`
+	Tunnel      string `yaml:"tunnel_addr"`
+	SNI         string `yaml:"sni_addr,omitempty"`
+	Admin       string `yaml:"admin_addr,omitempty"`
+	AdminPublic bool   `yaml:"admin_public,omitempty"`
+	Debug       string `yaml:"debug_addr,omitempty"`
+	WebSocket   bool   `yaml:"websocket,omitempty"`
+	// Public are additional listeners for public HTTP and HTTPS traffic.
+	Public []*PublicListenerConfig `yaml:"public,omitempty"`
+}
+
+// PublicListenerConfig defines a listener for public HTTP or HTTPS traffic,
+// HTTPS listeners use server certificate and TLS settings unless set.
+// Network overrides network of listeners.
+type PublicListenerConfig struct {
+	Protocol string     `yaml:"proto"`
+	Network  string     `yaml:"network,omitempty"`
+	Addr     string     `yaml:"addr"`
+	TLSCrt   string     `yaml:"tls_crt,omitempty"`
+	TLSKey   string     `yaml:"tls_key,omitempty"`
+	TLS      *TLSConfig `yaml:"tls,omitempty"`
+}
+
+// TLSConfig defines TLS protocol versions, cipher suites and elliptic curves
+// allowed on client and HTTPS connections.
+type TLSConfig struct {
+	MinVersion       string   `yaml:"min_version,omitempty"`
+	MaxVersion       string   `yaml:"max_version,omitempty"`
+	CipherSuites     []string `yaml:"cipher_suites,omitempty"`
+	CurvePreferences []string `yaml:"curve_preferences,omitempty"`
+}
+
+// TLSSourceConfig defines external source of server certificate and key used
+// instead of tls_crt and tls_key files, either Exec command printing PEM
+// data or Vault secret. Certificate is fetched again every Refresh.
+type TLSSourceConfig struct {
+	Exec    []string      `yaml:"exec,omitempty"`
+	Vault   *VaultConfig  `yaml:"vault,omitempty"`
+	Refresh time.Duration `yaml:"refresh,omitempty"`
+}
+
+// VaultConfig defines Vault secret holding PEM certificate and key, Addr
+// defaults to VAULT_ADDR environment variable, token is read from VAULT_TOKEN
+// environment variable. CA is optional path to PEM file with CA certificates
+// of Vault server.
+type VaultConfig struct {
+	Addr      string `yaml:"addr,omitempty"`
+	Path      string `yaml:"path"`
+	CertField string `yaml:"cert_field,omitempty"`
+	KeyField  string `yaml:"key_field,omitempty"`
+	CA        string `yaml:"ca,omitempty"`
+}
+
+// ClientConfig defines an allowed client. Hosts and addrs are path.Match
+// patterns restricting HTTP and SNI hosts, and TCP addresses the client may
+// register, if empty any host or address is allowed.
+type ClientConfig struct {
+	ID    string   `yaml:"id"`
+	Hosts []string `yaml:"hosts,omitempty"`
+	Addrs []string `yaml:"addrs,omitempty"`
+}
+
+// LimitsConfig defines limits of public traffic.
+type LimitsConfig struct {
+	MaxBodySize         int64   `yaml:"max_body_size,omitempty"`
+	RateLimit           float64 `yaml:"rate_limit,omitempty"`
+	RateBurst           int     `yaml:"rate_burst,omitempty"`
+	MaxConnsPerIP       int     `yaml:"max_conns_per_ip,omitempty"`
+	TCPMaxConns         int     `yaml:"tcp_max_conns,omitempty"`
+	TCPConnRate         float64 `yaml:"tcp_conn_rate,omitempty"`
+	TCPConnBurst        int     `yaml:"tcp_conn_burst,omitempty"`
+	MaxTunnelsPerClient int     `yaml:"max_tunnels_per_client,omitempty"`
+	MaxHostsPerClient   int     `yaml:"max_hosts_per_client,omitempty"`
+}
+
+// AuditConfig defines outputs of client registration audit records.
+type AuditConfig struct {
+	Log     string `yaml:"log,omitempty"`
+	Syslog  bool   `yaml:"syslog,omitempty"`
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+// WebhooksConfig defines URLs notified on server events.
+type WebhooksConfig struct {
+	URLs   []string `yaml:"urls,omitempty"`
+	Secret string   `yaml:"secret,omitempty"`
+}
+
+// StateConfig defines persistence of hosts and listener addresses allocated to
+// clients, on restart they are reserved for their clients for
+// ReservationTimeout.
+type StateConfig struct {
+	File               string        `yaml:"file,omitempty"`
+	ReservationTimeout time.Duration `yaml:"reservation_timeout,omitempty"`
+}
+
+// TimeoutsConfig defines timeouts of public traffic, RequestHeaderTimeout
+// limits reading headers of public HTTP requests, ResponseHeaderTimeout and
+// DialTimeout limit waiting for the client to respond to HTTP requests and to
+// connect TCP connections to local services. Zero means no timeout.
+type TimeoutsConfig struct {
+	DialTimeout           time.Duration `yaml:"dial_timeout,omitempty"`
+	RequestHeaderTimeout  time.Duration `yaml:"request_header_timeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout,omitempty"`
+}
+
+// TenantConfig defines a group of clients sharing quotas, clients are
+// members if listed by ID or if organization of their certificate subject
+// matches Organization. Zero quota means no limit, bandwidth is in bytes per
+// second.
+type TenantConfig struct {
+	Name         string   `yaml:"name"`
+	Clients      []string `yaml:"clients,omitempty"`
+	Organization string   `yaml:"organization,omitempty"`
+	MaxTunnels   int      `yaml:"max_tunnels,omitempty"`
+	MaxHosts     int      `yaml:"max_hosts,omitempty"`
+	Bandwidth    int64    `yaml:"bandwidth,omitempty"`
+	MaxStreams   int      `yaml:"max_streams,omitempty"`
+}
+
+// HTTPSRedirectConfig defines redirection of plain HTTP requests to HTTPS,
+// hosts of tunnels with https_only are always redirected.
+type HTTPSRedirectConfig struct {
+	All        bool          `yaml:"all,omitempty"`
+	HSTSMaxAge time.Duration `yaml:"hsts_max_age,omitempty"`
+}
+
+// ServerConfig is a tunnel server configuration.
+type ServerConfig struct {
+	Listeners          ListenersConfig     `yaml:"listeners"`
+	TLSCrt             string              `yaml:"tls_crt"`
+	TLSKey             string              `yaml:"tls_key"`
+	TLSSource          *TLSSourceConfig    `yaml:"tls_source,omitempty"`
+	RootCA             string              `yaml:"root_ca,omitempty"`
+	CAClients          bool                `yaml:"ca_clients,omitempty"`
+	CertHosts          bool                `yaml:"cert_hosts,omitempty"`
+	TLS                TLSConfig           `yaml:"tls,omitempty"`
+	Clients            []*ClientConfig     `yaml:"clients,omitempty"`
+	HTTPSRedirect      HTTPSRedirectConfig `yaml:"https_redirect,omitempty"`
+	Limits             LimitsConfig        `yaml:"limits,omitempty"`
+	Timeouts           TimeoutsConfig      `yaml:"timeouts,omitempty"`
+	Audit              AuditConfig         `yaml:"audit,omitempty"`
+	Webhooks           WebhooksConfig      `yaml:"webhooks,omitempty"`
+	State              StateConfig         `yaml:"state,omitempty"`
+	Tenants            []*TenantConfig     `yaml:"tenants,omitempty"`
+	ErrorPages         string              `yaml:"error_pages,omitempty"`
+	BaseDomain         string              `yaml:"base_domain,omitempty"`
+	MinProtocolVersion int                 `yaml:"min_protocol_version,omitempty"`
+	RedactHeaders      []string            `yaml:"redact_headers,omitempty"`
+	TrustedProxies     []string            `yaml:"trusted_proxies,omitempty"`
+	LogLevel           int                 `yaml:"log_level"`
+}
+
+func defaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Listeners: ListenersConfig{
+			HTTP:   DefaultHTTPAddr,
+			HTTPS:  DefaultHTTPSAddr,
+			Tunnel: DefaultTunnelAddr,
+		},
+		TLSCrt: DefaultTLSCrt,
+		TLSKey: DefaultTLSKey,
+		TLS: TLSConfig{
+			MinVersion:   DefaultTLSMinVersion,
+			CipherSuites: DefaultTLSCipherSuites,
+		},
+		LogLevel: DefaultLogLevel,
+	}
+}
+
+func loadServerConfigFromFile(file string) (*ServerConfig, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %q: %s", file, err)
+	}
+	if buf, err = envsubst.Expand(buf); err != nil {
+		return nil, fmt.Errorf("failed to expand file %q: %s", file, err)
+	}
+
+	c := defaultServerConfig()
+	if err = yaml.Unmarshal(buf, c); err != nil {
+		return nil, fmt.Errorf("failed to parse file %q: %s", file, err)
+	}
+
+	return c, nil
+}
+
+// validate checks configuration, it does not access files.
+func (c *ServerConfig) validate() error {
+	if c.Listeners.Tunnel == "" {
+		return fmt.Errorf("listeners.tunnel_addr: missing")
+	}
+	if err := validateNetwork(c.Listeners.Network); err != nil {
+		return fmt.Errorf("listeners.network: %s", err)
+	}
+	addrs := []struct {
+		name string
+		addr string
+	}{
+		{"http_addr", c.Listeners.HTTP},
+		{"https_addr", c.Listeners.HTTPS},
+		{"tunnel_addr", c.Listeners.Tunnel},
+		{"sni_addr", c.Listeners.SNI},
+		{"admin_addr", c.Listeners.Admin},
+		{"debug_addr", c.Listeners.Debug},
+	}
+	for _, a := range addrs {
+		if a.addr == "" {
+			continue
+		}
+		if err := validateListenAddr(c.Listeners.network(), a.addr); err != nil {
+			return fmt.Errorf("listeners.%s: %s", a.name, err)
+		}
+	}
+	if c.Listeners.Admin != "" && !c.Listeners.AdminPublic {
+		if err := validateLoopbackAddr(c.Listeners.Admin); err != nil {
+			return fmt.Errorf("listeners.admin_addr: %s, set admin_public to expose it", err)
+		}
+	}
+	if c.Listeners.Debug != "" {
+		if err := validateLoopbackAddr(c.Listeners.Debug); err != nil {
+			return fmt.Errorf("listeners.debug_addr: %s", err)
+		}
+	}
+
+	for i, l := range c.Listeners.Public {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listeners.public[%d].%s", i, err)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, l := range c.publicListeners() {
+		if err := validateListenAddr(l.Network, l.Addr); err != nil {
+			return fmt.Errorf("listeners: %s", err)
+		}
+		if seen[l.Addr] {
+			return fmt.Errorf("listeners: duplicate address %q", l.Addr)
+		}
+		seen[l.Addr] = true
+	}
+
+	if c.Listeners.WebSocket && c.httpsRedirect() == nil {
+		return fmt.Errorf("listeners.websocket: requires HTTPS listener")
+	}
+
+	if c.TLSSource == nil {
+		if c.TLSCrt == "" {
+			return fmt.Errorf("tls_crt: missing")
+		}
+		if c.TLSKey == "" {
+			return fmt.Errorf("tls_key: missing")
+		}
+	} else if err := c.TLSSource.validate(); err != nil {
+		return fmt.Errorf("tls_source.%s", err)
+	}
+	if c.CAClients && c.RootCA == "" {
+		return fmt.Errorf("ca_clients: requires root_ca")
+	}
+	if c.CertHosts && c.RootCA == "" {
+		return fmt.Errorf("cert_hosts: requires root_ca")
+	}
+	if err := c.TLS.policy().Apply(&tls.Config{}); err != nil {
+		return fmt.Errorf("tls: %s", err)
+	}
+
+	if c.BaseDomain != "" && (strings.HasPrefix(c.BaseDomain, ".") || strings.ContainsAny(c.BaseDomain, ":/*")) {
+		return fmt.Errorf("base_domain: invalid domain %q", c.BaseDomain)
+	}
+	if v := c.MinProtocolVersion; v != 0 && (v < proto.MinVersion || v > proto.Version) {
+		return fmt.Errorf("min_protocol_version: must be in range %d-%d", proto.MinVersion, proto.Version)
+	}
+	if _, err := tunnel.ParseTrustedProxies(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %s", err)
+	}
+	for i, name := range c.RedactHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("redact_headers[%d]: invalid header name %q", i, name)
+		}
+	}
+
+	ids := make(map[id.ID]bool)
+	for i, cc := range c.Clients {
+		var identifier id.ID
+		if cc.ID == "" {
+			return fmt.Errorf("clients[%d].id: missing", i)
+		}
+		if err := identifier.UnmarshalText([]byte(cc.ID)); err != nil {
+			return fmt.Errorf("clients[%d].id: %s", i, err)
+		}
+		if ids[identifier] {
+			return fmt.Errorf("clients[%d].id: duplicate", i)
+		}
+		ids[identifier] = true
+
+		for _, p := range append(cc.Hosts, cc.Addrs...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("clients[%d]: invalid pattern %q", i, p)
+			}
+		}
+	}
+
+	if c.HTTPSRedirect.HSTSMaxAge < 0 {
+		return fmt.Errorf("https_redirect.hsts_max_age: negative")
+	}
+	if (c.HTTPSRedirect.All || c.HTTPSRedirect.HSTSMaxAge > 0) && c.httpsRedirect() == nil {
+		return fmt.Errorf("https_redirect: requires HTTPS listener")
+	}
+
+	if c.Limits.MaxBodySize < 0 {
+		return fmt.Errorf("limits.max_body_size: negative")
+	}
+	if c.Limits.RateLimit < 0 {
+		return fmt.Errorf("limits.rate_limit: negative")
+	}
+	if c.Limits.RateBurst < 0 {
+		return fmt.Errorf("limits.rate_burst: negative")
+	}
+	if c.Limits.MaxConnsPerIP < 0 {
+		return fmt.Errorf("limits.max_conns_per_ip: negative")
+	}
+	if c.Limits.TCPMaxConns < 0 {
+		return fmt.Errorf("limits.tcp_max_conns: negative")
+	}
+	if c.Limits.TCPConnRate < 0 {
+		return fmt.Errorf("limits.tcp_conn_rate: negative")
+	}
+	if c.Limits.TCPConnBurst < 0 {
+		return fmt.Errorf("limits.tcp_conn_burst: negative")
+	}
+	if c.Limits.MaxTunnelsPerClient < 0 {
+		return fmt.Errorf("limits.max_tunnels_per_client: negative")
+	}
+	if c.Limits.MaxHostsPerClient < 0 {
+		return fmt.Errorf("limits.max_hosts_per_client: negative")
+	}
+
+	if c.Timeouts.DialTimeout < 0 {
+		return fmt.Errorf("timeouts.dial_timeout: negative")
+	}
+	if c.Timeouts.RequestHeaderTimeout < 0 {
+		return fmt.Errorf("timeouts.request_header_timeout: negative")
+	}
+	if c.Timeouts.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("timeouts.response_header_timeout: negative")
+	}
+
+	if c.Audit.Webhook != "" {
+		if _, err := url.ParseRequestURI(c.Audit.Webhook); err != nil {
+			return fmt.Errorf("audit.webhook: %s", err)
+		}
+	}
+	for _, u := range c.Webhooks.URLs {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return fmt.Errorf("webhooks.urls: %s", err)
+		}
+	}
+	if c.Webhooks.Secret != "" && len(c.Webhooks.URLs) == 0 && c.Audit.Webhook == "" {
+		return fmt.Errorf("webhooks.secret: requires webhooks.urls or audit.webhook")
+	}
+
+	if c.State.ReservationTimeout < 0 {
+		return fmt.Errorf("state.reservation_timeout: negative")
+	}
+
+	names := make(map[string]bool)
+	for i, tc := range c.Tenants {
+		if err := tc.validate(); err != nil {
+			return fmt.Errorf("tenants[%d].%s", i, err)
+		}
+		if names[tc.Name] {
+			return fmt.Errorf("tenants[%d].name: duplicate", i)
+		}
+		names[tc.Name] = true
+	}
+
+	if c.LogLevel < 0 || c.LogLevel > 3 {
+		return fmt.Errorf("log_level: must be in range 0-3")
+	}
+
+	return nil
+}
+
+func (l *PublicListenerConfig) validate() error {
+	switch l.Protocol {
+	case proto.HTTP:
+		if l.TLSCrt != "" {
+			return fmt.Errorf("tls_crt: unexpected")
+		}
+		if l.TLSKey != "" {
+			return fmt.Errorf("tls_key: unexpected")
+		}
+		if l.TLS != nil {
+			return fmt.Errorf("tls: unexpected")
+		}
+	case proto.HTTPS:
+		if (l.TLSCrt == "") != (l.TLSKey == "") {
+			return fmt.Errorf("tls_crt: must be set together with tls_key")
+		}
+		if l.TLS != nil {
+			if err := l.TLS.policy().Apply(&tls.Config{}); err != nil {
+				return fmt.Errorf("tls: %s", err)
+			}
+		}
+	default:
+		return fmt.Errorf("proto: invalid protocol %q", l.Protocol)
+	}
+
+	if err := validateNetwork(l.Network); err != nil {
+		return fmt.Errorf("network: %s", err)
+	}
+	if l.Addr == "" {
+		return fmt.Errorf("addr: missing")
+	}
+	if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+		return fmt.Errorf("addr: %s", err)
+	}
+
+	return nil
+}
+
+func (c *TLSSourceConfig) validate() error {
+	if len(c.Exec) == 0 && c.Vault == nil {
+		return fmt.Errorf("exec: missing, set exec or vault")
+	}
+	if len(c.Exec) != 0 && c.Vault != nil {
+		return fmt.Errorf("vault: unexpected, set exec or vault")
+	}
+	if len(c.Exec) != 0 && c.Exec[0] == "" {
+		return fmt.Errorf("exec: missing command")
+	}
+	if v := c.Vault; v != nil {
+		if v.Path == "" {
+			return fmt.Errorf("vault.path: missing")
+		}
+		if v.Addr != "" {
+			if _, err := url.ParseRequestURI(v.Addr); err != nil {
+				return fmt.Errorf("vault.addr: %s", err)
+			}
+		}
+	}
+	if c.Refresh < 0 {
+		return fmt.Errorf("refresh: negative")
+	}
+	return nil
+}
+
+// certReloader returns reloader of certificate from the source.
+func (c *TLSSourceConfig) certReloader(logger log.Logger) (*tunnel.CertReloader, error) {
+	var source tunnel.CertSource
+	if len(c.Exec) != 0 {
+		source = &tunnel.ExecCertSource{
+			Command: c.Exec,
+		}
+	} else {
+		v := &tunnel.VaultCertSource{
+			Addr:      c.Vault.Addr,
+			Token:     os.Getenv("VAULT_TOKEN"),
+			Path:      c.Vault.Path,
+			CertField: c.Vault.CertField,
+			KeyField:  c.Vault.KeyField,
+		}
+		if v.Addr == "" {
+			v.Addr = os.Getenv("VAULT_ADDR")
+		}
+		if v.Addr == "" {
+			return nil, fmt.Errorf("vault.addr: missing and VAULT_ADDR is not set")
+		}
+		if c.Vault.CA != "" {
+			roots, err := loadCertPool(c.Vault.CA)
+			if err != nil {
+				return nil, fmt.Errorf("vault.ca: %s", err)
+			}
+			v.Client = &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: &tls.Config{RootCAs: roots},
+				},
+				Timeout: tunnel.DefaultTimeout,
+			}
+		}
+		source = v
+	}
+
+	return tunnel.NewCertReloader(source, c.Refresh, logger)
+}
+
+// validHeaderName checks that name is a non empty HTTP header name.
+func validHeaderName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t:\r\n")
+}
+
+func validateNetwork(network string) error {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6":
+		return nil
+	default:
+		return fmt.Errorf("invalid network %q, choose tcp, tcp4 or tcp6", network)
+	}
+}
+
+// validateListenAddr checks that addr is a valid address and that IP host
+// belongs to the address family of network.
+func validateListenAddr(network, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	if network == "tcp4" && ip.To4() == nil {
+		return fmt.Errorf("address %s is not IPv4", addr)
+	}
+	if network == "tcp6" && ip.To4() != nil {
+		return fmt.Errorf("address %s is not IPv6", addr)
+	}
+	return nil
+}
+
+// validateLoopbackAddr checks that addr is a loopback address.
+func validateLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("must be loopback address")
+}
+
+// network returns network of listeners, tcp if not set.
+func (c ListenersConfig) network() string {
+	if c.Network == "" {
+		return "tcp"
+	}
+	return c.Network
+}
+
+// publicListeners returns all listeners for public traffic including
+// http_addr and https_addr, HTTPS listeners have server certificate and TLS
+// settings set unless configured.
+func (c *ServerConfig) publicListeners() []*PublicListenerConfig {
+	var listeners []*PublicListenerConfig
+	if c.Listeners.HTTP != "" {
+		listeners = append(listeners, &PublicListenerConfig{
+			Protocol: proto.HTTP,
+			Network:  c.Listeners.network(),
+			Addr:     c.Listeners.HTTP,
+		})
+	}
+	if c.Listeners.HTTPS != "" {
+		listeners = append(listeners, &PublicListenerConfig{
+			Protocol: proto.HTTPS,
+			Network:  c.Listeners.network(),
+			Addr:     c.Listeners.HTTPS,
+		})
+	}
+	for _, l := range c.Listeners.Public {
+		l := *l
+		listeners = append(listeners, &l)
+	}
+
+	for _, l := range listeners {
+		if l.Network == "" {
+			l.Network = c.Listeners.network()
+		}
+		if l.Protocol != proto.HTTPS {
+			continue
+		}
+		// listeners without certificate use tls_source
+		if l.TLSCrt == "" && c.TLSSource == nil {
+			l.TLSCrt = c.TLSCrt
+			l.TLSKey = c.TLSKey
+		}
+		if l.TLS == nil {
+			l.TLS = &c.TLS
+		}
+	}
+
+	return listeners
+}
+
+func (c TLSConfig) policy() *tunnel.TLSPolicy {
+	return &tunnel.TLSPolicy{
+		MinVersion:       c.MinVersion,
+		MaxVersion:       c.MaxVersion,
+		CipherSuites:     c.CipherSuites,
+		CurvePreferences: c.CurvePreferences,
+	}
+}
+
+// httpsRedirect returns HTTPS redirect to port of the first HTTPS listener or
+// nil if there is no HTTPS listener.
+func (c *ServerConfig) httpsRedirect() *tunnel.HTTPSRedirect {
+	for _, l := range c.publicListeners() {
+		if l.Protocol != proto.HTTPS {
+			continue
+		}
+		_, port, _ := net.SplitHostPort(l.Addr)
+		p, _ := strconv.Atoi(port)
+		return &tunnel.HTTPSRedirect{
+			All:        c.HTTPSRedirect.All,
+			Port:       p,
+			HSTSMaxAge: c.HTTPSRedirect.HSTSMaxAge,
+		}
+	}
+	return nil
+}
+
+// rateLimit returns rate limit or nil if traffic is not limited.
+func (c LimitsConfig) rateLimit() *tunnel.RateLimit {
+	if c.RateLimit == 0 && c.MaxConnsPerIP == 0 {
+		return nil
+	}
+	return &tunnel.RateLimit{
+		RequestsPerSecond: c.RateLimit,
+		Burst:             c.RateBurst,
+		MaxConns:          c.MaxConnsPerIP,
+	}
+}
+
+// listenerLimit returns limit of connections per TCP listener or nil if
+// connections are not limited.
+func (c LimitsConfig) listenerLimit() *tunnel.ListenerLimit {
+	if c.TCPMaxConns == 0 && c.TCPConnRate == 0 {
+		return nil
+	}
+	return &tunnel.ListenerLimit{
+		MaxConns:       c.TCPMaxConns,
+		ConnsPerSecond: c.TCPConnRate,
+		Burst:          c.TCPConnBurst,
+	}
+}
+
+func (c *TenantConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name: missing")
+	}
+	if len(c.Clients) == 0 && c.Organization == "" {
+		return fmt.Errorf("clients: missing, clients or organization is required")
+	}
+	for _, v := range c.Clients {
+		var identifier id.ID
+		if err := identifier.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("clients: %s", err)
+		}
+	}
+	if c.MaxTunnels < 0 {
+		return fmt.Errorf("max_tunnels: negative")
+	}
+	if c.MaxHosts < 0 {
+		return fmt.Errorf("max_hosts: negative")
+	}
+	if c.Bandwidth < 0 {
+		return fmt.Errorf("bandwidth: negative")
+	}
+	if c.MaxStreams < 0 {
+		return fmt.Errorf("max_streams: negative")
+	}
+	return nil
+}
+
+func (c *TenantConfig) tenant() *tunnel.Tenant {
+	return &tunnel.Tenant{
+		Name:       c.Name,
+		MaxTunnels: c.MaxTunnels,
+		MaxHosts:   c.MaxHosts,
+		Bandwidth:  c.Bandwidth,
+		MaxStreams: c.MaxStreams,
+	}
+}
+
+// tenantFunc returns function assigning clients to tenants or nil if no
+// tenants are configured. Clients are matched by ID first and then by
+// certificate organization, the first configured tenant wins.
+func tenantFunc(tenants []*TenantConfig) func(id.ID, *x509.Certificate) *tunnel.Tenant {
+	if len(tenants) == 0 {
+		return nil
+	}
+
+	byID := make(map[id.ID]*tunnel.Tenant)
+	byOrg := make(map[string]*tunnel.Tenant)
+	for _, tc := range tenants {
+		t := tc.tenant()
+		for _, v := range tc.Clients {
+			var identifier id.ID
+			identifier.UnmarshalText([]byte(v))
+			if _, ok := byID[identifier]; !ok {
+				byID[identifier] = t
+			}
+		}
+		if _, ok := byOrg[tc.Organization]; tc.Organization != "" && !ok {
+			byOrg[tc.Organization] = t
+		}
+	}
+
+	return func(identifier id.ID, cert *x509.Certificate) *tunnel.Tenant {
+		if t, ok := byID[identifier]; ok {
+			return t
+		}
+		if cert == nil {
+			return nil
+		}
+		for _, o := range cert.Subject.Organization {
+			if t, ok := byOrg[o]; ok {
+				return t
+			}
+		}
+		return nil
+	}
+}
+
+// tunnelPolicy returns function checking tunnels against hosts and addrs of
+// configured clients or nil if no client is restricted. Clients not listed
+// in configuration are not restricted.
+func tunnelPolicy(clients []*ClientConfig) func(id.ID, *proto.Tunnel) error {
+	m := make(map[id.ID]*ClientConfig)
+	for _, cc := range clients {
+		if len(cc.Hosts) == 0 && len(cc.Addrs) == 0 {
+			continue
+		}
+		var identifier id.ID
+		identifier.UnmarshalText([]byte(cc.ID))
+		m[identifier] = cc
+	}
+	if len(m) == 0 {
+		return nil
+	}
+
+	return func(identifier id.ID, t *proto.Tunnel) error {
+		cc, ok := m[identifier]
+		if !ok {
+			return nil
+		}
+
+		switch t.Protocol {
+		case proto.HTTP, proto.SNI:
+			if len(cc.Hosts) > 0 && !matchAny(cc.Hosts, t.Host) {
+				return fmt.Errorf("host %q not allowed", t.Host)
+			}
+		default:
+			if len(cc.Addrs) > 0 && !matchAny(cc.Addrs, t.Addr) {
+				return fmt.Errorf("addr %q not allowed", t.Addr)
+			}
+		}
+
+		return nil
+	}
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// store returns state store or nil if persistence is disabled.
+func (c StateConfig) store() tunnel.StateStore {
+	if c.File == "" {
+		return nil
+	}
+	return tunnel.NewFileStateStore(c.File)
+}
@@ -0,0 +1,286 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+const testClientID = "AADQ4FI-4EMVDC2-OB7IZGV-IW3CNFN-YHO7UFR-SJZVINS-IV63L3R-GL2LMQW"
+
+func TestServerConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tunneld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"", ""},
+		{"listeners:\n  tunnel_addr: \"\"\n", "listeners.tunnel_addr: missing"},
+		{"listeners:\n  tunnel_addr: ${TUNNELD_TEST_UNSET:-}\n", "listeners.tunnel_addr: missing"},
+		{"listeners:\n  tunnel_addr: :5223\n  admin_addr: localhost\n", "listeners.admin_addr: address localhost: missing port in address"},
+		{"listeners:\n  tunnel_addr: :5223\n  admin_addr: :5224\n", "listeners.admin_addr: must be loopback address, set admin_public to expose it"},
+		{"listeners:\n  tunnel_addr: :5223\n  admin_addr: 10.0.0.1:5224\n", "listeners.admin_addr: must be loopback address, set admin_public to expose it"},
+		{"listeners:\n  tunnel_addr: :5223\n  admin_addr: \"[::1]:5224\"\n", ""},
+		{"listeners:\n  tunnel_addr: :5223\n  admin_addr: :5224\n  admin_public: true\n", ""},
+		{"listeners:\n  tunnel_addr: :5223\n  debug_addr: localhost\n", "listeners.debug_addr: address localhost: missing port in address"},
+		{"listeners:\n  tunnel_addr: :5223\n  debug_addr: 0.0.0.0:6060\n", "listeners.debug_addr: must be loopback address"},
+		{"listeners:\n  tunnel_addr: :5223\n  debug_addr: localhost:6060\n", ""},
+		{"listeners:\n  tunnel_addr: :5223\n  public:\n    - {proto: https, addr: \"10.0.0.1:443\", tls_crt: a.crt, tls_key: a.key}\n    - {proto: http, addr: \"10.0.0.1:80\"}\n", ""},
+		{"listeners:\n  tunnel_addr: :5223\n  public:\n    - {proto: tcp, addr: \":22\"}\n", "listeners.public[0].proto: invalid protocol \"tcp\""},
+		{"listeners:\n  tunnel_addr: :5223\n  public:\n    - {proto: http}\n", "listeners.public[0].addr: missing"},
+		{"listeners:\n  tunnel_addr: :5223\n  public:\n    - {proto: http, addr: \":8080\", tls_crt: a.crt}\n", "listeners.public[0].tls_crt: unexpected"},
+		{"listeners:\n  tunnel_addr: :5223\n  public:\n    - {proto: https, addr: \":8443\", tls_crt: a.crt}\n", "listeners.public[0].tls_crt: must be set together with tls_key"},
+		{"listeners:\n  tunnel_addr: :5223\n  http_addr: :80\n  public:\n    - {proto: https, addr: \":80\"}\n", "listeners: duplicate address \":80\""},
+		{"listeners:\n  network: tcp6\n  tunnel_addr: \"[::]:5223\"\n  http_addr: \"[::]:80\"\n  https_addr: \"[::]:443\"\n", ""},
+		{"listeners:\n  network: udp\n  tunnel_addr: :5223\n", "listeners.network: invalid network \"udp\", choose tcp, tcp4 or tcp6"},
+		{"listeners:\n  network: tcp4\n  tunnel_addr: \"[::]:5223\"\n", "listeners.tunnel_addr: address [::]:5223 is not IPv4"},
+		{"listeners:\n  tunnel_addr: :5223\n  public:\n    - {proto: http, network: tcp6, addr: \"10.0.0.1:80\"}\n", "listeners: address 10.0.0.1:80 is not IPv6"},
+		{"listeners:\n  tunnel_addr: :5223\n  websocket: true\n", ""},
+		{"listeners:\n  tunnel_addr: :5223\n  https_addr: \"\"\n  websocket: true\n", "listeners.websocket: requires HTTPS listener"},
+		{"ca_clients: true\n", "ca_clients: requires root_ca"},
+		{"cert_hosts: true\n", "cert_hosts: requires root_ca"},
+		{"tls_crt: \"\"\ntls_source:\n  exec: [cat, server.pem]\n  refresh: 1h\n", ""},
+		{"tls_source:\n  vault: {addr: \"https://vault:8200\", path: secret/data/tunneld}\n", ""},
+		{"tls_source:\n  refresh: 1h\n", "tls_source.exec: missing, set exec or vault"},
+		{"tls_source:\n  exec: [cat]\n  vault: {path: secret/data/tunneld}\n", "tls_source.vault: unexpected, set exec or vault"},
+		{"tls_source:\n  vault: {addr: \"https://vault:8200\"}\n", "tls_source.vault.path: missing"},
+		{"tls_source:\n  exec: [cat]\n  refresh: -1h\n", "tls_source.refresh: negative"},
+		{"tls:\n  min_version: \"1.0\"\n", "tls: min_version: TLS 1.0 not supported, at least 1.2 is required"},
+		{"clients:\n  - hosts: [a.com]\n", "clients[0].id: missing"},
+		{"clients:\n  - id: " + testClientID + "\n  - id: " + testClientID + "\n", "clients[1].id: duplicate"},
+		{"clients:\n  - id: " + testClientID + "\n    hosts: [\"[\"]\n", "clients[0]: invalid pattern \"[\""},
+		{"base_domain: tunnel.example.com\n", ""},
+		{"base_domain: .example.com\n", "base_domain: invalid domain \".example.com\""},
+		{"base_domain: example.com:80\n", "base_domain: invalid domain \"example.com:80\""},
+		{"min_protocol_version: 2\n", ""},
+		{"min_protocol_version: 5\n", "min_protocol_version: must be in range 1-4"},
+		{"redact_headers: [X-Api-Key]\n", ""},
+		{"trusted_proxies: [10.0.0.0/8, \"::1\"]\n", ""},
+		{"trusted_proxies: [10.0.0.0/33]\n", "trusted_proxies: invalid CIDR address: 10.0.0.0/33"},
+		{"redact_headers: [\"X-Api-Key:\"]\n", "redact_headers[0]: invalid header name \"X-Api-Key:\""},
+		{"https_redirect:\n  all: true\n  hsts_max_age: 1h\n", ""},
+		{"https_redirect:\n  hsts_max_age: -1h\n", "https_redirect.hsts_max_age: negative"},
+		{"listeners:\n  tunnel_addr: :5223\n  https_addr: \"\"\nhttps_redirect:\n  all: true\n", "https_redirect: requires HTTPS listener"},
+		{"limits:\n  max_body_size: -1\n", "limits.max_body_size: negative"},
+		{"limits:\n  max_tunnels_per_client: 10\n  max_hosts_per_client: 5\n", ""},
+		{"limits:\n  max_tunnels_per_client: -1\n", "limits.max_tunnels_per_client: negative"},
+		{"limits:\n  max_hosts_per_client: -1\n", "limits.max_hosts_per_client: negative"},
+		{"limits:\n  tcp_max_conns: 100\n  tcp_conn_rate: 20\n  tcp_conn_burst: 40\n", ""},
+		{"limits:\n  tcp_max_conns: -1\n", "limits.tcp_max_conns: negative"},
+		{"limits:\n  tcp_conn_rate: -1\n", "limits.tcp_conn_rate: negative"},
+		{"limits:\n  tcp_conn_burst: -1\n", "limits.tcp_conn_burst: negative"},
+		{"timeouts:\n  dial_timeout: 5s\n  request_header_timeout: 10s\n  response_header_timeout: 30s\n", ""},
+		{"timeouts:\n  response_header_timeout: -1s\n", "timeouts.response_header_timeout: negative"},
+		{"webhooks:\n  secret: s3cr3t\n", "webhooks.secret: requires webhooks.urls or audit.webhook"},
+		{"state:\n  file: state.json\n  reservation_timeout: -1s\n", "state.reservation_timeout: negative"},
+		{"tenants:\n  - {name: acme, organization: Acme, max_tunnels: 10, bandwidth: 1048576}\n", ""},
+		{"tenants:\n  - {organization: Acme}\n", "tenants[0].name: missing"},
+		{"tenants:\n  - {name: acme}\n", "tenants[0].clients: missing, clients or organization is required"},
+		{"tenants:\n  - {name: acme, organization: Acme, max_streams: -1}\n", "tenants[0].max_streams: negative"},
+		{"tenants:\n  - {name: acme, organization: Acme}\n  - {name: acme, clients: [" + testClientID + "]}\n", "tenants[1].name: duplicate"},
+		{"log_level: 4\n", "log_level: must be in range 0-3"},
+	}
+
+	for i, tt := range tests {
+		file := filepath.Join(dir, "tunneld.yml")
+		if err := ioutil.WriteFile(file, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := loadServerConfigFromFile(file)
+		if err != nil {
+			t.Fatalf("[%d] load failed: %s", i, err)
+		}
+		err = c.validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("[%d] unexpected error %s", i, err)
+		}
+		if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("[%d] expected error %q got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestServerConfigPublicListeners(t *testing.T) {
+	t.Parallel()
+
+	c := defaultServerConfig()
+	c.Listeners.HTTP = ""
+	c.Listeners.Public = []*PublicListenerConfig{
+		{Protocol: proto.HTTP, Addr: "127.0.0.1:8080"},
+		{Protocol: proto.HTTPS, Network: "tcp6", Addr: "[::1]:443", TLSCrt: "a.crt", TLSKey: "a.key", TLS: &TLSConfig{MinVersion: "1.3"}},
+	}
+
+	expected := []*PublicListenerConfig{
+		{Protocol: proto.HTTPS, Network: "tcp", Addr: DefaultHTTPSAddr, TLSCrt: DefaultTLSCrt, TLSKey: DefaultTLSKey, TLS: &c.TLS},
+		{Protocol: proto.HTTP, Network: "tcp", Addr: "127.0.0.1:8080"},
+		{Protocol: proto.HTTPS, Network: "tcp6", Addr: "[::1]:443", TLSCrt: "a.crt", TLSKey: "a.key", TLS: &TLSConfig{MinVersion: "1.3"}},
+	}
+	if l := c.publicListeners(); !reflect.DeepEqual(l, expected) {
+		t.Errorf("expected %v got %v", expected, l)
+	}
+
+	// certificate from tls_source
+	c.TLSSource = &TLSSourceConfig{Exec: []string{"cat"}}
+	expected[0].TLSCrt, expected[0].TLSKey = "", ""
+	if l := c.publicListeners(); !reflect.DeepEqual(l, expected) {
+		t.Errorf("expected %v got %v", expected, l)
+	}
+}
+
+func TestServerConfigHTTPSRedirect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		https  string
+		public []*PublicListenerConfig
+		port   int
+	}{
+		{":443", nil, 443},
+		{"", []*PublicListenerConfig{{Protocol: proto.HTTP, Addr: ":80"}, {Protocol: proto.HTTPS, Addr: "10.0.0.1:8443"}}, 8443},
+		{"", nil, -1},
+	}
+
+	for i, tt := range tests {
+		c := defaultServerConfig()
+		c.Listeners.HTTPS = tt.https
+		c.Listeners.Public = tt.public
+
+		r := c.httpsRedirect()
+		if tt.port == -1 {
+			if r != nil {
+				t.Errorf("[%d] expected no redirect got %+v", i, r)
+			}
+			continue
+		}
+		if r == nil || r.Port != tt.port {
+			t.Errorf("[%d] expected port %d got %+v", i, tt.port, r)
+		}
+	}
+}
+
+func TestOptionsApply(t *testing.T) {
+	t.Parallel()
+
+	o := &options{
+		config:    "tunneld.yml",
+		httpAddr:  ":8080",
+		httpsAddr: ":8443",
+		clients:   testClientID,
+		set: map[string]bool{
+			"httpAddr": true,
+			"clients":  true,
+		},
+	}
+
+	c := defaultServerConfig()
+	c.Listeners.HTTP = ":81"
+	o.apply(c)
+
+	if c.Listeners.HTTP != ":8080" {
+		t.Errorf("expected set option to override file got %q", c.Listeners.HTTP)
+	}
+	if c.Listeners.HTTPS != DefaultHTTPSAddr {
+		t.Errorf("expected unset option to be ignored got %q", c.Listeners.HTTPS)
+	}
+	if !reflect.DeepEqual(c.Clients, []*ClientConfig{{ID: testClientID}}) {
+		t.Errorf("unexpected clients %v", c.Clients)
+	}
+}
+
+func TestTunnelPolicy(t *testing.T) {
+	t.Parallel()
+
+	var identifier, other id.ID
+	identifier.UnmarshalText([]byte(testClientID))
+	other[0] = 1
+
+	if tunnelPolicy([]*ClientConfig{{ID: testClientID}}) != nil {
+		t.Fatal("expected no policy for unrestricted clients")
+	}
+
+	policy := tunnelPolicy([]*ClientConfig{
+		{
+			ID:    testClientID,
+			Hosts: []string{"*.example.com"},
+			Addrs: []string{"0.0.0.0:22*"},
+		},
+	})
+
+	tests := []struct {
+		identifier id.ID
+		tunnel     *proto.Tunnel
+		allowed    bool
+	}{
+		{identifier, &proto.Tunnel{Protocol: proto.HTTP, Host: "a.example.com"}, true},
+		{identifier, &proto.Tunnel{Protocol: proto.SNI, Host: "example.com"}, false},
+		{identifier, &proto.Tunnel{Protocol: proto.TCP, Addr: "0.0.0.0:2222"}, true},
+		{identifier, &proto.Tunnel{Protocol: proto.TCP, Addr: "0.0.0.0:80"}, false},
+		{other, &proto.Tunnel{Protocol: proto.HTTP, Host: "evil.com"}, true},
+	}
+
+	for i, tt := range tests {
+		err := policy(tt.identifier, tt.tunnel)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("[%d] expected allowed %v got error %v", i, tt.allowed, err)
+		}
+	}
+}
+
+func TestTenantFunc(t *testing.T) {
+	t.Parallel()
+
+	var identifier, other id.ID
+	identifier.UnmarshalText([]byte(testClientID))
+	other[0] = 1
+
+	if tenantFunc(nil) != nil {
+		t.Fatal("expected no tenant func")
+	}
+
+	f := tenantFunc([]*TenantConfig{
+		{Name: "a", Clients: []string{testClientID}},
+		{Name: "b", Organization: "Acme"},
+		{Name: "c", Organization: "Acme"},
+	})
+
+	acme := &x509.Certificate{Subject: pkix.Name{Organization: []string{"Acme"}}}
+	tests := []struct {
+		identifier id.ID
+		cert       *x509.Certificate
+		tenant     string
+	}{
+		{identifier, acme, "a"},
+		{other, acme, "b"},
+		{other, &x509.Certificate{}, ""},
+		{other, nil, ""},
+	}
+
+	for i, tt := range tests {
+		var name string
+		if tenant := f(tt.identifier, tt.cert); tenant != nil {
+			name = tenant.Name
+		}
+		if name != tt.tenant {
+			t.Errorf("[%d] expected tenant %q got %q", i, tt.tenant, name)
+		}
+	}
+}
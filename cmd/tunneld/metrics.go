@@ -0,0 +1,71 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mmatczuk/go-http-tunnel"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes tunnel stats to w in Prometheus text format.
+func writeMetrics(w io.Writer, stats []*tunnel.TunnelStats) error {
+	bw := bufio.NewWriter(w)
+
+	labels := func(t *tunnel.TunnelStats) string {
+		return fmt.Sprintf(`tunnel="%s",id="%s"`, labelEscaper.Replace(t.Tunnel), t.Identifier)
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(t *tunnel.TunnelStats) int64
+	}{
+		{"tunnel_requests_total", "Number of proxied HTTP requests and TCP connections.", func(t *tunnel.TunnelStats) int64 { return t.Requests }},
+		{"tunnel_errors_total", "Number of failed HTTP requests and TCP connections.", func(t *tunnel.TunnelStats) int64 { return t.Errors }},
+		{"tunnel_bytes_in_total", "Number of bytes sent from users to the client.", func(t *tunnel.TunnelStats) int64 { return t.BytesIn }},
+		{"tunnel_bytes_out_total", "Number of bytes sent from the client to users.", func(t *tunnel.TunnelStats) int64 { return t.BytesOut }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, t := range stats {
+			fmt.Fprintf(bw, "%s{%s} %d\n", c.name, labels(t), c.value(t))
+		}
+	}
+
+	histograms := []struct {
+		name  string
+		help  string
+		value func(t *tunnel.TunnelStats) *tunnel.Histogram
+	}{
+		{"tunnel_latency_seconds", "Time until the client responds to HTTP request or connects to local TCP service.", func(t *tunnel.TunnelStats) *tunnel.Histogram { return t.Latency }},
+		{"tunnel_throughput_bytes_per_second", "Transfer rate of HTTP responses and TCP connections.", func(t *tunnel.TunnelStats) *tunnel.Histogram { return t.Throughput }},
+	}
+	for _, h := range histograms {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		for _, t := range stats {
+			writeHistogram(bw, h.name, labels(t), h.value(t))
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *tunnel.Histogram) {
+	var cum int64
+	for i, b := range h.Bounds {
+		cum += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.Count)
+}
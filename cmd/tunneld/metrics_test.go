@@ -0,0 +1,57 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	t.Parallel()
+
+	identifier := id.New([]byte("client"))
+	h := &tunnel.Histogram{
+		Bounds: []float64{0.1, 1},
+		Counts: []int64{2, 1, 1},
+		Count:  4,
+		Sum:    3.5,
+	}
+	stats := []*tunnel.TunnelStats{{
+		Tunnel:     `http://foo"bar.com`,
+		Identifier: identifier,
+		Requests:   4,
+		BytesIn:    100,
+		Latency:    h,
+		Throughput: h,
+	}}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := `tunnel="http://foo\"bar.com",id="` + identifier.String() + `"`
+	expected := []string{
+		"# TYPE tunnel_requests_total counter\n",
+		"tunnel_requests_total{" + labels + "} 4\n",
+		"tunnel_bytes_in_total{" + labels + "} 100\n",
+		"# TYPE tunnel_latency_seconds histogram\n",
+		"tunnel_latency_seconds_bucket{" + labels + `,le="0.1"} 2` + "\n",
+		"tunnel_latency_seconds_bucket{" + labels + `,le="1"} 3` + "\n",
+		"tunnel_latency_seconds_bucket{" + labels + `,le="+Inf"} 4` + "\n",
+		"tunnel_latency_seconds_sum{" + labels + "} 3.5\n",
+		"tunnel_throughput_bytes_per_second_count{" + labels + "} 4\n",
+	}
+	for i, e := range expected {
+		if !strings.Contains(buf.String(), e) {
+			t.Errorf("[%d] missing %q in:\n%s", i, e, buf.String())
+		}
+	}
+}
@@ -8,18 +8,55 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 )
 
-const usage1 string = `Usage: tunneld [OPTIONS]
+const usage1 string = `Usage: tunneld [OPTIONS] [command]
 options:
 `
 
 const usage2 string = `
+Commands:
+	tunneld                        Start server
+	tunneld clients                List connected clients of server with admin API on adminAddr
+
 Example:
 	tunneld
 	tunneld -clients YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4
 	tunneld -httpAddr :8080 -httpsAddr ""
+	tunneld -network tcp6 -httpAddr "[::]:80" -httpsAddr "[::]:443" -tunnelAddr "[::]:5223"
 	tunneld -httpsAddr "" -sniAddr ":443" -rootCA client_root.crt -tlsCrt server.crt -tlsKey server.key
+	tunneld -rootCA client_root.crt -clients YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4 -caClients
+	tunneld -rootCA client_root.crt -certHosts
+	tunneld -httpsRedirect -hstsMaxAge 8760h
+	tunneld -trustedProxies 10.0.0.0/8,192.168.1.10
+	tunneld -baseDomain my-tunnel-host.com
+	tunneld -rateLimit 10 -rateBurst 20 -maxConnsPerIP 50
+	tunneld -tcpMaxConns 100 -tcpConnRate 20 -tcpConnBurst 40
+	tunneld -requestHeaderTimeout 10s -responseHeaderTimeout 30s -dialTimeout 5s
+	tunneld -auditLog /var/log/tunneld/audit.log -auditSyslog
+	tunneld -webhooks https://example.com/hook -webhookSecret s3cr3t
+	tunneld -stateFile /var/lib/tunneld/state.json
+	tunneld -adminAddr 127.0.0.1:5224
+	tunneld -adminAddr 127.0.0.1:5224 clients
+	tunneld -debug-addr 127.0.0.1:6060
+	tunneld -config tunneld.yml -log-level 2
+
+tunneld.yml:
+	listeners:
+	  http_addr: :80
+	  https_addr: :443
+	  tunnel_addr: :5223
+	tls_crt: server.crt
+	tls_key: server.key
+	clients:
+	  - id: YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4
+	    hosts: ["*.my-tunnel-host.com"]
+	    addrs: ["0.0.0.0:22"]
+	limits:
+	  max_body_size: 10485760
+	  rate_limit: 10
 
 Author:
 	Written by M. Matczuk (mmatczuk@gmail.com)
@@ -38,41 +75,337 @@ func init() {
 
 // options specify arguments read command line arguments.
 type options struct {
-	httpAddr   string
-	httpsAddr  string
-	tunnelAddr string
-	sniAddr    string
-	tlsCrt     string
-	tlsKey     string
-	rootCA     string
-	clients    string
-	logLevel   int
-	version    bool
+	config          string
+	network         string
+	httpAddr        string
+	httpsAddr       string
+	tunnelAddr      string
+	sniAddr         string
+	websocket       bool
+	tlsCrt          string
+	tlsKey          string
+	rootCA          string
+	caClients       bool
+	certHosts       bool
+	trustedProxies  string
+	tlsPolicy       tlsPolicy
+	errorPages      string
+	baseDomain      string
+	minProtoVersion int
+	httpsRedirect   bool
+	hstsMaxAge      time.Duration
+	maxBodySize     int64
+	rateLimit       float64
+	rateBurst       int
+	maxConnsPerIP   int
+	tcpMaxConns     int
+	tcpConnRate     float64
+	tcpConnBurst    int
+	maxTunnels      int
+	maxHosts        int
+	timeouts        timeouts
+	auditLog        string
+	auditSyslog     bool
+	auditWebhook    string
+	webhooks        string
+	webhookSecret   string
+	stateFile       string
+	adminAddr       string
+	adminPublic     bool
+	debugAddr       string
+	clients         string
+	logLevel        int
+	version         bool
+	command         string
+	// set holds names of flags set on command line
+	set map[string]bool
+}
+
+// timeouts specifies timeouts of public traffic.
+type timeouts struct {
+	dial           time.Duration
+	requestHeader  time.Duration
+	responseHeader time.Duration
+}
+
+// tlsPolicy specifies TLS protocol settings.
+type tlsPolicy struct {
+	minVersion   string
+	maxVersion   string
+	cipherSuites string
+	curves       string
 }
 
 func parseArgs() *options {
-	httpAddr := flag.String("httpAddr", ":80", "Public address for HTTP connections, empty string to disable")
-	httpsAddr := flag.String("httpsAddr", ":443", "Public address listening for HTTPS connections, emptry string to disable")
-	tunnelAddr := flag.String("tunnelAddr", ":5223", "Public address listening for tunnel client")
+	config := flag.String("config", "", "Path to tunneld YAML configuration file, options set on command line override values from the file")
+	network := flag.String("network", "tcp", "Network of listeners, tcp4 or tcp6 restrict listeners to IPv4 or IPv6, with tcp addresses without host listen on both")
+	httpAddr := flag.String("httpAddr", DefaultHTTPAddr, "Public address for HTTP connections, empty string to disable")
+	httpsAddr := flag.String("httpsAddr", DefaultHTTPSAddr, "Public address listening for HTTPS connections, emptry string to disable")
+	tunnelAddr := flag.String("tunnelAddr", DefaultTunnelAddr, "Public address listening for tunnel client")
 	sniAddr := flag.String("sniAddr", "", "Public address listening for TLS SNI connections, empty string to disable")
-	tlsCrt := flag.String("tlsCrt", "server.crt", "Path to a TLS certificate file")
-	tlsKey := flag.String("tlsKey", "server.key", "Path to a TLS key file")
-	rootCA := flag.String("rootCA", "", "Path to the trusted certificate chian used for client certificate authentication, if empty any client certificate is accepted")
+	websocket := flag.Bool("websocket", false, "Accept client connections over WebSocket on HTTPS listeners, clients use server_transport ws")
+	tlsCrt := flag.String("tlsCrt", DefaultTLSCrt, "Path to a TLS certificate file")
+	tlsKey := flag.String("tlsKey", DefaultTLSKey, "Path to a TLS key file")
+	rootCA := flag.String("rootCA", "", "Path to the trusted certificate chain used for client certificate authentication, clients must have certificates signed by it, if -clients is empty all such clients are accepted")
+	caClients := flag.Bool("caClients", false, "Accept clients with certificates signed by rootCA in addition to clients listed in -clients, listed clients may then have any certificate")
+	trustedProxies := flag.String("trustedProxies", "", "Comma-separated list of IP addresses and CIDR networks of proxies in front of the server i.e. load balancers, forwarding headers of their requests are kept")
+	certHosts := flag.Bool("certHosts", false, "Restrict clients with certificates signed by rootCA to HTTP and SNI hosts listed in certificate DNS names and organizational units")
+	tlsMinVersion := flag.String("tlsMinVersion", DefaultTLSMinVersion, "Minimal TLS version accepted on client and HTTPS connections, 1.2 or 1.3")
+	tlsMaxVersion := flag.String("tlsMaxVersion", "", "Maximal TLS version accepted on client and HTTPS connections, if empty the highest supported version is used")
+	tlsCipherSuites := flag.String("tlsCipherSuites", strings.Join(DefaultTLSCipherSuites, ","), "Comma-separated list of TLS 1.2 cipher suites, if empty default suites are used")
+	tlsCurves := flag.String("tlsCurves", "", "Comma-separated list of elliptic curves in preference order i.e. X25519,P256, if empty default curves are used")
+	errorPages := flag.String("errorPages", "", "Path to a directory with HTML error page templates named after status code i.e. 404.html, 502.html, 504.html")
+	baseDomain := flag.String("baseDomain", "", "Domain under which random hosts are assigned to HTTP tunnels with empty host, empty string to disable")
+	minProtoVersion := flag.Int("minProtocolVersion", 0, "Oldest tunnel protocol version of accepted clients, older clients are rejected, 0 means all supported versions")
+	httpsRedirect := flag.Bool("httpsRedirect", false, "Redirect plain HTTP requests to all hosts to HTTPS with 301 status code, hosts of tunnels with https_only are redirected regardless")
+	hstsMaxAge := flag.Duration("hstsMaxAge", 0, "Max age of Strict-Transport-Security header added to HTTPS responses of redirected hosts, 0 to disable")
+	maxBodySize := flag.Int64("maxBodySize", 0, "Maximal size of HTTP request body in bytes, larger requests are rejected with 413 status code, 0 means no limit")
+	rateLimit := flag.Float64("rateLimit", 0, "Maximal rate of HTTP requests and TCP connections per second per remote IP, requests over the limit are rejected with 429 status code, 0 means no limit")
+	rateBurst := flag.Int("rateBurst", 0, "Number of requests per remote IP that may exceed rateLimit at once, if 0 rateLimit rounded up is used")
+	maxTunnels := flag.Int("maxTunnelsPerClient", 0, "Maximal number of tunnels a client may register, clients requesting more are rejected, 0 means no limit")
+	maxHosts := flag.Int("maxHostsPerClient", 0, "Maximal number of HTTP and SNI hosts a client may register, clients requesting more are rejected, 0 means no limit")
+	maxConnsPerIP := flag.Int("maxConnsPerIP", 0, "Maximal number of concurrent HTTP requests and TCP connections per remote IP, 0 means no limit")
+	tcpMaxConns := flag.Int("tcpMaxConns", 0, "Maximal number of concurrent connections per TCP, SNI or CONNECT tunnel, connections over the limit are closed, 0 means no limit")
+	tcpConnRate := flag.Float64("tcpConnRate", 0, "Maximal rate of accepted connections per second per TCP, SNI or CONNECT tunnel, 0 means no limit")
+	tcpConnBurst := flag.Int("tcpConnBurst", 0, "Number of connections per tunnel that may exceed tcpConnRate at once, if 0 tcpConnRate rounded up is used")
+	dialTimeout := flag.Duration("dialTimeout", 0, "Maximal time to wait for the client to connect TCP connection to local service, 0 means no timeout")
+	requestHeaderTimeout := flag.Duration("requestHeaderTimeout", 0, "Maximal time to read headers of public HTTP request, 0 means no timeout")
+	responseHeaderTimeout := flag.Duration("responseHeaderTimeout", 0, "Maximal time to wait for the client response headers, requests over the limit get 504 status code, 0 means no timeout")
+	auditLog := flag.String("auditLog", "", "Path to a file where JSON audit records of client registration attempts are appended")
+	auditSyslog := flag.Bool("auditSyslog", false, "Send audit records of client registration attempts to syslog")
+	auditWebhook := flag.String("auditWebhook", "", "URL notified with JSON POST on every client registration attempt, payload is signed with webhookSecret")
+	webhooks := flag.String("webhooks", "", "Comma-separated list of URLs notified with JSON POST on client connect, disconnect, tunnel registration, withdrawal and listener failure")
+	webhookSecret := flag.String("webhookSecret", "", "Secret used to sign webhook payloads with HMAC-SHA256, the signature is sent in X-Tunnel-Signature header")
+	stateFile := flag.String("stateFile", "", "Path to a file where hosts and addresses allocated to clients are persisted, on restart TCP listeners are rebound and allocations are reserved for reconnecting clients")
+	adminAddr := flag.String("adminAddr", "", "Loopback address of admin API listing connected clients and serving metrics, empty string to disable")
+	adminPublic := flag.Bool("adminPublic", false, "Allow non-loopback adminAddr i.e. to scrape metrics from another host, admin API is not authenticated so restrict access to it with a firewall")
+	debugAddr := flag.String("debug-addr", "", "Loopback address serving pprof profiles and expvar variables of the server, empty string to disable")
 	clients := flag.String("clients", "", "Comma-separated list of tunnel client ids, if empty accept all clients")
-	logLevel := flag.Int("log-level", 1, "Level of messages to log, 0-3")
+	logLevel := flag.Int("log-level", DefaultLogLevel, "Level of messages to log, 0-3")
 	version := flag.Bool("version", false, "Prints tunneld version")
 	flag.Parse()
 
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
 	return &options{
-		httpAddr:   *httpAddr,
-		httpsAddr:  *httpsAddr,
-		tunnelAddr: *tunnelAddr,
-		sniAddr:    *sniAddr,
-		tlsCrt:     *tlsCrt,
-		tlsKey:     *tlsKey,
-		rootCA:     *rootCA,
-		clients:    *clients,
-		logLevel:   *logLevel,
-		version:    *version,
+		config:         *config,
+		network:        *network,
+		httpAddr:       *httpAddr,
+		httpsAddr:      *httpsAddr,
+		tunnelAddr:     *tunnelAddr,
+		sniAddr:        *sniAddr,
+		websocket:      *websocket,
+		tlsCrt:         *tlsCrt,
+		tlsKey:         *tlsKey,
+		rootCA:         *rootCA,
+		caClients:      *caClients,
+		certHosts:      *certHosts,
+		trustedProxies: *trustedProxies,
+		tlsPolicy: tlsPolicy{
+			minVersion:   *tlsMinVersion,
+			maxVersion:   *tlsMaxVersion,
+			cipherSuites: *tlsCipherSuites,
+			curves:       *tlsCurves,
+		},
+		errorPages:      *errorPages,
+		baseDomain:      *baseDomain,
+		minProtoVersion: *minProtoVersion,
+		httpsRedirect:   *httpsRedirect,
+		hstsMaxAge:      *hstsMaxAge,
+		maxBodySize:     *maxBodySize,
+		rateLimit:       *rateLimit,
+		rateBurst:       *rateBurst,
+		maxConnsPerIP:   *maxConnsPerIP,
+		tcpMaxConns:     *tcpMaxConns,
+		tcpConnRate:     *tcpConnRate,
+		tcpConnBurst:    *tcpConnBurst,
+		maxTunnels:      *maxTunnels,
+		maxHosts:        *maxHosts,
+		timeouts: timeouts{
+			dial:           *dialTimeout,
+			requestHeader:  *requestHeaderTimeout,
+			responseHeader: *responseHeaderTimeout,
+		},
+		auditLog:      *auditLog,
+		auditSyslog:   *auditSyslog,
+		auditWebhook:  *auditWebhook,
+		webhooks:      *webhooks,
+		webhookSecret: *webhookSecret,
+		stateFile:     *stateFile,
+		adminAddr:     *adminAddr,
+		adminPublic:   *adminPublic,
+		debugAddr:     *debugAddr,
+		clients:       *clients,
+		logLevel:      *logLevel,
+		version:       *version,
+		command:       flag.Arg(0),
+		set:           set,
+	}
+}
+
+// serverConfig returns configuration read from configuration file if
+// specified, with values of options set on command line applied.
+func (o *options) serverConfig() (*ServerConfig, error) {
+	c := defaultServerConfig()
+	if o.config != "" {
+		var err error
+		if c, err = loadServerConfigFromFile(o.config); err != nil {
+			return nil, err
+		}
+	}
+
+	o.apply(c)
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// apply sets values of options in c, if configuration file is used only
+// options set on command line are applied.
+func (o *options) apply(c *ServerConfig) {
+	isSet := func(name string) bool {
+		return o.config == "" || o.set[name]
+	}
+
+	if isSet("network") {
+		c.Listeners.Network = o.network
+	}
+	if isSet("httpAddr") {
+		c.Listeners.HTTP = o.httpAddr
+	}
+	if isSet("httpsAddr") {
+		c.Listeners.HTTPS = o.httpsAddr
+	}
+	if isSet("tunnelAddr") {
+		c.Listeners.Tunnel = o.tunnelAddr
+	}
+	if isSet("sniAddr") {
+		c.Listeners.SNI = o.sniAddr
+	}
+	if isSet("websocket") {
+		c.Listeners.WebSocket = o.websocket
+	}
+	if isSet("adminAddr") {
+		c.Listeners.Admin = o.adminAddr
+	}
+	if isSet("adminPublic") {
+		c.Listeners.AdminPublic = o.adminPublic
+	}
+	if isSet("debug-addr") {
+		c.Listeners.Debug = o.debugAddr
+	}
+	if isSet("tlsCrt") {
+		c.TLSCrt = o.tlsCrt
+	}
+	if isSet("tlsKey") {
+		c.TLSKey = o.tlsKey
+	}
+	if isSet("rootCA") {
+		c.RootCA = o.rootCA
+	}
+	if isSet("caClients") {
+		c.CAClients = o.caClients
+	}
+	if isSet("certHosts") {
+		c.CertHosts = o.certHosts
+	}
+	if isSet("trustedProxies") {
+		c.TrustedProxies = splitList(o.trustedProxies)
+	}
+	if isSet("tlsMinVersion") {
+		c.TLS.MinVersion = o.tlsPolicy.minVersion
+	}
+	if isSet("tlsMaxVersion") {
+		c.TLS.MaxVersion = o.tlsPolicy.maxVersion
+	}
+	if isSet("tlsCipherSuites") {
+		c.TLS.CipherSuites = splitList(o.tlsPolicy.cipherSuites)
+	}
+	if isSet("tlsCurves") {
+		c.TLS.CurvePreferences = splitList(o.tlsPolicy.curves)
+	}
+	if isSet("clients") {
+		c.Clients = nil
+		for _, identifier := range splitList(o.clients) {
+			c.Clients = append(c.Clients, &ClientConfig{ID: identifier})
+		}
+	}
+	if isSet("httpsRedirect") {
+		c.HTTPSRedirect.All = o.httpsRedirect
+	}
+	if isSet("hstsMaxAge") {
+		c.HTTPSRedirect.HSTSMaxAge = o.hstsMaxAge
+	}
+	if isSet("maxBodySize") {
+		c.Limits.MaxBodySize = o.maxBodySize
+	}
+	if isSet("rateLimit") {
+		c.Limits.RateLimit = o.rateLimit
+	}
+	if isSet("rateBurst") {
+		c.Limits.RateBurst = o.rateBurst
+	}
+	if isSet("maxConnsPerIP") {
+		c.Limits.MaxConnsPerIP = o.maxConnsPerIP
+	}
+	if isSet("tcpMaxConns") {
+		c.Limits.TCPMaxConns = o.tcpMaxConns
+	}
+	if isSet("tcpConnRate") {
+		c.Limits.TCPConnRate = o.tcpConnRate
+	}
+	if isSet("tcpConnBurst") {
+		c.Limits.TCPConnBurst = o.tcpConnBurst
+	}
+	if isSet("maxTunnelsPerClient") {
+		c.Limits.MaxTunnelsPerClient = o.maxTunnels
+	}
+	if isSet("maxHostsPerClient") {
+		c.Limits.MaxHostsPerClient = o.maxHosts
+	}
+	if isSet("dialTimeout") {
+		c.Timeouts.DialTimeout = o.timeouts.dial
+	}
+	if isSet("requestHeaderTimeout") {
+		c.Timeouts.RequestHeaderTimeout = o.timeouts.requestHeader
+	}
+	if isSet("responseHeaderTimeout") {
+		c.Timeouts.ResponseHeaderTimeout = o.timeouts.responseHeader
+	}
+	if isSet("auditLog") {
+		c.Audit.Log = o.auditLog
+	}
+	if isSet("auditSyslog") {
+		c.Audit.Syslog = o.auditSyslog
+	}
+	if isSet("auditWebhook") {
+		c.Audit.Webhook = o.auditWebhook
+	}
+	if isSet("webhooks") {
+		c.Webhooks.URLs = splitList(o.webhooks)
+	}
+	if isSet("webhookSecret") {
+		c.Webhooks.Secret = o.webhookSecret
+	}
+	if isSet("stateFile") {
+		c.State.File = o.stateFile
+	}
+	if isSet("errorPages") {
+		c.ErrorPages = o.errorPages
+	}
+	if isSet("baseDomain") {
+		c.BaseDomain = o.baseDomain
+	}
+	if isSet("minProtocolVersion") {
+		c.MinProtocolVersion = o.minProtoVersion
+	}
+	if isSet("log-level") {
+		c.LogLevel = o.logLevel
 	}
 }
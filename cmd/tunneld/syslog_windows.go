@@ -0,0 +1,14 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func syslogWriter() (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
@@ -5,19 +5,30 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"html/template"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/http2"
 
 	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/internal/debug"
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
 func main() {
@@ -28,112 +39,370 @@ func main() {
 		return
 	}
 
-	fmt.Println(banner)
+	config, err := opts.serverConfig()
+	if err != nil {
+		fatal("configuration error: %s", err)
+	}
+
+	switch opts.command {
+	case "":
+	case "clients":
+		if config.Listeners.Admin == "" {
+			fatal("clients requires adminAddr")
+		}
+		if err := printClients(config.Listeners.Admin, os.Stdout); err != nil {
+			fatal("failed to list clients: %s", err)
+		}
+		return
+	default:
+		fatal("unknown command %q", opts.command)
+	}
+
+	fmt.Print(banner)
+
+	logger := log.NewFilterLogger(log.NewStdLogger(), config.LogLevel)
+
+	// load root CA for client authentication
+	var roots *x509.CertPool
+	if config.RootCA != "" {
+		roots, err = loadCertPool(config.RootCA)
+		if err != nil {
+			fatal("failed to load root CA: %s", err)
+		}
+	}
 
-	logger := log.NewFilterLogger(log.NewStdLogger(), opts.logLevel)
+	// certificate from external source is refreshed while running
+	var certs *tunnel.CertReloader
+	if config.TLSSource != nil {
+		certs, err = config.TLSSource.certReloader(logger)
+		if err != nil {
+			fatal("failed to load tls certificate: %s", err)
+		}
+		go certs.Run(context.Background())
+	}
 
-	tlsconf, err := tlsConfig(opts)
+	tlsconf, err := tlsConfig(config, roots, certs)
 	if err != nil {
 		fatal("failed to configure tls: %s", err)
 	}
 
-	autoSubscribe := opts.clients == ""
+	var errorPages map[int]*template.Template
+	if config.ErrorPages != "" {
+		errorPages, err = loadErrorPages(config.ErrorPages)
+		if err != nil {
+			fatal("failed to load error pages: %s", err)
+		}
+	}
+
+	// webhooks are closed on exit so that queued messages are delivered
+	var hooks webhookSet
+
+	var onEvent func(*tunnel.Event)
+	if len(config.Webhooks.URLs) > 0 {
+		onEvent = webhooks(&hooks, config.Webhooks.URLs, config.Webhooks.Secret, logger)
+	}
+
+	auditSink, err := auditSink(config, &hooks, logger)
+	if err != nil {
+		fatal("failed to configure audit: %s", err)
+	}
+
+	trustedProxies, err := tunnel.ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		fatal("failed to parse trusted proxies: %s", err)
+	}
+
+	// clients must have certificates signed by root CA, with ca_clients
+	// listed clients may have any certificate and clients with certificates
+	// signed by root CA are subscribed on connect
+	requireVerified := roots != nil && !config.CAClients
 
 	// setup server
 	server, err := tunnel.NewServer(&tunnel.ServerConfig{
-		Addr:          opts.tunnelAddr,
-		SNIAddr:       opts.sniAddr,
-		AutoSubscribe: autoSubscribe,
-		TLSConfig:     tlsconf,
-		Logger:        logger,
+		Addr:                      config.Listeners.Tunnel,
+		Network:                   config.Listeners.network(),
+		SNIAddr:                   config.Listeners.SNI,
+		WebSocket:                 config.Listeners.WebSocket,
+		AutoSubscribe:             len(config.Clients) == 0,
+		TLSConfig:                 tlsconf,
+		ClientCAs:                 roots,
+		RequireVerifiedClientCert: requireVerified,
+		SubscribeVerifiedClients:  config.CAClients,
+		CertificateHosts:          config.CertHosts,
+		ErrorPages:                errorPages,
+		BaseDomain:                config.BaseDomain,
+		MinProtocolVersion:        config.MinProtocolVersion,
+		RedactHeaders:             config.RedactHeaders,
+		TrustedProxies:            trustedProxies,
+		HTTPSRedirect:             config.httpsRedirect(),
+		MaxRequestBodySize:        config.Limits.MaxBodySize,
+		RateLimit:                 config.Limits.rateLimit(),
+		ListenerLimit:             config.Limits.listenerLimit(),
+		MaxTunnelsPerClient:       config.Limits.MaxTunnelsPerClient,
+		MaxHostsPerClient:         config.Limits.MaxHostsPerClient,
+		AuditSink:                 auditSink,
+		TunnelPolicy:              tunnelPolicy(config.Clients),
+		OnEvent:                   onEvent,
+		StateStore:                config.State.store(),
+		ReservationTimeout:        config.State.ReservationTimeout,
+		Tenant:                    tenantFunc(config.Tenants),
+		DialTimeout:               config.Timeouts.DialTimeout,
+		ResponseHeaderTimeout:     config.Timeouts.ResponseHeaderTimeout,
+		Logger:                    logger,
 	})
 	if err != nil {
 		fatal("failed to create server: %s", err)
 	}
 
-	if !autoSubscribe {
-		for _, c := range strings.Split(opts.clients, ",") {
-			if c == "" {
-				fatal("empty client id")
-			}
-			identifier := id.ID{}
-			err := identifier.UnmarshalText([]byte(c))
-			if err != nil {
-				fatal("invalid identifier %q: %s", c, err)
-			}
-			server.Subscribe(identifier)
-		}
+	for _, c := range config.Clients {
+		identifier := id.ID{}
+		identifier.UnmarshalText([]byte(c.ID))
+		server.Subscribe(identifier)
 	}
 
-	// start HTTP
-	if opts.httpAddr != "" {
+	// start admin API
+	if config.Listeners.Admin != "" {
 		go func() {
 			logger.Log(
 				"level", 1,
-				"action", "start http",
-				"addr", opts.httpAddr,
+				"action", "start admin",
+				"addr", config.Listeners.Admin,
 			)
 
-			fatal("failed to start HTTP: %s", http.ListenAndServe(opts.httpAddr, server))
+			fatal("failed to start admin API: %s", listenAndServe(config.Listeners.network(), config.Listeners.Admin, adminHandler(server)))
 		}()
 	}
 
-	// start HTTPS
-	if opts.httpsAddr != "" {
+	// start debug endpoints
+	if config.Listeners.Debug != "" {
 		go func() {
 			logger.Log(
 				"level", 1,
-				"action", "start https",
-				"addr", opts.httpsAddr,
+				"action", "start debug",
+				"addr", config.Listeners.Debug,
 			)
 
-			s := &http.Server{
-				Addr:    opts.httpsAddr,
-				Handler: server,
-			}
-			http2.ConfigureServer(s, nil)
-
-			fatal("failed to start HTTPS: %s", s.ListenAndServeTLS(opts.tlsCrt, opts.tlsKey))
+			fatal("failed to start debug endpoints: %s", listenAndServe(config.Listeners.network(), config.Listeners.Debug, debug.Handler()))
 		}()
 	}
 
+	// start HTTP and HTTPS
+	for _, l := range config.publicListeners() {
+		go servePublic(l, server, certs, config.Timeouts.RequestHeaderTimeout, logger)
+	}
+
+	go stopOnSignal(server)
 	server.Start()
+	hooks.close()
+}
+
+// stopOnSignal stops server on SIGINT or SIGTERM.
+func stopOnSignal(server *tunnel.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	server.Stop()
+}
+
+// servePublic serves public HTTP or HTTPS traffic on listener l, process exits
+// if serving fails. HTTPS listeners without certificate file use certs.
+// Connections not sending request headers within readHeaderTimeout are
+// closed, 0 means no timeout.
+func servePublic(l *PublicListenerConfig, handler http.Handler, certs *tunnel.CertReloader, readHeaderTimeout time.Duration, logger log.Logger) {
+	logger.Log(
+		"level", 1,
+		"action", "start "+l.Protocol,
+		"addr", l.Addr,
+	)
+
+	s := &http.Server{
+		Addr:              l.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	ln, err := net.Listen(l.Network, l.Addr)
+	if err != nil {
+		fatal("failed to listen on %s: %s", l.Addr, err)
+	}
+
+	if l.Protocol == proto.HTTP {
+		fatal("failed to start HTTP on %s: %s", l.Addr, s.Serve(ln))
+	}
+
+	s.TLSConfig = &tls.Config{}
+	if err := l.TLS.policy().Apply(s.TLSConfig); err != nil {
+		fatal("failed to configure HTTPS tls on %s: %s", l.Addr, err)
+	}
+	if l.TLSCrt == "" {
+		s.TLSConfig.GetCertificate = certs.GetCertificate
+	}
+	if err := http2.ConfigureServer(s, nil); err != nil {
+		fatal("failed to configure HTTP/2 on %s: %s", l.Addr, err)
+	}
+
+	fatal("failed to start HTTPS on %s: %s", l.Addr, s.ServeTLS(ln, l.TLSCrt, l.TLSKey))
 }
 
-func tlsConfig(opts *options) (*tls.Config, error) {
+// listenAndServe is like http.ListenAndServe with listener on network.
+func listenAndServe(network, addr string, handler http.Handler) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, handler)
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if ok := pool.AppendCertsFromPEM(b); !ok {
+		return nil, fmt.Errorf("no certificates found in %q", file)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns configuration of client connections, certificate is
+// loaded from files unless certs is set.
+func tlsConfig(config *ServerConfig, roots *x509.CertPool, certs *tunnel.CertReloader) (*tls.Config, error) {
+	// client certificates are verified by server, roots are used to
+	// advertise acceptable authorities to clients
+	c := &tls.Config{
+		ClientAuth:               tls.RequireAnyClientCert,
+		ClientCAs:                roots,
+		SessionTicketsDisabled:   true,
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		NextProtos:               []string{"h2"},
+	}
+
 	// load certs
-	cert, err := tls.LoadX509KeyPair(opts.tlsCrt, opts.tlsKey)
+	if certs != nil {
+		c.GetCertificate = certs.GetCertificate
+	} else {
+		cert, err := tls.LoadX509KeyPair(config.TLSCrt, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := config.TLS.policy().Apply(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadErrorPages parses error page templates from files in dir named after
+// HTTP status code i.e. 404.html.
+func loadErrorPages(dir string) (map[int]*template.Template, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
 	if err != nil {
 		return nil, err
 	}
 
-	// load root CA for client authentication
-	clientAuth := tls.RequireAnyClientCert
-	var roots *x509.CertPool
-	if opts.rootCA != "" {
-		roots = x509.NewCertPool()
-		rootPEM, err := ioutil.ReadFile(opts.rootCA)
+	pages := make(map[int]*template.Template)
+	for _, f := range files {
+		code, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".html"))
+		if err != nil || http.StatusText(code) == "" {
+			continue
+		}
+		t, err := template.ParseFiles(f)
 		if err != nil {
 			return nil, err
 		}
-		if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
+		pages[code] = t
+	}
+
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no error pages found in %q", dir)
+	}
+
+	return pages, nil
+}
+
+// auditSink returns sink writing audit records to all configured outputs or
+// nil if audit is disabled.
+func auditSink(config *ServerConfig, hooks *webhookSet, logger log.Logger) (tunnel.AuditSink, error) {
+	var sinks []tunnel.AuditSink
+
+	if config.Audit.Log != "" {
+		f, err := os.OpenFile(config.Audit.Log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
 			return nil, err
 		}
-		clientAuth = tls.RequireAndVerifyClientCert
-	}
-
-	return &tls.Config{
-		Certificates:           []tls.Certificate{cert},
-		ClientAuth:             clientAuth,
-		ClientCAs:              roots,
-		SessionTicketsDisabled: true,
-		MinVersion:             tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
-		PreferServerCipherSuites: true,
-		NextProtos:               []string{"h2"},
-	}, nil
+		sinks = append(sinks, tunnel.NewWriterAuditSink(f))
+	}
+	if config.Audit.Syslog {
+		w, err := syslogWriter()
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, tunnel.NewWriterAuditSink(w))
+	}
+	if config.Audit.Webhook != "" {
+		w := hooks.add(config.Audit.Webhook, config.Webhooks.Secret, logger)
+		sinks = append(sinks, tunnel.AuditSinkFunc(func(r *tunnel.AuditRecord) {
+			w.Post(r)
+		}))
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sinks[0], nil
+	default:
+		return tunnel.MultiAuditSink(sinks...), nil
+	}
+}
+
+// webhooks returns event handler posting events to all webhook URLs.
+func webhooks(hooks *webhookSet, urls []string, secret string, logger log.Logger) func(*tunnel.Event) {
+	var ws []*tunnel.Webhook
+	for _, u := range urls {
+		ws = append(ws, hooks.add(u, secret, logger))
+	}
+
+	return func(e *tunnel.Event) {
+		for _, w := range ws {
+			w.PostEvent(e)
+		}
+	}
+}
+
+// webhookSet holds all webhooks of the server.
+type webhookSet []*tunnel.Webhook
+
+func (hooks *webhookSet) add(url, secret string, logger log.Logger) *tunnel.Webhook {
+	w := tunnel.NewWebhook(url, secret, logger)
+	*hooks = append(*hooks, w)
+	return w
+}
+
+// close delivers queued messages of all webhooks.
+func (hooks webhookSet) close() {
+	var wg sync.WaitGroup
+	for _, w := range hooks {
+		wg.Add(1)
+		go func(w *tunnel.Webhook) {
+			w.Close()
+			wg.Done()
+		}(w)
+	}
+	wg.Wait()
+}
+
+// splitList splits comma-separated list, empty string results in nil.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
 }
 
 func fatal(format string, a ...interface{}) {
@@ -0,0 +1,133 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// connectAddr is address of CONNECT gateway listener, its network is
+// proto.CONNECT.
+type connectAddr struct {
+	net.Addr
+}
+
+func (a connectAddr) Network() string {
+	return proto.CONNECT
+}
+
+// connectListener is a CONNECT gateway listener, accepted connections must
+// be passed to connectHandshake before proxying.
+type connectListener struct {
+	net.Listener
+	auth *Auth
+}
+
+func (l *connectListener) Addr() net.Addr {
+	return connectAddr{l.Listener.Addr()}
+}
+
+// connectConn is a connection of CONNECT gateway user, data buffered while
+// reading CONNECT request is read first. The user is told if the tunnel is
+// established when client dials the target.
+type connectConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *connectConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// established writes response to CONNECT request, the status depends on
+// err returned by client.
+func (c *connectConn) established(err error) error {
+	if err == nil {
+		_, err := io.WriteString(c.Conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+
+	code := http.StatusBadGateway
+	if err == errClientTimeout {
+		code = http.StatusGatewayTimeout
+	}
+	if e, ok := err.(*proto.Error); ok {
+		code = e.StatusCode()
+		if e.Code == proto.ErrorCodeNoTarget {
+			code = http.StatusForbidden
+		}
+	}
+	return writeConnectResponse(c.Conn, code, nil)
+}
+
+// establish informs user of CONNECT gateway about the result of dialing the
+// target, it's a noop for other connections.
+func establish(conn net.Conn, err error) {
+	if c, ok := conn.(*connectConn); ok {
+		c.established(err)
+	}
+}
+
+// connectHandshake reads CONNECT request from conn and sets the requested
+// host:port as msg.ForwardedHost. If the request is rejected error response
+// is written to conn.
+func (s *Server) connectHandshake(l *connectListener, conn net.Conn, msg *proto.ControlMessage) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(DefaultTimeout))
+	br := bufio.NewReader(conn)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CONNECT request: %s", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if r.Method != http.MethodConnect {
+		writeConnectResponse(conn, http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	if auth := l.auth; auth != nil {
+		user, password, _ := proxyBasicAuth(r)
+		if auth.User != user || auth.Password != password {
+			writeConnectResponse(conn, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {"Basic realm=\"User Visible Realm\""}})
+			return nil, errUnauthorised
+		}
+	}
+	if _, _, err := net.SplitHostPort(r.Host); err != nil {
+		writeConnectResponse(conn, http.StatusBadRequest, nil)
+		return nil, fmt.Errorf("invalid CONNECT target %q: %s", r.Host, err)
+	}
+
+	msg.ForwardedHost = r.Host
+
+	return &connectConn{Conn: conn, r: br}, nil
+}
+
+// proxyBasicAuth returns credentials from Proxy-Authorization header.
+func proxyBasicAuth(r *http.Request) (user, password string, ok bool) {
+	pr := &http.Request{
+		Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]},
+	}
+	return pr.BasicAuth()
+}
+
+func writeConnectResponse(w io.Writer, code int, h http.Header) error {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set("Connection", "close")
+	return resp.Write(w)
+}
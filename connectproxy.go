@@ -0,0 +1,92 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// ConnectProxy forwards streams of CONNECT gateway to host:port requested by
+// the user, only targets matching Allow patterns are dialed.
+type ConnectProxy struct {
+	// Allow specifies host:port patterns of allowed targets, patterns use
+	// path.Match syntax i.e. "*.internal:443" or "10.0.0.1:*".
+	Allow []string
+	// DialTimeout specifies how long to wait for connection to target, if
+	// 0 DefaultTimeout is used.
+	DialTimeout time.Duration
+	// logger is the proxy logger.
+	logger log.Logger
+}
+
+// NewConnectProxy creates new ConnectProxy allowing targets matching allow
+// patterns.
+func NewConnectProxy(allow []string, logger log.Logger) *ConnectProxy {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &ConnectProxy{
+		Allow:  allow,
+		logger: logger,
+	}
+}
+
+// Proxy is a ProxyFunc.
+func (p *ConnectProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+	p.ProxyContext(context.Background(), w, r, msg)
+}
+
+// ProxyContext is a ProxyFuncContext, dialing target is aborted and
+// connection to target is closed when ctx is done.
+func (p *ConnectProxy) ProxyContext(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+	if msg.ForwardedProto != proto.CONNECT {
+		p.logger.Log(
+			"level", 0,
+			"msg", "unsupported protocol",
+			"ctrlMsg", msg,
+		)
+		proxyError(w, proto.ErrorCodeUnsupportedProtocol, fmt.Errorf("unsupported protocol %q", msg.ForwardedProto))
+		return
+	}
+
+	if !p.allowed(msg.ForwardedHost) {
+		p.logger.Log(
+			"level", 1,
+			"msg", "target not allowed",
+			"ctrlMsg", msg,
+		)
+		proxyError(w, proto.ErrorCodeNoTarget, fmt.Errorf("target %q not allowed", msg.ForwardedHost))
+		return
+	}
+
+	// the stream is proxied as a TCP connection to the requested target
+	m := *msg
+	m.ForwardedProto = proto.TCP
+	tp := &TCPProxy{
+		localAddr:   msg.ForwardedHost,
+		DialTimeout: p.DialTimeout,
+		logger:      p.logger,
+	}
+	tp.ProxyContext(ctx, w, r, &m)
+}
+
+func (p *ConnectProxy) allowed(hostPort string) bool {
+	hostPort = strings.ToLower(hostPort)
+	for _, pattern := range p.Allow {
+		if ok, _ := path.Match(strings.ToLower(pattern), hostPort); ok {
+			return true
+		}
+	}
+	return false
+}
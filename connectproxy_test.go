@@ -0,0 +1,57 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestConnectProxy_Allowed(t *testing.T) {
+	t.Parallel()
+
+	p := NewConnectProxy([]string{"*.internal:443", "10.0.0.1:*", "DB.local:5432"}, nil)
+
+	tests := []struct {
+		hostPort string
+		allowed  bool
+	}{
+		{"git.internal:443", true},
+		{"git.internal:80", false},
+		{"internal:443", false},
+		{"10.0.0.1:22", true},
+		{"10.0.0.10:22", false},
+		{"db.local:5432", true},
+		{"example.com:443", false},
+	}
+
+	for i, tt := range tests {
+		if allowed := p.allowed(tt.hostPort); allowed != tt.allowed {
+			t.Errorf("[%d] expected %v got %v", i, tt.allowed, allowed)
+		}
+	}
+}
+
+func TestConnectProxy_ProxyContextNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	p := NewConnectProxy([]string{"*.internal:443"}, nil)
+	w := httptest.NewRecorder()
+	p.ProxyContext(context.Background(), w, ioutil.NopCloser(strings.NewReader("")), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "example.com:443",
+		ForwardedProto: proto.CONNECT,
+	})
+
+	e := proto.ReadError(w.Header())
+	if e == nil || e.Code != proto.ErrorCodeNoTarget {
+		t.Errorf("expected %s error got %v", proto.ErrorCodeNoTarget, e)
+	}
+}
@@ -10,6 +10,12 @@ var (
 	errClientNotSubscribed    = errors.New("client not subscribed")
 	errClientNotConnected     = errors.New("client not connected")
 	errClientAlreadyConnected = errors.New("client already connected")
+	errClientStopped          = errors.New("client stopped")
 
-	errUnauthorised = errors.New("unauthorised")
+	errUnauthorised        = errors.New("unauthorised")
+	errRequestBodyTooLarge = errors.New("request body too large")
+	errRateLimited         = errors.New("rate limit exceeded")
+	errTooManyConns        = errors.New("too many concurrent connections")
+	errTenantStreams       = errors.New("tenant stream quota exceeded")
+	errClientTimeout       = errors.New("timeout awaiting client response")
 )
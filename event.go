@@ -0,0 +1,53 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// Event types.
+const (
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventTunnelRegistered   = "tunnel_registered"
+	EventTunnelWithdrawn    = "tunnel_withdrawn"
+	EventListenerFailed     = "listener_failed"
+)
+
+// Event describes a change of server state.
+type Event struct {
+	// Type is one of the Event* constants.
+	Type string `json:"type"`
+	// Time is when the event occurred.
+	Time time.Time `json:"time"`
+	// Identifier is the client identifier.
+	Identifier id.ID `json:"client_id"`
+	// RemoteAddr is the client address.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Tunnel is the tunnel name as requested by the client.
+	Tunnel string `json:"tunnel,omitempty"`
+	// Protocol is the tunnel protocol.
+	Protocol string `json:"proto,omitempty"`
+	// Host is the tunnel host.
+	Host string `json:"host,omitempty"`
+	// Addr is the tunnel listener address.
+	Addr string `json:"addr,omitempty"`
+	// Error describes the failure if any.
+	Error string `json:"error,omitempty"`
+}
+
+// emit sends event to ServerConfig.OnEvent if set.
+func (s *Server) emit(e *Event) {
+	if s.config.OnEvent == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.config.OnEvent(e)
+}
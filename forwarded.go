@@ -0,0 +1,139 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders are request headers set by proxies, they are removed from
+// requests of untrusted callers.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+}
+
+// ParseTrustedProxies parses IP addresses and CIDR networks i.e. 10.0.0.0/8
+// for use as ServerConfig TrustedProxies.
+func ParseTrustedProxies(addrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: a}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedProxy checks if remoteAddr belongs to one of TrustedProxies.
+func (s *Server) trustedProxy(remoteAddr string) bool {
+	if len(s.config.TrustedProxies) == 0 {
+		return false
+	}
+	ip := net.ParseIP(trimPort(remoteAddr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.config.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns IP address of the caller of r. If r is sent by a trusted
+// proxy it's the right-most X-Forwarded-For address not belonging to
+// TrustedProxies, addresses left of it may be spoofed by the caller.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := trimPort(r.RemoteAddr)
+	if !s.trustedProxy(r.RemoteAddr) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// setForwarded sets X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and
+// RFC 7239 Forwarded headers of request received from remoteAddr for host
+// over scheme. If caller is trusted values set by previous proxies are kept,
+// X-Forwarded-For and Forwarded are extended, otherwise they are replaced.
+func setForwarded(h http.Header, remoteAddr, host, scheme string, trusted bool) {
+	if !trusted {
+		for _, k := range forwardedHeaders {
+			h.Del(k)
+		}
+	}
+
+	setXForwardedFor(h, remoteAddr)
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", host)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", scheme)
+	}
+
+	elem := "for=" + forwardedNode(trimPort(remoteAddr)) + ";host=" + forwardedValue(host) + ";proto=" + scheme
+	if prior, ok := h["Forwarded"]; ok {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	h.Set("Forwarded", elem)
+}
+
+// forwardedNode formats IP address as RFC 7239 node, IPv6 addresses are
+// enclosed in brackets.
+func forwardedNode(ip string) string {
+	if ip == "" {
+		return "unknown"
+	}
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue returns v as token or quoted string if v contains
+// characters not allowed in token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	return c < 0x7f && c > 0x20 && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+}
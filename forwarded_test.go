@@ -0,0 +1,145 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Parallel()
+
+	nets, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{config: &ServerConfig{TrustedProxies: nets}}
+
+	tests := []struct {
+		addr    string
+		trusted bool
+	}{
+		{"10.1.2.3:80", true},
+		{"192.168.1.1:80", true},
+		{"192.168.1.2:80", false},
+		{"[fd00::1]:80", true},
+		{"[::1]:80", true},
+		{"[::2]:80", false},
+		{"invalid", false},
+	}
+	for i, tt := range tests {
+		if trusted := s.trustedProxy(tt.addr); trusted != tt.trusted {
+			t.Errorf("[%d] expected %t got %t", i, tt.trusted, trusted)
+		}
+	}
+
+	for _, addrs := range [][]string{{"10.0.0.0/33"}, {"example.com"}} {
+		if _, err := ParseTrustedProxies(addrs); err == nil {
+			t.Errorf("expected error for %v", addrs)
+		}
+	}
+}
+
+func TestServerClientIP(t *testing.T) {
+	t.Parallel()
+
+	nets, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{config: &ServerConfig{TrustedProxies: nets}}
+
+	tests := []struct {
+		remoteAddr string
+		xff        []string
+		ip         string
+	}{
+		{"1.2.3.4:80", nil, "1.2.3.4"},
+		{"1.2.3.4:80", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"10.0.0.1:80", nil, "10.0.0.1"},
+		{"10.0.0.1:80", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:80", []string{"6.6.6.6, 5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:80", []string{"6.6.6.6", "5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"10.0.0.1:80", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"10.0.0.1:80", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:80", []string{"5.6.7.8, unknown"}, "10.0.0.1"},
+		{"[::1]:80", nil, "::1"},
+	}
+	for i, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		if tt.xff != nil {
+			r.Header["X-Forwarded-For"] = tt.xff
+		}
+		if ip := s.clientIP(r); ip != tt.ip {
+			t.Errorf("[%d] expected %s got %s", i, tt.ip, ip)
+		}
+	}
+}
+
+func TestSetForwarded(t *testing.T) {
+	t.Parallel()
+
+	prior := http.Header{
+		"Forwarded":         {"for=198.51.100.1;host=example.com;proto=https"},
+		"X-Forwarded-For":   {"198.51.100.1"},
+		"X-Forwarded-Host":  {"example.com"},
+		"X-Forwarded-Proto": {"https"},
+	}
+
+	tests := []struct {
+		header     http.Header
+		remoteAddr string
+		host       string
+		trusted    bool
+		expected   http.Header
+	}{
+		{
+			http.Header{},
+			"203.0.113.7:4321",
+			"example.com",
+			false,
+			http.Header{
+				"Forwarded":         {"for=203.0.113.7;host=example.com;proto=http"},
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Host":  {"example.com"},
+				"X-Forwarded-Proto": {"http"},
+			},
+		},
+		{
+			prior,
+			"203.0.113.7:4321",
+			"example.com:8080",
+			false,
+			http.Header{
+				"Forwarded":         {`for=203.0.113.7;host="example.com:8080";proto=http`},
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Host":  {"example.com:8080"},
+				"X-Forwarded-Proto": {"http"},
+			},
+		},
+		{
+			prior,
+			"[2001:db8::1]:4321",
+			"example.com",
+			true,
+			http.Header{
+				"Forwarded":         {`for=198.51.100.1;host=example.com;proto=https, for="[2001:db8::1]";host=example.com;proto=http`},
+				"X-Forwarded-For":   {"198.51.100.1, 2001:db8::1"},
+				"X-Forwarded-Host":  {"example.com"},
+				"X-Forwarded-Proto": {"https"},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		h := cloneHeader(tt.header)
+		setForwarded(h, tt.remoteAddr, tt.host, "http", tt.trusted)
+		if !reflect.DeepEqual(h, tt.expected) {
+			t.Errorf("[%d] expected %v got %v", i, tt.expected, h)
+		}
+	}
+}
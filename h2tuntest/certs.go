@@ -0,0 +1,188 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package h2tuntest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// certValidity specifies how long generated certificates are valid.
+const certValidity = 24 * time.Hour
+
+// KeyPair is a generated certificate with its private key.
+type KeyPair struct {
+	// Certificate is the parsed certificate.
+	Certificate *x509.Certificate
+	// Key is the private key.
+	Key crypto.Signer
+	// CertPEM and KeyPEM are PEM encodings of certificate and key.
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// TLSCertificate returns certificate for use in tls.Config.
+func (kp *KeyPair) TLSCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{kp.Certificate.Raw},
+		PrivateKey:  kp.Key,
+		Leaf:        kp.Certificate,
+	}
+}
+
+// ID returns client identifier of certificate.
+func (kp *KeyPair) ID() id.ID {
+	return id.New(kp.Certificate.Raw)
+}
+
+// CA is an ephemeral certificate authority issuing server and client
+// certificates, keys are kept in memory only.
+type CA struct {
+	KeyPair
+}
+
+// NewCA returns a new certificate authority with self-signed certificate.
+func NewCA() (*CA, error) {
+	kp, err := newKeyPair(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "h2tuntest CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{*kp}, nil
+}
+
+// CertPool returns pool with CA certificate, use it as server ClientCAs or
+// client RootCAs.
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// NewServerCert issues server certificate for hosts, host names and IP
+// addresses, if no hosts are given localhost, 127.0.0.1 and ::1 are used.
+func (ca *CA) NewServerCert(hosts ...string) (*KeyPair, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	return newKeyPair(template, &ca.KeyPair)
+}
+
+// NewClientCert issues client certificate with subject, the organization is
+// used by server tenants.
+func (ca *CA) NewClientCert(subject pkix.Name) (*KeyPair, error) {
+	return newKeyPair(clientTemplate(subject), &ca.KeyPair)
+}
+
+// NewSelfSignedClientCert returns self-signed client certificate like the
+// ones generated with tunnel id new, such clients are known to the server by
+// ID only.
+func NewSelfSignedClientCert() (*KeyPair, error) {
+	return newKeyPair(clientTemplate(pkix.Name{CommonName: "tunnel client"}), nil)
+}
+
+// ClientTLSConfig returns configuration of tunnel client with certificate kp,
+// if roots is nil server certificate is not verified.
+func ClientTLSConfig(kp *KeyPair, roots *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{kp.TLSCertificate()},
+		RootCAs:            roots,
+		InsecureSkipVerify: roots == nil,
+	}
+}
+
+// ServerTLSConfig returns configuration of tunnel server with certificate kp,
+// client certificates are required and verified by the server.
+func ServerTLSConfig(kp *KeyPair) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{kp.TLSCertificate()},
+		ClientAuth:   tls.RequireAnyClientCert,
+		NextProtos:   []string{"h2"},
+	}
+}
+
+func clientTemplate(subject pkix.Name) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     subject,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+}
+
+// newKeyPair generates key and certificate from template signed by parent,
+// if parent is nil certificate is self-signed.
+func newKeyPair(template *x509.Certificate, parent *KeyPair) (*KeyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template.SerialNumber = serial
+	template.NotBefore = now.Add(-time.Hour)
+	template.NotAfter = now.Add(certValidity)
+
+	var (
+		parentCert = template
+		parentKey  crypto.Signer
+	)
+	parentKey = key
+	if parent != nil {
+		parentCert, parentKey = parent.Certificate, parent.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{
+		Certificate: cert,
+		Key:         key,
+		CertPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}),
+	}, nil
+}
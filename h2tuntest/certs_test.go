@@ -0,0 +1,113 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package h2tuntest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestCAHandshake(t *testing.T) {
+	t.Parallel()
+
+	ca, err := NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ca.NewServerCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned, err := NewSelfSignedClientCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := []*KeyPair{selfSigned}
+	for _, org := range []string{"a", "b"} {
+		kp, err := ca.NewClientCert(pkix.Name{CommonName: "client", Organization: []string{org}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, kp)
+	}
+
+	ids := make(map[id.ID]bool)
+	for i, kp := range clients {
+		if ids[kp.ID()] {
+			t.Errorf("[%d] duplicate ID %s", i, kp.ID())
+		}
+		ids[kp.ID()] = true
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			conn, err := tls.Dial("tcp", l.Addr().String(), ClientTLSConfig(kp, ca.CertPool()))
+			if err == nil {
+				conn.Close()
+			}
+			done <- err
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := id.PeerID(tls.Server(conn, ServerTLSConfig(server)))
+		if err != nil {
+			t.Errorf("[%d] server handshake failed: %s", i, err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("[%d] client handshake failed: %s", i, err)
+		}
+		if peer != kp.ID() {
+			t.Errorf("[%d] expected ID %s got %s", i, kp.ID(), peer)
+		}
+
+		conn.Close()
+		l.Close()
+	}
+}
+
+func TestCAVerifyClient(t *testing.T) {
+	t.Parallel()
+
+	ca, err := NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := other.NewClientCert(pkix.Name{CommonName: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kp.Certificate.Verify(x509.VerifyOptions{
+		Roots:     ca.CertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := kp.Certificate.Verify(x509.VerifyOptions{
+		Roots:     other.CertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Error(err)
+	}
+	if _, err := tls.X509KeyPair(kp.CertPEM, kp.KeyPEM); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,7 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// Package h2tuntest contains ProxyFuncs, in-memory certificates and other
+// fixtures for testing and benchmarking tunnels.
+package h2tuntest
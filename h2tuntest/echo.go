@@ -0,0 +1,229 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package h2tuntest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Echo control headers, if present in request they override the respective
+// EchoHTTPConfig values.
+const (
+	HeaderEchoStatus     = "X-Echo-Status"
+	HeaderEchoDelay      = "X-Echo-Delay"
+	HeaderEchoChunkSize  = "X-Echo-Chunk-Size"
+	HeaderEchoChunkDelay = "X-Echo-Chunk-Delay"
+)
+
+// EchoHeaderPrefix is prepended to request header names when they are echoed
+// back in response.
+const EchoHeaderPrefix = "X-Echo-"
+
+// EchoHTTPConfig specifies behaviour of echo ProxyFunc.
+type EchoHTTPConfig struct {
+	// StatusCode specifies response status code, if 0 http.StatusOK is
+	// used.
+	StatusCode int
+	// Delay specifies how long to wait before writing response.
+	Delay time.Duration
+	// ChunkSize if greater than 0 enables chunked transfer encoding,
+	// response body is written in chunks of ChunkSize bytes, each chunk is
+	// flushed.
+	ChunkSize int
+	// ChunkDelay specifies how long to wait between writing chunks.
+	ChunkDelay time.Duration
+	// EchoHeaders if enabled request headers are copied to response
+	// headers with EchoHeaderPrefix.
+	EchoHeaders bool
+}
+
+// EchoHTTPProxyFunc reads HTTP requests and writes back request body with
+// status 200.
+var EchoHTTPProxyFunc = NewEchoHTTPProxyFunc(&EchoHTTPConfig{})
+
+// NewEchoHTTPProxyFunc returns a ProxyFunc that reads HTTP requests and writes
+// back request body. For HTTP tunnels the response is written using
+// http.ResponseWriter and chunks are flushed as they are written. For other
+// tunnels the stream is treated as HTTP/1.1 connection, requests are read and
+// HTTP/1.1 responses are written until r is exhausted.
+func NewEchoHTTPProxyFunc(config *EchoHTTPConfig) tunnel.ProxyFunc {
+	return func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		br := bufio.NewReader(r)
+
+		switch msg.ForwardedProto {
+		case proto.HTTP, proto.HTTPS:
+			rw, ok := w.(http.ResponseWriter)
+			if !ok {
+				panic("expected http.ResponseWriter")
+			}
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			echoHTTP(rw, req, config)
+			return
+		}
+
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if err := echoRawHTTP(w, req, config); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func echoHTTP(w http.ResponseWriter, r *http.Request, config *EchoHTTPConfig) {
+	c := requestConfig(r, config)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	time.Sleep(c.Delay)
+
+	if c.EchoHeaders {
+		echoHeader(w.Header(), r.Header)
+	}
+	if c.ChunkSize <= 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(c.StatusCode)
+
+	if c.ChunkSize <= 0 {
+		w.Write(body)
+		return
+	}
+
+	f, _ := w.(http.Flusher)
+	cr := &chunkReader{r: bytes.NewReader(body), config: c}
+	buf := make([]byte, c.ChunkSize)
+	for {
+		n, err := cr.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func echoRawHTTP(w io.Writer, r *http.Request, config *EchoHTTPConfig) error {
+	c := requestConfig(r, config)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(c.Delay)
+
+	resp := &http.Response{
+		StatusCode: c.StatusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    r,
+		Header:     make(http.Header),
+	}
+	if c.EchoHeaders {
+		echoHeader(resp.Header, r.Header)
+	}
+	if c.ChunkSize > 0 {
+		resp.ContentLength = -1
+		resp.TransferEncoding = []string{"chunked"}
+		resp.Body = ioutil.NopCloser(&chunkReader{r: bytes.NewReader(body), config: c})
+	} else {
+		resp.ContentLength = int64(len(body))
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return resp.Write(flushWriter{w})
+}
+
+// requestConfig returns copy of config updated with values from echo control
+// headers.
+func requestConfig(r *http.Request, config *EchoHTTPConfig) *EchoHTTPConfig {
+	c := *config
+
+	if v, err := strconv.Atoi(r.Header.Get(HeaderEchoStatus)); err == nil {
+		c.StatusCode = v
+	}
+	if v, err := time.ParseDuration(r.Header.Get(HeaderEchoDelay)); err == nil {
+		c.Delay = v
+	}
+	if v, err := strconv.Atoi(r.Header.Get(HeaderEchoChunkSize)); err == nil {
+		c.ChunkSize = v
+	}
+	if v, err := time.ParseDuration(r.Header.Get(HeaderEchoChunkDelay)); err == nil {
+		c.ChunkDelay = v
+	}
+
+	if c.StatusCode == 0 {
+		c.StatusCode = http.StatusOK
+	}
+
+	return &c
+}
+
+func echoHeader(dst, src http.Header) {
+	for k, v := range src {
+		vv := make([]string, len(v))
+		copy(vv, v)
+		dst[EchoHeaderPrefix+k] = vv
+	}
+}
+
+// chunkReader returns at most config.ChunkSize bytes on every read and sleeps
+// config.ChunkDelay between reads.
+type chunkReader struct {
+	r      io.Reader
+	config *EchoHTTPConfig
+	read   bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.read {
+		time.Sleep(cr.config.ChunkDelay)
+	}
+	cr.read = true
+
+	if len(p) > cr.config.ChunkSize {
+		p = p[:cr.config.ChunkSize]
+	}
+	return cr.r.Read(p)
+}
+
+type flushWriter struct {
+	w io.Writer
+}
+
+func (fw flushWriter) Write(p []byte) (n int, err error) {
+	n, err = fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return
+}
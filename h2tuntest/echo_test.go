@@ -0,0 +1,94 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package h2tuntest
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestEchoHTTPProxyFunc(t *testing.T) {
+	t.Parallel()
+
+	f := NewEchoHTTPProxyFunc(&EchoHTTPConfig{
+		EchoHeaders: true,
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+	r.Header.Set(HeaderEchoStatus, "502")
+	r.Header.Set("Foo", "bar")
+	buf := new(bytes.Buffer)
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	f(w, ioutil.NopCloser(buf), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "localhost",
+		ForwardedProto: proto.HTTP,
+	})
+
+	if w.Code != http.StatusBadGateway {
+		t.Error("Unexpected status code", w.Code)
+	}
+	if w.Header().Get(EchoHeaderPrefix+"Foo") != "bar" {
+		t.Error("Header not echoed", w.Header())
+	}
+	if w.Body.String() != "payload" {
+		t.Error("Unexpected body", w.Body.String())
+	}
+}
+
+func TestEchoHTTPProxyFuncRawChunked(t *testing.T) {
+	t.Parallel()
+
+	f := NewEchoHTTPProxyFunc(&EchoHTTPConfig{
+		ChunkSize: 2,
+	})
+
+	buf := new(bytes.Buffer)
+	for _, body := range []string{"first", "second"} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if err := r.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	f(w, ioutil.NopCloser(buf), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "localhost:2000",
+		ForwardedProto: proto.TCP,
+	})
+
+	br := bufio.NewReader(w.Body)
+	for _, body := range []string{"first", "second"} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ProtoMajor != 1 || resp.ProtoMinor != 1 {
+			t.Error("Unexpected protocol", resp.Proto)
+		}
+		if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+			t.Error("Expected chunked transfer encoding", resp.TransferEncoding)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Error("Unexpected body", string(b))
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package h2tuntest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// StreamingFileServer returns a ProxyFunc that serves files from root. Unlike
+// loading the files into memory, files are read from disk as they are sent
+// so it's suitable for transferring multi-GB payloads through the tunnel.
+// Responses carry Content-Length, Last-Modified and ETag headers, Range
+// requests and conditional requests with If-Modified-Since, If-None-Match and
+// If-Range are supported so that resumable downloads and caching can be
+// tested.
+func StreamingFileServer(root string) tunnel.ProxyFunc {
+	return func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		rw, ok := w.(http.ResponseWriter)
+		if !ok {
+			panic("expected http.ResponseWriter")
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(r))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		serveFile(rw, req, root)
+	}
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, root string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// ok
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", fileETag(fi))
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// fileETag returns strong entity tag of file derived from modification time
+// and size, it changes whenever the file is rewritten.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
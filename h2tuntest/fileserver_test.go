@@ -0,0 +1,111 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package h2tuntest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestStreamingFileServer(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "h2tuntest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	name := filepath.Join(dir, "data.bin")
+	if err := ioutil.WriteFile(name, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := fileETag(fi)
+	lastModified := modTime.Format(http.TimeFormat)
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		path   string
+		header http.Header
+		status int
+		body   []byte
+	}{
+		{"/data.bin", nil, http.StatusOK, content},
+		{"/data.bin", http.Header{"Range": {"bytes=10-19"}}, http.StatusPartialContent, content[10:20]},
+		{"/data.bin", http.Header{"Range": {"bytes=9990-"}}, http.StatusPartialContent, content[9990:]},
+		{"/data.bin", http.Header{"Range": {"bytes=20000-"}}, http.StatusRequestedRangeNotSatisfiable, nil},
+		{"/data.bin", http.Header{"Range": {"bytes=10-19"}, "If-Range": {etag}}, http.StatusPartialContent, content[10:20]},
+		{"/data.bin", http.Header{"Range": {"bytes=10-19"}, "If-Range": {`"stale"`}}, http.StatusOK, content},
+		{"/data.bin", http.Header{"Range": {"bytes=10-19"}, "If-Range": {lastModified}}, http.StatusPartialContent, content[10:20]},
+		{"/data.bin", http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified, nil},
+		{"/data.bin", http.Header{"If-Modified-Since": {before}}, http.StatusOK, content},
+		{"/data.bin", http.Header{"If-None-Match": {etag}}, http.StatusNotModified, nil},
+		{"/data.bin", http.Header{"If-None-Match": {`"stale"`}}, http.StatusOK, content},
+		{"/data.bin", http.Header{"If-None-Match": {etag}, "If-Modified-Since": {before}}, http.StatusNotModified, nil},
+		{"/../data.bin", nil, http.StatusOK, content},
+		{"/missing.bin", nil, http.StatusNotFound, nil},
+	}
+
+	f := StreamingFileServer(dir)
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "localhost",
+		ForwardedProto: proto.HTTP,
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		for k, v := range tt.header {
+			r.Header[k] = v
+		}
+		buf := new(bytes.Buffer)
+		if err := r.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		f(w, ioutil.NopCloser(buf), msg)
+
+		if w.Code != tt.status {
+			t.Errorf("[%d] expected status %d got %d", i, tt.status, w.Code)
+			continue
+		}
+		if w.Code == http.StatusOK || w.Code == http.StatusPartialContent || w.Code == http.StatusNotModified {
+			if h := w.Header().Get("ETag"); h != etag {
+				t.Errorf("[%d] expected ETag %s got %s", i, etag, h)
+			}
+			if h := w.Header().Get("Last-Modified"); w.Code != http.StatusNotModified && h != lastModified {
+				t.Errorf("[%d] expected Last-Modified %s got %s", i, lastModified, h)
+			}
+		}
+		if tt.body == nil {
+			continue
+		}
+		if !bytes.Equal(w.Body.Bytes(), tt.body) {
+			t.Errorf("[%d] body mismatch", i)
+		}
+		if l := w.Header().Get("Content-Length"); l != strconv.Itoa(len(tt.body)) {
+			t.Errorf("[%d] expected Content-Length %d got %s", i, len(tt.body), l)
+		}
+	}
+}
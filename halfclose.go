@@ -0,0 +1,127 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/inconshreveable/go-vhost"
+)
+
+// HTTP/2 server can't end response while reading request, when half-close is
+// negotiated client writes TCP data in length-prefixed frames and signals end
+// of data with an empty frame.
+
+// halfCloseWriter writes data in frames, CloseWrite writes the empty frame.
+type halfCloseWriter struct {
+	w io.Writer
+}
+
+func (w halfCloseWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	b := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(b, uint32(len(p)))
+	copy(b[4:], p)
+	if _, err := w.w.Write(b); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// ReadFrom reads r into pooled buffer after room left for the frame header,
+// so data is framed in place instead of being copied again by Write.
+func (w halfCloseWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := copyBuffers.Get()
+	defer copyBuffers.Put(buf)
+
+	for {
+		m, rerr := r.Read(buf[4:])
+		if m > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(m))
+			if _, err := w.w.Write(buf[:4+m]); err != nil {
+				return n, err
+			}
+			n += int64(m)
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+func (w halfCloseWriter) CloseWrite() error {
+	_, err := w.w.Write(make([]byte, 4))
+	return err
+}
+
+// halfCloseReader reads data written by halfCloseWriter, it returns io.EOF
+// on the empty frame and io.ErrUnexpectedEOF if stream ends without it.
+type halfCloseReader struct {
+	r         io.Reader
+	remaining uint32
+	eof       bool
+}
+
+func (r *halfCloseReader) Read(p []byte) (int, error) {
+	if r.eof {
+		return 0, io.EOF
+	}
+
+	if r.remaining == 0 {
+		var h [4]byte
+		if _, err := io.ReadFull(r.r, h[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.remaining = binary.BigEndian.Uint32(h[:])
+		if r.remaining == 0 {
+			r.eof = true
+			return 0, io.EOF
+		}
+	}
+
+	if uint32(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= uint32(n)
+	if err == io.EOF {
+		if n > 0 {
+			err = nil
+		} else {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	return n, err
+}
+
+// closeWrite shuts down the writing side of conn if it's supported.
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *vhost.TLSConn:
+		return closeWrite(c.Conn)
+	case *onDemandConn:
+		return closeWrite(c.Conn)
+	case *connectConn:
+		return closeWrite(c.Conn)
+	case interface {
+		CloseWrite() error
+	}:
+		return c.CloseWrite()
+	}
+	return nil
+}
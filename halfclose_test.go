@@ -0,0 +1,70 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestHalfCloseReadWrite(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w := halfCloseWriter{&buf}
+	w.Write([]byte("foo"))
+	w.Write(nil)
+	w.Write([]byte("bar"))
+	w.CloseWrite()
+	buf.WriteString("trailing data")
+
+	r := &halfCloseReader{r: &buf}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "foobar" {
+		t.Fatalf("expected foobar got %q %v", b, err)
+	}
+	if !r.eof {
+		t.Error("expected eof")
+	}
+	if buf.String() != "trailing data" {
+		t.Errorf("unexpected remaining data %q", buf.String())
+	}
+}
+
+func TestHalfCloseReadUnexpectedEOF(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	halfCloseWriter{&buf}.Write([]byte("foo"))
+
+	tests := []int{buf.Len(), buf.Len() - 1, 2}
+	for i, n := range tests {
+		r := &halfCloseReader{r: bytes.NewReader(buf.Bytes()[:n])}
+		if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+			t.Errorf("[%d] expected unexpected EOF got %v", i, err)
+		}
+	}
+}
+
+func TestHalfCloseReadFrom(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("0123456789"), copyBufferSize/4)
+
+	var buf bytes.Buffer
+	w := &halfCloseWriter{&buf}
+	n, err := copyStream(w, bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("expected %d bytes got %d %v", len(data), n, err)
+	}
+	w.CloseWrite()
+
+	b, err := ioutil.ReadAll(&halfCloseReader{r: &buf})
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("data mismatch %v", err)
+	}
+}
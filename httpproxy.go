@@ -7,12 +7,17 @@ package tunnel
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"path"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
@@ -29,11 +34,72 @@ type HTTPProxy struct {
 	// * host and port
 	// * port
 	// * host
+	// * empty key, the tunnel with host assigned by the server
 	localURLMap map[string]*url.URL
+	// Options specifies default options.
+	Options *HTTPProxyOptions
+	// OptionsMap specifies mapping from ControlMessage.ForwardedHost to
+	// options, keys follow the same rules as in localURLMap.
+	OptionsMap map[string]*HTTPProxyOptions
+	// Inspector optionally records proxied requests and responses.
+	Inspector *Inspector
+	// RedactHeaders specifies names of headers which values are redacted
+	// from request logs in addition to DefaultRedactHeaders.
+	RedactHeaders []string
 	// logger is the proxy logger.
 	logger log.Logger
+	// transports holds transports of options with TLSClientConfig.
+	transports map[*HTTPProxyOptions]http.RoundTripper
+	mu         sync.Mutex
 }
 
+// HTTPProxyOptions specifies per tunnel HTTPProxy behaviour.
+type HTTPProxyOptions struct {
+	// RequestHeaders specifies headers set on requests forwarded to local
+	// service.
+	RequestHeaders map[string]string
+	// ClientIPHeader specifies optional name of request header set to IP
+	// address of the public caller, see proto.ControlMessage ClientIP.
+	ClientIPHeader string
+	// StripResponseHeaders specifies names of headers removed from local
+	// service responses.
+	StripResponseHeaders []string
+	// FlushInterval specifies the flush interval to flush to the server
+	// while copying the response body of local service, zero value
+	// means flush immediately after each write.
+	FlushInterval time.Duration
+	// TLSClientConfig specifies optional TLS configuration used to connect
+	// to local service over HTTPS, i.e. with custom root CAs or server
+	// name.
+	TLSClientConfig *tls.Config
+	// DialTimeout specifies how long to wait for connection to local
+	// service, if 0 the default transport timeout is used.
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout specifies how long to wait for response
+	// headers of local service after the request is written, on timeout
+	// the public caller gets 504. If 0 there is no timeout.
+	ResponseHeaderTimeout time.Duration
+	// PreserveHost if enabled forwards requests with the public hostname in
+	// Host header, by default host of local service URL is used.
+	PreserveHost bool
+	// HostHeader specifies optional Host header value of requests forwarded
+	// to local service, it takes precedence over PreserveHost.
+	HostHeader string
+	// PathRewrites specifies rules rewriting request path before it's
+	// joined with local service URL path, the first matching rule is
+	// applied.
+	PathRewrites []*PathRewrite
+}
+
+// PathRewrite replaces request path matching Pattern with Replacement,
+// Replacement may refer to submatches i.e. $1.
+type PathRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+type httpProxyOptionsKey struct{}
+
 // NewHTTPProxy creates a new direct HTTPProxy, everything will be proxied to
 // localURL.
 func NewHTTPProxy(localURL *url.URL, logger log.Logger) *HTTPProxy {
@@ -45,7 +111,11 @@ func NewHTTPProxy(localURL *url.URL, logger log.Logger) *HTTPProxy {
 		localURL: localURL,
 		logger:   logger,
 	}
+	p.ReverseProxy.FlushInterval = -1
+	p.ReverseProxy.BufferPool = copyBuffers
 	p.ReverseProxy.Director = p.Director
+	p.ReverseProxy.ModifyResponse = p.ModifyResponse
+	p.ReverseProxy.ErrorHandler = p.ErrorHandler
 
 	return p
 }
@@ -61,13 +131,23 @@ func NewMultiHTTPProxy(localURLMap map[string]*url.URL, logger log.Logger) *HTTP
 		localURLMap: localURLMap,
 		logger:      logger,
 	}
+	p.ReverseProxy.FlushInterval = -1
+	p.ReverseProxy.BufferPool = copyBuffers
 	p.ReverseProxy.Director = p.Director
+	p.ReverseProxy.ModifyResponse = p.ModifyResponse
+	p.ReverseProxy.ErrorHandler = p.ErrorHandler
 
 	return p
 }
 
 // Proxy is a ProxyFunc.
 func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+	p.ProxyContext(context.Background(), w, r, msg)
+}
+
+// ProxyContext is a ProxyFuncContext, request to local service is canceled
+// when ctx is done.
+func (p *HTTPProxy) ProxyContext(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
 	switch msg.ForwardedProto {
 	case proto.HTTP, proto.HTTPS:
 		// ok
@@ -77,6 +157,7 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 			"msg", "unsupported protocol",
 			"ctrlMsg", msg,
 		)
+		proxyError(w, proto.ErrorCodeUnsupportedProtocol, fmt.Errorf("unsupported protocol %q", msg.ForwardedProto))
 		return
 	}
 
@@ -87,6 +168,7 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 			"msg", "expected http.ResponseWriter",
 			"ctrlMsg", msg,
 		)
+		return
 	}
 
 	req, err := http.ReadRequest(bufio.NewReader(r))
@@ -97,13 +179,66 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 			"ctrlMsg", msg,
 			"err", err,
 		)
+		proxyError(w, proto.ErrorCodeProxyFailed, fmt.Errorf("failed to read request: %s", err))
 		return
 	}
 
+	p.logger.Log(
+		"level", 3,
+		"action", "request",
+		"ctrlMsg", msg,
+		"method", req.Method,
+		"url", req.URL,
+		"header", redactedHeader{req.Header, p.RedactHeaders},
+	)
+
+	// servers older than proto.Version4 do not resolve client IP
+	clientIP := msg.ClientIP
+	if clientIP == "" {
+		clientIP = lastXForwardedFor(req.Header)
+	}
 	setXForwardedFor(req.Header, msg.RemoteAddr)
 	req.URL.Host = msg.ForwardedHost
 
-	p.ServeHTTP(rw, req)
+	if p.localURLFor(req.URL) == nil {
+		p.logger.Log(
+			"level", 1,
+			"msg", "no target",
+			"ctrlMsg", msg,
+		)
+		proxyError(w, proto.ErrorCodeNoTarget, fmt.Errorf("no target for %q", msg.ForwardedHost))
+		return
+	}
+
+	if p.Inspector != nil {
+		var done func()
+		rw, req, done = p.Inspector.capture(ctx, rw, req, msg)
+		defer done()
+	}
+
+	if o := p.optionsFor(req.URL.Host); o != nil {
+		for k, v := range o.RequestHeaders {
+			req.Header.Set(k, v)
+		}
+		if o.ClientIPHeader != "" && clientIP != "" {
+			req.Header.Set(o.ClientIPHeader, clientIP)
+		}
+		ctx = context.WithValue(ctx, httpProxyOptionsKey{}, o)
+
+		if o.FlushInterval > 0 || o.customTransport() {
+			rp := p.ReverseProxy
+			if o.FlushInterval > 0 {
+				rp.FlushInterval = o.FlushInterval
+			}
+			if o.customTransport() {
+				rp.Transport = p.transportFor(o)
+			}
+			rp.ServeHTTP(rw, req.WithContext(ctx))
+			return
+		}
+	}
+
+	p.ServeHTTP(rw, req.WithContext(ctx))
 }
 
 // Director is ReverseProxy Director it changes request URL so that the request
@@ -111,6 +246,7 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 // the request is canceled.
 func (p *HTTPProxy) Director(req *http.Request) {
 	orig := *req.URL
+	host := req.Host
 
 	target := p.localURLFor(req.URL)
 	if target == nil {
@@ -126,8 +262,13 @@ func (p *HTTPProxy) Director(req *http.Request) {
 		return
 	}
 
+	o, _ := req.Context().Value(httpProxyOptionsKey{}).(*HTTPProxyOptions)
+
 	req.URL.Host = target.Host
 	req.URL.Scheme = target.Scheme
+	if o != nil {
+		req.URL.Path = o.rewritePath(req.URL.Path)
+	}
 	req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
 
 	targetQuery := target.RawQuery
@@ -142,6 +283,14 @@ func (p *HTTPProxy) Director(req *http.Request) {
 	}
 
 	req.Host = req.URL.Host
+	if o != nil {
+		switch {
+		case o.HostHeader != "":
+			req.Host = o.HostHeader
+		case o.PreserveHost:
+			req.Host = host
+		}
+	}
 
 	p.logger.Log(
 		"level", 2,
@@ -151,6 +300,63 @@ func (p *HTTPProxy) Director(req *http.Request) {
 	)
 }
 
+// ModifyResponse is ReverseProxy ModifyResponse it logs response and removes
+// response headers based on options.
+func (p *HTTPProxy) ModifyResponse(resp *http.Response) error {
+	p.logger.Log(
+		"level", 3,
+		"action", "response",
+		"url", resp.Request.URL,
+		"status code", resp.StatusCode,
+		"header", redactedHeader{resp.Header, p.RedactHeaders},
+	)
+
+	// error headers are reserved for the client, backend must not be able
+	// to turn its response into a tunnel error
+	resp.Header.Del(proto.HeaderTunnelErrorCode)
+	resp.Header.Del(proto.HeaderTunnelError)
+
+	o, ok := resp.Request.Context().Value(httpProxyOptionsKey{}).(*HTTPProxyOptions)
+	if !ok {
+		return nil
+	}
+
+	for _, h := range o.StripResponseHeaders {
+		resp.Header.Del(h)
+	}
+
+	return nil
+}
+
+// ErrorHandler is ReverseProxy ErrorHandler it reports errors of local service
+// to the server.
+func (p *HTTPProxy) ErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	p.logger.Log(
+		"level", 0,
+		"msg", "round trip failed",
+		"url", req.URL,
+		"err", err,
+	)
+
+	code := proto.ErrorCodeProxyFailed
+	if _, ok := err.(*net.OpError); ok {
+		code = dialErrorCode(err)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		code = proto.ErrorCodeTimeout
+	}
+	proxyError(w, code, err)
+}
+
+// rewritePath applies the first path rewrite rule matching path.
+func (o *HTTPProxyOptions) rewritePath(path string) string {
+	for _, r := range o.PathRewrites {
+		if r.Pattern.MatchString(path) {
+			return r.Pattern.ReplaceAllString(path, r.Replacement)
+		}
+	}
+	return path
+}
+
 func singleJoiningSlash(a, b string) string {
 	if a == "" || a == "/" {
 		return b
@@ -184,5 +390,72 @@ func (p *HTTPProxy) localURLFor(u *url.URL) *url.URL {
 		return addr
 	}
 
+	// try host assigned by the server
+	if addr := p.localURLMap[""]; addr != nil {
+		return addr
+	}
+
 	return p.localURL
 }
+
+// customTransport returns true if o requires transport other than the
+// default one.
+func (o *HTTPProxyOptions) customTransport() bool {
+	return o.TLSClientConfig != nil || o.DialTimeout > 0 || o.ResponseHeaderTimeout > 0
+}
+
+// transportFor returns transport using o.TLSClientConfig and timeouts,
+// transports are created on first use and reused.
+func (p *HTTPProxy) transportFor(o *HTTPProxyOptions) http.RoundTripper {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.transports[o]; ok {
+		return t
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = o.TLSClientConfig
+	if o.DialTimeout > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   o.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	t.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	if p.transports == nil {
+		p.transports = make(map[*HTTPProxyOptions]http.RoundTripper)
+	}
+	p.transports[o] = t
+
+	return t
+}
+
+func (p *HTTPProxy) optionsFor(hostPort string) *HTTPProxyOptions {
+	if len(p.OptionsMap) == 0 {
+		return p.Options
+	}
+
+	// try host and port
+	if o := p.OptionsMap[hostPort]; o != nil {
+		return o
+	}
+
+	// try port
+	host, port, _ := net.SplitHostPort(hostPort)
+	if o := p.OptionsMap[port]; o != nil {
+		return o
+	}
+
+	// try host
+	if o := p.OptionsMap[host]; o != nil {
+		return o
+	}
+
+	// try host assigned by the server
+	if o := p.OptionsMap[""]; o != nil {
+		return o
+	}
+
+	return p.Options
+}
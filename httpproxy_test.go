@@ -0,0 +1,319 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestHTTPProxy_Options(t *testing.T) {
+	t.Parallel()
+
+	var header http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Powered-By", "go")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	p := NewMultiHTTPProxy(map[string]*url.URL{"foo.com": u}, nil)
+	p.OptionsMap = map[string]*HTTPProxyOptions{
+		"foo.com": {
+			RequestHeaders:       map[string]string{"X-Auth": "secret"},
+			ClientIPHeader:       "X-Tunnel-Client-IP",
+			StripResponseHeaders: []string{"Server", "X-Powered-By"},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "foo.com"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	buf := new(bytes.Buffer)
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.ProxyContext(context.Background(), w, ioutil.NopCloser(buf), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "foo.com",
+		ForwardedProto: proto.HTTP,
+		RemoteAddr:     "10.0.0.1:5223",
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatal("Unexpected status code", w.Code)
+	}
+	if header.Get("X-Auth") != "secret" {
+		t.Error("Request header not set", header)
+	}
+	if header.Get("X-Tunnel-Client-IP") != "1.2.3.4" {
+		t.Error("Client IP header not set", header)
+	}
+	if w.Header().Get("Server") != "" || w.Header().Get("X-Powered-By") != "" {
+		t.Error("Response headers not stripped", w.Header())
+	}
+}
+
+func TestHTTPProxy_ClientIP(t *testing.T) {
+	t.Parallel()
+
+	var header http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	p := NewHTTPProxy(u, nil)
+	p.Options = &HTTPProxyOptions{ClientIPHeader: "X-Tunnel-Client-IP"}
+
+	// request forwarded by a load balancer trusted by the server
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "foo.com"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.2")
+	buf := new(bytes.Buffer)
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.ProxyContext(context.Background(), w, ioutil.NopCloser(buf), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "foo.com",
+		ForwardedProto: proto.HTTP,
+		RemoteAddr:     "10.0.0.1:5223",
+		ClientIP:       "1.2.3.4",
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatal("Unexpected status code", w.Code)
+	}
+	if header.Get("X-Tunnel-Client-IP") != "1.2.3.4" {
+		t.Error("Client IP header not set", header)
+	}
+}
+
+func TestHTTPProxy_TLSClientConfig(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+
+	tests := []struct {
+		options *HTTPProxyOptions
+		code    int
+	}{
+		{nil, http.StatusBadGateway},
+		{&HTTPProxyOptions{TLSClientConfig: &tls.Config{RootCAs: roots}}, http.StatusOK},
+		{&HTTPProxyOptions{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "other.com"}}, http.StatusBadGateway},
+		{&HTTPProxyOptions{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		u, _ := url.Parse(backend.URL)
+		p := NewHTTPProxy(u, nil)
+		p.Options = tt.options
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = "foo.com"
+		buf := new(bytes.Buffer)
+		if err := r.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		p.ProxyContext(context.Background(), w, ioutil.NopCloser(buf), &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedHost:  "foo.com",
+			ForwardedProto: proto.HTTP,
+		})
+
+		if w.Code != tt.code {
+			t.Errorf("[%d] expected status %d got %d", i, tt.code, w.Code)
+		}
+	}
+}
+
+func TestHTTPProxy_ResponseHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer backend.Close()
+	defer close(done)
+
+	u, _ := url.Parse(backend.URL)
+	p := NewHTTPProxy(u, nil)
+	p.Options = &HTTPProxyOptions{
+		ResponseHeaderTimeout: 50 * time.Millisecond,
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "foo.com"
+	buf := new(bytes.Buffer)
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.ProxyContext(context.Background(), w, ioutil.NopCloser(buf), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "foo.com",
+		ForwardedProto: proto.HTTP,
+	})
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d got %d", http.StatusGatewayTimeout, w.Code)
+	}
+	if code := w.Header().Get(proto.HeaderTunnelErrorCode); code != proto.ErrorCodeTimeout {
+		t.Errorf("expected error code %s got %s", proto.ErrorCodeTimeout, code)
+	}
+}
+
+func TestHTTPProxy_BackendErrorHeaders(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(proto.HeaderTunnelErrorCode, proto.ErrorCodeTimeout)
+		w.Header().Set(proto.HeaderTunnelError, "spoofed")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	p := NewHTTPProxy(u, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "foo.com"
+	buf := new(bytes.Buffer)
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.ProxyContext(context.Background(), w, ioutil.NopCloser(buf), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "foo.com",
+		ForwardedProto: proto.HTTP,
+	})
+
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("expected backend response got %d %q", w.Code, w.Body.String())
+	}
+	if e := proto.ReadError(w.Header()); e != nil {
+		t.Errorf("unexpected error %s", e)
+	}
+}
+
+func TestHTTPProxy_Rewrite(t *testing.T) {
+	t.Parallel()
+
+	var host, path string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, path = r.Host, r.URL.Path
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/base/")
+	rewrites := []*PathRewrite{
+		{Pattern: regexp.MustCompile("^/api/(.*)$"), Replacement: "/v1/$1"},
+		{Pattern: regexp.MustCompile("^/api"), Replacement: "/never"},
+	}
+
+	tests := []struct {
+		options *HTTPProxyOptions
+		path    string
+		host    string
+		local   string
+	}{
+		{&HTTPProxyOptions{}, "/api/users", u.Host, "/base/api/users"},
+		{&HTTPProxyOptions{PreserveHost: true}, "/", "foo.com", "/base/"},
+		{&HTTPProxyOptions{PreserveHost: true, HostHeader: "app.local"}, "/", "app.local", "/base/"},
+		{&HTTPProxyOptions{PathRewrites: rewrites}, "/api/users", u.Host, "/base/v1/users"},
+		{&HTTPProxyOptions{PathRewrites: rewrites}, "/web/api", u.Host, "/base/web/api"},
+	}
+
+	for i, tt := range tests {
+		p := NewMultiHTTPProxy(map[string]*url.URL{"foo.com": u}, nil)
+		p.OptionsMap = map[string]*HTTPProxyOptions{"foo.com": tt.options}
+
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Host = "foo.com"
+		buf := new(bytes.Buffer)
+		if err := r.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		p.ProxyContext(context.Background(), w, ioutil.NopCloser(buf), &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedHost:  "foo.com",
+			ForwardedProto: proto.HTTP,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("[%d] unexpected status code %d", i, w.Code)
+		}
+		if host != tt.host {
+			t.Errorf("[%d] expected host %q got %q", i, tt.host, host)
+		}
+		if path != tt.local {
+			t.Errorf("[%d] expected path %q got %q", i, tt.local, path)
+		}
+	}
+}
+
+func TestHTTPProxy_LocalURLFor(t *testing.T) {
+	t.Parallel()
+
+	foo := &url.URL{Host: "foo"}
+	bar := &url.URL{Host: "bar"}
+	assigned := &url.URL{Host: "assigned"}
+	p := NewMultiHTTPProxy(map[string]*url.URL{
+		"foo.com:8080": foo,
+		"bar.com":      bar,
+		"":             assigned,
+	}, nil)
+
+	tests := []struct {
+		host  string
+		local *url.URL
+	}{
+		{"foo.com:8080", foo},
+		{"bar.com", bar},
+		{"bar.com:8080", bar},
+		{"abc.example.com", assigned},
+		{"abc.example.com:8080", assigned},
+	}
+
+	for i, tt := range tests {
+		if u := p.localURLFor(&url.URL{Host: tt.host}); u != tt.local {
+			t.Errorf("[%d] expected %v got %v", i, tt.local, u)
+		}
+	}
+}
@@ -23,13 +23,14 @@ func PeerID(conn *tls.Conn) (ID, error) {
 
 	cs := conn.ConnectionState()
 
-	// We should have exactly one peer certificate.
+	// We should have at least one peer certificate, the leaf certificate
+	// may be followed by intermediate certificates.
 	certs := cs.PeerCertificates
-	if cl := len(certs); cl != 1 {
+	if cl := len(certs); cl < 1 {
 		return emptyID, ImproperCertsNumberError{cl}
 	}
 
-	// Get remote cert's ID.
+	// Get remote leaf cert's ID.
 	remoteCert := certs[0]
 	remoteID := New(remoteCert.Raw)
 
@@ -37,11 +38,11 @@ func PeerID(conn *tls.Conn) (ID, error) {
 }
 
 // ImproperCertsNumberError is returned from Server/Client whenever the remote
-// peer presents a number of PeerCertificates that is not 1.
+// peer presents no PeerCertificates.
 type ImproperCertsNumberError struct {
 	n int
 }
 
 func (e ImproperCertsNumberError) Error() string {
-	return fmt.Sprintf("ptls: expecting 1 peer certificate, got %d", e.n)
+	return fmt.Sprintf("ptls: expecting at least 1 peer certificate, got %d", e.n)
 }
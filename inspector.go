@@ -0,0 +1,435 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Default inspector configuration.
+const (
+	DefaultInspectorSize        = 100
+	DefaultInspectorMaxBodySize = 64 << 10
+)
+
+var errNoRecord = errors.New("no such request")
+
+// Inspector records recent requests and responses proxied by HTTPProxy, the
+// recorded requests can be replayed against local service. Inspector is an
+// http.Handler serving web UI and JSON API:
+//
+//	GET    /                          web UI
+//	GET    /api/requests              JSON list of records, newest first
+//	DELETE /api/requests              remove all records
+//	GET    /api/requests/{id}         JSON record
+//	POST   /api/requests/{id}/replay  replay request, JSON record of replay
+//
+// Values of credential headers are redacted in the API, see RedactHeaders.
+// It's not authenticated and should not be public. Replay requests must have
+// application/json content type and must not be cross-origin so that web
+// pages cannot replay requests.
+type Inspector struct {
+	// Size specifies how many records are kept, older records are dropped.
+	// If zero DefaultInspectorSize is used.
+	Size int
+	// MaxBodySize specifies how many bytes of request and response body are
+	// recorded, longer bodies are truncated. If zero
+	// DefaultInspectorMaxBodySize is used.
+	MaxBodySize int64
+	// Proxy is used to replay requests, it's typically ProxyContext of
+	// HTTPProxy using the inspector.
+	Proxy ProxyFuncContext
+	// RedactHeaders specifies names of headers which values are redacted
+	// from API responses in addition to DefaultRedactHeaders, records keep
+	// the original values so that requests can be replayed.
+	RedactHeaders []string
+
+	mu      sync.Mutex
+	lastID  uint64
+	records []*InspectorRecord
+}
+
+// InspectorRecord is a request and response recorded by Inspector.
+type InspectorRecord struct {
+	// ID identifies the record.
+	ID uint64 `json:"id"`
+	// ReplayOf is ID of replayed record, zero if request is not a replay.
+	ReplayOf uint64 `json:"replay_of,omitempty"`
+	// Time is when the request was received.
+	Time time.Time `json:"time"`
+	// Duration is how long it took to proxy the request.
+	Duration time.Duration `json:"duration"`
+	// Scheme is the scheme of public request.
+	Scheme string `json:"scheme"`
+	// Host is the public host of the tunnel.
+	Host string `json:"host"`
+	// RemoteAddr is the address of the server connection the request was
+	// received on.
+	RemoteAddr string `json:"remote_addr"`
+	// Request is the request as received from the server.
+	Request *InspectorMessage `json:"request"`
+	// Response is the response of local service or the proxy error.
+	Response *InspectorMessage `json:"response"`
+}
+
+// InspectorMessage is a recorded request or response.
+type InspectorMessage struct {
+	// Method and URI are set on requests.
+	Method string `json:"method,omitempty"`
+	URI    string `json:"uri,omitempty"`
+	// StatusCode is set on responses.
+	StatusCode int         `json:"status_code,omitempty"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	// Truncated is true if only MaxBodySize bytes of body are recorded.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// inspectorReplayKey is context key of *InspectorRecord receiving replay.
+type inspectorReplayKey struct{}
+
+// capture starts recording of req, it returns writer and request to proxy
+// and a function that must be called when done.
+func (i *Inspector) capture(ctx context.Context, w http.ResponseWriter, req *http.Request, msg *proto.ControlMessage) (http.ResponseWriter, *http.Request, func()) {
+	rec := &InspectorRecord{
+		Time:       time.Now(),
+		Scheme:     msg.ForwardedProto,
+		Host:       msg.ForwardedHost,
+		RemoteAddr: msg.RemoteAddr,
+		Request: &InspectorMessage{
+			Method: req.Method,
+			URI:    req.RequestURI,
+			Header: cloneHeader(req.Header),
+		},
+	}
+	replay, _ := ctx.Value(inspectorReplayKey{}).(*InspectorRecord)
+	if replay != nil {
+		rec.ReplayOf = replay.ID
+	}
+
+	reqBody := &limitedBuffer{max: i.maxBodySize()}
+	if req.Body != nil {
+		req.Body = &captureReadCloser{req.Body, reqBody}
+	}
+	cw := &captureResponseWriter{
+		ResponseWriter: w,
+		body:           &limitedBuffer{max: i.maxBodySize()},
+	}
+
+	return cw, req, func() {
+		rec.Duration = time.Since(rec.Time)
+		rec.Request.Body, rec.Request.Truncated = reqBody.bytes()
+		rec.Response = &InspectorMessage{
+			StatusCode: cw.status,
+			Header:     cloneHeader(w.Header()),
+		}
+		if rec.Response.StatusCode == 0 {
+			rec.Response.StatusCode = http.StatusOK
+		}
+		rec.Response.Body, rec.Response.Truncated = cw.body.bytes()
+
+		i.add(rec)
+		if replay != nil {
+			*replay = *rec
+		}
+	}
+}
+
+func (i *Inspector) add(rec *InspectorRecord) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.lastID++
+	rec.ID = i.lastID
+	i.records = append(i.records, rec)
+	if n := len(i.records) - i.size(); n > 0 {
+		i.records = append(i.records[:0:0], i.records[n:]...)
+	}
+}
+
+// Records returns recorded requests, newest first.
+func (i *Inspector) Records() []*InspectorRecord {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	records := make([]*InspectorRecord, len(i.records))
+	for j, rec := range i.records {
+		records[len(records)-1-j] = rec
+	}
+	return records
+}
+
+// Record returns record with id or nil if there is no such record.
+func (i *Inspector) Record(id uint64) *InspectorRecord {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, rec := range i.records {
+		if rec.ID == id {
+			return rec
+		}
+	}
+	return nil
+}
+
+// Clear removes all records.
+func (i *Inspector) Clear() {
+	i.mu.Lock()
+	i.records = nil
+	i.mu.Unlock()
+}
+
+// Replay sends recorded request with id to Proxy again and returns record of
+// the replay.
+func (i *Inspector) Replay(ctx context.Context, id uint64) (*InspectorRecord, error) {
+	if i.Proxy == nil {
+		return nil, errors.New("replay not supported")
+	}
+
+	rec := i.Record(id)
+	if rec == nil {
+		return nil, errNoRecord
+	}
+	if rec.Request.Truncated {
+		return nil, errors.New("request body is truncated")
+	}
+
+	req, err := http.NewRequest(rec.Request.Method, rec.Request.URI, bytes.NewReader(rec.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = cloneHeader(rec.Request.Header)
+	req.Host = rec.Host
+	req.ContentLength = int64(len(rec.Request.Body))
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header["User-Agent"] = nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := req.Write(buf); err != nil {
+		return nil, err
+	}
+
+	replay := &InspectorRecord{ID: id}
+	w := &discardResponseWriter{header: make(http.Header)}
+	i.Proxy(context.WithValue(ctx, inspectorReplayKey{}, replay), w, ioutil.NopCloser(buf), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  rec.Host,
+		ForwardedProto: rec.Scheme,
+		RemoteAddr:     rec.RemoteAddr,
+	})
+	if replay.ReplayOf != id {
+		return nil, fmt.Errorf("replay not recorded: %s", w.header.Get(proto.HeaderError))
+	}
+
+	return replay, nil
+}
+
+func (i *Inspector) size() int {
+	if i.Size > 0 {
+		return i.Size
+	}
+	return DefaultInspectorSize
+}
+
+func (i *Inspector) maxBodySize() int64 {
+	if i.MaxBodySize > 0 {
+		return i.MaxBodySize
+	}
+	return DefaultInspectorMaxBodySize
+}
+
+// ServeHTTP serves inspector web UI and API.
+func (i *Inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/api/requests"
+
+	switch p := r.URL.Path; {
+	case p == "/" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, inspectorPage)
+	case p == prefix && r.Method == http.MethodGet:
+		records := i.Records()
+		for j, rec := range records {
+			records[j] = i.redact(rec)
+		}
+		writeJSON(w, records)
+	case p == prefix && r.Method == http.MethodDelete:
+		i.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(p, prefix+"/"):
+		p = strings.TrimPrefix(p, prefix+"/")
+		replay := strings.HasSuffix(p, "/replay")
+		id, err := strconv.ParseUint(strings.TrimSuffix(p, "/replay"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case !replay && r.Method == http.MethodGet:
+			rec := i.Record(id)
+			if rec == nil {
+				http.Error(w, errNoRecord.Error(), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, i.redact(rec))
+		case replay && r.Method == http.MethodPost:
+			if !sameOrigin(r) {
+				http.Error(w, "cross-origin request", http.StatusForbidden)
+				return
+			}
+			if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+				http.Error(w, "expected application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			rec, err := i.Replay(r.Context(), id)
+			if err == errNoRecord {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeJSON(w, i.redact(rec))
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sameOrigin returns false if r is sent by a web page of other origin,
+// browsers set Origin header of POST requests.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// redact returns copy of rec with header values redacted.
+func (i *Inspector) redact(rec *InspectorRecord) *InspectorRecord {
+	rec2 := *rec
+	if rec.Request != nil {
+		m := *rec.Request
+		m.Header = RedactHeader(m.Header, i.RedactHeaders...)
+		rec2.Request = &m
+	}
+	if rec.Response != nil {
+		m := *rec.Response
+		m.Header = RedactHeader(m.Header, i.RedactHeaders...)
+		rec2.Response = &m
+	}
+	return &rec2
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// limitedBuffer keeps up to max bytes written to it.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	if room := b.max - int64(b.buf.Len()); int64(n) > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *limitedBuffer) bytes() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]byte(nil), b.buf.Bytes()...), b.truncated
+}
+
+// captureReadCloser copies read bytes to buffer.
+type captureReadCloser struct {
+	io.ReadCloser
+	buf *limitedBuffer
+}
+
+func (r *captureReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
+
+// captureResponseWriter records status code and copies body to buffer.
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   *limitedBuffer
+}
+
+func (w *captureResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.body.Write(p[:n])
+	return n, err
+}
+
+func (w *captureResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// discardResponseWriter is http.ResponseWriter of replayed requests.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(int) {}
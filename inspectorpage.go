@@ -0,0 +1,117 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+// inspectorPage is the Inspector web UI, it uses Inspector JSON API.
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tunnel inspector</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 0; display: flex; height: 100vh; }
+#list { width: 40%; overflow: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow: auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; white-space: nowrap; }
+tr.rec { cursor: pointer; }
+tr.rec:hover, tr.selected { background: #eef; }
+pre { background: #f6f6f6; padding: 8px; white-space: pre-wrap; word-break: break-all; }
+.bar { padding: 8px; border-bottom: 1px solid #ccc; }
+</style>
+</head>
+<body>
+<div id="list">
+<div class="bar"><button onclick="load()">Refresh</button> <button onclick="clearAll()">Clear</button></div>
+<table><thead><tr><th>Time</th><th>Method</th><th>Host</th><th>URI</th><th>Status</th><th>Duration</th></tr></thead><tbody id="records"></tbody></table>
+</div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+var selected = 0;
+
+function text(s) {
+	var d = document.createElement("div");
+	d.textContent = s;
+	return d.innerHTML;
+}
+
+function body(b) {
+	if (!b) {
+		return "";
+	}
+	try {
+		return atob(b);
+	} catch (e) {
+		return b;
+	}
+}
+
+function message(m, start) {
+	var s = start + "\n";
+	Object.keys(m.header || {}).sort().forEach(function(k) {
+		m.header[k].forEach(function(v) { s += k + ": " + v + "\n"; });
+	});
+	s += "\n" + body(m.body);
+	if (m.truncated) {
+		s += "\n[truncated]";
+	}
+	return "<pre>" + text(s) + "</pre>";
+}
+
+function show(r) {
+	selected = r.id;
+	document.getElementById("detail").innerHTML =
+		"<h3>#" + r.id + (r.replay_of ? " (replay of #" + r.replay_of + ")" : "") + "</h3>" +
+		"<button onclick=\"replay(" + r.id + ")\">Replay</button>" +
+		"<h4>Request</h4>" + message(r.request, r.request.method + " " + r.scheme + "://" + r.host + r.request.uri) +
+		"<h4>Response</h4>" + message(r.response, String(r.response.status_code));
+	load();
+}
+
+function load() {
+	fetch("api/requests").then(function(resp) { return resp.json(); }).then(function(records) {
+		var rows = "";
+		records.forEach(function(r) {
+			rows += "<tr class=\"rec" + (r.id === selected ? " selected" : "") + "\" data-id=\"" + r.id + "\">" +
+				"<td>" + text(new Date(r.time).toLocaleTimeString()) + "</td>" +
+				"<td>" + text(r.request.method) + "</td>" +
+				"<td>" + text(r.host) + "</td>" +
+				"<td>" + text(r.request.uri) + "</td>" +
+				"<td>" + r.response.status_code + "</td>" +
+				"<td>" + Math.round(r.duration / 1e6) + "ms</td></tr>";
+		});
+		var tbody = document.getElementById("records");
+		tbody.innerHTML = rows;
+		Array.prototype.forEach.call(tbody.rows, function(tr) {
+			tr.onclick = function() {
+				fetch("api/requests/" + tr.dataset.id).then(function(resp) { return resp.json(); }).then(show);
+			};
+		});
+	});
+}
+
+function replay(id) {
+	fetch("api/requests/" + id + "/replay", {method: "POST", headers: {"Content-Type": "application/json"}}).then(function(resp) {
+		if (!resp.ok) {
+			return resp.text().then(function(t) { alert(t); });
+		}
+		return resp.json().then(show);
+	});
+}
+
+function clearAll() {
+	fetch("api/requests", {method: "DELETE"}).then(function() {
+		selected = 0;
+		document.getElementById("detail").innerHTML = "<p>Select a request.</p>";
+		load();
+	});
+}
+
+load();
+setInterval(load, 2000);
+</script>
+</body>
+</html>
+`
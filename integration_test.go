@@ -5,8 +5,14 @@
 package tunnel_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,12 +21,20 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/net/http2"
+
 	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/h2tuntest"
+	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
@@ -44,6 +58,9 @@ func echoHTTP(t testing.TB, l net.Listener) {
 		if r.Header.Get("X-Forwarded-Proto") != "http" {
 			t.Fatal(r.Header)
 		}
+		if !strings.HasSuffix(r.Header.Get("Forwarded"), ";proto=http") {
+			t.Fatal(r.Header)
+		}
 
 		w.WriteHeader(http.StatusOK)
 		if r.Body != nil {
@@ -170,9 +187,8 @@ func TestIntegration(t *testing.T) {
 		httpLocalAddr, http.Addr(),
 		tcpLocalAddr, tcp.Addr(),
 	)
-	// FIXME: replace sleep with client state change watch when ready
-	time.Sleep(500 * time.Millisecond)
 	defer c.Stop()
+	waitConnected(t, c)
 
 	payload := randPayload(payloadInitialSize, payloadLen)
 	table := []struct {
@@ -204,6 +220,1561 @@ func TestIntegration(t *testing.T) {
 	wg.Wait()
 }
 
+func TestIntegrationProxyError(t *testing.T) {
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client with HTTP tunnel pointing to a closed port
+	httpProxy := tunnel.NewHTTPProxy(&url.URL{
+		Scheme: "http",
+		Host:   freeAddr().String(),
+	}, log.NewStdLogger())
+
+	c := startHTTPClient(t, s.Addr(), httpProxy.ProxyContext)
+	defer c.Stop()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("Unexpected status code", resp.StatusCode)
+	}
+	if code := resp.Header.Get(proto.HeaderTunnelErrorCode); code != proto.ErrorCodeDialFailed {
+		t.Error("Unexpected error code", code)
+	}
+}
+
+func TestIntegrationResponseHeaderTimeout(t *testing.T) {
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:                  ":0",
+		AutoSubscribe:         true,
+		TLSConfig:             tlsConfig(),
+		ResponseHeaderTimeout: 100 * time.Millisecond,
+		Logger:                log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client never responds
+	c := startHTTPClient(t, s.Addr(), func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		<-ctx.Done()
+	})
+	defer c.Stop()
+
+	start := time.Now()
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Error("Unexpected status code", resp.StatusCode)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("Response took", d)
+	}
+}
+
+func TestIntegrationClientDrain(t *testing.T) {
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client responds when released
+	release := make(chan struct{})
+	c := startHTTPClient(t, s.Addr(), func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		<-release
+		w.Write([]byte("hello"))
+	})
+	defer c.Stop()
+
+	url := fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr()))
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		inFlight <- result{string(b), err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- c.StopContext(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// tunnel is withdrawn
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Unexpected status code", resp.StatusCode)
+	}
+
+	// request in flight completes
+	close(release)
+	if r := <-inFlight; r.err != nil || r.body != "hello" {
+		t.Errorf("expected hello got %q %v", r.body, r.err)
+	}
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error("Stop failed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestIntegrationAssignedHost(t *testing.T) {
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		BaseDomain:    "example.com",
+		Logger:        log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client with empty host
+	registered := make(chan string, 1)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.HTTP: {
+				Protocol: proto.HTTP,
+			},
+		},
+		ProxyContext: tunnel.ProxyContext(tunnel.ProxyFuncsContext{
+			HTTP: func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+				w.Write([]byte("hello"))
+			},
+		}),
+		OnTunnelRegistered: func(name string, t *proto.Tunnel) {
+			registered <- t.Host
+		},
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	var host string
+	select {
+	case host = <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if !strings.HasSuffix(host, ".example.com") || len(host) == len(".example.com") {
+		t.Fatalf("unexpected host %q", host)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, h.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("expected hello got %q %v", b, err)
+	}
+}
+
+func TestIntegrationClientStatus(t *testing.T) {
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	c := startHTTPClient(t, s.Addr(), func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		r.Read(make([]byte, 512))
+		w.Write([]byte("hello"))
+	})
+	defer c.Stop()
+
+	url := fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr()))
+	resp, err := http.Post(url, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	status := c.Status()
+	if !status.Connected || status.ServerAddr != s.Addr() || status.ProtocolVersion != proto.Version {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if len(status.Tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel got %d", len(status.Tunnels))
+	}
+	ts := status.Tunnels[0]
+	if ts.Name != proto.HTTP || ts.Public != "http://localhost" {
+		t.Errorf("unexpected tunnel %+v", ts)
+	}
+	if ts.Streams != 1 || ts.ActiveStreams != 0 || ts.BytesIn == 0 || ts.BytesOut == 0 {
+		t.Errorf("unexpected counters %+v", ts)
+	}
+
+	stats := c.Stats()
+	if !stats.Connected || stats.Connects != 1 || stats.Reconnects != 0 || stats.LastError != "" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	tc := stats.Tunnels[proto.HTTP]
+	if tc == nil || tc.Streams != ts.Streams || tc.BytesIn != ts.BytesIn || tc.BytesOut != ts.BytesOut {
+		t.Errorf("unexpected tunnel stats %+v", tc)
+	}
+
+	var v tunnel.ClientStats
+	if err := json.Unmarshal([]byte(c.Var().String()), &v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&v, stats) {
+		t.Errorf("expected var %+v got %+v", stats, v)
+	}
+}
+
+func TestIntegrationSetTunnels(t *testing.T) {
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client, requests to /slow are blocked until release is closed
+	registered := make(chan string, 10)
+	slow := make(chan struct{})
+	release := make(chan struct{})
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"a": {
+				Protocol: proto.HTTP,
+				Host:     "a.localhost",
+			},
+		},
+		ProxyContext: tunnel.ProxyContext(tunnel.ProxyFuncsContext{
+			HTTP: func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+				req, err := http.ReadRequest(bufio.NewReader(r))
+				if err != nil {
+					return
+				}
+				if req.URL.Path == "/slow" {
+					close(slow)
+					<-release
+				}
+				w.Write([]byte("hello " + msg.ForwardedHost))
+			},
+		}),
+		OnTunnelRegistered: func(name string, t *proto.Tunnel) {
+			registered <- name
+		},
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Start()
+	}()
+	defer c.Stop()
+
+	wait := func(name string) {
+		t.Helper()
+		select {
+		case n := <-registered:
+			if n != name {
+				t.Fatalf("expected %s registered got %s", name, n)
+			}
+		case err := <-errc:
+			t.Fatalf("client stopped: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	get := func(host, path string) string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, h.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.Status
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	wait("a")
+	if b := get("a.localhost", "/"); b != "hello a.localhost" {
+		t.Errorf("unexpected response %q", b)
+	}
+
+	// request in flight on replaced connection is not aborted
+	slowc := make(chan string, 1)
+	go func() {
+		slowc <- get("a.localhost", "/slow")
+	}()
+	<-slow
+
+	// replace tunnels twice, reconnects are not disconnect hiccups
+	for _, name := range []string{"b", "c"} {
+		c.SetTunnels(map[string]*proto.Tunnel{
+			name: {
+				Protocol: proto.HTTP,
+				Host:     name + ".localhost",
+			},
+		})
+		wait(name)
+	}
+	if b := get("c.localhost", "/"); b != "hello c.localhost" {
+		t.Errorf("unexpected response %q", b)
+	}
+	if b := get("a.localhost", "/"); strings.HasPrefix(b, "hello") {
+		t.Errorf("removed tunnel responded %q", b)
+	}
+	close(release)
+	if b := <-slowc; b != "hello a.localhost" {
+		t.Errorf("unexpected response %q", b)
+	}
+	if status := c.Status(); len(status.Tunnels) != 1 || status.Tunnels[0].Name != "c" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if stats := c.Stats(); stats.Reconnects != 2 || len(stats.Tunnels) != 1 || stats.Tunnels["c"] == nil {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// no tunnels, client waits disconnected
+	c.SetTunnels(nil)
+	time.Sleep(500 * time.Millisecond)
+	if status := c.Status(); status.Connected {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if b := get("c.localhost", "/"); strings.HasPrefix(b, "hello") {
+		t.Errorf("removed tunnel responded %q", b)
+	}
+
+	c.SetTunnels(map[string]*proto.Tunnel{
+		"a": {
+			Protocol: proto.HTTP,
+			Host:     "a.localhost",
+		},
+	})
+	wait("a")
+	if b := get("a.localhost", "/"); b != "hello a.localhost" {
+		t.Errorf("unexpected response %q", b)
+	}
+}
+
+func TestIntegrationModifyResponse(t *testing.T) {
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		ModifyRequest: func(r *http.Request) error {
+			r.Header.Set("Foo", "bar")
+			return nil
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Set("Modified", "true")
+			return nil
+		},
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	echo := h2tuntest.NewEchoHTTPProxyFunc(&h2tuntest.EchoHTTPConfig{
+		EchoHeaders: true,
+	})
+	c := startHTTPClient(t, s.Addr(), tunnel.ProxyFuncWithContext(echo))
+	defer c.Stop()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Unexpected status code", resp.StatusCode)
+	}
+	if resp.Header.Get(h2tuntest.EchoHeaderPrefix+"Foo") != "bar" {
+		t.Error("Request not modified", resp.Header)
+	}
+	if resp.Header.Get("Modified") != "true" {
+		t.Error("Response not modified", resp.Header)
+	}
+}
+
+func TestIntegrationStreaming(t *testing.T) {
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// local service sending events one by one
+	next := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+	}))
+	defer local.Close()
+
+	// client
+	u, _ := url.Parse(local.URL)
+	httpProxy := tunnel.NewHTTPProxy(u, log.NewStdLogger())
+	c := startHTTPClient(t, s.Addr(), httpProxy.ProxyContext)
+	defer c.Stop()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		n, err := io.ReadAtLeast(resp.Body, buf, len("data: 0\n\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("data: %d\n\n", i); string(buf[:n]) != expected {
+			t.Fatalf("expected %q got %q", expected, buf[:n])
+		}
+		select {
+		case next <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("local service not waiting")
+		}
+	}
+}
+
+func TestIntegrationFileServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := randBytes(256 * 1024)
+	if err := ioutil.WriteFile(filepath.Join(dir, "data.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	c := startHTTPClient(t, s.Addr(), tunnel.ProxyFuncWithContext(h2tuntest.StreamingFileServer(dir)))
+	defer c.Stop()
+
+	u := fmt.Sprintf("http://localhost:%s/data.bin", port(h.Listener.Addr()))
+	get := func(header http.Header) (*http.Response, []byte) {
+		r, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header = header
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, b
+	}
+
+	// interrupted download
+	resp, b := get(http.Header{"Range": {"bytes=0-1023"}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatal("expected status 206 got", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatal("missing validators", resp.Header)
+	}
+
+	// resumed download
+	resp, rest := get(http.Header{"Range": {"bytes=1024-"}, "If-Range": {etag}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatal("expected status 206 got", resp.StatusCode)
+	}
+	if !bytes.Equal(append(b, rest...), content) {
+		t.Error("resumed download content mismatch")
+	}
+
+	// cached copy
+	resp, _ = get(http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Error("expected status 304 got", resp.StatusCode)
+	}
+	resp, _ = get(http.Header{"If-Modified-Since": {lastModified}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Error("expected status 304 got", resp.StatusCode)
+	}
+}
+
+func TestIntegrationMaxRequestBodySize(t *testing.T) {
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:               ":0",
+		AutoSubscribe:      true,
+		TLSConfig:          tlsConfig(),
+		MaxRequestBodySize: 1024,
+		Logger:             log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	c := startHTTPClient(t, s.Addr(), tunnel.ProxyFuncWithContext(h2tuntest.EchoHTTPProxyFunc))
+	defer c.Stop()
+
+	tests := []struct {
+		size    int
+		chunked bool
+		status  int
+	}{
+		{1024, false, http.StatusOK},
+		{1025, false, http.StatusRequestEntityTooLarge},
+		{1024, true, http.StatusOK},
+		{64 * 1024, true, http.StatusRequestEntityTooLarge},
+	}
+
+	for i, tt := range tests {
+		var body io.Reader = bytes.NewReader(make([]byte, tt.size))
+		if tt.chunked {
+			body = ioutil.NopCloser(body)
+		}
+		r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr())), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("[%d] expected status %d got %d", i, tt.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestIntegrationMaxRequestBodySizeStreaming(t *testing.T) {
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:               ":0",
+		AutoSubscribe:      true,
+		TLSConfig:          tlsConfig(),
+		MaxRequestBodySize: 1024,
+		Logger:             log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+
+	// HTTP/2 so that request body is read after response is sent
+	h := httptest.NewUnstartedServer(s)
+	h.TLS = &tls.Config{NextProtos: []string{http2.NextProtoTLS}}
+	if err := http2.ConfigureServer(h.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	h.StartTLS()
+	defer h.Close()
+
+	// client, backend responds before reading the request body
+	c := startHTTPClient(t, s.Addr(), func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		w.Write([]byte("start"))
+		w.(http.Flusher).Flush()
+		io.Copy(ioutil.Discard, r)
+		w.Write([]byte("end"))
+	})
+	defer c.Stop()
+
+	// body exceeds the limit after response headers are received
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	headers := make(chan struct{})
+	go func() {
+		pw.Write(make([]byte, 512))
+		<-headers
+		pw.Write(make([]byte, 2048))
+		pw.Close()
+	}()
+
+	r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://localhost:%s/", port(h.Listener.Addr())), pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Do(r)
+	close(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, resp.StatusCode)
+	}
+	if b, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Errorf("expected aborted response got %q", b)
+	}
+}
+
+func TestIntegrationAudit(t *testing.T) {
+	deny := func(identifier id.ID, t *proto.Tunnel) error {
+		return errors.New("denied")
+	}
+
+	tests := []struct {
+		autoSubscribe bool
+		policy        func(id.ID, *proto.Tunnel) error
+		accepted      bool
+		reason        string
+	}{
+		{true, nil, true, ""},
+		{false, nil, false, "unknown client"},
+		{true, deny, false, "handshake failed: tunnel http not allowed: denied"},
+	}
+
+	for i, tt := range tests {
+		records := make(chan *tunnel.AuditRecord, 1)
+		s, err := tunnel.NewServer(&tunnel.ServerConfig{
+			Addr:          ":0",
+			AutoSubscribe: tt.autoSubscribe,
+			TLSConfig:     tlsConfig(),
+			TunnelPolicy:  tt.policy,
+			AuditSink: tunnel.AuditSinkFunc(func(r *tunnel.AuditRecord) {
+				records <- r
+			}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Start()
+
+		c := newHTTPClient(t, s.Addr(), tunnel.ProxyFuncWithContext(h2tuntest.EchoHTTPProxyFunc))
+		go c.Start()
+
+		var r *tunnel.AuditRecord
+		select {
+		case r = <-records:
+		case <-time.After(time.Second):
+			t.Fatalf("[%d] no audit record", i)
+		}
+		c.Stop()
+		s.Stop()
+
+		if r.Accepted != tt.accepted {
+			t.Errorf("[%d] expected accepted %v got %v", i, tt.accepted, r.Accepted)
+		}
+		if r.Reason != tt.reason {
+			t.Errorf("[%d] expected reason %q got %q", i, tt.reason, r.Reason)
+		}
+		if r.Fingerprint == "" || r.RemoteAddr == "" {
+			t.Errorf("[%d] missing fields %+v", i, r)
+		}
+		if tt.accepted && (len(r.Hosts) != 1 || r.Hosts[0] != "localhost") {
+			t.Errorf("[%d] unexpected hosts %v", i, r.Hosts)
+		}
+	}
+}
+
+func TestIntegrationClients(t *testing.T) {
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	if clients := s.Clients(); len(clients) != 0 {
+		t.Fatalf("expected no clients got %v", clients)
+	}
+
+	// client
+	c := startHTTPClient(t, s.Addr(), tunnel.ProxyFuncWithContext(h2tuntest.EchoHTTPProxyFunc))
+	defer c.Stop()
+
+	payload := randBytes(1024)
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr())), "application/octet-stream", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	clients := s.Clients()
+	if len(clients) != 1 {
+		t.Fatalf("expected 1 client got %d", len(clients))
+	}
+	ci := clients[0]
+	if ci.RemoteAddr == "" || ci.ConnectedAt.IsZero() || ci.ProtocolVersion != proto.Version {
+		t.Errorf("missing fields %+v", ci)
+	}
+	if len(ci.Tunnels) != 1 || ci.Tunnels[0] != "http://localhost" {
+		t.Errorf("unexpected tunnels %v", ci.Tunnels)
+	}
+	if ci.BytesIn < int64(len(payload)) || ci.BytesOut < int64(len(payload)) {
+		t.Errorf("expected at least %d bytes each way got in %d out %d", len(payload), ci.BytesIn, ci.BytesOut)
+	}
+
+	stats := s.TunnelStats()
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 tunnel got %d", len(stats))
+	}
+	ts := stats[0]
+	if ts.Tunnel != "http://localhost" || ts.Identifier != ci.Identifier {
+		t.Errorf("unexpected tunnel %+v", ts)
+	}
+	if ts.Requests != 1 || ts.Errors != 0 || ts.Latency.Count != 1 {
+		t.Errorf("unexpected counters %+v", ts)
+	}
+	if ts.BytesIn < int64(len(payload)) || ts.BytesOut != int64(len(payload)) {
+		t.Errorf("expected at least %d bytes each way got in %d out %d", len(payload), ts.BytesIn, ts.BytesOut)
+	}
+}
+
+func TestIntegrationMultipleClients(t *testing.T) {
+	ca, err := h2tuntest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := ca.NewServerCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:      ":0",
+		TLSConfig: h2tuntest.ServerTLSConfig(serverCert),
+		Logger:    log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// clients, the last one is not subscribed
+	hosts := []string{"a.localhost", "b.localhost", "c.localhost"}
+	ids := make(map[id.ID]string)
+	for i, host := range hosts {
+		kp, err := h2tuntest.NewSelfSignedClientCert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(hosts)-1 {
+			s.Subscribe(kp.ID())
+			ids[kp.ID()] = "http://" + host
+		}
+
+		tlsConf := h2tuntest.ClientTLSConfig(kp, ca.CertPool())
+		tlsConf.ServerName = "localhost"
+
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: tlsConf,
+			Tunnels: map[string]*proto.Tunnel{
+				proto.HTTP: {
+					Protocol: proto.HTTP,
+					Host:     host,
+				},
+			},
+			ProxyContext: tunnel.ProxyContext(tunnel.ProxyFuncsContext{
+				HTTP: tunnel.ProxyFuncWithContext(h2tuntest.EchoHTTPProxyFunc),
+			}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.Start()
+		defer c.Stop()
+		if i < len(hosts)-1 {
+			waitConnected(t, c)
+		}
+	}
+
+	for i, host := range hosts {
+		payload := randBytes(1024)
+		req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if i < len(hosts)-1 {
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(b, payload) {
+				t.Errorf("[%d] unexpected response %s", i, resp.Status)
+			}
+		} else if resp.StatusCode == http.StatusOK {
+			t.Errorf("[%d] unsubscribed client served request", i)
+		}
+	}
+
+	clients := s.Clients()
+	if len(clients) != len(ids) {
+		t.Fatalf("expected %d clients got %d", len(ids), len(clients))
+	}
+	for _, ci := range clients {
+		if len(ci.Tunnels) != 1 || ci.Tunnels[0] != ids[ci.Identifier] {
+			t.Errorf("unexpected tunnels %v for %s", ci.Tunnels, ci.Identifier)
+		}
+	}
+}
+
+func TestIntegrationClientCAs(t *testing.T) {
+	ca, err := h2tuntest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := ca.NewServerCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type client struct {
+		signed bool
+		listed bool
+	}
+	clients := []client{{true, true}, {true, false}, {false, true}, {false, false}}
+
+	tests := []struct {
+		requireVerified   bool
+		subscribeVerified bool
+		connected         []bool
+	}{
+		// only listed clients with certificates signed by CA
+		{true, false, []bool{true, false, false, false}},
+		// listed clients and any client with certificate signed by CA
+		{false, true, []bool{true, true, true, false}},
+	}
+
+	for i, tt := range tests {
+		s, err := tunnel.NewServer(&tunnel.ServerConfig{
+			Addr:                      ":0",
+			TLSConfig:                 h2tuntest.ServerTLSConfig(serverCert),
+			ClientCAs:                 ca.CertPool(),
+			RequireVerifiedClientCert: tt.requireVerified,
+			SubscribeVerifiedClients:  tt.subscribeVerified,
+			Logger:                    log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Start()
+
+		var (
+			ids []id.ID
+			cs  []*tunnel.Client
+		)
+		for j, cl := range clients {
+			var kp *h2tuntest.KeyPair
+			if cl.signed {
+				kp, err = ca.NewClientCert(pkix.Name{CommonName: "client"})
+			} else {
+				kp, err = h2tuntest.NewSelfSignedClientCert()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, kp.ID())
+			if cl.listed {
+				s.Subscribe(kp.ID())
+			}
+
+			tlsConf := h2tuntest.ClientTLSConfig(kp, ca.CertPool())
+			tlsConf.ServerName = "localhost"
+			c, err := tunnel.NewClient(&tunnel.ClientConfig{
+				ServerAddr:      s.Addr(),
+				TLSClientConfig: tlsConf,
+				Tunnels: map[string]*proto.Tunnel{
+					proto.HTTP: {
+						Protocol: proto.HTTP,
+						Host:     fmt.Sprintf("c%d.localhost", j),
+					},
+				},
+				Proxy:  tunnel.Proxy(tunnel.ProxyFuncs{}),
+				Logger: log.NewStdLogger(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			go c.Start()
+			cs = append(cs, c)
+		}
+		for j, c := range cs {
+			if tt.connected[j] {
+				waitConnected(t, c)
+			}
+		}
+
+		connected := make(map[id.ID]bool)
+		for _, ci := range s.Clients() {
+			connected[ci.Identifier] = true
+		}
+		for j := range clients {
+			if connected[ids[j]] != tt.connected[j] {
+				t.Errorf("[%d] client %+v expected connected %t", i, clients[j], tt.connected[j])
+			}
+		}
+		for _, c := range cs {
+			c.Stop()
+		}
+		s.Stop()
+	}
+}
+
+func TestIntegrationCertificateHosts(t *testing.T) {
+	ca, err := h2tuntest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := ca.NewServerCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:                     ":0",
+		TLSConfig:                h2tuntest.ServerTLSConfig(serverCert),
+		ClientCAs:                ca.CertPool(),
+		SubscribeVerifiedClients: true,
+		CertificateHosts:         true,
+		Logger:                   log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"app.team.localhost", true},
+		{"other.localhost", false},
+	}
+
+	for i, tt := range tests {
+		kp, err := ca.NewClientCert(pkix.Name{
+			CommonName:         "client",
+			OrganizationalUnit: []string{"*.team.localhost"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConf := h2tuntest.ClientTLSConfig(kp, ca.CertPool())
+		tlsConf.ServerName = "localhost"
+
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: tlsConf,
+			Tunnels: map[string]*proto.Tunnel{
+				proto.HTTP: {
+					Protocol: proto.HTTP,
+					Host:     tt.host,
+				},
+			},
+			Proxy:  tunnel.Proxy(tunnel.ProxyFuncs{}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.Start()
+		if tt.ok {
+			waitConnected(t, c)
+		} else {
+			waitStatus(t, c, func(status *tunnel.ClientStatus) bool {
+				return status.LastError != ""
+			})
+		}
+
+		ok := false
+		for _, ci := range s.Clients() {
+			ok = ok || ci.Identifier == kp.ID()
+		}
+		if ok != tt.ok {
+			t.Errorf("[%d] expected connected %t", i, tt.ok)
+		}
+		c.Stop()
+	}
+}
+
+func TestIntegrationListenerLimit(t *testing.T) {
+	// local service closing connections on EOF so that streams end
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		ListenerLimit: &tunnel.ListenerLimit{MaxConns: 5},
+		Logger:        log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+
+	// client, tunnel lowers server limit
+	tcpLocalAddr := freeAddr()
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.TCP: {
+				Protocol: proto.TCP,
+				Addr:     tcpLocalAddr.String(),
+				MaxConns: 1,
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			TCP: tunnel.NewMultiTCPProxy(map[string]string{
+				port(tcpLocalAddr): tcp.Addr().String(),
+			}, log.NewStdLogger()).Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+	waitConnected(t, c)
+
+	conn, err := net.Dial("tcp", tcpLocalAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+	if err := testEcho(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// over the limit
+	rejected, err := net.Dial("tcp", tcpLocalAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testEcho(rejected); err == nil {
+		t.Error("expected connection to be closed")
+	}
+	rejected.Close()
+
+	// slot is released on close
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn, err = net.Dial("tcp", tcpLocalAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := testEcho(conn); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIntegrationWebSocket(t *testing.T) {
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		WebSocket:     true,
+		Logger:        log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+	hs := httptest.NewUnstartedServer(s)
+	hs.TLS = &tls.Config{Certificates: tlsConfig().Certificates}
+	hs.StartTLS()
+	defer hs.Close()
+
+	// client
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      hs.Listener.Addr().String(),
+		TLSClientConfig: tlsConfig(),
+		Transport:       tunnel.TransportWebSocket,
+		Tunnels: map[string]*proto.Tunnel{
+			proto.HTTP: {
+				Protocol: proto.HTTP,
+				Host:     "localhost",
+			},
+		},
+		ProxyContext: tunnel.ProxyContext(tunnel.ProxyFuncsContext{
+			HTTP: tunnel.ProxyFuncWithContext(h2tuntest.EchoHTTPProxyFunc),
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+	waitConnected(t, c)
+
+	payload := randBytes(100 * 1024)
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%s/", port(h.Listener.Addr())), "application/octet-stream", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(b, payload) {
+		t.Errorf("unexpected response status %d body length %d", resp.StatusCode, len(b))
+	}
+}
+
+func TestIntegrationTCPHalfClose(t *testing.T) {
+	// local service writes, closes write side and reads until EOF
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		conn.(*net.TCPConn).CloseWrite()
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	// client
+	remoteAddr := freeAddr()
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.TCP: {
+				Protocol: proto.TCP,
+				Addr:     remoteAddr.String(),
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			TCP: tunnel.NewMultiTCPProxy(map[string]string{
+				port(remoteAddr): local.Addr().String(),
+			}, log.NewStdLogger()).Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+	waitConnected(t, c)
+
+	conn, err := net.Dial("tcp", remoteAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b, err := ioutil.ReadAll(conn)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("expected hello got %q %v", b, err)
+	}
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	select {
+	case r := <-received:
+		if r != "bye" {
+			t.Errorf("expected bye got %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestIntegrationConnect(t *testing.T) {
+	// local service
+	_, tcp := makeEcho(t)
+	defer tcp.Close()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	// client
+	target := "127.0.0.1:" + port(tcp.Addr())
+	remoteAddr := freeAddr()
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.CONNECT: {
+				Protocol: proto.CONNECT,
+				Addr:     remoteAddr.String(),
+				Auth:     "user:password",
+			},
+		},
+		ProxyContext: tunnel.ProxyContext(tunnel.ProxyFuncsContext{
+			Connect: tunnel.NewConnectProxy([]string{target}, log.NewStdLogger()).ProxyContext,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+	waitConnected(t, c)
+
+	connect := func(target, auth string) (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", remoteAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+		if auth != "" {
+			fmt.Fprintf(conn, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
+		fmt.Fprint(conn, "\r\n")
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if br.Buffered() != 0 {
+			t.Fatal("unexpected data after response")
+		}
+		return conn, resp
+	}
+
+	tests := []struct {
+		target string
+		auth   string
+		code   int
+	}{
+		{target, "user:password", http.StatusOK},
+		{target, "", http.StatusProxyAuthRequired},
+		{target, "user:bad", http.StatusProxyAuthRequired},
+		{"127.0.0.1:1", "user:password", http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		conn, resp := connect(tt.target, tt.auth)
+		if resp.StatusCode != tt.code {
+			t.Errorf("[%d] expected status %d got %d", i, tt.code, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK {
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+				t.Errorf("[%d] expected hello got %q %v", i, b, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestIntegrationBackpressure(t *testing.T) {
+	const size = 64 << 20
+
+	// local service writes as fast as it can
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	var written int64
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 32<<10)
+		for atomic.LoadInt64(&written) < size {
+			n, err := conn.Write(b)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	// client
+	remoteAddr := freeAddr()
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.TCP: {
+				Protocol: proto.TCP,
+				Addr:     remoteAddr.String(),
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			TCP: tunnel.NewMultiTCPProxy(map[string]string{
+				port(remoteAddr): local.Addr().String(),
+			}, log.NewStdLogger()).Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+	waitConnected(t, c)
+
+	conn, err := net.Dial("tcp", remoteAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// slow reader blocks local service once buffers are full
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt64(&written); n == 0 || n > size/2 {
+		t.Fatalf("expected local service to be blocked got %d bytes written", n)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	n, err := io.CopyN(ioutil.Discard, conn, size)
+	if err != nil {
+		t.Fatalf("expected %d bytes got %d %s", size, n, err)
+	}
+}
+
+// startHTTPClient starts client with a single HTTP tunnel for host localhost
+// and waits until it's connected.
+func startHTTPClient(t testing.TB, serverAddr string, proxy tunnel.ProxyFuncContext) *tunnel.Client {
+	t.Helper()
+
+	c := newHTTPClient(t, serverAddr, proxy)
+	go c.Start()
+	waitConnected(t, c)
+
+	return c
+}
+
+// newHTTPClient returns client with a single HTTP tunnel for host localhost.
+func newHTTPClient(t testing.TB, serverAddr string, proxy tunnel.ProxyFuncContext) *tunnel.Client {
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      serverAddr,
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.HTTP: {
+				Protocol: proto.HTTP,
+				Host:     "localhost",
+			},
+		},
+		ProxyContext: tunnel.ProxyContext(tunnel.ProxyFuncsContext{
+			HTTP: proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// waitStatus polls client status until ok returns true.
+func waitStatus(t testing.TB, c *tunnel.Client, ok func(status *tunnel.ClientStatus) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok(c.Status()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for client status %+v", c.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitConnected waits until client is connected and its tunnels are
+// registered.
+func waitConnected(t testing.TB, c *tunnel.Client) {
+	t.Helper()
+
+	waitStatus(t, c, func(status *tunnel.ClientStatus) bool {
+		if !status.Connected {
+			return false
+		}
+		for _, ts := range status.Tunnels {
+			if ts.Public == "" {
+				return false
+			}
+		}
+		return true
+	})
+}
+
 func testHTTP(t testing.TB, addr net.Addr, payload []byte, repeat uint) {
 	url := fmt.Sprintf("http://localhost:%s/some/path", port(addr))
 
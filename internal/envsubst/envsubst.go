@@ -0,0 +1,177 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// Package envsubst expands references to environment variables in
+// configuration files of tunnel and tunneld.
+package envsubst
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	envVarPattern      = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+	placeholderPattern = regexp.MustCompile(`__envsubst_([0-9]+)__`)
+)
+
+// Expand replaces ${VAR} and ${VAR:-default} in string values of YAML
+// configuration with values of environment variables, default is used if
+// variable is unset or empty. $${VAR} results in literal ${VAR}. Values are
+// expanded after configuration is parsed so they are never interpreted as
+// YAML, except that a value consisting of a single reference may be a
+// number or boolean. Keys and comments are left intact. It's an error if
+// variable without default is not set. Configuration that is not valid YAML
+// is returned as is for the caller to report the parse error.
+func Expand(buf []byte) ([]byte, error) {
+	doc, refs, err := parse(buf)
+	if err != nil {
+		return buf, nil
+	}
+
+	walk(doc, "", refs, func(path, s string) interface{} {
+		v, e := expand(s, refs)
+		if e != nil && err == nil {
+			err = fmt.Errorf("%s: %s", path, e)
+		}
+		return v
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(doc)
+}
+
+// parse parses configuration with references replaced by placeholders, so
+// that they are valid in any YAML context, and returns the references by
+// placeholder number.
+func parse(buf []byte) (yaml.MapSlice, []string, error) {
+	var refs []string
+	buf = envVarPattern.ReplaceAllFunc(buf, func(m []byte) []byte {
+		refs = append(refs, string(m))
+		return []byte(fmt.Sprintf("__envsubst_%d__", len(refs)-1))
+	})
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return nil, nil, err
+	}
+	return doc, refs, nil
+}
+
+// ref returns reference of placeholder m.
+func ref(m string, refs []string) string {
+	i, err := strconv.Atoi(placeholderPattern.FindStringSubmatch(m)[1])
+	if err != nil || i >= len(refs) {
+		return m
+	}
+	return refs[i]
+}
+
+// restore replaces placeholders in s with the references.
+func restore(s string, refs []string) string {
+	return placeholderPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return ref(m, refs)
+	})
+}
+
+// expand expands references in s, if s is a single reference and the value
+// is a YAML number or boolean the typed value is returned.
+func expand(s string, refs []string) (interface{}, error) {
+	var err error
+
+	v := placeholderPattern.ReplaceAllStringFunc(s, func(m string) string {
+		r := ref(m, refs)
+		sub := envVarPattern.FindStringSubmatch(r)
+		if sub == nil {
+			return r
+		}
+		if r[1] == '$' {
+			return r[1:]
+		}
+
+		name := sub[1]
+		v, ok := os.LookupEnv(name)
+		if v == "" && sub[2] != "" {
+			return sub[3]
+		}
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if m := placeholderPattern.FindStringIndex(s); m != nil && m[0] == 0 && m[1] == len(s) && ref(s, refs)[1] != '$' {
+		var typed interface{}
+		if yaml.Unmarshal([]byte(v), &typed) == nil {
+			switch typed.(type) {
+			case int, int64, uint64, float64, bool:
+				return typed, nil
+			}
+		}
+	}
+
+	return v, nil
+}
+
+// Values returns values of environment variables referenced in string values
+// of configuration, defaults and empty values are omitted.
+func Values(buf []byte) []string {
+	doc, refs, err := parse(buf)
+	if err != nil {
+		return nil
+	}
+
+	var values []string
+	walk(doc, "", refs, func(path, s string) interface{} {
+		for _, m := range placeholderPattern.FindAllString(s, -1) {
+			sub := envVarPattern.FindStringSubmatch(ref(m, refs))
+			if sub == nil || sub[0][1] == '$' {
+				continue
+			}
+			if v := os.Getenv(sub[1]); v != "" {
+				values = append(values, v)
+			}
+		}
+		return s
+	})
+
+	return values
+}
+
+// walk replaces string values in v with results of f called with the value
+// and its path i.e. tunnels.webui.auth, placeholders in keys are restored.
+func walk(v interface{}, path string, refs []string, f func(path, s string) interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			if k, ok := v[i].Key.(string); ok {
+				v[i].Key = restore(k, refs)
+			}
+			v[i].Value = walk(v[i].Value, join(path, v[i].Key), refs, f)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = walk(v[i], fmt.Sprintf("%s[%d]", path, i), refs, f)
+		}
+	case string:
+		return f(path, v)
+	}
+	return v
+}
+
+func join(path string, key interface{}) string {
+	if path == "" {
+		return fmt.Sprint(key)
+	}
+	return fmt.Sprint(path, ".", key)
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package envsubst
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExpand(t *testing.T) {
+	os.Setenv("TUNNEL_TEST_SET", "value")
+	os.Setenv("TUNNEL_TEST_EMPTY", "")
+	os.Setenv("TUNNEL_TEST_COMMENT", "abc #x")
+	os.Setenv("TUNNEL_TEST_COLON", "a: b")
+	os.Setenv("TUNNEL_TEST_NEWLINE", "a\nhost: evil")
+	os.Setenv("TUNNEL_TEST_ALIAS", "*alias")
+	os.Setenv("TUNNEL_TEST_NUMBER", "10")
+	defer os.Unsetenv("TUNNEL_TEST_SET")
+	defer os.Unsetenv("TUNNEL_TEST_EMPTY")
+	defer os.Unsetenv("TUNNEL_TEST_COMMENT")
+	defer os.Unsetenv("TUNNEL_TEST_COLON")
+	defer os.Unsetenv("TUNNEL_TEST_NEWLINE")
+	defer os.Unsetenv("TUNNEL_TEST_ALIAS")
+	defer os.Unsetenv("TUNNEL_TEST_NUMBER")
+
+	tests := []struct {
+		config   string
+		expected interface{}
+		error    string
+	}{
+		{
+			config:   "auth: user:${TUNNEL_TEST_SET}",
+			expected: "user:value",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_SET:-default}",
+			expected: "value",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_EMPTY:-default}",
+			expected: "default",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_UNSET:-}",
+			expected: "",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_EMPTY}",
+			expected: "",
+		},
+		{
+			config:   "auth: user:pa$$word$TUNNEL_TEST_SET",
+			expected: "user:pa$$word$TUNNEL_TEST_SET",
+		},
+		{
+			config:   "auth: $${TUNNEL_TEST_SET}",
+			expected: "${TUNNEL_TEST_SET}",
+		},
+		{
+			config:   "# auth: ${TUNNEL_TEST_UNSET}\nauth: ${TUNNEL_TEST_SET}\n",
+			expected: "value",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_COMMENT}",
+			expected: "abc #x",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_COLON}",
+			expected: "a: b",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_NEWLINE}",
+			expected: "a\nhost: evil",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_ALIAS}",
+			expected: "*alias",
+		},
+		{
+			config:   "auth: ${TUNNEL_TEST_NUMBER}",
+			expected: 10,
+		},
+		{
+			config:   "auth: \"${TUNNEL_TEST_NUMBER}s\"",
+			expected: "10s",
+		},
+		{
+			config:   "auth: [${TUNNEL_TEST_SET}, __envsubst_9__]",
+			expected: []interface{}{"value", "__envsubst_9__"},
+		},
+		{
+			config: "host: a\ntunnels:\n  webui:\n    auth: ${TUNNEL_TEST_UNSET}",
+			error:  "tunnels.webui.auth: environment variable TUNNEL_TEST_UNSET is not set",
+		},
+	}
+
+	for i, tt := range tests {
+		b, err := Expand([]byte(tt.config))
+		if tt.error != "" {
+			if err == nil || err.Error() != tt.error {
+				t.Errorf("[%d] expected error %q got %v", i, tt.error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] unexpected error %s", i, err)
+			continue
+		}
+		var config map[string]interface{}
+		if err := yaml.Unmarshal(b, &config); err != nil {
+			t.Errorf("[%d] invalid result %s", i, err)
+			continue
+		}
+		if len(config) != 1 || !reflect.DeepEqual(config["auth"], tt.expected) {
+			t.Errorf("[%d] expected auth %q got %q", i, tt.expected, config)
+		}
+	}
+
+	// invalid configuration is left for the caller to report
+	if b, err := Expand([]byte("auth: [")); err != nil || string(b) != "auth: [" {
+		t.Errorf("unexpected result %q %v", b, err)
+	}
+}
+
+func TestValues(t *testing.T) {
+	os.Setenv("TUNNEL_TEST_VALUES", "value")
+	defer os.Unsetenv("TUNNEL_TEST_VALUES")
+
+	config := "# ${TUNNEL_TEST_VALUES}\nauth: ${TUNNEL_TEST_VALUES}\nhost: $${TUNNEL_TEST_VALUES}\naddr: ${TUNNEL_TEST_UNSET:-default}\ntunnels:\n  a:\n    hosts: [a, \"$${TUNNEL_TEST_VALUES}\"]\n"
+	if v := Values([]byte(config)); len(v) != 1 || v[0] != "value" {
+		t.Errorf("unexpected values %q", v)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// Histogram bucket upper bounds.
+var (
+	// LatencyBounds are bounds of latency histogram in seconds.
+	LatencyBounds = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	// ThroughputBounds are bounds of throughput histogram in bytes per
+	// second.
+	ThroughputBounds = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+)
+
+// TunnelStats describes traffic of a tunnel.
+type TunnelStats struct {
+	// Tunnel is the tunnel in form of protocol://host or protocol://addr.
+	Tunnel string `json:"tunnel"`
+	// Identifier is the identifier of client serving the tunnel.
+	Identifier id.ID `json:"id"`
+	// Requests is the number of proxied HTTP requests or TCP connections.
+	Requests int64 `json:"requests"`
+	// Errors is the number of requests or connections that failed.
+	Errors int64 `json:"errors"`
+	// BytesIn is the number of bytes sent from users to the client.
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the number of bytes sent from the client to users.
+	BytesOut int64 `json:"bytes_out"`
+	// Latency is distribution of time in seconds until the client responds
+	// with HTTP response headers or connects to local TCP service.
+	Latency *Histogram `json:"latency"`
+	// Throughput is distribution of transfer rates of HTTP responses and
+	// TCP connections in bytes per second.
+	Throughput *Histogram `json:"throughput"`
+}
+
+// Histogram is a snapshot of distribution of observed values.
+type Histogram struct {
+	// Bounds are inclusive upper bounds of buckets.
+	Bounds []float64 `json:"bounds"`
+	// Counts are numbers of values in buckets, the last element counts
+	// values greater than all bounds.
+	Counts []int64 `json:"counts"`
+	// Count is the number of observed values.
+	Count int64 `json:"count"`
+	// Sum is the sum of observed values.
+	Sum float64 `json:"sum"`
+	// P50, P90 and P99 are estimated percentiles.
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// Quantile estimates q-quantile of observed values assuming uniform
+// distribution within a bucket, values greater than all bounds are
+// reported as the last bound.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+
+	rank := q * float64(h.Count)
+	var cum float64
+	for i, c := range h.Counts {
+		if c == 0 || cum+float64(c) < rank {
+			cum += float64(c)
+			continue
+		}
+		if i == len(h.Bounds) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		}
+		return lower + (h.Bounds[i]-lower)*(rank-cum)/float64(c)
+	}
+
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+type histogram struct {
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) snapshot() *Histogram {
+	s := &Histogram{
+		Bounds: h.bounds,
+		Counts: append([]int64(nil), h.counts...),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+	s.P50 = s.Quantile(0.5)
+	s.P90 = s.Quantile(0.9)
+	s.P99 = s.Quantile(0.99)
+	return s
+}
+
+// tunnelStats holds traffic counters and histograms of a tunnel, methods
+// are safe to call on nil.
+type tunnelStats struct {
+	identifier id.ID
+	requests   int64
+	errors     int64
+	bytesIn    int64
+	bytesOut   int64
+	latency    *histogram
+	throughput *histogram
+	mu         sync.Mutex
+}
+
+func newTunnelStats(identifier id.ID) *tunnelStats {
+	return &tunnelStats{
+		identifier: identifier,
+		latency:    newHistogram(LatencyBounds),
+		throughput: newHistogram(ThroughputBounds),
+	}
+}
+
+// observe records dispatched request or connection, latency is recorded only
+// if err is nil.
+func (t *tunnelStats) observe(latency time.Duration, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.requests++
+	if err != nil {
+		t.errors++
+		return
+	}
+	t.latency.observe(latency.Seconds())
+}
+
+// observeTransfer records throughput of n bytes transferred in d.
+func (t *tunnelStats) observeTransfer(n int64, d time.Duration) {
+	if t == nil || d <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.throughput.observe(float64(n) / d.Seconds())
+}
+
+func (t *tunnelStats) addIn(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.bytesIn += n
+	t.mu.Unlock()
+}
+
+func (t *tunnelStats) addOut(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.bytesOut += n
+	t.mu.Unlock()
+}
+
+func (t *tunnelStats) snapshot(name string) *TunnelStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &TunnelStats{
+		Tunnel:     name,
+		Identifier: t.identifier,
+		Requests:   t.requests,
+		Errors:     t.errors,
+		BytesIn:    t.bytesIn,
+		BytesOut:   t.bytesOut,
+		Latency:    t.latency.snapshot(),
+		Throughput: t.throughput.snapshot(),
+	}
+}
+
+// tunnelMetrics holds stats of registered tunnels by name.
+type tunnelMetrics struct {
+	tunnels map[string]*tunnelStats
+	mu      sync.Mutex
+}
+
+func newTunnelMetrics() *tunnelMetrics {
+	return &tunnelMetrics{
+		tunnels: make(map[string]*tunnelStats),
+	}
+}
+
+// stats returns stats of tunnel served by client with a given identifier,
+// stats are created on first use and reset if the tunnel changes client.
+func (m *tunnelMetrics) stats(name string, identifier id.ID) *tunnelStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tunnels[name]
+	if !ok || t.identifier != identifier {
+		t = newTunnelStats(identifier)
+		m.tunnels[name] = t
+	}
+	return t
+}
+
+func (m *tunnelMetrics) remove(name string) {
+	m.mu.Lock()
+	delete(m.tunnels, name)
+	m.mu.Unlock()
+}
+
+// statsReadCloser counts bytes of response body and records throughput when
+// it's closed.
+type statsReadCloser struct {
+	io.ReadCloser
+	stats *tunnelStats
+	start time.Time
+	n     int64
+	once  sync.Once
+}
+
+func (r *statsReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.n += int64(n)
+	r.stats.addOut(int64(n))
+	return
+}
+
+func (r *statsReadCloser) Close() error {
+	r.once.Do(func() {
+		r.stats.observeTransfer(r.n, time.Since(r.start))
+	})
+	return r.ReadCloser.Close()
+}
+
+// TunnelStats returns traffic stats of registered tunnels sorted by tunnel.
+func (s *Server) TunnelStats() []*TunnelStats {
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+
+	stats := make([]*TunnelStats, 0, len(s.metrics.tunnels))
+	for name, t := range s.metrics.tunnels {
+		stats = append(stats, t.snapshot(name))
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Tunnel < stats[j].Tunnel
+	})
+
+	return stats
+}
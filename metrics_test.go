@@ -0,0 +1,89 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestHistogram_Quantile(t *testing.T) {
+	t.Parallel()
+
+	h := newHistogram([]float64{1, 2, 4})
+	for _, v := range []float64{0.5, 0.5, 1.5, 3, 3, 3, 3, 3, 3, 10} {
+		h.observe(v)
+	}
+	s := h.snapshot()
+
+	if s.Count != 10 || s.Sum != 30.5 {
+		t.Fatalf("unexpected count %d sum %f", s.Count, s.Sum)
+	}
+	expected := []int64{2, 1, 6, 1}
+	for i, c := range expected {
+		if s.Counts[i] != c {
+			t.Errorf("[%d] expected count %d got %d", i, c, s.Counts[i])
+		}
+	}
+
+	tests := []struct {
+		q, v float64
+	}{
+		{0.1, 0.5},
+		{0.2, 1},
+		{0.3, 2},
+		{0.6, 3},
+		{0.99, 4},
+	}
+	for i, tt := range tests {
+		if v := s.Quantile(tt.q); v != tt.v {
+			t.Errorf("[%d] expected %v quantile %f got %f", i, tt.q, tt.v, v)
+		}
+	}
+
+	if v := (&Histogram{Bounds: []float64{1}, Counts: []int64{0, 0}}).Quantile(0.5); v != 0 {
+		t.Error("Unexpected quantile of empty histogram", v)
+	}
+}
+
+func TestTunnelMetrics(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+
+	m := newTunnelMetrics()
+	st := m.stats("http://foo.com", a)
+	st.observe(10*time.Millisecond, nil)
+	st.observe(time.Second, errors.New("failed"))
+	st.observeTransfer(1<<20, time.Second)
+
+	if m.stats("http://foo.com", a) != st {
+		t.Fatal("stats not reused")
+	}
+	s := st.snapshot("http://foo.com")
+	if s.Requests != 2 || s.Errors != 1 || s.Latency.Count != 1 || s.Throughput.Count != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	if m.stats("http://foo.com", b) == st {
+		t.Error("stats not reset on client change")
+	}
+
+	m.remove("http://foo.com")
+	if len(m.tunnels) != 0 {
+		t.Error("stats not removed")
+	}
+
+	// nil stats are ignored
+	var nilStats *tunnelStats
+	nilStats.observe(time.Second, nil)
+	nilStats.observeTransfer(1, time.Second)
+	nilStats.addIn(1)
+	nilStats.addOut(1)
+}
@@ -0,0 +1,262 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+)
+
+// Default OnDemandBackend timeouts.
+const (
+	DefaultOnDemandStartTimeout = 30 * time.Second
+	DefaultOnDemandStopTimeout  = 5 * time.Second
+	onDemandDialInterval        = 100 * time.Millisecond
+)
+
+var errBackendExited = errors.New("backend exited")
+
+// OnDemandBackend starts local backend with a command on the first connection
+// and stops it when it has no connections for IdleTimeout. It's safe for
+// concurrent use.
+type OnDemandBackend struct {
+	// Command specifies program and arguments starting the backend.
+	Command []string
+	// StartTimeout specifies how long to wait for the started backend to
+	// accept connections, if 0 DefaultOnDemandStartTimeout is used.
+	StartTimeout time.Duration
+	// IdleTimeout specifies how long the backend runs without connections
+	// before it's stopped, if 0 it's never stopped.
+	IdleTimeout time.Duration
+	// Stdout and Stderr specify optional outputs of the backend process.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Logger is optional logger. If nil logging is disabled.
+	Logger log.Logger
+
+	cmd    *exec.Cmd
+	exited chan struct{}
+	// stopping is closed when process being stopped exits, backend is not
+	// started again before that
+	stopping <-chan struct{}
+	conns    int
+	timer    *time.Timer
+	gen      int
+	mu       sync.Mutex
+}
+
+// DialContext starts the backend if it's not running and connects to it,
+// connection attempts are repeated until StartTimeout elapses.
+func (b *OnDemandBackend) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	b.mu.Lock()
+	for b.stopping != nil {
+		stopping := b.stopping
+		b.mu.Unlock()
+		select {
+		case <-stopping:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		b.mu.Lock()
+		if b.stopping == stopping {
+			b.stopping = nil
+		}
+	}
+	exited, err := b.start()
+	if err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	b.conns++
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	conn, err := b.dial(ctx, network, addr, exited)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+
+	return &onDemandConn{Conn: conn, b: b}, nil
+}
+
+// Close stops the backend if it's running and waits for it to exit.
+func (b *OnDemandBackend) Close() error {
+	b.mu.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.stop()
+	stopping := b.stopping
+	b.mu.Unlock()
+
+	if stopping != nil {
+		<-stopping
+	}
+
+	return nil
+}
+
+// start starts backend process if it's not running, it returns channel closed
+// when the process exits. It must be called with lock held.
+func (b *OnDemandBackend) start() (<-chan struct{}, error) {
+	if b.cmd != nil {
+		select {
+		case <-b.exited:
+		default:
+			return b.exited, nil
+		}
+	}
+
+	if len(b.Command) == 0 {
+		return nil, errors.New("missing command")
+	}
+
+	cmd := exec.Command(b.Command[0], b.Command[1:]...)
+	cmd.Stdout = b.Stdout
+	cmd.Stderr = b.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	b.logger().Log(
+		"level", 1,
+		"action", "backend started",
+		"command", b.Command,
+		"pid", cmd.Process.Pid,
+	)
+
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		b.logger().Log(
+			"level", 1,
+			"action", "backend exited",
+			"command", b.Command,
+			"pid", cmd.Process.Pid,
+			"err", err,
+		)
+		close(exited)
+	}()
+
+	b.cmd = cmd
+	b.exited = exited
+
+	return exited, nil
+}
+
+// stop signals backend process to terminate without waiting for it to exit,
+// process is killed if it does not exit within DefaultOnDemandStopTimeout.
+// It must be called with lock held.
+func (b *OnDemandBackend) stop() {
+	if b.cmd == nil {
+		return
+	}
+
+	cmd, exited := b.cmd, b.exited
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+	}
+	go func() {
+		select {
+		case <-exited:
+		case <-time.After(DefaultOnDemandStopTimeout):
+			cmd.Process.Kill()
+		}
+	}()
+
+	b.cmd = nil
+	b.exited = nil
+	b.stopping = exited
+}
+
+func (b *OnDemandBackend) dial(ctx context.Context, network, addr string, exited <-chan struct{}) (net.Conn, error) {
+	timeout := b.StartTimeout
+	if timeout == 0 {
+		timeout = DefaultOnDemandStartTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	d := &net.Dialer{
+		Timeout: DefaultTimeout,
+	}
+	for {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-exited:
+			return nil, errBackendExited
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(onDemandDialInterval):
+		}
+	}
+}
+
+// release is called when connection is closed, if there are no more
+// connections idle timer is started.
+func (b *OnDemandBackend) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.conns--
+	if b.conns > 0 || b.IdleTimeout <= 0 || b.cmd == nil {
+		return
+	}
+
+	b.gen++
+	gen := b.gen
+	b.timer = time.AfterFunc(b.IdleTimeout, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if b.gen != gen || b.conns > 0 {
+			return
+		}
+		b.logger().Log(
+			"level", 1,
+			"action", "stopping idle backend",
+			"command", b.Command,
+		)
+		b.timer = nil
+		b.stop()
+	})
+}
+
+func (b *OnDemandBackend) logger() log.Logger {
+	if b.Logger == nil {
+		return log.NewNopLogger()
+	}
+	return b.Logger
+}
+
+// onDemandConn releases backend on close.
+type onDemandConn struct {
+	net.Conn
+	b    *OnDemandBackend
+	once sync.Once
+}
+
+func (c *onDemandConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.b.release)
+	return err
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"testing"
+	"time"
+)
+
+// TestOnDemandHelperProcess is not a real test, it's an echo server started by
+// OnDemandBackend in TestOnDemandBackend, arguments after "--" are address
+// and optional "ignore-interrupt".
+func TestOnDemandHelperProcess(t *testing.T) {
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return
+	}
+	if len(args) > 2 && args[2] == "ignore-interrupt" {
+		signal.Ignore(os.Interrupt)
+	}
+
+	// simulate slow start
+	time.Sleep(200 * time.Millisecond)
+
+	l, err := net.Listen("tcp", args[1])
+	if err != nil {
+		os.Exit(1)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func TestOnDemandBackend(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	b := &OnDemandBackend{
+		Command:      []string{os.Args[0], "-test.run=TestOnDemandHelperProcess", "--", addr},
+		StartTimeout: 10 * time.Second,
+		IdleTimeout:  100 * time.Millisecond,
+	}
+	defer b.Close()
+
+	running := func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.cmd != nil
+	}
+
+	if running() {
+		t.Fatal("backend started before first connection")
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := b.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("[%d] dial failed: %s", i, err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("[%d] write failed: %s", i, err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("[%d] unexpected echo %q: %v", i, buf, err)
+		}
+
+		// backend must not be stopped while connection is open
+		time.Sleep(200 * time.Millisecond)
+		if !running() {
+			t.Fatalf("[%d] backend stopped while in use", i)
+		}
+
+		conn.Close()
+		time.Sleep(500 * time.Millisecond)
+		if running() {
+			t.Fatalf("[%d] idle backend not stopped", i)
+		}
+	}
+}
+
+func TestOnDemandBackendStopping(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	b := &OnDemandBackend{
+		Command:      []string{os.Args[0], "-test.run=TestOnDemandHelperProcess", "--", addr, "ignore-interrupt"},
+		StartTimeout: 10 * time.Second,
+		IdleTimeout:  100 * time.Millisecond,
+	}
+
+	conn, err := b.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// backend ignores interrupt, it's being stopped until killed
+	time.Sleep(300 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := b.DialContext(ctx, "tcp", addr); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("dial blocked by stopping backend for %s", d)
+	}
+
+	b.Close()
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("backend running after close")
+	}
+}
@@ -15,11 +15,14 @@ import (
 	"golang.org/x/net/http2"
 
 	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
 type connPair struct {
 	conn       net.Conn
 	clientConn *http2.ClientConn
+	sched      *scheduler
+	stats      *clientStats
 }
 
 type connPool struct {
@@ -58,7 +61,14 @@ func (p *connPool) MarkDead(c *http2.ClientConn) {
 
 	for addr, cp := range p.conns {
 		if cp.clientConn == c {
-			p.close(cp, addr)
+			// connection is usable so client sent GOAWAY, it's draining,
+			// streams in flight continue and client closes the connection
+			// when they are done
+			if c.CanTakeNewRequest() {
+				p.remove(addr)
+			} else {
+				p.close(cp, addr)
+			}
 			return
 		}
 	}
@@ -73,6 +83,10 @@ func (p *connPool) AddConn(conn net.Conn, identifier id.ID) error {
 	if cp, ok := p.conns[addr]; ok {
 		if err := p.ping(cp); err != nil {
 			p.close(cp, addr)
+		} else if !cp.clientConn.CanTakeNewRequest() {
+			// client sent GOAWAY and reconnects i.e. to register new
+			// tunnels, old connection is draining
+			p.remove(addr)
 		} else {
 			return errClientAlreadyConnected
 		}
@@ -85,6 +99,7 @@ func (p *connPool) AddConn(conn net.Conn, identifier id.ID) error {
 	p.conns[addr] = connPair{
 		conn:       conn,
 		clientConn: c,
+		stats:      newClientStats(conn.RemoteAddr()),
 	}
 
 	return nil
@@ -101,6 +116,55 @@ func (p *connPool) DeleteConn(identifier id.ID) {
 	}
 }
 
+// scheduler returns write scheduler of client connection or nil if client
+// is not connected.
+func (p *connPool) scheduler(identifier id.ID) *scheduler {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.conns[p.addr(identifier)].sched
+}
+
+// prioritize enables scheduling of writes to client connection if tunnels
+// have different priorities.
+func (p *connPool) prioritize(identifier id.ID, tunnels map[string]*proto.Tunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addr := p.addr(identifier)
+	cp, ok := p.conns[addr]
+	if !ok {
+		return
+	}
+	if !prioritized(tunnels) {
+		cp.sched = nil
+	} else if cp.sched == nil {
+		cp.sched = newScheduler()
+	}
+	p.conns[addr] = cp
+}
+
+// stats returns traffic counters of client connection or nil if client is not
+// connected.
+func (p *connPool) stats(identifier id.ID) *clientStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.conns[p.addr(identifier)].stats
+}
+
+// clients returns traffic counters of all connected clients.
+func (p *connPool) clients() map[id.ID]*clientStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	m := make(map[id.ID]*clientStats, len(p.conns))
+	for addr, cp := range p.conns {
+		m[p.identifier(addr)] = cp.stats
+	}
+	return m
+}
+
 func (p *connPool) Ping(identifier id.ID) (time.Duration, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -125,6 +189,11 @@ func (p *connPool) ping(cp connPair) error {
 
 func (p *connPool) close(cp connPair, addr string) {
 	cp.conn.Close()
+	p.remove(addr)
+}
+
+// remove removes connection from the pool without closing it.
+func (p *connPool) remove(addr string) {
 	delete(p.conns, addr)
 	if p.free != nil {
 		p.free(p.identifier(addr))
@@ -0,0 +1,310 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"container/heap"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+const (
+	// priorityChunkSize is the maximal number of bytes written at once,
+	// it matches the default HTTP/2 frame size.
+	priorityChunkSize = 16 << 10
+	// priorityStallTimeout specifies how long a write may block other
+	// streams before connection throughput is known, after that it's
+	// considered stalled i.e. by flow control and the next stream is allowed
+	// to write.
+	priorityStallTimeout = 50 * time.Millisecond
+	// priorityMinStall is the lower bound of time a write may block other
+	// streams.
+	priorityMinStall = time.Millisecond
+)
+
+// prioritized returns true if tunnels have different priorities, unset
+// priority is the default one. Otherwise all streams have equal weights and
+// writes are not scheduled.
+func prioritized(tunnels map[string]*proto.Tunnel) bool {
+	weight := 0
+	for _, t := range tunnels {
+		w := t.Priority
+		if w == 0 {
+			w = proto.DefaultPriority
+		}
+		if weight != 0 && weight != w {
+			return true
+		}
+		weight = w
+	}
+	return false
+}
+
+// scheduler orders writes of streams sharing a connection using weighted fair
+// queuing, when streams compete each gets share of the connection
+// proportional to its priority weight. Virtual time advances by the number of
+// bytes written divided by the total weight of competing streams.
+//
+// A write blocks other streams only as long as sending it at the measured
+// connection throughput takes, a write that blocks longer i.e. by flow
+// control of a slow reader is considered stalled and the next stream is
+// allowed to write.
+type scheduler struct {
+	mu     sync.Mutex
+	vtime  uint64
+	seq    uint64
+	busy   bool
+	gen    uint64
+	timer  *time.Timer
+	queue  waitQueue
+	queued int
+	stall  time.Duration
+	// granted and size are start time and size of the current write
+	granted time.Time
+	size    int
+	// perByte is moving average of time it takes to write a byte
+	perByte time.Duration
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		stall: priorityStallTimeout,
+	}
+}
+
+type waiter struct {
+	start  uint64
+	finish uint64
+	seq    uint64
+	weight int
+	n      int
+	ready  chan uint64
+}
+
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].finish == q[j].finish {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].finish < q[j].finish
+}
+
+func (q waitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *waitQueue) Push(x interface{}) { *q = append(*q, x.(*waiter)) }
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	*q = old[:n-1]
+	return w
+}
+
+// acquire blocks until a write of n bytes by stream with last finish tag
+// finish and weight may proceed. It returns the new finish tag of the
+// stream and a generation that must be passed to release.
+func (s *scheduler) acquire(finish uint64, weight, n int) (uint64, uint64) {
+	s.mu.Lock()
+
+	w := &waiter{
+		start:  finish,
+		seq:    s.seq,
+		weight: weight,
+		n:      n,
+	}
+	s.seq++
+	if s.vtime > w.start {
+		w.start = s.vtime
+	}
+	w.finish = w.start + uint64(n)*proto.MaxPriority/uint64(weight)
+
+	if !s.busy {
+		s.busy = true
+		s.grant(w)
+		gen := s.gen
+		s.mu.Unlock()
+		return w.finish, gen
+	}
+
+	w.ready = make(chan uint64, 1)
+	heap.Push(&s.queue, w)
+	s.queued += weight
+	if s.timer == nil {
+		s.startTimer(s.stallAfter(s.size) - time.Since(s.granted))
+	}
+	s.mu.Unlock()
+
+	return w.finish, <-w.ready
+}
+
+// grant starts a new generation for write w and advances virtual time.
+func (s *scheduler) grant(w *waiter) {
+	if s.vtime < w.start {
+		s.vtime = w.start
+	}
+	s.vtime += uint64(w.n) * proto.MaxPriority / uint64(s.queued+w.weight)
+	s.gen++
+	s.granted = time.Now()
+	s.size = w.n
+}
+
+// stallAfter returns time after which write of n bytes is considered
+// stalled.
+func (s *scheduler) stallAfter(n int) time.Duration {
+	if s.perByte == 0 {
+		return s.stall
+	}
+	d := 4 * time.Duration(n) * s.perByte
+	if d < priorityMinStall {
+		d = priorityMinStall
+	}
+	if d > s.stall {
+		d = s.stall
+	}
+	return d
+}
+
+// startTimer lets the next write proceed after d if the current one does
+// not finish in time.
+func (s *scheduler) startTimer(d time.Duration) {
+	gen := s.gen
+	s.timer = time.AfterFunc(d, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if gen == s.gen {
+			s.next()
+		}
+	})
+}
+
+// release marks write of generation gen as done and lets the next write
+// proceed.
+func (s *scheduler) release(gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.gen {
+		return
+	}
+
+	// writes that stalled are not measured unless nothing was waiting,
+	// then they count as long as the longest allowed write
+	if s.size > 0 {
+		d := time.Since(s.granted)
+		if limit := s.stallAfter(s.size); d > limit {
+			d = limit
+		}
+		d /= time.Duration(s.size)
+		if s.perByte == 0 {
+			s.perByte = d
+		} else {
+			s.perByte += (d - s.perByte) / 8
+		}
+		if s.perByte == 0 {
+			s.perByte = 1
+		}
+	}
+
+	s.next()
+}
+
+// next lets the first waiting write proceed.
+func (s *scheduler) next() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	if s.queue.Len() == 0 {
+		s.gen++
+		s.busy = false
+		return
+	}
+
+	w := heap.Pop(&s.queue).(*waiter)
+	s.queued -= w.weight
+	s.grant(w)
+	if s.queue.Len() != 0 {
+		s.startTimer(s.stallAfter(w.n))
+	}
+	w.ready <- s.gen
+}
+
+// priorityWriter writes to w in chunks scheduled by sched. If sched is nil
+// writes are passed through.
+type priorityWriter struct {
+	w      io.Writer
+	sched  *scheduler
+	weight int
+	finish uint64
+}
+
+func newPriorityWriter(w io.Writer, sched *scheduler, priority int) *priorityWriter {
+	if priority == 0 {
+		priority = proto.DefaultPriority
+	}
+	return &priorityWriter{
+		w:      w,
+		sched:  sched,
+		weight: priority,
+	}
+}
+
+func (pw *priorityWriter) Write(p []byte) (n int, err error) {
+	if pw.sched == nil {
+		return pw.w.Write(p)
+	}
+
+	for len(p) > 0 {
+		c := p
+		if len(c) > priorityChunkSize {
+			c = c[:priorityChunkSize]
+		}
+
+		var gen uint64
+		pw.finish, gen = pw.sched.acquire(pw.finish, pw.weight, len(c))
+		m, err := pw.w.Write(c)
+		pw.sched.release(gen)
+
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// priorityResponseWriter is http.ResponseWriter that schedules writes of
+// response body.
+type priorityResponseWriter struct {
+	http.ResponseWriter
+	pw *priorityWriter
+}
+
+func newPriorityResponseWriter(w http.ResponseWriter, sched *scheduler, priority int) *priorityResponseWriter {
+	return &priorityResponseWriter{
+		ResponseWriter: w,
+		pw:             newPriorityWriter(w, sched, priority),
+	}
+}
+
+func (w *priorityResponseWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *priorityResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
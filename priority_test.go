@@ -0,0 +1,183 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// slowWriter simulates a connection with limited bandwidth, it records
+// writes of each stream.
+type slowWriter struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (w *slowWriter) writer(name string) *streamWriter {
+	return &streamWriter{w, name}
+}
+
+func (w *slowWriter) count(name string) (n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, s := range w.writes {
+		if s == name {
+			n++
+		}
+	}
+	return
+}
+
+type streamWriter struct {
+	*slowWriter
+	name string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	w.mu.Lock()
+	w.writes = append(w.writes, w.name)
+	w.mu.Unlock()
+	return len(p), nil
+}
+
+func TestPriorityWriter(t *testing.T) {
+	t.Parallel()
+
+	var (
+		sched = newScheduler()
+		sink  = &slowWriter{}
+		chunk = make([]byte, priorityChunkSize)
+	)
+
+	// bulk streams
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bulk := newPriorityWriter(sink.writer("bulk"), sched, 1)
+			for i := 0; i < 25; i++ {
+				bulk.Write(chunk)
+			}
+		}()
+	}
+
+	// let bulk streams start
+	time.Sleep(10 * time.Millisecond)
+
+	interactive := newPriorityWriter(sink.writer("interactive"), sched, 256)
+	before := sink.count("bulk")
+	for i := 0; i < 10; i++ {
+		if _, err := interactive.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after := sink.count("bulk")
+
+	// without priorities bulk streams would write 80 chunks
+	if after-before > 30 {
+		t.Errorf("interactive stream starved, bulk wrote %d chunks meanwhile", after-before)
+	}
+
+	wg.Wait()
+	if n := sink.count("bulk"); n != 200 {
+		t.Errorf("expected 200 bulk writes got %d", n)
+	}
+}
+
+type blockingWriter chan struct{}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
+
+func TestPriorityWriterStall(t *testing.T) {
+	t.Parallel()
+
+	sched := newScheduler()
+	sched.stall = 10 * time.Millisecond
+
+	blocked := make(blockingWriter)
+	defer close(blocked)
+
+	go newPriorityWriter(blocked, sched, 256).Write([]byte("x"))
+
+	// let stalled stream start
+	time.Sleep(10 * time.Millisecond)
+
+	sink := &slowWriter{}
+	done := make(chan struct{})
+	go func() {
+		newPriorityWriter(sink.writer("a"), sched, 1).Write([]byte("x"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked by stalled stream")
+	}
+}
+
+func TestPriorityWriterStallMeasured(t *testing.T) {
+	t.Parallel()
+
+	sched := newScheduler()
+	sched.stall = time.Second
+
+	// measure throughput
+	sink := &slowWriter{}
+	w := newPriorityWriter(sink.writer("a"), sched, 1)
+	for i := 0; i < 5; i++ {
+		w.Write(make([]byte, priorityChunkSize))
+	}
+
+	blocked := make(blockingWriter)
+	defer close(blocked)
+
+	go newPriorityWriter(blocked, sched, 256).Write([]byte("x"))
+
+	// let stalled stream start
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	w.Write([]byte("x"))
+	if d := time.Since(start); d > sched.stall/2 {
+		t.Fatalf("write blocked by stalled stream for %s", d)
+	}
+}
+
+func TestPrioritized(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		priorities []int
+		expected   bool
+	}{
+		{[]int{0}, false},
+		{[]int{0, 0}, false},
+		{[]int{0, proto.DefaultPriority}, false},
+		{[]int{8, 8}, false},
+		{[]int{0, 8}, true},
+		{[]int{1, 256, 1}, true},
+	}
+
+	for i, tt := range tests {
+		tunnels := make(map[string]*proto.Tunnel)
+		for j, p := range tt.priorities {
+			tunnels[fmt.Sprint(j)] = &proto.Tunnel{Priority: p}
+		}
+		if actual := prioritized(tunnels); actual != tt.expected {
+			t.Errorf("[%d] expected %t got %t", i, tt.expected, actual)
+		}
+	}
+}
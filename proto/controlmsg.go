@@ -7,15 +7,21 @@ package proto
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 )
 
 // Protocol HTTP headers.
 const (
 	HeaderError = "X-Error"
+	// HeaderRegistered is set on request sending tunnels registered by the
+	// server to the client.
+	HeaderRegistered = "X-Tunnel-Registered"
 
 	HeaderAction         = "X-Action"
 	HeaderForwardedHost  = "X-Forwarded-Host"
 	HeaderForwardedProto = "X-Forwarded-Proto"
+	HeaderPriority       = "X-Tunnel-Priority"
+	HeaderHalfClose      = "X-Tunnel-Half-Close"
 )
 
 // Known actions.
@@ -33,6 +39,10 @@ const (
 	TCP6 = "tcp6"
 	UNIX = "unix"
 	SNI  = "sni"
+
+	// CONNECT is a gateway accepting HTTP CONNECT requests, the requested
+	// host:port is dialed by the client.
+	CONNECT = "connect"
 )
 
 // ControlMessage is sent from server to client before streaming data. It's
@@ -43,15 +53,38 @@ type ControlMessage struct {
 	ForwardedHost  string
 	ForwardedProto string
 	RemoteAddr     string
+	Priority       int
+	// ClientIP is IP address of the caller of HTTP request, if the request
+	// is sent by trusted proxies it's the address the proxies received the
+	// request from. It's sent in control frame since Version4.
+	ClientIP string
+	// HalfClose is set if server supports half-close of TCP connections,
+	// client confirms it with HeaderHalfClose response header and writes
+	// data in frames so that it can signal end of data while still reading.
+	HalfClose bool
 }
 
-// ReadControlMessage reads ControlMessage from HTTP headers.
+// ReadControlMessage reads ControlMessage from control frame at the start of
+// request body if HeaderControlFrame is set, otherwise from HTTP headers.
 func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
+	if r.Header.Get(HeaderControlFrame) != "" {
+		if r.Body == nil {
+			return nil, fmt.Errorf("missing control frame")
+		}
+		msg, err := ReadControlFrame(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid control frame: %s", err)
+		}
+		msg.RemoteAddr = r.RemoteAddr
+		return msg, nil
+	}
+
 	msg := ControlMessage{
 		Action:         r.Header.Get(HeaderAction),
 		ForwardedHost:  r.Header.Get(HeaderForwardedHost),
 		ForwardedProto: r.Header.Get(HeaderForwardedProto),
 		RemoteAddr:     r.RemoteAddr,
+		HalfClose:      r.Header.Get(HeaderHalfClose) != "",
 	}
 
 	var missing []string
@@ -70,6 +103,14 @@ func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
 		return nil, fmt.Errorf("missing headers: %s", missing)
 	}
 
+	if v := r.Header.Get(HeaderPriority); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < MinPriority || p > MaxPriority {
+			return nil, fmt.Errorf("invalid header %s: %q", HeaderPriority, v)
+		}
+		msg.Priority = p
+	}
+
 	return &msg, nil
 }
 
@@ -78,4 +119,10 @@ func (c *ControlMessage) WriteToHeader(h http.Header) {
 	h.Set(HeaderAction, string(c.Action))
 	h.Set(HeaderForwardedHost, c.ForwardedHost)
 	h.Set(HeaderForwardedProto, c.ForwardedProto)
+	if c.Priority != 0 {
+		h.Set(HeaderPriority, strconv.Itoa(c.Priority))
+	}
+	if c.HalfClose {
+		h.Set(HeaderHalfClose, "1")
+	}
 }
@@ -47,6 +47,33 @@ func TestControlMessageWriteRead(t *testing.T) {
 			},
 			errors.New("missing headers: [X-Forwarded-Host]"),
 		},
+		{
+			&ControlMessage{
+				Action:         "action",
+				ForwardedHost:  "forwarded_host",
+				ForwardedProto: "forwarded_proto",
+				Priority:       200,
+			},
+			nil,
+		},
+		{
+			&ControlMessage{
+				Action:         "action",
+				ForwardedHost:  "forwarded_host",
+				ForwardedProto: "forwarded_proto",
+				HalfClose:      true,
+			},
+			nil,
+		},
+		{
+			&ControlMessage{
+				Action:         "action",
+				ForwardedHost:  "forwarded_host",
+				ForwardedProto: "forwarded_proto",
+				Priority:       300,
+			},
+			errors.New(`invalid header X-Tunnel-Priority: "300"`),
+		},
 	}
 
 	for i, tt := range data {
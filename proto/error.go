@@ -0,0 +1,85 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Error HTTP headers, client sets them on response when proxying fails.
+const (
+	HeaderTunnelError     = "X-Tunnel-Error"
+	HeaderTunnelErrorCode = "X-Tunnel-Error-Code"
+)
+
+// Known error codes.
+const (
+	// ErrorCodeUnsupportedProtocol is reported when client cannot handle
+	// ControlMessage.ForwardedProto.
+	ErrorCodeUnsupportedProtocol = "unsupported_protocol"
+	// ErrorCodeNoTarget is reported when there is no local service for
+	// ControlMessage.ForwardedHost.
+	ErrorCodeNoTarget = "no_target"
+	// ErrorCodeDialFailed is reported when connecting to local service
+	// fails.
+	ErrorCodeDialFailed = "dial_failed"
+	// ErrorCodeTimeout is reported when local service does not respond
+	// in time.
+	ErrorCodeTimeout = "timeout"
+	// ErrorCodeProxyFailed is reported on any other error.
+	ErrorCodeProxyFailed = "proxy_failed"
+)
+
+var errorStatus = map[string]int{
+	ErrorCodeUnsupportedProtocol: http.StatusBadGateway,
+	ErrorCodeNoTarget:            http.StatusBadGateway,
+	ErrorCodeDialFailed:          http.StatusBadGateway,
+	ErrorCodeTimeout:             http.StatusGatewayTimeout,
+	ErrorCodeProxyFailed:         http.StatusBadGateway,
+}
+
+// Error is sent from client to server when proxying fails before any data is
+// written.
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// StatusCode returns HTTP status code that shall be returned to the public
+// caller.
+func (e *Error) StatusCode() int {
+	if s, ok := errorStatus[e.Code]; ok {
+		return s
+	}
+	return http.StatusBadGateway
+}
+
+// WriteError writes Error to HTTP headers and sends them with status code
+// matching the error code.
+func WriteError(w http.ResponseWriter, e *Error) {
+	w.Header().Set(HeaderTunnelErrorCode, e.Code)
+	w.Header().Set(HeaderTunnelError, e.Message)
+	w.WriteHeader(e.StatusCode())
+}
+
+// ReadError reads Error from HTTP headers, it returns nil if headers do not
+// contain a known error code.
+func ReadError(h http.Header) *Error {
+	code := h.Get(HeaderTunnelErrorCode)
+	if _, ok := errorStatus[code]; !ok {
+		return nil
+	}
+
+	return &Error{
+		Code:    code,
+		Message: h.Get(HeaderTunnelError),
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestErrorWriteRead(t *testing.T) {
+	t.Parallel()
+
+	data := []struct {
+		err    *Error
+		status int
+	}{
+		{&Error{Code: ErrorCodeDialFailed, Message: "connection refused"}, http.StatusBadGateway},
+		{&Error{Code: ErrorCodeTimeout, Message: "i/o timeout"}, http.StatusGatewayTimeout},
+	}
+
+	for i, tt := range data {
+		w := httptest.NewRecorder()
+		WriteError(w, tt.err)
+
+		if w.Code != tt.status {
+			t.Error(i, "status", w.Code)
+		}
+		actual := ReadError(w.Header())
+		if !reflect.DeepEqual(tt.err, actual) {
+			t.Error(i, tt.err, actual)
+		}
+	}
+
+	h := http.Header{}
+	h.Set(HeaderTunnelErrorCode, "foo")
+	if e := ReadError(h); e != nil {
+		t.Error("unknown code", e)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// HeaderControlFrame is set on requests which body starts with control
+// frame, it's used since Version3.
+const HeaderControlFrame = "X-Tunnel-Control-Frame"
+
+// Control frame is a length-prefixed binary encoding of ControlMessage:
+//
+//	version  1 byte, FrameVersion
+//	length   4 bytes, big endian length of fields
+//	fields   sequence of type (1 byte), uvarint length and value
+//
+// Fields may appear once in any order, string values are raw bytes and
+// integer values are uvarints. Unknown fields are rejected, new fields
+// require a new FrameVersion or a protocol version so that they are sent
+// only to peers that know them.
+const (
+	// FrameVersion is the version of control frame encoding.
+	FrameVersion = 1
+	// MaxFrameSize is the maximal length of frame fields.
+	MaxFrameSize = 16 << 10
+)
+
+// Control frame field types.
+const (
+	fieldAction byte = iota + 1
+	fieldForwardedHost
+	fieldForwardedProto
+	fieldPriority
+	fieldHalfClose
+	fieldClientIP
+	fieldMax
+)
+
+var errFrameTooLarge = errors.New("control frame too large")
+
+// MarshalBinary encodes ControlMessage as control frame, RemoteAddr is not
+// encoded.
+func (c *ControlMessage) MarshalBinary() ([]byte, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	var fields bytes.Buffer
+	putField := func(t byte, v []byte) {
+		var n [binary.MaxVarintLen64]byte
+		fields.WriteByte(t)
+		fields.Write(n[:binary.PutUvarint(n[:], uint64(len(v)))])
+		fields.Write(v)
+	}
+	putUvarint := func(t byte, v uint64) {
+		var n [binary.MaxVarintLen64]byte
+		putField(t, n[:binary.PutUvarint(n[:], v)])
+	}
+
+	putField(fieldAction, []byte(c.Action))
+	putField(fieldForwardedHost, []byte(c.ForwardedHost))
+	putField(fieldForwardedProto, []byte(c.ForwardedProto))
+	if c.Priority != 0 {
+		putUvarint(fieldPriority, uint64(c.Priority))
+	}
+	if c.HalfClose {
+		putUvarint(fieldHalfClose, 1)
+	}
+	if c.ClientIP != "" {
+		putField(fieldClientIP, []byte(c.ClientIP))
+	}
+
+	if fields.Len() > MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+
+	b := make([]byte, 5, 5+fields.Len())
+	b[0] = FrameVersion
+	binary.BigEndian.PutUint32(b[1:], uint32(fields.Len()))
+	return append(b, fields.Bytes()...), nil
+}
+
+// UnmarshalBinary decodes control frame, b must contain exactly one frame.
+func (c *ControlMessage) UnmarshalBinary(b []byte) error {
+	if len(b) < 5 {
+		return io.ErrUnexpectedEOF
+	}
+	if b[0] != FrameVersion {
+		return fmt.Errorf("unsupported control frame version %d", b[0])
+	}
+	n := binary.BigEndian.Uint32(b[1:5])
+	if n > MaxFrameSize {
+		return errFrameTooLarge
+	}
+	if uint32(len(b)-5) != n {
+		return fmt.Errorf("control frame length mismatch, expected %d got %d", n, len(b)-5)
+	}
+
+	var (
+		msg  ControlMessage
+		seen [fieldMax]bool
+	)
+	for p := b[5:]; len(p) > 0; {
+		t := p[0]
+		if t == 0 || t >= fieldMax {
+			return fmt.Errorf("unknown control frame field %d", t)
+		}
+		if seen[t] {
+			return fmt.Errorf("duplicate control frame field %d", t)
+		}
+		seen[t] = true
+
+		l, k := binary.Uvarint(p[1:])
+		if k <= 0 || l > uint64(len(p)-1-k) {
+			return fmt.Errorf("invalid length of control frame field %d", t)
+		}
+		v := p[1+k : 1+k+int(l)]
+		p = p[1+k+int(l):]
+
+		switch t {
+		case fieldAction:
+			msg.Action = string(v)
+		case fieldForwardedHost:
+			msg.ForwardedHost = string(v)
+		case fieldForwardedProto:
+			msg.ForwardedProto = string(v)
+		case fieldClientIP:
+			msg.ClientIP = string(v)
+		case fieldPriority, fieldHalfClose:
+			u, k := binary.Uvarint(v)
+			if k <= 0 || k != len(v) {
+				return fmt.Errorf("invalid value of control frame field %d", t)
+			}
+			if t == fieldPriority {
+				if u < MinPriority || u > MaxPriority {
+					return fmt.Errorf("invalid priority %d", u)
+				}
+				msg.Priority = int(u)
+			} else {
+				if u != 1 {
+					return fmt.Errorf("invalid half-close %d", u)
+				}
+				msg.HalfClose = true
+			}
+		}
+	}
+
+	if err := msg.validate(); err != nil {
+		return err
+	}
+
+	*c = msg
+	return nil
+}
+
+// ReadControlFrame reads a single control frame from r, data following the
+// frame is not read.
+func ReadControlFrame(r io.Reader) (*ControlMessage, error) {
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if b[0] != FrameVersion {
+		return nil, fmt.Errorf("unsupported control frame version %d", b[0])
+	}
+	n := binary.BigEndian.Uint32(b[1:])
+	if n > MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+
+	b = append(b, make([]byte, n)...)
+	if _, err := io.ReadFull(r, b[5:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	msg := new(ControlMessage)
+	if err := msg.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// validate checks that required fields are set and priority is valid.
+func (c *ControlMessage) validate() error {
+	var missing []string
+	if c.Action == "" {
+		missing = append(missing, "Action")
+	}
+	if c.ForwardedHost == "" {
+		missing = append(missing, "ForwardedHost")
+	}
+	if c.ForwardedProto == "" {
+		missing = append(missing, "ForwardedProto")
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("missing fields: %s", missing)
+	}
+	if c.Priority != 0 && (c.Priority < MinPriority || c.Priority > MaxPriority) {
+		return fmt.Errorf("invalid priority %d", c.Priority)
+	}
+	if c.ClientIP != "" && net.ParseIP(c.ClientIP) == nil {
+		return fmt.Errorf("invalid client IP %q", c.ClientIP)
+	}
+	return nil
+}
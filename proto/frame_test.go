@@ -0,0 +1,231 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestControlFrameWriteRead(t *testing.T) {
+	t.Parallel()
+
+	data := []*ControlMessage{
+		{
+			Action:         ActionProxy,
+			ForwardedHost:  "foo.com",
+			ForwardedProto: HTTP,
+		},
+		{
+			Action:         ActionProxy,
+			ForwardedHost:  "foo.com",
+			ForwardedProto: HTTP,
+			ClientIP:       "2001:db8::1",
+		},
+		{
+			Action:         ActionProxy,
+			ForwardedHost:  "127.0.0.1:8080",
+			ForwardedProto: TCP,
+			Priority:       MaxPriority,
+			HalfClose:      true,
+		},
+		{
+			Action:         ActionProxy,
+			ForwardedHost:  "X-Forwarded-Host: evil\r\n\r\n",
+			ForwardedProto: CONNECT,
+			Priority:       MinPriority,
+		},
+	}
+
+	for i, msg := range data {
+		b, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		// frame is followed by stream data
+		r := bytes.NewReader(append(b, "data"...))
+		actual, err := ReadControlFrame(r)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !reflect.DeepEqual(msg, actual) {
+			t.Error(i, msg, actual)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "data" {
+			t.Errorf("[%d] frame overread, rest %q", i, rest)
+		}
+	}
+}
+
+func TestControlFrameMarshalError(t *testing.T) {
+	t.Parallel()
+
+	data := []*ControlMessage{
+		{ForwardedHost: "foo.com", ForwardedProto: HTTP},
+		{Action: ActionProxy, ForwardedProto: HTTP},
+		{Action: ActionProxy, ForwardedHost: "foo.com", ForwardedProto: HTTP, Priority: 300},
+		{Action: ActionProxy, ForwardedHost: "foo.com", ForwardedProto: HTTP, ClientIP: "foo"},
+		{Action: ActionProxy, ForwardedHost: strings.Repeat("a", MaxFrameSize), ForwardedProto: HTTP},
+	}
+
+	for i, msg := range data {
+		if _, err := msg.MarshalBinary(); err == nil {
+			t.Errorf("[%d] expected error", i)
+		}
+	}
+}
+
+func TestControlFrameStrict(t *testing.T) {
+	t.Parallel()
+
+	frame := func(version byte, fields ...byte) []byte {
+		b := []byte{version, 0, 0, 0, byte(len(fields))}
+		return append(b, fields...)
+	}
+	var (
+		action = []byte{fieldAction, 5, 'p', 'r', 'o', 'x', 'y'}
+		host   = []byte{fieldForwardedHost, 1, 'h'}
+		proto  = []byte{fieldForwardedProto, 3, 't', 'c', 'p'}
+		valid  = append(append(append([]byte{}, action...), host...), proto...)
+	)
+	with := func(fields ...byte) []byte {
+		return append(append([]byte{}, valid...), fields...)
+	}
+
+	data := []struct {
+		b  []byte
+		ok bool
+	}{
+		{frame(FrameVersion, valid...), true},
+		{frame(FrameVersion, with(fieldPriority, 1, 16)...), true},
+		{frame(FrameVersion, with(fieldHalfClose, 1, 1)...), true},
+		{frame(FrameVersion, with(fieldClientIP, 7, '1', '.', '2', '.', '3', '.', '4')...), true},
+		// unsupported version
+		{frame(2, valid...), false},
+		// missing field
+		{frame(FrameVersion, append(append([]byte{}, action...), host...)...), false},
+		// duplicate field
+		{frame(FrameVersion, with(host...)...), false},
+		// unknown field
+		{frame(FrameVersion, with(fieldMax, 0)...), false},
+		{frame(FrameVersion, with(0, 0)...), false},
+		// field length past the end
+		{frame(FrameVersion, with(fieldPriority, 5, 1)...), false},
+		// invalid values
+		{frame(FrameVersion, with(fieldPriority, 1, 0)...), false},
+		{frame(FrameVersion, with(fieldPriority, 2, 0x80, 0x04)...), false},
+		{frame(FrameVersion, with(fieldPriority, 2, 16, 0)...), false},
+		{frame(FrameVersion, with(fieldHalfClose, 1, 2)...), false},
+		{frame(FrameVersion, with(fieldClientIP, 3, 'f', 'o', 'o')...), false},
+		// truncated
+		{frame(FrameVersion, valid...)[:10], false},
+		{[]byte{FrameVersion, 0, 0}, false},
+		{nil, false},
+		// too large
+		{[]byte{FrameVersion, 0xff, 0xff, 0xff, 0xff}, false},
+	}
+
+	for i, tt := range data {
+		_, err := ReadControlFrame(bytes.NewReader(tt.b))
+		if (err == nil) != tt.ok {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+	}
+}
+
+// TestControlFrameRandom checks that decoding of mutated frames does not
+// panic and that decoded frames encode to an equal message, see Fuzz for
+// go-fuzz version.
+func TestControlFrameRandom(t *testing.T) {
+	t.Parallel()
+
+	msg := &ControlMessage{
+		Action:         ActionProxy,
+		ForwardedHost:  "foo.com:443",
+		ForwardedProto: SNI,
+		Priority:       DefaultPriority,
+		HalfClose:      true,
+	}
+	valid, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		b := append([]byte{}, valid...)
+		for n := rnd.Intn(4) + 1; n > 0; n-- {
+			switch rnd.Intn(3) {
+			case 0:
+				b[rnd.Intn(len(b))] = byte(rnd.Intn(256))
+			case 1:
+				b = b[:rnd.Intn(len(b))]
+			case 2:
+				p := rnd.Intn(len(b) + 1)
+				b = append(b[:p], append([]byte{byte(rnd.Intn(256))}, b[p:]...)...)
+			}
+			if len(b) == 0 {
+				break
+			}
+		}
+
+		decoded, err := ReadControlFrame(bytes.NewReader(b))
+		if err != nil {
+			continue
+		}
+		e, err := decoded.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%x: decoded frame does not encode: %s", b, err)
+		}
+		actual, err := ReadControlFrame(bytes.NewReader(e))
+		if err != nil || !reflect.DeepEqual(decoded, actual) {
+			t.Fatalf("%x: round trip mismatch %v %v %v", b, decoded, actual, err)
+		}
+	}
+}
+
+func TestReadControlMessageFrame(t *testing.T) {
+	t.Parallel()
+
+	msg := &ControlMessage{
+		Action:         ActionProxy,
+		ForwardedHost:  "foo.com",
+		ForwardedProto: HTTP,
+		RemoteAddr:     "10.0.0.1:5223",
+	}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest(http.MethodPut, "/", bytes.NewReader(append(b, "GET / HTTP/1.1\r\n"...)))
+	r.RemoteAddr = msg.RemoteAddr
+	r.Header.Set(HeaderControlFrame, "1")
+	// headers are ignored
+	r.Header.Set(HeaderForwardedHost, "bar.com")
+
+	actual, err := ReadControlMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, actual) {
+		t.Error(msg, actual)
+	}
+	if rest, _ := ioutil.ReadAll(r.Body); string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("unexpected body %q", rest)
+	}
+
+	r, _ = http.NewRequest(http.MethodPut, "/", strings.NewReader("garbage"))
+	r.Header.Set(HeaderControlFrame, "1")
+	if _, err := ReadControlMessage(r); err == nil {
+		t.Error("expected error")
+	}
+}
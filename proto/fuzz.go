@@ -0,0 +1,35 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// +build gofuzz
+
+package proto
+
+import (
+	"bytes"
+	"reflect"
+)
+
+// Fuzz is go-fuzz entry point for control frame decoding, decoded frames
+// must encode to an equal message.
+func Fuzz(data []byte) int {
+	msg, err := ReadControlFrame(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	actual, err := ReadControlFrame(bytes.NewReader(b))
+	if err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(msg, actual) {
+		panic("control frame round trip mismatch")
+	}
+
+	return 1
+}
@@ -4,6 +4,14 @@
 
 package proto
 
+// Stream priority weights, like in HTTP/2 a stream gets share of connection
+// bandwidth proportional to its weight.
+const (
+	MinPriority     = 1
+	MaxPriority     = 256
+	DefaultPriority = 16
+)
+
 // Tunnel describes a single tunnel between client and server. When connecting
 // client sends tunnels to server. If client gets connected server proxies
 // connections to given Host and Addr to the client.
@@ -20,4 +28,24 @@ type Tunnel struct {
 	// Addr specifies TCP address server would listen on, it's required
 	// for TCP tunnels.
 	Addr string
+	// Priority specifies weight of tunnel streams in range 1-256 when
+	// sharing the connection with other tunnels, if 0 DefaultPriority is
+	// used.
+	Priority int
+	// MaxBodySize specifies the maximal size of HTTP request body in bytes
+	// for HTTP tunnels, it can only lower the server limit. If 0 the
+	// server limit is used.
+	MaxBodySize int64
+	// MaxConns specifies the maximal number of concurrent public
+	// connections of TCP, SNI and CONNECT tunnels, it can only lower the
+	// server limit. If 0 the server limit is used.
+	MaxConns int
+	// ConnRate specifies the maximal rate of public connections per
+	// second accepted by TCP, SNI and CONNECT tunnels, it can only lower
+	// the server limit. If 0 the server limit is used.
+	ConnRate float64
+	// HTTPSOnly specifies if plain HTTP requests to HTTP tunnels should be
+	// redirected to HTTPS, it requires server with HTTPS redirect
+	// configured.
+	HTTPSOnly bool
 }
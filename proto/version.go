@@ -0,0 +1,99 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Version HTTP headers, server sets them on handshake request and client on
+// handshake response. Peers that do not send them speak Version1.
+const (
+	HeaderVersion    = "X-Tunnel-Version"
+	HeaderMinVersion = "X-Tunnel-Min-Version"
+)
+
+// Protocol versions, every version extends the previous one.
+const (
+	// Version1 is the protocol of peers without version negotiation.
+	Version1 = 1
+	// Version2 adds notification of registered tunnels, hosts assigned by
+	// the server and CONNECT tunnels.
+	Version2 = 2
+	// Version3 sends ControlMessage in control frame instead of HTTP
+	// headers.
+	Version3 = 3
+	// Version4 adds IP address of the caller of HTTP requests resolved by
+	// the server to control frame.
+	Version4 = 4
+
+	// Version is the latest protocol version.
+	Version = Version4
+	// MinVersion is the oldest protocol version supported.
+	MinVersion = Version1
+)
+
+// protocolVersion specifies protocol version that introduced tunnel
+// protocol.
+var protocolVersion = map[string]int{
+	HTTP:    Version1,
+	TCP:     Version1,
+	TCP4:    Version1,
+	TCP6:    Version1,
+	UNIX:    Version1,
+	SNI:     Version1,
+	CONNECT: Version2,
+}
+
+// WriteVersion sets range of supported protocol versions in HTTP headers.
+func WriteVersion(h http.Header, min, max int) {
+	h.Set(HeaderVersion, strconv.Itoa(max))
+	h.Set(HeaderMinVersion, strconv.Itoa(min))
+}
+
+// ReadVersion reads range of supported protocol versions from HTTP headers,
+// if headers are missing Version1 is returned.
+func ReadVersion(h http.Header) (min, max int, err error) {
+	min, max = Version1, Version1
+	if v := h.Get(HeaderVersion); v != "" {
+		if max, err = strconv.Atoi(v); err != nil || max < Version1 {
+			return 0, 0, fmt.Errorf("invalid %s header %q", HeaderVersion, v)
+		}
+		min = max
+	}
+	if v := h.Get(HeaderMinVersion); v != "" {
+		if min, err = strconv.Atoi(v); err != nil || min < Version1 || min > max {
+			return 0, 0, fmt.Errorf("invalid %s header %q", HeaderMinVersion, v)
+		}
+	}
+	return min, max, nil
+}
+
+// NegotiateVersion returns the latest protocol version supported by both
+// peers, it fails if the version ranges do not overlap.
+func NegotiateVersion(min, max, peerMin, peerMax int) (int, error) {
+	v := max
+	if peerMax < v {
+		v = peerMax
+	}
+	if v < min || v < peerMin {
+		return 0, fmt.Errorf("incompatible protocol versions %d-%d and %d-%d", min, max, peerMin, peerMax)
+	}
+	return v, nil
+}
+
+// CheckVersion returns error if tunnel requires features not available in
+// protocol version v.
+func (t *Tunnel) CheckVersion(v int) error {
+	if pv, ok := protocolVersion[t.Protocol]; ok && pv > v {
+		return fmt.Errorf("protocol %s requires protocol version %d", t.Protocol, pv)
+	}
+	if t.Protocol == HTTP && t.Host == "" && v < Version2 {
+		return fmt.Errorf("assigned host requires protocol version %d", Version2)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReadVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		version    string
+		minVersion string
+		min        int
+		max        int
+		err        bool
+	}{
+		{"", "", Version1, Version1, false},
+		{"2", "", 2, 2, false},
+		{"2", "1", 1, 2, false},
+		{"3", "2", 2, 3, false},
+		{"0", "", 0, 0, true},
+		{"x", "", 0, 0, true},
+		{"2", "3", 0, 0, true},
+		{"2", "0", 0, 0, true},
+	}
+
+	for i, tt := range tests {
+		h := http.Header{}
+		if tt.version != "" {
+			h.Set(HeaderVersion, tt.version)
+		}
+		if tt.minVersion != "" {
+			h.Set(HeaderMinVersion, tt.minVersion)
+		}
+		min, max, err := ReadVersion(h)
+		if (err != nil) != tt.err {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+		if min != tt.min || max != tt.max {
+			t.Errorf("[%d] expected %d-%d got %d-%d", i, tt.min, tt.max, min, max)
+		}
+	}
+
+	h := http.Header{}
+	WriteVersion(h, MinVersion, Version)
+	if min, max, err := ReadVersion(h); err != nil || min != MinVersion || max != Version {
+		t.Errorf("expected %d-%d got %d-%d %v", MinVersion, Version, min, max, err)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		min, max, peerMin, peerMax int
+		version                    int
+		err                        bool
+	}{
+		{1, 2, 1, 2, 2, false},
+		{1, 2, 1, 1, 1, false},
+		{1, 1, 1, 2, 1, false},
+		{1, 3, 2, 2, 2, false},
+		{2, 2, 1, 1, 0, true},
+		{1, 1, 2, 3, 0, true},
+		{1, 2, 3, 4, 0, true},
+	}
+
+	for i, tt := range tests {
+		v, err := NegotiateVersion(tt.min, tt.max, tt.peerMin, tt.peerMax)
+		if (err != nil) != tt.err {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+		if v != tt.version {
+			t.Errorf("[%d] expected %d got %d", i, tt.version, v)
+		}
+	}
+}
+
+func TestTunnelCheckVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		tunnel  *Tunnel
+		version int
+		err     bool
+	}{
+		{&Tunnel{Protocol: HTTP, Host: "foo.com"}, Version1, false},
+		{&Tunnel{Protocol: HTTP}, Version1, true},
+		{&Tunnel{Protocol: HTTP}, Version2, false},
+		{&Tunnel{Protocol: TCP, Addr: ":22"}, Version1, false},
+		{&Tunnel{Protocol: CONNECT, Addr: ":3128"}, Version1, true},
+		{&Tunnel{Protocol: CONNECT, Addr: ":3128"}, Version2, false},
+	}
+
+	for i, tt := range tests {
+		if err := tt.tunnel.CheckVersion(tt.version); (err != nil) != tt.err {
+			t.Errorf("[%d] unexpected error %v", i, err)
+		}
+	}
+}
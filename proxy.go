@@ -5,6 +5,8 @@
 package tunnel
 
 import (
+	"context"
+	"fmt"
 	"io"
 
 	"github.com/mmatczuk/go-http-tunnel/proto"
@@ -14,12 +16,27 @@ import (
 // and writing the response.
 type ProxyFunc func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage)
 
+// ProxyFuncContext is like ProxyFunc but it takes a context that is canceled
+// when the stream is closed by the server or the client is stopped. It allows
+// to abort dialing local server and copying data promptly.
+type ProxyFuncContext func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage)
+
+// ProxyFuncWithContext adapts ProxyFunc to ProxyFuncContext, the context is
+// ignored.
+func ProxyFuncWithContext(f ProxyFunc) ProxyFuncContext {
+	return func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		f(w, r, msg)
+	}
+}
+
 // ProxyFuncs is a collection of ProxyFunc.
 type ProxyFuncs struct {
 	// HTTP is custom implementation of HTTP proxing.
 	HTTP ProxyFunc
 	// TCP is custom implementation of TCP proxing.
 	TCP ProxyFunc
+	// Connect is custom implementation of CONNECT gateway proxing.
+	Connect ProxyFunc
 }
 
 // Proxy returns a ProxyFunc that uses custom function if provided.
@@ -31,12 +48,48 @@ func Proxy(p ProxyFuncs) ProxyFunc {
 			f = p.HTTP
 		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
 			f = p.TCP
+		case proto.CONNECT:
+			f = p.Connect
 		}
 
 		if f == nil {
+			proxyError(w, proto.ErrorCodeUnsupportedProtocol, fmt.Errorf("unsupported protocol %q", msg.ForwardedProto))
 			return
 		}
 
 		f(w, r, msg)
 	}
 }
+
+// ProxyFuncsContext is a collection of ProxyFuncContext.
+type ProxyFuncsContext struct {
+	// HTTP is custom implementation of HTTP proxing.
+	HTTP ProxyFuncContext
+	// TCP is custom implementation of TCP proxing.
+	TCP ProxyFuncContext
+	// Connect is custom implementation of CONNECT gateway proxing.
+	Connect ProxyFuncContext
+}
+
+// ProxyContext returns a ProxyFuncContext that uses custom function if
+// provided.
+func ProxyContext(p ProxyFuncsContext) ProxyFuncContext {
+	return func(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		var f ProxyFuncContext
+		switch msg.ForwardedProto {
+		case proto.HTTP, proto.HTTPS:
+			f = p.HTTP
+		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
+			f = p.TCP
+		case proto.CONNECT:
+			f = p.Connect
+		}
+
+		if f == nil {
+			proxyError(w, proto.ErrorCodeUnsupportedProtocol, fmt.Errorf("unsupported protocol %q", msg.ForwardedProto))
+			return
+		}
+
+		f(ctx, w, r, msg)
+	}
+}
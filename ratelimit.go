@@ -0,0 +1,265 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval specifies how often idle limiter entries are
+// removed.
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds up to burst tokens refilled at rate tokens per second, it's
+// not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns full bucket.
+func newTokenBucket(rate, burst float64, now time.Time) tokenBucket {
+	return tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// refill adds tokens accumulated since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take takes a token, it returns false if there is none.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// debit takes n tokens even if there are not enough, it returns how long it
+// takes to pay the debt.
+func (b *tokenBucket) debit(now time.Time, n int) time.Duration {
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full returns true if bucket would be full after refill.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// RateLimit specifies limits of public traffic per remote IP address.
+type RateLimit struct {
+	// RequestsPerSecond specifies rate of HTTP requests and TCP
+	// connections, if 0 rate is not limited.
+	RequestsPerSecond float64
+	// Burst specifies how many requests may exceed the rate at once, if 0
+	// RequestsPerSecond rounded up is used.
+	Burst int
+	// MaxConns specifies maximal number of concurrent HTTP requests and
+	// TCP connections, if 0 it's not limited.
+	MaxConns int
+}
+
+// ipLimiter enforces RateLimit using token bucket per IP address.
+type ipLimiter struct {
+	limit     RateLimit
+	burst     float64
+	clients   map[string]*ipState
+	lastSweep time.Time
+	now       func() time.Time
+	mu        sync.Mutex
+}
+
+type ipState struct {
+	bucket tokenBucket
+	conns  int
+}
+
+func newIPLimiter(limit *RateLimit) *ipLimiter {
+	l := &ipLimiter{
+		limit:   *limit,
+		burst:   float64(limit.Burst),
+		clients: make(map[string]*ipState),
+		now:     time.Now,
+	}
+	if l.burst == 0 {
+		l.burst = math.Ceil(limit.RequestsPerSecond)
+	}
+	return l
+}
+
+// acquire takes a token and a connection slot for addr, release must be
+// called when connection is done.
+func (l *ipLimiter) acquire(addr string) error {
+	ip := remoteIP(addr)
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	c := l.clients[ip]
+	if c == nil {
+		c = &ipState{
+			bucket: newTokenBucket(l.limit.RequestsPerSecond, l.burst, now),
+		}
+		l.clients[ip] = c
+	}
+
+	if l.limit.MaxConns > 0 && c.conns >= l.limit.MaxConns {
+		return errTooManyConns
+	}
+
+	if l.limit.RequestsPerSecond > 0 && !c.bucket.take(now) {
+		return errRateLimited
+	}
+
+	c.conns++
+
+	return nil
+}
+
+// release frees connection slot taken by acquire.
+func (l *ipLimiter) release(addr string) {
+	ip := remoteIP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c := l.clients[ip]; c != nil && c.conns > 0 {
+		c.conns--
+	}
+}
+
+// sweep removes entries of addresses with no connections and full bucket.
+func (l *ipLimiter) sweep(now time.Time) {
+	for ip, c := range l.clients {
+		if c.conns != 0 || !c.bucket.full(now) {
+			continue
+		}
+		delete(l.clients, ip)
+	}
+	l.lastSweep = now
+}
+
+// remoteIP returns IP part of addr, if addr has no port it's returned as is.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// ListenerLimit specifies limits of public connections accepted by a single
+// TCP, SNI or CONNECT tunnel.
+type ListenerLimit struct {
+	// MaxConns specifies maximal number of concurrent connections, if 0
+	// it's not limited.
+	MaxConns int
+	// ConnsPerSecond specifies rate of accepted connections, if 0 rate is
+	// not limited.
+	ConnsPerSecond float64
+	// Burst specifies how many connections may exceed the rate at once, if
+	// 0 ConnsPerSecond rounded up is used.
+	Burst int
+}
+
+// listenerLimiter enforces ListenerLimit using token bucket, methods are safe
+// to call on nil.
+type listenerLimiter struct {
+	limit  ListenerLimit
+	bucket tokenBucket
+	conns  int
+	now    func() time.Time
+	mu     sync.Mutex
+}
+
+// newListenerLimiter returns limiter of server limit lowered by tunnel
+// limits or nil if connections are not limited.
+func newListenerLimiter(limit *ListenerLimit, maxConns int, connRate float64) *listenerLimiter {
+	var l ListenerLimit
+	if limit != nil {
+		l = *limit
+	}
+	if maxConns > 0 && (l.MaxConns == 0 || maxConns < l.MaxConns) {
+		l.MaxConns = maxConns
+	}
+	if connRate > 0 && (l.ConnsPerSecond == 0 || connRate < l.ConnsPerSecond) {
+		l.ConnsPerSecond = connRate
+		l.Burst = 0
+	}
+	if l.MaxConns == 0 && l.ConnsPerSecond == 0 {
+		return nil
+	}
+
+	burst := float64(l.Burst)
+	if burst == 0 {
+		burst = math.Ceil(l.ConnsPerSecond)
+	}
+	return &listenerLimiter{
+		limit:  l,
+		bucket: newTokenBucket(l.ConnsPerSecond, burst, time.Now()),
+		now:    time.Now,
+	}
+}
+
+// acquire takes a token and a connection slot, release must be called when
+// connection is done.
+func (l *listenerLimiter) acquire() error {
+	if l == nil {
+		return nil
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit.MaxConns > 0 && l.conns >= l.limit.MaxConns {
+		return errTooManyConns
+	}
+
+	if l.limit.ConnsPerSecond > 0 && !l.bucket.take(now) {
+		return errRateLimited
+	}
+
+	l.conns++
+
+	return nil
+}
+
+// release frees connection slot taken by acquire.
+func (l *listenerLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	if l.conns > 0 {
+		l.conns--
+	}
+	l.mu.Unlock()
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	b := newTokenBucket(2, 2, now)
+
+	steps := []struct {
+		advance time.Duration
+		take    bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{400 * time.Millisecond, false},
+		{100 * time.Millisecond, true},
+		{10 * time.Second, true},
+		{0, true},
+		{0, false},
+	}
+
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		if ok := b.take(now); ok != s.take {
+			t.Errorf("[%d] expected %v got %v", i, s.take, ok)
+		}
+	}
+
+	if b.full(now) {
+		t.Error("empty bucket is full")
+	}
+	if d := b.debit(now, 3); d != 1500*time.Millisecond {
+		t.Errorf("unexpected debt %s", d)
+	}
+	if !b.full(now.Add(2500 * time.Millisecond)) {
+		t.Error("refilled bucket is not full")
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	l := newIPLimiter(&RateLimit{
+		RequestsPerSecond: 2,
+		MaxConns:          3,
+	})
+	l.now = func() time.Time { return now }
+
+	steps := []struct {
+		addr    string
+		advance time.Duration
+		release bool
+		err     error
+	}{
+		{"1.1.1.1:1", 0, true, nil},
+		{"1.1.1.1:2", 0, true, nil},
+		{"1.1.1.1:3", 0, true, errRateLimited},
+		{"2.2.2.2:1", 0, false, nil},
+		{"1.1.1.1:4", 500 * time.Millisecond, false, nil},
+		{"1.1.1.1:5", time.Second, false, nil},
+		{"1.1.1.1:6", 0, false, nil},
+		{"1.1.1.1:7", time.Second, false, errTooManyConns},
+	}
+
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		err := l.acquire(s.addr)
+		if err != s.err {
+			t.Errorf("[%d] expected error %v got %v", i, s.err, err)
+		}
+		if err == nil && s.release {
+			l.release(s.addr)
+		}
+	}
+}
+
+func TestIPLimiterSweep(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	l := newIPLimiter(&RateLimit{
+		RequestsPerSecond: 1,
+	})
+	l.now = func() time.Time { return now }
+
+	l.acquire("1.1.1.1:1")
+	l.release("1.1.1.1:1")
+	now = now.Add(2 * rateLimitSweepInterval)
+	l.acquire("2.2.2.2:1")
+
+	if _, ok := l.clients["1.1.1.1"]; ok {
+		t.Error("idle entry not removed")
+	}
+	if _, ok := l.clients["2.2.2.2"]; !ok {
+		t.Error("active entry removed")
+	}
+}
+
+func TestListenerLimiter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	l := newListenerLimiter(&ListenerLimit{
+		MaxConns:       10,
+		ConnsPerSecond: 4,
+		Burst:          4,
+	}, 3, 2)
+	l.now = func() time.Time { return now }
+	l.bucket.last = now
+
+	steps := []struct {
+		advance time.Duration
+		release bool
+		err     error
+	}{
+		{0, true, nil},
+		{0, true, nil},
+		{0, true, errRateLimited},
+		{500 * time.Millisecond, false, nil},
+		{time.Second, false, nil},
+		{0, false, nil},
+		{time.Second, false, errTooManyConns},
+	}
+
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		err := l.acquire()
+		if err != s.err {
+			t.Errorf("[%d] expected error %v got %v", i, s.err, err)
+		}
+		if err == nil && s.release {
+			l.release()
+		}
+	}
+
+	if l := newListenerLimiter(nil, 0, 0); l != nil {
+		t.Error("expected nil limiter")
+	}
+	if l := newListenerLimiter(&ListenerLimit{MaxConns: 2}, 5, 0); l.limit.MaxConns != 2 {
+		t.Errorf("tunnel raised server limit %+v", l.limit)
+	}
+	var nl *listenerLimiter
+	if err := nl.acquire(); err != nil {
+		t.Error(err)
+	}
+	nl.release()
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(&ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{},
+		RateLimit: &RateLimit{
+			RequestsPerSecond: 1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	codes := []int{http.StatusNotFound, http.StatusTooManyRequests}
+	for i, code := range codes {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != code {
+			t.Errorf("[%d] expected status %d got %d", i, code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// DefaultRedactHeaders specifies headers carrying credentials, their values
+// are always redacted from request logs and inspector API.
+var DefaultRedactHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// RedactedValue replaces values of redacted headers.
+const RedactedValue = "[REDACTED]"
+
+// RedactHeader returns copy of h with values of DefaultRedactHeaders and
+// headers in names replaced with RedactedValue.
+func RedactHeader(h http.Header, names ...string) http.Header {
+	h2 := cloneHeader(h)
+	for _, names := range [][]string{DefaultRedactHeaders, names} {
+		for _, name := range names {
+			vv, ok := h2[http.CanonicalHeaderKey(name)]
+			if !ok {
+				continue
+			}
+			for i := range vv {
+				vv[i] = RedactedValue
+			}
+		}
+	}
+	return h2
+}
+
+// redactedHeader is a header logged with values redacted, the header is
+// copied only if the message is actually written.
+type redactedHeader struct {
+	header http.Header
+	names  []string
+}
+
+func (h redactedHeader) String() string {
+	return fmt.Sprint(RedactHeader(h.header, h.names...))
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRedactHeader(t *testing.T) {
+	t.Parallel()
+
+	h := http.Header{
+		"Authorization": {"Bearer token"},
+		"Cookie":        {"a=1", "b=2"},
+		"X-Api-Key":     {"secret"},
+		"X-Foo":         {"bar"},
+	}
+
+	tests := []struct {
+		names    []string
+		expected http.Header
+	}{
+		{
+			nil,
+			http.Header{
+				"Authorization": {RedactedValue},
+				"Cookie":        {RedactedValue, RedactedValue},
+				"X-Api-Key":     {"secret"},
+				"X-Foo":         {"bar"},
+			},
+		},
+		{
+			[]string{"x-api-key", "X-Missing"},
+			http.Header{
+				"Authorization": {RedactedValue},
+				"Cookie":        {RedactedValue, RedactedValue},
+				"X-Api-Key":     {RedactedValue},
+				"X-Foo":         {"bar"},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		if r := RedactHeader(h, tt.names...); !reflect.DeepEqual(r, tt.expected) {
+			t.Errorf("[%d] expected %v got %v", i, tt.expected, r)
+		}
+	}
+
+	if h.Get("Authorization") != "Bearer token" {
+		t.Error("header modified")
+	}
+	if s := (redactedHeader{h, nil}).String(); s != "map[Authorization:[[REDACTED]] Cookie:[[REDACTED] [REDACTED]] X-Api-Key:[secret] X-Foo:[bar]]" {
+		t.Errorf("unexpected string %s", s)
+	}
+}
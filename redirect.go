@@ -0,0 +1,56 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPSRedirect specifies redirection of plain HTTP requests to HTTPS.
+type HTTPSRedirect struct {
+	// All if enabled redirects requests to all hosts, otherwise only hosts
+	// of tunnels with HTTPSOnly set are redirected.
+	All bool
+	// Port is the HTTPS server port, if 0 or 443 it's omitted in redirect
+	// location.
+	Port int
+	// HSTSMaxAge if positive adds Strict-Transport-Security header with
+	// the max-age to HTTPS responses of redirected hosts.
+	HSTSMaxAge time.Duration
+}
+
+// redirectHTTPS redirects plain HTTP request with 301 status code if HTTPS
+// redirect is enabled for the host, for HTTPS requests it sets HSTS header.
+// It returns true if request was redirected.
+func (s *Server) redirectHTTPS(w http.ResponseWriter, r *http.Request) bool {
+	c := s.config.HTTPSRedirect
+	if c == nil {
+		return false
+	}
+
+	h := s.registry.lookup(r.Host)
+	if h == nil || !(c.All || h.httpsOnly) {
+		return false
+	}
+
+	if r.TLS != nil {
+		if c.HSTSMaxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int64(c.HSTSMaxAge/time.Second)))
+		}
+		return false
+	}
+
+	host := trimPort(r.Host)
+	if c.Port != 0 && c.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(c.Port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+
+	return true
+}
@@ -7,6 +7,7 @@ package tunnel
 import (
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 
 	"github.com/mmatczuk/go-http-tunnel/id"
@@ -24,11 +25,21 @@ type RegistryItem struct {
 type HostAuth struct {
 	Host string
 	Auth *Auth
+	// Priority is the tunnel priority weight, 0 means default.
+	Priority int
+	// MaxBodySize is the maximal request body size in bytes, 0 means no
+	// limit.
+	MaxBodySize int64
+	// HTTPSOnly specifies if plain HTTP requests are redirected to HTTPS.
+	HTTPSOnly bool
 }
 
 type hostInfo struct {
-	identifier id.ID
-	auth       *Auth
+	identifier  id.ID
+	auth        *Auth
+	priority    int
+	maxBodySize int64
+	httpsOnly   bool
 }
 
 type registry struct {
@@ -91,6 +102,14 @@ func (r *registry) Subscriber(hostPort string) (id.ID, *Auth, bool) {
 	return h.identifier, h.auth, ok
 }
 
+// lookup returns information on tunnel serving hostPort or nil.
+func (r *registry) lookup(hostPort string) *hostInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.hosts[trimPort(hostPort)]
+}
+
 // Unsubscribe removes client from registry and returns it's RegistryItem.
 func (r *registry) Unsubscribe(identifier id.ID) *RegistryItem {
 	r.mu.Lock()
@@ -148,8 +167,11 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 
 		for _, h := range i.Hosts {
 			r.hosts[trimPort(h.Host)] = &hostInfo{
-				identifier: identifier,
-				auth:       h.Auth,
+				identifier:  identifier,
+				auth:        h.Auth,
+				priority:    h.Priority,
+				maxBodySize: h.MaxBodySize,
+				httpsOnly:   h.HTTPSOnly,
 			}
 		}
 	}
@@ -188,7 +210,8 @@ func (r *registry) clear(identifier id.ID) *RegistryItem {
 func trimPort(hostPort string) (host string) {
 	host, _, _ = net.SplitHostPort(hostPort)
 	if host == "" {
-		host = hostPort
+		// IPv6 literal without port
+		host = strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]")
 	}
 	return
 }
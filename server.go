@@ -5,14 +5,22 @@
 package tunnel
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base32"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,18 +37,145 @@ type ServerConfig struct {
 	// Addr is TCP address to listen for client connections. If empty ":0"
 	// is used.
 	Addr string
+	// Network is the network of Addr and SNIAddr listeners, "tcp4" or
+	// "tcp6" restrict listeners to IPv4 or IPv6. If empty "tcp" is used and
+	// addresses without host listen on both IPv4 and IPv6 if the system
+	// supports it.
+	Network string
 	// AutoSubscribe if enabled will automatically subscribe new clients on
 	// first call.
 	AutoSubscribe bool
 	// TLSConfig specifies the tls configuration to use with tls.Listener.
 	TLSConfig *tls.Config
+	// ClientCAs specifies optional pool of certificate authorities used to
+	// verify client certificates. Clients are accepted only if subscribed,
+	// see AutoSubscribe and SubscribeVerifiedClients.
+	ClientCAs *x509.CertPool
+	// RequireVerifiedClientCert if enabled only clients with certificates
+	// signed by one of ClientCAs are accepted. Requires ClientCAs.
+	RequireVerifiedClientCert bool
+	// SubscribeVerifiedClients if enabled clients with certificates signed
+	// by one of ClientCAs are subscribed on connect, so any certificate
+	// issued by the authorities is accepted. Requires ClientCAs.
+	SubscribeVerifiedClients bool
 	// Listener specifies optional listener for client connections. If nil
-	// tls.Listen("tcp", Addr, TLSConfig) is used.
+	// tls.Listen(Network, Addr, TLSConfig) is used.
 	Listener net.Listener
 	// Logger is optional logger. If nil logging is disabled.
 	Logger log.Logger
 	// Addr is TCP address to listen for TLS SNI connections
 	SNIAddr string
+	// WebSocket if enabled accepts client connections over WebSocket,
+	// requests to WebSocketPath opening client connections are upgraded
+	// instead of being proxied. Server must be served over HTTPS.
+	WebSocket bool
+	// ModifyRequest is an optional function that modifies HTTP request
+	// before it's dispatched to the client. It's invoked after the request
+	// is authenticated and forwarding headers are set, the request routing
+	// is based on the original Host. If it returns an error the request is
+	// not dispatched and the caller gets 502.
+	ModifyRequest func(*http.Request) error
+	// ModifyResponse is an optional function that modifies HTTP response
+	// from the client. If it returns an error the caller gets 502.
+	ModifyResponse func(*http.Response) error
+	// ErrorPages specifies optional templates of error responses served to
+	// HTTP callers by status code i.e. 404 for unknown host, 502 for
+	// client offline and 504 for timeout. Templates are executed with
+	// ErrorPageData.
+	ErrorPages map[int]*template.Template
+	// MaxRequestBodySize specifies the maximal size of HTTP request body in
+	// bytes, requests with larger bodies are rejected with 413 status code.
+	// If body of unknown length exceeds the limit after the response status
+	// is sent the response is aborted. Tunnels may specify lower limits. If 0
+	// there is no limit.
+	MaxRequestBodySize int64
+	// RateLimit specifies optional limits of public HTTP requests and TCP
+	// connections per remote IP address. HTTP requests over the limit are
+	// rejected with 429 status code, TCP connections are closed.
+	RateLimit *RateLimit
+	// ListenerLimit specifies optional limits of public connections per
+	// TCP, SNI and CONNECT tunnel, connections over the limits are closed
+	// right after accept so that a flood against one tunnel does not
+	// exhaust streams of the client connection. Tunnels may specify lower
+	// limits.
+	ListenerLimit *ListenerLimit
+	// MaxTunnelsPerClient specifies the maximal number of tunnels a client
+	// may register, clients requesting more are rejected. If 0 there is no
+	// limit.
+	MaxTunnelsPerClient int
+	// MaxHostsPerClient specifies the maximal number of HTTP and SNI hosts
+	// a client may register, clients requesting more are rejected. If 0
+	// there is no limit.
+	MaxHostsPerClient int
+	// HTTPSRedirect specifies optional redirection of plain HTTP requests
+	// to HTTPS, it should be set only if server serves HTTPS.
+	HTTPSRedirect *HTTPSRedirect
+	// AuditSink optionally receives records of all client registration
+	// attempts.
+	AuditSink AuditSink
+	// TunnelPolicy is an optional function invoked for every tunnel
+	// requested by a client. If it returns an error the client is rejected.
+	TunnelPolicy func(identifier id.ID, t *proto.Tunnel) error
+	// OnEvent is an optional function invoked on client and tunnel
+	// lifecycle events, it must not block.
+	OnEvent func(*Event)
+	// StateStore optionally persists hosts and listener addresses
+	// allocated to clients. On start allocations are restored, TCP
+	// listeners are bound immediately, and reserved for their clients for
+	// ReservationTimeout.
+	StateStore StateStore
+	// ReservationTimeout specifies how long restored allocations are
+	// reserved, if 0 DefaultReservationTimeout is used.
+	ReservationTimeout time.Duration
+	// Tenant is an optional function returning tenant of a client based
+	// on identifier and certificate, if it returns nil client has no
+	// quotas. Tunnels over tenant quotas are rejected on registration,
+	// HTTP requests over stream quota get 429 and TCP connections are
+	// closed.
+	Tenant func(identifier id.ID, cert *x509.Certificate) *Tenant
+	// BaseDomain enables hosts assigned by the server, HTTP tunnels
+	// registered with empty host get a random subdomain of BaseDomain.
+	BaseDomain string
+	// DialTimeout specifies how long to wait for the client to connect TCP
+	// stream to local service, on timeout public connection is closed. If
+	// 0 there is no timeout.
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout specifies how long to wait for the client to
+	// send response headers of HTTP request, on timeout the caller gets
+	// 504. If 0 there is no timeout.
+	ResponseHeaderTimeout time.Duration
+	// MinProtocolVersion specifies the oldest protocol version of accepted
+	// clients, it allows to retire old clients after protocol change. If 0
+	// proto.MinVersion is used.
+	MinProtocolVersion int
+	// RedactHeaders specifies names of headers which values are redacted
+	// from request logs in addition to DefaultRedactHeaders.
+	RedactHeaders []string
+	// TrustedProxies specifies networks of proxies in front of the server
+	// i.e. load balancers. Forwarding headers X-Forwarded-For,
+	// X-Forwarded-Host, X-Forwarded-Proto and Forwarded of requests from
+	// trusted proxies are kept and extended, for other requests they are
+	// replaced so that callers can't spoof their address.
+	TrustedProxies []*net.IPNet
+	// CertificateHosts if enabled clients with certificates signed by one
+	// of ClientCAs may register only HTTP and SNI hosts returned by
+	// CertificateHosts for their certificates, issuing a certificate
+	// authorizes its hosts. Hosts assigned by the server are allowed.
+	// Clients with unverified certificates are not restricted. Requires
+	// ClientCAs.
+	CertificateHosts bool
+}
+
+// ErrorPageData is passed to error page templates.
+type ErrorPageData struct {
+	// StatusCode is HTTP response status code.
+	StatusCode int
+	// Status is HTTP response status text.
+	Status string
+	// Host is requested host.
+	Host string
+	// Code is error code reported by the client if any.
+	Code string
 }
 
 // Server is responsible for proxying public connections to the client over a
@@ -52,12 +187,36 @@ type Server struct {
 	listener   net.Listener
 	connPool   *connPool
 	httpClient *http.Client
+	limiter    *ipLimiter
+	metrics    *tunnelMetrics
+	reserved   *reservations
+	tenants    *tenants
+	certHosts  *certHosts
 	logger     log.Logger
 	vhostMuxer *vhost.TLSMuxer
 }
 
 // NewServer creates a new Server.
 func NewServer(config *ServerConfig) (*Server, error) {
+	if (config.RequireVerifiedClientCert || config.SubscribeVerifiedClients || config.CertificateHosts) && config.ClientCAs == nil {
+		return nil, errors.New("missing ClientCAs")
+	}
+	if l := config.RateLimit; l != nil && (l.RequestsPerSecond < 0 || l.Burst < 0 || l.MaxConns < 0) {
+		return nil, errors.New("invalid RateLimit")
+	}
+	if l := config.ListenerLimit; l != nil && (l.MaxConns < 0 || l.ConnsPerSecond < 0 || l.Burst < 0) {
+		return nil, errors.New("invalid ListenerLimit")
+	}
+	if config.MaxTunnelsPerClient < 0 {
+		return nil, errors.New("invalid MaxTunnelsPerClient")
+	}
+	if config.MaxHostsPerClient < 0 {
+		return nil, errors.New("invalid MaxHostsPerClient")
+	}
+	if v := config.MinProtocolVersion; v != 0 && (v < proto.MinVersion || v > proto.Version) {
+		return nil, fmt.Errorf("invalid MinProtocolVersion, must be in range %d-%d", proto.MinVersion, proto.Version)
+	}
+
 	listener, err := listener(config)
 	if err != nil {
 		return nil, fmt.Errorf("listener failed: %s", err)
@@ -69,10 +228,21 @@ func NewServer(config *ServerConfig) (*Server, error) {
 	}
 
 	s := &Server{
-		registry: newRegistry(logger),
-		config:   config,
-		listener: listener,
-		logger:   logger,
+		registry:  newRegistry(logger),
+		config:    config,
+		listener:  listener,
+		metrics:   newTunnelMetrics(),
+		tenants:   newTenants(),
+		certHosts: newCertHosts(),
+		logger:    logger,
+	}
+	if config.RateLimit != nil {
+		s.limiter = newIPLimiter(config.RateLimit)
+	}
+	if config.StateStore != nil {
+		if err := s.restore(); err != nil {
+			return nil, fmt.Errorf("failed to restore state: %s", err)
+		}
 	}
 
 	t := &http2.Transport{}
@@ -87,7 +257,7 @@ func NewServer(config *ServerConfig) (*Server, error) {
 	}
 
 	if config.SNIAddr != "" {
-		l, err := net.Listen("tcp", config.SNIAddr)
+		l, err := net.Listen(config.network(), config.SNIAddr)
 		if err != nil {
 			return nil, err
 		}
@@ -149,7 +319,14 @@ func listener(config *ServerConfig) (net.Listener, error) {
 		return nil, errors.New("missing TLSConfig")
 	}
 
-	return net.Listen("tcp", config.Addr)
+	return net.Listen(config.network(), config.Addr)
+}
+
+func (c *ServerConfig) network() string {
+	if c.Network == "" {
+		return "tcp"
+	}
+	return c.Network
 }
 
 // disconnected clears resources used by client, it's invoked by connection pool
@@ -161,10 +338,22 @@ func (s *Server) disconnected(identifier id.ID) {
 		"identifier", identifier,
 	)
 
+	s.tenants.of(identifier).unregister(identifier)
+	s.certHosts.assign(identifier, nil)
+
 	i := s.registry.clear(identifier)
 	if i == nil {
 		return
 	}
+	for _, h := range i.Hosts {
+		s.metrics.remove(httpTunnelName(h.Host))
+		s.emit(&Event{
+			Type:       EventTunnelWithdrawn,
+			Identifier: identifier,
+			Protocol:   proto.HTTP,
+			Host:       h.Host,
+		})
+	}
 	for _, l := range i.Listeners {
 		s.logger.Log(
 			"level", 2,
@@ -173,7 +362,19 @@ func (s *Server) disconnected(identifier id.ID) {
 			"addr", l.Addr(),
 		)
 		l.Close()
+		s.metrics.remove(listenerName(l))
+		s.emit(&Event{
+			Type:       EventTunnelWithdrawn,
+			Identifier: identifier,
+			Protocol:   l.Addr().Network(),
+			Addr:       l.Addr().String(),
+		})
 	}
+
+	s.emit(&Event{
+		Type:       EventClientDisconnected,
+		Identifier: identifier,
+	})
 }
 
 // Start starts accepting connections form clients. For accepting http traffic
@@ -236,6 +437,10 @@ func (s *Server) handleClient(conn net.Conn) {
 		tunnels    map[string]*proto.Tunnel
 		err        error
 		ok         bool
+		verified   bool
+		reason     string
+
+		version, peerMin, peerMax int
 
 		inConnPool bool
 	)
@@ -247,6 +452,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "invalid connection type",
 			"err", fmt.Errorf("expected TLS conn, got %T", conn),
 		)
+		reason = "invalid connection type"
 		goto reject
 	}
 
@@ -257,18 +463,37 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "certificate error",
 			"err", err,
 		)
+		reason = "certificate error"
 		goto reject
 	}
 
 	logger = logger.With("identifier", identifier)
 
-	if s.config.AutoSubscribe {
+	if s.config.ClientCAs != nil {
+		err = s.verifyClientCert(tlsConn)
+		verified = err == nil
+		if err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "certificate verification failed",
+				"err", err,
+			)
+			if s.config.RequireVerifiedClientCert {
+				reason = "certificate verification failed"
+				goto reject
+			}
+			err = nil
+		}
+	}
+
+	if s.config.AutoSubscribe || (verified && s.config.SubscribeVerifiedClients) {
 		s.Subscribe(identifier)
 	} else if !s.IsSubscribed(identifier) {
 		logger.Log(
 			"level", 2,
 			"msg", "unknown client",
 		)
+		reason = "unknown client"
 		goto reject
 	}
 
@@ -278,19 +503,29 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "setting infinite deadline failed",
 			"err", err,
 		)
+		reason = "setting infinite deadline failed"
 		goto reject
 	}
 
-	if err := s.connPool.AddConn(conn, identifier); err != nil {
+	if err = s.connPool.AddConn(conn, identifier); err != nil {
 		logger.Log(
 			"level", 2,
 			"msg", "adding connection failed",
 			"err", err,
 		)
+		reason = "adding connection failed"
 		goto reject
 	}
 	inConnPool = true
 
+	// assigned after replaced connection of the client is removed from pool
+	if s.config.Tenant != nil {
+		s.tenants.assign(identifier, s.config.Tenant(identifier, tlsConn.ConnectionState().PeerCertificates[0]))
+	}
+	if s.config.CertificateHosts && verified {
+		s.certHosts.assign(identifier, tlsConn.ConnectionState().PeerCertificates[0])
+	}
+
 	req, err = http.NewRequest(http.MethodConnect, s.connPool.URL(identifier), nil)
 	if err != nil {
 		logger.Log(
@@ -298,8 +533,10 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake request creation failed",
 			"err", err,
 		)
+		reason = "handshake request creation failed"
 		goto reject
 	}
+	proto.WriteVersion(req.Header, s.minProtocolVersion(), proto.Version)
 
 	{
 		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
@@ -314,9 +551,27 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake failed"
 		goto reject
 	}
 
+	// version is checked first, client with incompatible version fails
+	// the handshake
+	peerMin, peerMax, err = proto.ReadVersion(resp.Header)
+	if err == nil {
+		version, err = proto.NegotiateVersion(s.minProtocolVersion(), proto.Version, peerMin, peerMax)
+	}
+	if err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "handshake failed",
+			"err", err,
+		)
+		reason = "unsupported protocol version"
+		goto reject
+	}
+	s.connPool.stats(identifier).setVersion(version)
+
 	if resp.StatusCode != http.StatusOK {
 		err = fmt.Errorf("Status %s", resp.Status)
 		logger.Log(
@@ -324,6 +579,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake failed"
 		goto reject
 	}
 
@@ -334,6 +590,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake failed"
 		goto reject
 	}
 
@@ -343,6 +600,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake failed"
 		goto reject
 	}
 
@@ -353,6 +611,23 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake failed"
+		goto reject
+	}
+
+	for name, t := range tunnels {
+		if err = t.CheckVersion(version); err != nil {
+			err = fmt.Errorf("tunnel %s: %s", name, err)
+			break
+		}
+	}
+	if err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "handshake failed",
+			"err", err,
+		)
+		reason = "handshake failed"
 		goto reject
 	}
 
@@ -362,14 +637,34 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake failed"
 		goto reject
 	}
+	s.connPool.prioritize(identifier, tunnels)
+
+	if version >= proto.Version2 {
+		s.notifyRegistered(tunnels, identifier)
+	}
 
 	logger.Log(
 		"level", 1,
 		"action", "connected",
+		"version", version,
 	)
 
+	s.emit(&Event{
+		Type:       EventClientConnected,
+		Identifier: identifier,
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+
+	s.audit(&AuditRecord{
+		Identifier: identifier,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Hosts:      tunnelHosts(tunnels),
+		Accepted:   true,
+	})
+
 	return
 
 reject:
@@ -378,6 +673,16 @@ reject:
 		"action", "rejected",
 	)
 
+	if err != nil {
+		reason = fmt.Sprintf("%s: %s", reason, err)
+	}
+	s.audit(&AuditRecord{
+		Identifier: identifier,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Hosts:      tunnelHosts(tunnels),
+		Reason:     reason,
+	})
+
 	if inConnPool {
 		s.notifyError(err, identifier)
 		s.connPool.DeleteConn(identifier)
@@ -386,6 +691,26 @@ reject:
 	conn.Close()
 }
 
+// verifyClientCert verifies client certificate chain against ClientCAs.
+func (s *Server) verifyClientCert(conn *tls.Conn) error {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         s.config.ClientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
 // notifyError tries to send error to client.
 func (s *Server) notifyError(serverError error, identifier id.ID) {
 	if serverError == nil {
@@ -411,6 +736,57 @@ func (s *Server) notifyError(serverError error, identifier id.ID) {
 	s.httpClient.Do(req.WithContext(ctx))
 }
 
+// notifyRegistered tries to send registered tunnels to client, hosts
+// assigned by the server are set.
+func (s *Server) notifyRegistered(tunnels map[string]*proto.Tunnel, identifier id.ID) {
+	b, err := json.Marshal(tunnels)
+	if err == nil {
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodConnect, s.connPool.URL(identifier), bytes.NewReader(b))
+		if err == nil {
+			req.Header.Set(proto.HeaderRegistered, "1")
+
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+			defer cancel()
+
+			var resp *http.Response
+			resp, err = s.httpClient.Do(req.WithContext(ctx))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	if err != nil {
+		s.logger.Log(
+			"level", 2,
+			"action", "client registration notification failed",
+			"identifier", identifier,
+			"err", err,
+		)
+	}
+}
+
+func (s *Server) minProtocolVersion() int {
+	if s.config.MinProtocolVersion > 0 {
+		return s.config.MinProtocolVersion
+	}
+	return proto.MinVersion
+}
+
+// randomHost returns a random subdomain of BaseDomain.
+func (s *Server) randomHost() (string, error) {
+	if s.config.BaseDomain == "" {
+		return "", errors.New("missing host")
+	}
+
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b)) + "." + s.config.BaseDomain, nil
+}
+
 // addTunnels invokes addHost or addListener based on data from proto.Tunnel. If
 // a tunnel cannot be added whole batch is reverted.
 func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID) error {
@@ -419,15 +795,81 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 		Listeners: []net.Listener{},
 	}
 
-	var err error
+	var (
+		registered []*Event
+		listened   = make(map[net.Listener]*proto.Tunnel)
+		claimed    = make(map[net.Listener]*proto.Tunnel)
+		err        error
+	)
+	if err = s.checkClientQuota(tunnels); err != nil {
+		return err
+	}
+	if err = s.tenants.of(identifier).register(identifier, tunnels); err != nil {
+		return err
+	}
+
 	for name, t := range tunnels {
+		if (t.Protocol == proto.HTTP && t.Host != "") || t.Protocol == proto.SNI {
+			if err = s.certHosts.check(identifier, t.Host); err != nil {
+				err = fmt.Errorf("tunnel %s not allowed: %s", name, err)
+				goto rollback
+			}
+		}
+		if t.Protocol == proto.HTTP && t.Host == "" {
+			if t.Host, err = s.randomHost(); err != nil {
+				err = fmt.Errorf("tunnel %s: %s", name, err)
+				goto rollback
+			}
+		}
+		if t.Priority != 0 && (t.Priority < proto.MinPriority || t.Priority > proto.MaxPriority) {
+			err = fmt.Errorf("invalid priority for tunnel %s: %d", name, t.Priority)
+			goto rollback
+		}
+		if t.MaxBodySize < 0 {
+			err = fmt.Errorf("invalid max body size for tunnel %s: %d", name, t.MaxBodySize)
+			goto rollback
+		}
+		if t.MaxConns < 0 || t.ConnRate < 0 {
+			err = fmt.Errorf("invalid connection limits for tunnel %s", name)
+			goto rollback
+		}
+		if s.config.TunnelPolicy != nil {
+			if err = s.config.TunnelPolicy(identifier, t); err != nil {
+				err = fmt.Errorf("tunnel %s not allowed: %s", name, err)
+				goto rollback
+			}
+		}
+		if err = s.checkReserved(identifier, t); err != nil {
+			err = fmt.Errorf("tunnel %s: %s", name, err)
+			goto rollback
+		}
+
 		switch t.Protocol {
 		case proto.HTTP:
-			i.Hosts = append(i.Hosts, &HostAuth{t.Host, NewAuth(t.Auth)})
+			i.Hosts = append(i.Hosts, &HostAuth{t.Host, NewAuth(t.Auth), t.Priority, t.MaxBodySize, t.HTTPSOnly})
+			registered = append(registered, &Event{
+				Type:       EventTunnelRegistered,
+				Identifier: identifier,
+				Tunnel:     name,
+				Protocol:   t.Protocol,
+				Host:       t.Host,
+			})
 		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
-			var l net.Listener
-			l, err = net.Listen(t.Protocol, t.Addr)
+			l := s.claimListener(identifier, t.Protocol, t.Addr)
+			if l != nil {
+				claimed[l] = t
+			} else {
+				l, err = net.Listen(t.Protocol, t.Addr)
+			}
 			if err != nil {
+				s.emit(&Event{
+					Type:       EventListenerFailed,
+					Identifier: identifier,
+					Tunnel:     name,
+					Protocol:   t.Protocol,
+					Addr:       t.Addr,
+					Error:      err.Error(),
+				})
 				goto rollback
 			}
 
@@ -439,6 +881,46 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 			)
 
 			i.Listeners = append(i.Listeners, l)
+			listened[l] = t
+			registered = append(registered, &Event{
+				Type:       EventTunnelRegistered,
+				Identifier: identifier,
+				Tunnel:     name,
+				Protocol:   t.Protocol,
+				Addr:       l.Addr().String(),
+			})
+		case proto.CONNECT:
+			var l net.Listener
+			l, err = net.Listen("tcp", t.Addr)
+			if err != nil {
+				s.emit(&Event{
+					Type:       EventListenerFailed,
+					Identifier: identifier,
+					Tunnel:     name,
+					Protocol:   t.Protocol,
+					Addr:       t.Addr,
+					Error:      err.Error(),
+				})
+				goto rollback
+			}
+			l = &connectListener{Listener: l, auth: NewAuth(t.Auth)}
+
+			s.logger.Log(
+				"level", 2,
+				"action", "open CONNECT listener",
+				"identifier", identifier,
+				"addr", l.Addr(),
+			)
+
+			i.Listeners = append(i.Listeners, l)
+			listened[l] = t
+			registered = append(registered, &Event{
+				Type:       EventTunnelRegistered,
+				Identifier: identifier,
+				Tunnel:     name,
+				Protocol:   t.Protocol,
+				Addr:       l.Addr().String(),
+			})
 		case proto.SNI:
 			if s.vhostMuxer == nil {
 				err = fmt.Errorf("unable to configure SNI for tunnel %s: %s", name, t.Protocol)
@@ -447,6 +929,14 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 			var l net.Listener
 			l, err = s.vhostMuxer.Listen(t.Host)
 			if err != nil {
+				s.emit(&Event{
+					Type:       EventListenerFailed,
+					Identifier: identifier,
+					Tunnel:     name,
+					Protocol:   t.Protocol,
+					Host:       t.Host,
+					Error:      err.Error(),
+				})
 				goto rollback
 			}
 
@@ -458,6 +948,14 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 			)
 
 			i.Listeners = append(i.Listeners, l)
+			listened[l] = t
+			registered = append(registered, &Event{
+				Type:       EventTunnelRegistered,
+				Identifier: identifier,
+				Tunnel:     name,
+				Protocol:   t.Protocol,
+				Host:       t.Host,
+			})
 		default:
 			err = fmt.Errorf("unsupported protocol for tunnel %s: %s", name, t.Protocol)
 			goto rollback
@@ -470,19 +968,61 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 	}
 
 	for _, l := range i.Listeners {
-		go s.listen(l, identifier)
+		t := listened[l]
+		go s.listen(l, identifier, t.Priority, newListenerLimiter(s.config.ListenerLimit, t.MaxConns, t.ConnRate))
+	}
+
+	s.releaseClient(identifier)
+	s.saveAllocations(identifier, tunnels)
+
+	for _, e := range registered {
+		s.emit(e)
 	}
 
 	return nil
 
 rollback:
+	s.tenants.of(identifier).unregister(identifier)
 	for _, l := range i.Listeners {
+		if t, ok := claimed[l]; ok {
+			s.unclaimListener(identifier, t.Protocol, t.Addr, l)
+			continue
+		}
 		l.Close()
 	}
 
 	return err
 }
 
+// checkClientQuota checks that tunnels do not exceed per client limits.
+func (s *Server) checkClientQuota(tunnels map[string]*proto.Tunnel) error {
+	if max := s.config.MaxTunnelsPerClient; max > 0 && len(tunnels) > max {
+		return fmt.Errorf("tunnels quota exceeded, %d requested, %d allowed per client", len(tunnels), max)
+	}
+
+	hosts := 0
+	for _, t := range tunnels {
+		if t.Protocol == proto.HTTP || t.Protocol == proto.SNI {
+			hosts++
+		}
+	}
+	if max := s.config.MaxHostsPerClient; max > 0 && hosts > max {
+		return fmt.Errorf("hosts quota exceeded, %d requested, %d allowed per client", hosts, max)
+	}
+
+	return nil
+}
+
+// maxBodySize returns request body size limit for host, tunnel limit may only
+// lower the server limit.
+func (s *Server) maxBodySize(h *hostInfo) int64 {
+	limit := s.config.MaxRequestBodySize
+	if h.maxBodySize > 0 && (limit == 0 || h.maxBodySize < limit) {
+		limit = h.maxBodySize
+	}
+	return limit
+}
+
 // Unsubscribe removes client from registry, disconnects client if already
 // connected and returns it's RegistryItem.
 func (s *Server) Unsubscribe(identifier id.ID) *RegistryItem {
@@ -495,8 +1035,9 @@ func (s *Server) Ping(identifier id.ID) (time.Duration, error) {
 	return s.connPool.Ping(identifier)
 }
 
-func (s *Server) listen(l net.Listener, identifier id.ID) {
+func (s *Server) listen(l net.Listener, identifier id.ID, priority int, limiter *listenerLimiter) {
 	addr := l.Addr().String()
+	st := s.metrics.stats(listenerName(l), identifier)
 
 	for {
 		conn, err := l.Accept()
@@ -522,9 +1063,38 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 			continue
 		}
 
+		if err := limiter.acquire(); err != nil {
+			s.logger.Log(
+				"level", 2,
+				"msg", "connection rejected",
+				"identifier", identifier,
+				"addr", conn.RemoteAddr(),
+				"listener", addr,
+				"err", err,
+			)
+			conn.Close()
+			continue
+		}
+
+		if s.limiter != nil {
+			if err := s.limiter.acquire(conn.RemoteAddr().String()); err != nil {
+				s.logger.Log(
+					"level", 2,
+					"msg", "connection rejected",
+					"identifier", identifier,
+					"addr", conn.RemoteAddr(),
+					"err", err,
+				)
+				limiter.release()
+				conn.Close()
+				continue
+			}
+		}
+
 		msg := &proto.ControlMessage{
 			Action:         proto.ActionProxy,
 			ForwardedProto: l.Addr().Network(),
+			Priority:       priority,
 		}
 
 		tlsConn, ok := conn.(*vhost.TLSConn)
@@ -547,8 +1117,27 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 			)
 		}
 
-		go func() {
-			if err := s.proxyConn(identifier, conn, msg); err != nil {
+		go func(conn net.Conn) {
+			defer limiter.release()
+			if s.limiter != nil {
+				defer s.limiter.release(conn.RemoteAddr().String())
+			}
+			if cl, ok := l.(*connectListener); ok {
+				c, err := s.connectHandshake(cl, conn, msg)
+				if err != nil {
+					s.logger.Log(
+						"level", 1,
+						"msg", "CONNECT request rejected",
+						"identifier", identifier,
+						"addr", conn.RemoteAddr(),
+						"err", err,
+					)
+					conn.Close()
+					return
+				}
+				conn = c
+			}
+			if err := s.proxyConn(identifier, conn, msg, st); err != nil {
 				s.logger.Log(
 					"level", 0,
 					"msg", "proxy error",
@@ -557,12 +1146,49 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 					"err", err,
 				)
 			}
-		}()
+		}(conn)
 	}
 }
 
 // ServeHTTP proxies http connection to the client.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.WebSocket && isWebSocketTunnel(r) {
+		s.serveWebSocket(w, r)
+		return
+	}
+
+	if s.limiter != nil {
+		ip := s.clientIP(r)
+		if err := s.limiter.acquire(ip); err != nil {
+			s.logger.Log(
+				"level", 2,
+				"msg", "request rejected",
+				"addr", r.RemoteAddr,
+				"client", ip,
+				"host", r.Host,
+				"err", err,
+			)
+			w.Header().Set("Retry-After", "1")
+			s.writeError(w, r, err)
+			return
+		}
+		defer s.limiter.release(ip)
+	}
+
+	if s.redirectHTTPS(w, r) {
+		return
+	}
+
+	s.logger.Log(
+		"level", 3,
+		"action", "request",
+		"addr", r.RemoteAddr,
+		"host", r.Host,
+		"method", r.Method,
+		"url", r.URL,
+		"header", redactedHeader{r.Header, s.config.RedactHeaders},
+	)
+
 	resp, err := s.RoundTrip(r)
 	if err == errUnauthorised {
 		w.Header().Set("WWW-Authenticate", "Basic realm=\"User Visible Realm\"")
@@ -579,27 +1205,101 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"err", err,
 		)
 
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		s.writeError(w, r, err)
 		return
 	}
 	defer resp.Body.Close()
 
+	s.logger.Log(
+		"level", 3,
+		"action", "response",
+		"addr", r.RemoteAddr,
+		"host", r.Host,
+		"status code", resp.StatusCode,
+		"header", redactedHeader{resp.Header, s.config.RedactHeaders},
+	)
+
 	copyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 
-	transfer(w, resp.Body, log.NewContext(s.logger).With(
+	// flush as data arrives so that streaming responses are not buffered
+	transfer(flushWriter{w}, resp.Body, log.NewContext(s.logger).With(
 		"dir", "client to user",
 		"dst", r.RemoteAddr,
 		"src", r.Host,
 	))
+
+	// status is already sent, abort the response so that it's not taken as
+	// complete
+	if b, ok := resp.Body.(*limitedResponseBody); ok && b.body.exceeded() {
+		s.logger.Log(
+			"level", 0,
+			"action", "response aborted",
+			"addr", r.RemoteAddr,
+			"host", r.Host,
+			"url", r.URL,
+			"err", errRequestBodyTooLarge,
+		)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeError writes error response to HTTP caller using error page template if
+// configured for the response status code.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	data := &ErrorPageData{
+		StatusCode: http.StatusBadGateway,
+		Host:       r.Host,
+	}
+	msg := err.Error()
+
+	switch err {
+	case errClientNotSubscribed:
+		data.StatusCode = http.StatusNotFound
+	case errRequestBodyTooLarge:
+		data.StatusCode = http.StatusRequestEntityTooLarge
+	case errRateLimited, errTooManyConns, errTenantStreams:
+		data.StatusCode = http.StatusTooManyRequests
+	case errClientTimeout:
+		data.StatusCode = http.StatusGatewayTimeout
+	}
+	// do not expose client error details to the public
+	if e, ok := err.(*proto.Error); ok {
+		data.StatusCode = e.StatusCode()
+		data.Code = e.Code
+		msg = fmt.Sprintf("%s (%s)", http.StatusText(data.StatusCode), e.Code)
+		w.Header().Set(proto.HeaderTunnelErrorCode, e.Code)
+	}
+	data.Status = http.StatusText(data.StatusCode)
+
+	if t := s.config.ErrorPages[data.StatusCode]; t != nil {
+		var buf bytes.Buffer
+		err := t.Execute(&buf, data)
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(data.StatusCode)
+			buf.WriteTo(w)
+			return
+		}
+
+		s.logger.Log(
+			"level", 0,
+			"msg", "error page failed",
+			"status code", data.StatusCode,
+			"err", err,
+		)
+	}
+
+	http.Error(w, msg, data.StatusCode)
 }
 
 // RoundTrip is http.RoundTriper implementation.
 func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
-	identifier, auth, ok := s.Subscriber(r.Host)
-	if !ok {
+	h := s.registry.lookup(r.Host)
+	if h == nil {
 		return nil, errClientNotSubscribed
 	}
+	identifier := h.identifier
 
 	outr := r.WithContext(r.Context())
 	if r.ContentLength == 0 {
@@ -607,7 +1307,7 @@ func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
 	}
 	outr.Header = cloneHeader(r.Header)
 
-	if auth != nil {
+	if auth := h.auth; auth != nil {
 		user, password, _ := r.BasicAuth()
 		if auth.User != user || auth.Password != password {
 			return nil, errUnauthorised
@@ -615,7 +1315,19 @@ func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
 		outr.Header.Del("Authorization")
 	}
 
-	setXForwardedFor(outr.Header, r.RemoteAddr)
+	// reject large bodies before sending anything to the client, bodies of
+	// unknown length are cut when limit is exceeded, and the response is
+	// rejected or aborted if it's already being sent
+	var body *limitedBody
+	if limit := s.maxBodySize(h); limit > 0 {
+		if r.ContentLength > limit {
+			return nil, errRequestBodyTooLarge
+		}
+		if r.ContentLength < 0 && outr.Body != nil {
+			body = &limitedBody{r: outr.Body, n: limit}
+			outr.Body = body
+		}
+	}
 
 	scheme := r.URL.Scheme
 	if scheme == "" {
@@ -625,21 +1337,59 @@ func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
 			scheme = proto.HTTP
 		}
 	}
-	if r.Header.Get("X-Forwarded-Host") == "" {
-		outr.Header.Set("X-Forwarded-Host", r.Host)
-		outr.Header.Set("X-Forwarded-Proto", scheme)
+	setForwarded(outr.Header, r.RemoteAddr, r.Host, scheme, s.trustedProxy(r.RemoteAddr))
+
+	if s.config.ModifyRequest != nil {
+		if err := s.config.ModifyRequest(outr); err != nil {
+			return nil, err
+		}
 	}
 
 	msg := &proto.ControlMessage{
 		Action:         proto.ActionProxy,
 		ForwardedHost:  r.Host,
 		ForwardedProto: scheme,
+		Priority:       h.priority,
+		ClientIP:       s.clientIP(r),
+	}
+
+	st := s.metrics.stats(httpTunnelName(trimPort(r.Host)), identifier)
+	start := time.Now()
+
+	resp, err := s.proxyHTTP(identifier, outr, msg, st)
+	if body != nil && body.exceeded() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, errRequestBodyTooLarge
+	}
+	if err != nil {
+		st.observe(time.Since(start), err)
+		return nil, err
 	}
 
-	return s.proxyHTTP(identifier, outr, msg)
+	if e := proto.ReadError(resp.Header); e != nil {
+		resp.Body.Close()
+		st.observe(time.Since(start), e)
+		return nil, e
+	}
+	st.observe(time.Since(start), nil)
+
+	if s.config.ModifyResponse != nil {
+		if err := s.config.ModifyResponse(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	resp.Body = &statsReadCloser{ReadCloser: resp.Body, stats: st, start: start}
+	if body != nil {
+		resp.Body = &limitedResponseBody{ReadCloser: resp.Body, body: body}
+	}
+
+	return resp, nil
 }
 
-func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMessage) error {
+func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMessage, st *tunnelStats) error {
 	s.logger.Log(
 		"level", 2,
 		"action", "proxy conn",
@@ -649,43 +1399,106 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 
 	defer conn.Close()
 
+	ts := s.tenants.of(identifier)
+	if err := ts.acquireStream(); err != nil {
+		st.observe(0, err)
+		establish(conn, err)
+		return err
+	}
+	defer ts.releaseStream()
+
 	pr, pw := io.Pipe()
 	defer pr.Close()
 	defer pw.Close()
 
+	msg.HalfClose = true
 	req, err := s.connectRequest(identifier, msg, pr)
 	if err != nil {
+		establish(conn, err)
 		return err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	req = req.WithContext(ctx)
 
+	stats := s.connPool.stats(identifier)
+	start := time.Now()
+	stop := cancelAfter(cancel, s.config.DialTimeout)
+
+	var in int64
 	done := make(chan struct{})
+	halfClose := make(chan bool, 1)
 	go func() {
-		transfer(pw, conn, log.NewContext(s.logger).With(
+		w := ts.writer(ctx, newPriorityWriter(pw, s.connPool.scheduler(identifier), msg.Priority))
+		in = transfer(w, conn, log.NewContext(s.logger).With(
 			"dir", "user to client",
 			"dst", identifier,
 			"src", conn.RemoteAddr(),
 		))
-		cancel()
+		stats.addIn(in)
+		st.addIn(in)
+		// if client supports half-close end of request closes the write
+		// side of its local connection, otherwise the stream is aborted
+		if <-halfClose {
+			pw.Close()
+		} else {
+			cancel()
+		}
 		close(done)
 	}()
 
 	resp, err := s.httpClient.Do(req)
+	if stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = errClientTimeout
+	}
 	if err != nil {
+		halfClose <- false
+		st.observe(time.Since(start), err)
+		establish(conn, err)
 		return fmt.Errorf("io error: %s", err)
 	}
 	defer resp.Body.Close()
+	halfClose <- resp.Header.Get(proto.HeaderHalfClose) != ""
+
+	if e := proto.ReadError(resp.Header); e != nil {
+		st.observe(time.Since(start), e)
+		establish(conn, e)
+		return e
+	}
+	st.observe(time.Since(start), nil)
+	establish(conn, nil)
 
-	transfer(conn, resp.Body, log.NewContext(s.logger).With(
+	var (
+		body io.Reader = resp.Body
+		hr   *halfCloseReader
+	)
+	if resp.Header.Get(proto.HeaderHalfClose) != "" {
+		hr = &halfCloseReader{r: resp.Body}
+		body = hr
+	}
+
+	out := transfer(ts.writer(ctx, conn), body, log.NewContext(s.logger).With(
 		"dir", "client to user",
 		"dst", conn.RemoteAddr(),
 		"src", identifier,
 	))
+	stats.addOut(out)
+	st.addOut(out)
+
+	// local service closed the write side, user may still be writing, the
+	// stream ends when client is done
+	if hr != nil && hr.eof {
+		closeWrite(conn)
+		io.Copy(ioutil.Discard, resp.Body)
+	}
 
 	select {
 	case <-done:
+		st.observeTransfer(in+out, time.Since(start))
 	case <-time.After(DefaultTimeout):
 	}
 
@@ -699,7 +1512,7 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 	return nil
 }
 
-func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.ControlMessage) (*http.Response, error) {
+func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.ControlMessage, st *tunnelStats) (*http.Response, error) {
 	s.logger.Log(
 		"level", 2,
 		"action", "proxy HTTP",
@@ -707,19 +1520,34 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 		"ctrlMsg", msg,
 	)
 
+	ts := s.tenants.of(identifier)
+	if err := ts.acquireStream(); err != nil {
+		return nil, err
+	}
+
 	pr, pw := io.Pipe()
 	defer pr.Close()
 	defer pw.Close()
 
 	req, err := s.connectRequest(identifier, msg, pr)
 	if err != nil {
+		ts.releaseStream()
 		return nil, fmt.Errorf("proxy request error: %s", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+
+	stats := s.connPool.stats(identifier)
+
 	go func() {
-		cw := &countWriter{pw, 0}
+		cw := &countWriter{ts.writer(ctx, newPriorityWriter(pw, s.connPool.scheduler(identifier), msg.Priority)), 0}
 		err := r.Write(cw)
 		if err != nil {
+			pw.CloseWithError(err)
+			// transport does not reset stream on request body error
+			// after response is received, the response would hang
+			cancel()
 			s.logger.Log(
 				"level", 0,
 				"msg", "proxy error",
@@ -729,6 +1557,9 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 			)
 		}
 
+		stats.addIn(cw.count)
+		st.addIn(cw.count)
+
 		s.logger.Log(
 			"level", 3,
 			"action", "transferred",
@@ -744,10 +1575,30 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 		}
 	}()
 
+	stop := cancelAfter(cancel, s.config.ResponseHeaderTimeout)
 	resp, err := s.httpClient.Do(req)
+	if stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = errClientTimeout
+	}
 	if err != nil {
+		ts.releaseStream()
+		cancel()
+		if err == errClientTimeout {
+			return nil, err
+		}
+		if ue, ok := err.(*url.Error); ok && ue.Err == errClientNotConnected {
+			return nil, errClientNotConnected
+		}
 		return nil, fmt.Errorf("io error: %s", err)
 	}
+	resp.Body = &countReadCloser{ts.readCloser(ctx, resp.Body), stats}
+	resp.Body = &releaseReadCloser{ReadCloser: resp.Body, release: func() {
+		ts.releaseStream()
+		cancel()
+	}}
 
 	s.logger.Log(
 		"level", 2,
@@ -764,11 +1615,30 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 // control message and data input stream, output data stream results from
 // response the created request.
 func (s *Server) connectRequest(identifier id.ID, msg *proto.ControlMessage, r io.Reader) (*http.Request, error) {
+	version := s.connPool.stats(identifier).protocolVersion()
+	frame := version >= proto.Version3
+	if frame {
+		m := *msg
+		// older clients reject unknown fields
+		if version < proto.Version4 {
+			m.ClientIP = ""
+		}
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("could not encode control frame: %s", err)
+		}
+		r = io.MultiReader(bytes.NewReader(b), r)
+	}
+
 	req, err := http.NewRequest(http.MethodPut, s.connPool.URL(identifier), r)
 	if err != nil {
 		return nil, fmt.Errorf("could not create request: %s", err)
 	}
-	msg.WriteToHeader(req.Header)
+	if frame {
+		req.Header.Set(proto.HeaderControlFrame, strconv.Itoa(proto.FrameVersion))
+	} else {
+		msg.WriteToHeader(req.Header)
+	}
 
 	return req, nil
 }
@@ -791,4 +1661,5 @@ func (s *Server) Stop() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	s.releaseReservations()
 }
@@ -0,0 +1,268 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestServer_ErrorPage(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(&ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{},
+		ErrorPages: map[int]*template.Template{
+			http.StatusNotFound: template.Must(template.New("404").Parse("<h1>{{.StatusCode}} {{.Host}}</h1>")),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	tests := []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{"unknown.com", http.StatusNotFound, "<h1>404 unknown.com</h1>"},
+		{"<b>", http.StatusNotFound, "<h1>404 &lt;b&gt;</h1>"},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("[%d] expected status %d got %d", i, tt.status, w.Code)
+		}
+		if w.Body.String() != tt.body {
+			t.Errorf("[%d] expected body %q got %q", i, tt.body, w.Body.String())
+		}
+	}
+}
+
+func TestServer_ModifyRequest(t *testing.T) {
+	t.Parallel()
+
+	var forwardedHost string
+	s, err := NewServer(&ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{},
+		ModifyRequest: func(r *http.Request) error {
+			forwardedHost = r.Header.Get("X-Forwarded-Host")
+			return errors.New("denied")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	identifier := id.New([]byte("client"))
+	s.Subscribe(identifier)
+	if err := s.set(&RegistryItem{Hosts: []*HostAuth{{Host: "foo.com"}}}, identifier); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "foo.com"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadGateway {
+		t.Error("Unexpected status code", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "denied") {
+		t.Error("Unexpected body", w.Body.String())
+	}
+	if forwardedHost != "foo.com" {
+		t.Error("Unexpected X-Forwarded-Host", forwardedHost)
+	}
+}
+
+func TestServer_Events(t *testing.T) {
+	t.Parallel()
+
+	var events []*Event
+	s, err := NewServer(&ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{},
+		OnEvent: func(e *Event) {
+			events = append(events, e)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	identifier := id.New([]byte("client"))
+	s.Subscribe(identifier)
+
+	err = s.addTunnels(map[string]*proto.Tunnel{
+		"www": {Protocol: proto.HTTP, Host: "foo.com"},
+	}, identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.disconnected(identifier)
+
+	err = s.addTunnels(map[string]*proto.Tunnel{
+		"ssh": {Protocol: proto.TCP, Addr: "256.0.0.1:22"},
+	}, identifier)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	expected := []string{
+		EventTunnelRegistered,
+		EventTunnelWithdrawn,
+		EventClientDisconnected,
+		EventListenerFailed,
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events got %d", len(expected), len(events))
+	}
+	for i, e := range events {
+		if e.Type != expected[i] {
+			t.Errorf("[%d] expected type %s got %s", i, expected[i], e.Type)
+		}
+		if e.Identifier != identifier {
+			t.Errorf("[%d] unexpected identifier %s", i, e.Identifier)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("[%d] missing time", i)
+		}
+	}
+	if events[0].Host != "foo.com" || events[0].Tunnel != "www" {
+		t.Error("Unexpected event", events[0])
+	}
+	if events[3].Error == "" {
+		t.Error("Missing error", events[3])
+	}
+}
+
+func TestServer_maxBodySize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		server, tunnel, limit int64
+	}{
+		{0, 0, 0},
+		{100, 0, 100},
+		{0, 100, 100},
+		{100, 50, 50},
+		{100, 200, 100},
+	}
+
+	for i, tt := range tests {
+		s := &Server{config: &ServerConfig{MaxRequestBodySize: tt.server}}
+		if limit := s.maxBodySize(&hostInfo{maxBodySize: tt.tunnel}); limit != tt.limit {
+			t.Errorf("[%d] expected limit %d got %d", i, tt.limit, limit)
+		}
+	}
+}
+
+func TestServer_checkClientQuota(t *testing.T) {
+	t.Parallel()
+
+	tunnels := map[string]*proto.Tunnel{
+		"www": {Protocol: proto.HTTP, Host: "foo.com"},
+		"tls": {Protocol: proto.SNI, Host: "bar.com"},
+		"ssh": {Protocol: proto.TCP, Addr: ":22"},
+	}
+
+	tests := []struct {
+		maxTunnels, maxHosts int
+		err                  string
+	}{
+		{0, 0, ""},
+		{3, 2, ""},
+		{2, 0, "tunnels quota exceeded, 3 requested, 2 allowed per client"},
+		{0, 1, "hosts quota exceeded, 2 requested, 1 allowed per client"},
+	}
+
+	for i, tt := range tests {
+		s := &Server{config: &ServerConfig{
+			MaxTunnelsPerClient: tt.maxTunnels,
+			MaxHostsPerClient:   tt.maxHosts,
+		}}
+		err := s.checkClientQuota(tunnels)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("[%d] expected error %q got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestServer_HTTPSRedirect(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(&ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{},
+		HTTPSRedirect: &HTTPSRedirect{
+			Port:       8443,
+			HSTSMaxAge: time.Hour,
+		},
+		ModifyRequest: func(r *http.Request) error {
+			return errors.New("proxied")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	identifier := id.New([]byte("client"))
+	s.Subscribe(identifier)
+	hosts := []*HostAuth{{Host: "foo.com", HTTPSOnly: true}, {Host: "bar.com"}, {Host: "[::1]", HTTPSOnly: true}}
+	if err := s.set(&RegistryItem{Hosts: hosts}, identifier); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url      string
+		code     int
+		location string
+		hsts     string
+	}{
+		{"http://foo.com/path?q=1", http.StatusMovedPermanently, "https://foo.com:8443/path?q=1", ""},
+		{"https://foo.com/path", http.StatusBadGateway, "", "max-age=3600"},
+		{"http://bar.com/path", http.StatusBadGateway, "", ""},
+		{"http://baz.com/path", http.StatusNotFound, "", ""},
+		{"http://[::1]/path", http.StatusMovedPermanently, "https://[::1]:8443/path", ""},
+		{"http://[::1]:80/path", http.StatusMovedPermanently, "https://[::1]:8443/path", ""},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != tt.code {
+			t.Errorf("[%d] expected status %d got %d", i, tt.code, w.Code)
+		}
+		if l := w.Header().Get("Location"); l != tt.location {
+			t.Errorf("[%d] expected location %q got %q", i, tt.location, l)
+		}
+		if h := w.Header().Get("Strict-Transport-Security"); h != tt.hsts {
+			t.Errorf("[%d] expected HSTS %q got %q", i, tt.hsts, h)
+		}
+	}
+}
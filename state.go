@@ -0,0 +1,375 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// DefaultReservationTimeout specifies how long allocations restored from
+// StateStore are reserved for their clients.
+const DefaultReservationTimeout = 5 * time.Minute
+
+// Allocation is a host or listener address assigned to a client.
+type Allocation struct {
+	// Protocol is the tunnel protocol.
+	Protocol string `json:"proto"`
+	// Host is the host of HTTP and SNI tunnels.
+	Host string `json:"host,omitempty"`
+	// Addr is the listener address of TCP tunnels.
+	Addr string `json:"addr,omitempty"`
+}
+
+// ClientAllocations holds allocations of a client.
+type ClientAllocations struct {
+	Identifier  id.ID         `json:"id"`
+	Allocations []*Allocation `json:"allocations"`
+}
+
+// StateStore persists allocations of clients so that they survive server
+// restarts, it must be safe for concurrent use.
+type StateStore interface {
+	// Load returns persisted allocations.
+	Load() ([]*ClientAllocations, error)
+	// Save replaces allocations of a client, if allocations are empty the
+	// client is removed.
+	Save(identifier id.ID, allocations []*Allocation) error
+}
+
+// FileStateStore is a StateStore keeping allocations in a JSON file, the file
+// is replaced on every change.
+type FileStateStore struct {
+	path  string
+	state map[id.ID][]*Allocation
+	mu    sync.Mutex
+}
+
+// NewFileStateStore creates FileStateStore using file at path, the file is
+// created on first save.
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{
+		path: path,
+	}
+}
+
+// Load implements StateStore.
+func (s *FileStateStore) Load() ([]*ClientAllocations, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	var c []*ClientAllocations
+	for identifier, a := range s.state {
+		c = append(c, &ClientAllocations{
+			Identifier:  identifier,
+			Allocations: a,
+		})
+	}
+	sort.Slice(c, func(i, j int) bool {
+		return c[i].Identifier.String() < c[j].Identifier.String()
+	})
+
+	return c, nil
+}
+
+// Save implements StateStore.
+func (s *FileStateStore) Save(identifier id.ID, allocations []*Allocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	if len(allocations) == 0 {
+		delete(s.state, identifier)
+	} else {
+		s.state[identifier] = allocations
+	}
+
+	return s.write()
+}
+
+// load reads state file if not loaded yet, it must be called with lock held.
+func (s *FileStateStore) load() error {
+	if s.state != nil {
+		return nil
+	}
+
+	s.state = make(map[id.ID][]*Allocation)
+
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var c []*ClientAllocations
+	if err := json.Unmarshal(b, &c); err != nil {
+		return fmt.Errorf("failed to parse file %q: %s", s.path, err)
+	}
+	for _, v := range c {
+		s.state[v.Identifier] = v.Allocations
+	}
+
+	return nil
+}
+
+// write replaces state file with a temporary file so that a crash does not
+// leave it truncated, it must be called with lock held.
+func (s *FileStateStore) write() error {
+	c := make([]*ClientAllocations, 0, len(s.state))
+	for identifier, a := range s.state {
+		c = append(c, &ClientAllocations{
+			Identifier:  identifier,
+			Allocations: a,
+		})
+	}
+	sort.Slice(c, func(i, j int) bool {
+		return c[i].Identifier.String() < c[j].Identifier.String()
+	})
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
+
+// reservedListener is a listener bound on server start for a client that is
+// expected to reconnect.
+type reservedListener struct {
+	identifier id.ID
+	listener   net.Listener
+}
+
+// reservations holds hosts and listeners restored from StateStore until
+// their clients reconnect or reservation times out.
+type reservations struct {
+	hosts     map[string]id.ID
+	listeners map[string]*reservedListener
+	released  bool
+	mu        sync.Mutex
+}
+
+func reservationKey(protocol, addr string) string {
+	return fmt.Sprint(protocol, "://", addr)
+}
+
+// restore reserves allocations loaded from StateStore, TCP listeners are
+// bound immediately.
+func (s *Server) restore() error {
+	c, err := s.config.StateStore.Load()
+	if err != nil {
+		return err
+	}
+
+	r := &reservations{
+		hosts:     make(map[string]id.ID),
+		listeners: make(map[string]*reservedListener),
+	}
+	for _, v := range c {
+		for _, a := range v.Allocations {
+			switch a.Protocol {
+			case proto.HTTP, proto.SNI:
+				r.hosts[reservationKey(a.Protocol, trimPort(a.Host))] = v.Identifier
+			case proto.TCP, proto.TCP4, proto.TCP6:
+				l, err := net.Listen(a.Protocol, a.Addr)
+				if err != nil {
+					s.logger.Log(
+						"level", 0,
+						"msg", "failed to restore listener",
+						"identifier", v.Identifier,
+						"addr", a.Addr,
+						"err", err,
+					)
+					continue
+				}
+				s.logger.Log(
+					"level", 2,
+					"action", "reserve listener",
+					"identifier", v.Identifier,
+					"addr", l.Addr(),
+				)
+				r.listeners[reservationKey(a.Protocol, a.Addr)] = &reservedListener{v.Identifier, l}
+			}
+		}
+	}
+	s.reserved = r
+
+	timeout := s.config.ReservationTimeout
+	if timeout == 0 {
+		timeout = DefaultReservationTimeout
+	}
+	time.AfterFunc(timeout, s.releaseReservations)
+
+	return nil
+}
+
+// checkReserved returns error if host or address is reserved for another
+// client.
+func (s *Server) checkReserved(identifier id.ID, t *proto.Tunnel) error {
+	r := s.reserved
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if owner, ok := r.hosts[reservationKey(t.Protocol, trimPort(t.Host))]; ok && owner != identifier {
+		return fmt.Errorf("host %q is reserved", t.Host)
+	}
+	if l, ok := r.listeners[reservationKey(t.Protocol, t.Addr)]; ok && l.identifier != identifier {
+		return fmt.Errorf("address %q is reserved", t.Addr)
+	}
+
+	return nil
+}
+
+// claimListener returns listener reserved for client or nil.
+func (s *Server) claimListener(identifier id.ID, protocol, addr string) net.Listener {
+	r := s.reserved
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := reservationKey(protocol, addr)
+	l, ok := r.listeners[k]
+	if !ok || l.identifier != identifier {
+		return nil
+	}
+	delete(r.listeners, k)
+
+	return l.listener
+}
+
+// unclaimListener returns listener to reservations if registration failed.
+func (s *Server) unclaimListener(identifier id.ID, protocol, addr string, l net.Listener) {
+	r := s.reserved
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.released {
+		l.Close()
+		return
+	}
+	r.listeners[reservationKey(protocol, addr)] = &reservedListener{identifier, l}
+}
+
+// releaseClient drops reservations of client after it registered tunnels,
+// reserved listeners the client did not claim are closed.
+func (s *Server) releaseClient(identifier id.ID) {
+	r := s.reserved
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, owner := range r.hosts {
+		if owner == identifier {
+			delete(r.hosts, k)
+		}
+	}
+	for k, l := range r.listeners {
+		if l.identifier == identifier {
+			l.listener.Close()
+			delete(r.listeners, k)
+		}
+	}
+}
+
+// releaseReservations drops all reservations, it's invoked when reservation
+// timeout elapses or server is stopped.
+func (s *Server) releaseReservations() {
+	r := s.reserved
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.hosts) > 0 || len(r.listeners) > 0 {
+		s.logger.Log(
+			"level", 1,
+			"action", "release reservations",
+			"hosts", len(r.hosts),
+			"listeners", len(r.listeners),
+		)
+	}
+
+	for _, l := range r.listeners {
+		l.listener.Close()
+	}
+	r.hosts = make(map[string]id.ID)
+	r.listeners = make(map[string]*reservedListener)
+	r.released = true
+}
+
+// saveAllocations persists allocations of tunnels registered by client.
+func (s *Server) saveAllocations(identifier id.ID, tunnels map[string]*proto.Tunnel) {
+	if s.config.StateStore == nil {
+		return
+	}
+
+	var a []*Allocation
+	for _, t := range tunnels {
+		switch t.Protocol {
+		case proto.HTTP, proto.SNI:
+			a = append(a, &Allocation{Protocol: t.Protocol, Host: t.Host})
+		case proto.TCP, proto.TCP4, proto.TCP6:
+			// random ports can't be restored
+			if _, port, _ := net.SplitHostPort(t.Addr); port == "0" || port == "" {
+				continue
+			}
+			a = append(a, &Allocation{Protocol: t.Protocol, Addr: t.Addr})
+		}
+	}
+	sort.Slice(a, func(i, j int) bool {
+		return reservationKey(a[i].Protocol, a[i].Host+a[i].Addr) < reservationKey(a[j].Protocol, a[j].Host+a[j].Addr)
+	})
+
+	if err := s.config.StateStore.Save(identifier, a); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "failed to save allocations",
+			"identifier", identifier,
+			"err", err,
+		)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestFileStateStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+
+	s := NewFileStateStore(path)
+	if c, err := s.Load(); err != nil || len(c) != 0 {
+		t.Fatal("Unexpected state", c, err)
+	}
+	allocations := []*Allocation{{Protocol: proto.HTTP, Host: "foo.com"}, {Protocol: proto.TCP, Addr: "0.0.0.0:22"}}
+	if err := s.Save(a, allocations); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(b, []*Allocation{{Protocol: proto.SNI, Host: "bar.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewFileStateStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 || c[0].Identifier != a || !reflect.DeepEqual(c[0].Allocations, allocations) {
+		t.Errorf("Unexpected state %+v", c)
+	}
+}
+
+func TestServer_RestoreState(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+
+	store := NewFileStateStore(filepath.Join(dir, "state.json"))
+	store.Save(a, []*Allocation{{Protocol: proto.HTTP, Host: "foo.com"}, {Protocol: proto.TCP, Addr: addr}})
+
+	s, err := NewServer(&ServerConfig{
+		Addr:       "127.0.0.1:0",
+		TLSConfig:  &tls.Config{},
+		StateStore: store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// listener is bound before client reconnects
+	if l, err := net.Listen("tcp", addr); err == nil {
+		l.Close()
+		t.Fatal("listener not restored")
+	}
+
+	s.Subscribe(a)
+	s.Subscribe(b)
+
+	tests := []struct {
+		tunnel *proto.Tunnel
+		err    string
+	}{
+		{&proto.Tunnel{Protocol: proto.HTTP, Host: "foo.com"}, "host \"foo.com\" is reserved"},
+		{&proto.Tunnel{Protocol: proto.TCP, Addr: addr}, "is reserved"},
+	}
+	for i, tt := range tests {
+		err := s.addTunnels(map[string]*proto.Tunnel{"t": tt.tunnel}, b)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("[%d] expected error %q got %v", i, tt.err, err)
+		}
+	}
+
+	err = s.addTunnels(map[string]*proto.Tunnel{
+		"www": {Protocol: proto.HTTP, Host: "foo.com"},
+		"ssh": {Protocol: proto.TCP, Addr: addr},
+	}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := s.lookup("foo.com"); h == nil || h.identifier != a {
+		t.Error("Unexpected host", h)
+	}
+
+	c, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 || len(c[0].Allocations) != 2 {
+		t.Errorf("Unexpected state %+v", c)
+	}
+	if len(s.reserved.hosts) != 0 || len(s.reserved.listeners) != 0 {
+		t.Error("Reservations not released")
+	}
+}
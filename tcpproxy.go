@@ -5,9 +5,13 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"time"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
@@ -24,6 +28,15 @@ type TCPProxy struct {
 	// * port
 	// * host
 	localAddrMap map[string]string
+	// Backends specifies optional mapping from local server address to
+	// backend started on demand.
+	Backends map[string]*OnDemandBackend
+	// TLSClientConfigs specifies optional mapping from local server
+	// address to TLS configuration used to connect to it over TLS.
+	TLSClientConfigs map[string]*tls.Config
+	// DialTimeout specifies how long to wait for connection to local
+	// server, if 0 DefaultTimeout is used.
+	DialTimeout time.Duration
 	// logger is the proxy logger.
 	logger log.Logger
 }
@@ -56,6 +69,12 @@ func NewMultiTCPProxy(localAddrMap map[string]string, logger log.Logger) *TCPPro
 
 // Proxy is a ProxyFunc.
 func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+	p.ProxyContext(context.Background(), w, r, msg)
+}
+
+// ProxyContext is a ProxyFuncContext, dialing local server is aborted and
+// connection to local server is closed when ctx is done.
+func (p *TCPProxy) ProxyContext(ctx context.Context, w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
 	switch msg.ForwardedProto {
 	case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX, proto.SNI:
 		// ok
@@ -65,6 +84,7 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 			"msg", "unsupported protocol",
 			"ctrlMsg", msg,
 		)
+		proxyError(w, proto.ErrorCodeUnsupportedProtocol, fmt.Errorf("unsupported protocol %q", msg.ForwardedProto))
 		return
 	}
 
@@ -75,10 +95,22 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 			"msg", "no target",
 			"ctrlMsg", msg,
 		)
+		proxyError(w, proto.ErrorCodeNoTarget, fmt.Errorf("no target for %q", msg.ForwardedHost))
 		return
 	}
 
-	local, err := net.DialTimeout("tcp", target, DefaultTimeout)
+	var (
+		local net.Conn
+		err   error
+	)
+	if b := p.Backends[target]; b != nil {
+		local, err = b.DialContext(ctx, "tcp", target)
+	} else {
+		d := &net.Dialer{
+			Timeout: p.dialTimeout(),
+		}
+		local, err = d.DialContext(ctx, "tcp", target)
+	}
 	if err != nil {
 		p.logger.Log(
 			"level", 0,
@@ -87,11 +119,17 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 			"ctrlMsg", msg,
 			"err", err,
 		)
+		proxyError(w, dialErrorCode(err), err)
 		return
 	}
 	defer local.Close()
+	defer closeOnDone(ctx, local)()
 
-	if err := keepAlive(local); err != nil {
+	raw := local
+	if c, ok := local.(*onDemandConn); ok {
+		raw = c.Conn
+	}
+	if err := keepAlive(raw); err != nil {
 		p.logger.Log(
 			"level", 1,
 			"msg", "TCP keepalive for tunneled connection failed",
@@ -101,12 +139,45 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 		)
 	}
 
+	if c := p.TLSClientConfigs[target]; c != nil {
+		tlsConn := tls.Client(local, c)
+		tlsConn.SetDeadline(time.Now().Add(DefaultTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			p.logger.Log(
+				"level", 0,
+				"msg", "TLS handshake failed",
+				"target", target,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+			proxyError(w, proto.ErrorCodeProxyFailed, err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		local = tlsConn
+	}
+
+	var out io.Writer = flushWriter{w}
+	var hw *halfCloseWriter
+	if rw, ok := w.(http.ResponseWriter); ok && msg.HalfClose {
+		// send header now, server decides on half-close when it arrives
+		rw.Header().Set(proto.HeaderHalfClose, "1")
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		hw = &halfCloseWriter{out}
+		out = hw
+	}
+
 	done := make(chan struct{})
 	go func() {
-		transfer(flushWriter{w}, local, log.NewContext(p.logger).With(
+		transfer(out, local, log.NewContext(p.logger).With(
 			"dst", msg.ForwardedHost,
 			"src", target,
 		))
+		if hw != nil {
+			hw.CloseWrite()
+		}
 		close(done)
 	}()
 
@@ -114,10 +185,18 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 		"dst", target,
 		"src", msg.ForwardedHost,
 	))
+	closeWrite(local)
 
 	<-done
 }
 
+func (p *TCPProxy) dialTimeout() time.Duration {
+	if p.DialTimeout > 0 {
+		return p.DialTimeout
+	}
+	return DefaultTimeout
+}
+
 func (p *TCPProxy) localAddrFor(hostPort string) string {
 	if len(p.localAddrMap) == 0 {
 		return p.localAddr
@@ -134,10 +213,13 @@ func (p *TCPProxy) localAddrFor(hostPort string) string {
 		return addr
 	}
 
-	// try 0.0.0.0:port
+	// try 0.0.0.0:port and [::]:port
 	if addr := p.localAddrMap[fmt.Sprintf("0.0.0.0:%s", port)]; addr != "" {
 		return addr
 	}
+	if addr := p.localAddrMap[fmt.Sprintf("[::]:%s", port)]; addr != "" {
+		return addr
+	}
 
 	// try host
 	if addr := p.localAddrMap[host]; addr != "" {
@@ -0,0 +1,121 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestTCPProxy_ProxyContextCancel(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}()
+
+	p := NewTCPProxy(l.Addr().String(), nil)
+
+	// r blocks until closed
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.ProxyContext(ctx, ioutil.Discard, pr, &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedHost:  "localhost:2000",
+			ForwardedProto: proto.TCP,
+		})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	pw.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Proxy not interrupted")
+	}
+}
+
+func TestTCPProxy_TLSClientConfig(t *testing.T) {
+	t.Parallel()
+
+	cert, err := tls.LoadX509KeyPair("./testdata/selfsigned.crt", "./testdata/selfsigned.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					conn.Write(buf)
+				}
+				conn.Close()
+			}()
+		}
+	}()
+
+	tests := []struct {
+		config *tls.Config
+		echo   string
+	}{
+		{&tls.Config{InsecureSkipVerify: true}, "ping"},
+		{&tls.Config{ServerName: "foo.com"}, ""},
+	}
+
+	for i, tt := range tests {
+		p := NewTCPProxy(l.Addr().String(), nil)
+		p.TLSClientConfigs = map[string]*tls.Config{l.Addr().String(): tt.config}
+
+		w := httptest.NewRecorder()
+		p.ProxyContext(context.Background(), w, ioutil.NopCloser(strings.NewReader("ping")), &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedHost:  "localhost:2000",
+			ForwardedProto: proto.TCP,
+		})
+
+		body := w.Body.String()
+		if tt.echo != "" && body != tt.echo {
+			t.Errorf("[%d] expected echo %q got %q", i, tt.echo, body)
+		}
+		if tt.echo == "" && w.Header().Get(proto.HeaderTunnelErrorCode) != proto.ErrorCodeProxyFailed {
+			t.Errorf("[%d] expected proxy error got %q", i, w.Header().Get(proto.HeaderTunnelErrorCode))
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Tenant groups clients sharing quotas, zero quota means no limit.
+type Tenant struct {
+	// Name identifies the tenant, clients of tenants with the same name
+	// share quotas.
+	Name string
+	// MaxTunnels limits number of tunnels registered by clients of the
+	// tenant.
+	MaxTunnels int
+	// MaxHosts limits number of HTTP and SNI hostnames registered by
+	// clients of the tenant.
+	MaxHosts int
+	// Bandwidth limits combined traffic of tenant tunnels in both
+	// directions in bytes per second.
+	Bandwidth int64
+	// MaxStreams limits number of concurrent HTTP requests and TCP
+	// connections of tenant tunnels.
+	MaxStreams int
+}
+
+// tenantUsage holds tunnels registered by a client.
+type tenantUsage struct {
+	tunnels int
+	hosts   int
+}
+
+// tenantState tracks usage of tenant quotas, methods are safe to call on nil.
+type tenantState struct {
+	tenant    *Tenant
+	usage     map[id.ID]tenantUsage
+	streams   int
+	bandwidth *bandwidthLimiter
+	mu        sync.Mutex
+}
+
+// tenants maps clients to tenant states.
+type tenants struct {
+	byName  map[string]*tenantState
+	clients map[id.ID]*tenantState
+	mu      sync.Mutex
+}
+
+func newTenants() *tenants {
+	return &tenants{
+		byName:  make(map[string]*tenantState),
+		clients: make(map[id.ID]*tenantState),
+	}
+}
+
+// assign sets tenant of client, if t is nil client has no quotas.
+func (ts *tenants) assign(identifier id.ID, t *Tenant) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if t == nil {
+		delete(ts.clients, identifier)
+		return
+	}
+
+	st, ok := ts.byName[t.Name]
+	if !ok {
+		st = &tenantState{
+			tenant: t,
+			usage:  make(map[id.ID]tenantUsage),
+		}
+		if t.Bandwidth > 0 {
+			st.bandwidth = newBandwidthLimiter(t.Bandwidth)
+		}
+		ts.byName[t.Name] = st
+	}
+	ts.clients[identifier] = st
+}
+
+// of returns tenant state of client or nil.
+func (ts *tenants) of(identifier id.ID) *tenantState {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.clients[identifier]
+}
+
+// register checks that tunnels fit in tenant quotas and records them as
+// registered by client.
+func (t *tenantState) register(identifier id.ID, tunnels map[string]*proto.Tunnel) error {
+	if t == nil {
+		return nil
+	}
+
+	u := tenantUsage{
+		tunnels: len(tunnels),
+	}
+	for _, tun := range tunnels {
+		if tun.Protocol == proto.HTTP || tun.Protocol == proto.SNI {
+			u.hosts++
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var total tenantUsage
+	for i, v := range t.usage {
+		if i == identifier {
+			continue
+		}
+		total.tunnels += v.tunnels
+		total.hosts += v.hosts
+	}
+
+	if max := t.tenant.MaxTunnels; max > 0 && total.tunnels+u.tunnels > max {
+		return fmt.Errorf("tenant %s: tunnels quota exceeded, %d of %d in use", t.tenant.Name, total.tunnels, max)
+	}
+	if max := t.tenant.MaxHosts; max > 0 && total.hosts+u.hosts > max {
+		return fmt.Errorf("tenant %s: hosts quota exceeded, %d of %d in use", t.tenant.Name, total.hosts, max)
+	}
+
+	t.usage[identifier] = u
+
+	return nil
+}
+
+// unregister removes tunnels registered by client.
+func (t *tenantState) unregister(identifier id.ID) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.usage, identifier)
+	t.mu.Unlock()
+}
+
+// acquireStream takes a stream slot, releaseStream must be called when stream
+// is done.
+func (t *tenantState) acquireStream() error {
+	if t == nil || t.tenant.MaxStreams <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.streams >= t.tenant.MaxStreams {
+		return errTenantStreams
+	}
+	t.streams++
+
+	return nil
+}
+
+// releaseStream frees stream slot taken by acquireStream.
+func (t *tenantState) releaseStream() {
+	if t == nil || t.tenant.MaxStreams <= 0 {
+		return
+	}
+	t.mu.Lock()
+	if t.streams > 0 {
+		t.streams--
+	}
+	t.mu.Unlock()
+}
+
+// writer returns w limited to tenant bandwidth, waiting for bandwidth is
+// interrupted when ctx is done.
+func (t *tenantState) writer(ctx context.Context, w io.Writer) io.Writer {
+	if t == nil || t.bandwidth == nil {
+		return w
+	}
+	return &throttledWriter{w, t.bandwidth, ctx}
+}
+
+// readCloser returns r limited to tenant bandwidth, waiting for bandwidth is
+// interrupted when ctx is done.
+func (t *tenantState) readCloser(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if t == nil || t.bandwidth == nil {
+		return r
+	}
+	return &throttledReadCloser{r, t.bandwidth, ctx}
+}
+
+// bandwidthLimiter is a token bucket of bytes, burst is one second of
+// traffic.
+type bandwidthLimiter struct {
+	bucket tokenBucket
+	now    func() time.Time
+	sleep  func(ctx context.Context, d time.Duration) error
+	mu     sync.Mutex
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	rate := float64(bytesPerSecond)
+	return &bandwidthLimiter{
+		bucket: newTokenBucket(rate, rate, time.Now()),
+		now:    time.Now,
+		sleep:  sleepContext,
+	}
+}
+
+// chunk returns maximal number of bytes taken by a single wait, it's the
+// burst so that a stream waits at most a second for its own traffic.
+func (l *bandwidthLimiter) chunk() int {
+	if l.bucket.burst < 1 {
+		return 1
+	}
+	return int(l.bucket.burst)
+}
+
+// wait takes n tokens, if there are not enough tokens it blocks until the
+// debt is paid or ctx is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	d := l.bucket.debit(l.now(), n)
+	l.mu.Unlock()
+
+	if d > 0 {
+		return l.sleep(ctx, d)
+	}
+	return nil
+}
+
+// sleepContext sleeps for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		t.Stop()
+		return ctx.Err()
+	}
+}
+
+// throttledWriter writes in chunks of at most limiter burst waiting for
+// bandwidth before each of them.
+type throttledWriter struct {
+	w   io.Writer
+	l   *bandwidthLimiter
+	ctx context.Context
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		b := p
+		if c := w.l.chunk(); len(b) > c {
+			b = b[:c]
+		}
+		if err := w.l.wait(w.ctx, len(b)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(b)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledReadCloser reads at most limiter burst at once and waits for
+// bandwidth after each read.
+type throttledReadCloser struct {
+	io.ReadCloser
+	l   *bandwidthLimiter
+	ctx context.Context
+}
+
+func (r *throttledReadCloser) Read(p []byte) (int, error) {
+	if c := r.l.chunk(); len(p) > c {
+		p = p[:c]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if e := r.l.wait(r.ctx, n); e != nil && err == nil {
+			err = e
+		}
+	}
+	return n, err
+}
+
+// releaseReadCloser calls release once when closed.
+type releaseReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestTenants_Register(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+	c := id.New([]byte("c"))
+
+	ts := newTenants()
+	tenant := &Tenant{Name: "acme", MaxTunnels: 3, MaxHosts: 2}
+	ts.assign(a, tenant)
+	ts.assign(b, tenant)
+	ts.assign(c, nil)
+
+	if ts.of(a) != ts.of(b) {
+		t.Fatal("expected shared tenant state")
+	}
+	if ts.of(c) != nil {
+		t.Fatal("expected no tenant")
+	}
+
+	tests := []struct {
+		identifier id.ID
+		tunnels    map[string]*proto.Tunnel
+		err        string
+	}{
+		{a, map[string]*proto.Tunnel{
+			"www": {Protocol: proto.HTTP, Host: "a.com"},
+			"ssh": {Protocol: proto.TCP, Addr: ":22"},
+		}, ""},
+		{b, map[string]*proto.Tunnel{
+			"www": {Protocol: proto.HTTP, Host: "b.com"},
+			"tls": {Protocol: proto.SNI, Host: "c.com"},
+		}, "tenant acme: tunnels quota exceeded, 2 of 3 in use"},
+		{b, map[string]*proto.Tunnel{
+			"tls": {Protocol: proto.SNI, Host: "c.com"},
+		}, ""},
+		{b, map[string]*proto.Tunnel{
+			"www": {Protocol: proto.HTTP, Host: "b.com"},
+		}, ""},
+		{a, map[string]*proto.Tunnel{
+			"www": {Protocol: proto.HTTP, Host: "a.com"},
+			"tls": {Protocol: proto.SNI, Host: "d.com"},
+		}, "tenant acme: hosts quota exceeded, 1 of 2 in use"},
+		{c, map[string]*proto.Tunnel{
+			"www": {Protocol: proto.HTTP, Host: "e.com"},
+		}, ""},
+	}
+
+	for i, tt := range tests {
+		err := ts.of(tt.identifier).register(tt.identifier, tt.tunnels)
+		if tt.err == "" && err != nil {
+			t.Errorf("[%d] unexpected error %s", i, err)
+		}
+		if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("[%d] expected error %q got %v", i, tt.err, err)
+		}
+	}
+
+	ts.of(b).unregister(b)
+	if err := ts.of(a).register(a, tests[4].tunnels); err != nil {
+		t.Errorf("unexpected error after unregister %s", err)
+	}
+}
+
+func TestTenants_Streams(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	ts := newTenants()
+	ts.assign(a, &Tenant{Name: "acme", MaxStreams: 2})
+	st := ts.of(a)
+
+	for i := 0; i < 2; i++ {
+		if err := st.acquireStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.acquireStream(); err != errTenantStreams {
+		t.Fatal("expected errTenantStreams got", err)
+	}
+	st.releaseStream()
+	if err := st.acquireStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	var none *tenantState
+	if err := none.acquireStream(); err != nil {
+		t.Fatal(err)
+	}
+	none.releaseStream()
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	var slept time.Duration
+
+	l := newBandwidthLimiter(100)
+	l.bucket.last = now
+	l.now = func() time.Time { return now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		slept += d
+		return nil
+	}
+
+	tests := []struct {
+		advance time.Duration
+		n       int
+		slept   time.Duration
+	}{
+		{0, 100, 0},
+		{0, 50, 500 * time.Millisecond},
+		{time.Second, 50, 0},
+		{0, 25, 250 * time.Millisecond},
+		{10 * time.Second, 100, 0},
+		{0, 200, 2 * time.Second},
+	}
+
+	for i, tt := range tests {
+		now = now.Add(tt.advance)
+		slept = 0
+		l.wait(context.Background(), tt.n)
+		if slept != tt.slept {
+			t.Errorf("[%d] expected sleep %s got %s", i, tt.slept, slept)
+		}
+	}
+}
+
+func TestBandwidthLimiterCancel(t *testing.T) {
+	t.Parallel()
+
+	l := newBandwidthLimiter(100)
+	l.wait(context.Background(), 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := l.wait(ctx, 100); err != context.Canceled {
+		t.Fatalf("expected %s got %v", context.Canceled, err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("wait not interrupted, took %s", d)
+	}
+}
+
+func TestThrottledWriter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	var sleeps []time.Duration
+
+	l := newBandwidthLimiter(100)
+	l.bucket.last = now
+	l.now = func() time.Time { return now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	w := &throttledWriter{&buf, l, context.Background()}
+	n, err := w.Write(make([]byte, 250))
+	if n != 250 || err != nil {
+		t.Fatalf("expected 250 bytes got %d %v", n, err)
+	}
+	if buf.Len() != 250 {
+		t.Fatalf("expected 250 bytes written got %d", buf.Len())
+	}
+
+	expected := []time.Duration{time.Second, 1500 * time.Millisecond}
+	if len(sleeps) != len(expected) {
+		t.Fatalf("expected sleeps %v got %v", expected, sleeps)
+	}
+	for i := range expected {
+		if sleeps[i] != expected[i] {
+			t.Errorf("[%d] expected sleep %s got %s", i, expected[i], sleeps[i])
+		}
+	}
+}
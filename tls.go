@@ -0,0 +1,134 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy specifies TLS protocol versions, cipher suites and elliptic curves
+// allowed on connections. Values are human readable names, versions are given
+// as "1.2" or "1.3", cipher suites as crypto/tls constant names i.e.
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", curves as "P256", "P384", "P521"
+// or "X25519". Empty values are not applied.
+type TLSPolicy struct {
+	MinVersion       string
+	MaxVersion       string
+	CipherSuites     []string
+	CurvePreferences []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":          tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":        tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+// Apply validates the policy and sets it on c.
+func (p *TLSPolicy) Apply(c *tls.Config) error {
+	var (
+		min, max uint16
+		ok       bool
+	)
+
+	if p.MinVersion != "" {
+		if min, ok = tlsVersions[p.MinVersion]; !ok {
+			return fmt.Errorf("min_version: unknown TLS version %q", p.MinVersion)
+		}
+		// HTTP/2 requires TLS 1.2, see RFC 7540 section 9.2
+		if min < tls.VersionTLS12 {
+			return fmt.Errorf("min_version: TLS %s not supported, at least 1.2 is required", p.MinVersion)
+		}
+	}
+	if p.MaxVersion != "" {
+		if max, ok = tlsVersions[p.MaxVersion]; !ok {
+			return fmt.Errorf("max_version: unknown TLS version %q", p.MaxVersion)
+		}
+		if max < tls.VersionTLS12 {
+			return fmt.Errorf("max_version: TLS %s not supported, at least 1.2 is required", p.MaxVersion)
+		}
+	}
+	if min != 0 && max != 0 && min > max {
+		return fmt.Errorf("min_version %s is greater than max_version %s", p.MinVersion, p.MaxVersion)
+	}
+
+	var suites []uint16
+	for _, name := range p.CipherSuites {
+		s, ok := tlsCipherSuites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return fmt.Errorf("cipher_suites: unknown cipher suite %q", name)
+		}
+		suites = append(suites, s)
+	}
+	// HTTP/2 requires TLS 1.2 connections to use one of these, see RFC 7540
+	// section 9.2.2, TLS 1.3 suites are not configurable
+	if suites != nil && min != tls.VersionTLS13 && !hasHTTP2CipherSuite(suites) {
+		return fmt.Errorf("cipher_suites: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 is required by HTTP/2")
+	}
+
+	var curves []tls.CurveID
+	for _, name := range p.CurvePreferences {
+		cv, ok := tlsCurves[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return fmt.Errorf("curve_preferences: unknown curve %q", name)
+		}
+		curves = append(curves, cv)
+	}
+
+	if min != 0 {
+		c.MinVersion = min
+	}
+	if max != 0 {
+		c.MaxVersion = max
+	}
+	if suites != nil {
+		c.CipherSuites = suites
+	}
+	if curves != nil {
+		c.CurvePreferences = curves
+	}
+
+	return nil
+}
+
+// hasHTTP2CipherSuite returns true if suites contain cipher suite required by
+// HTTP/2.
+func hasHTTP2CipherSuite(suites []uint16) bool {
+	for _, s := range suites {
+		if s == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || s == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
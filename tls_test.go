@@ -0,0 +1,90 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTLSPolicyApply(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		policy   TLSPolicy
+		expected *tls.Config
+		error    string
+	}{
+		{
+			policy:   TLSPolicy{},
+			expected: &tls.Config{},
+		},
+		{
+			policy: TLSPolicy{
+				MinVersion:       "1.2",
+				MaxVersion:       "1.3",
+				CipherSuites:     []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_rsa_with_aes_256_gcm_sha384"},
+				CurvePreferences: []string{"X25519", "p256"},
+			},
+			expected: &tls.Config{
+				MinVersion:       tls.VersionTLS12,
+				MaxVersion:       tls.VersionTLS13,
+				CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+				CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+			},
+		},
+		{
+			policy: TLSPolicy{MinVersion: "1.1"},
+			error:  "at least 1.2 is required",
+		},
+		{
+			policy: TLSPolicy{MinVersion: "2.0"},
+			error:  "unknown TLS version",
+		},
+		{
+			policy: TLSPolicy{MinVersion: "1.3", MaxVersion: "1.2"},
+			error:  "greater than max_version",
+		},
+		{
+			policy: TLSPolicy{CipherSuites: []string{"TLS_FOO"}},
+			error:  "unknown cipher suite",
+		},
+		{
+			policy: TLSPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+			error:  "cipher_suites: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 is required",
+		},
+		{
+			policy: TLSPolicy{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+			expected: &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+			},
+		},
+		{
+			policy: TLSPolicy{CurvePreferences: []string{"P128"}},
+			error:  "unknown curve",
+		},
+	}
+
+	for i, tt := range tests {
+		c := &tls.Config{}
+		err := tt.policy.Apply(c)
+		if tt.error != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("[%d] expected error contains %q, got %v", i, tt.error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] unexpected error %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tt.expected) {
+			t.Errorf("[%d] expected %+v got %+v", i, tt.expected, c)
+		}
+	}
+}
@@ -5,16 +5,49 @@
 package tunnel
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
-func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
-	n, err := io.Copy(dst, src)
+// copyBufferSize is the size of buffers used to copy stream data, a stream
+// holds at most one buffer per direction and writes block until the buffer is
+// consumed, slow readers thus slow down writers instead of growing memory.
+const copyBufferSize = 32 << 10
+
+// bufferPool is a pool of copy buffers, it implements httputil.BufferPool.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func (p *bufferPool) Get() []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, copyBufferSize)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if len(b) != copyBufferSize {
+		return
+	}
+	p.pool.Put(&b)
+}
+
+var copyBuffers = &bufferPool{}
+
+// transfer copies src to dst and returns the number of bytes copied.
+func transfer(dst io.Writer, src io.Reader, logger log.Logger) int64 {
+	n, err := copyStream(dst, src)
 	if err != nil {
 		if !strings.Contains(err.Error(), "context canceled") && !strings.Contains(err.Error(), "CANCEL") {
 			logger.Log(
@@ -30,6 +63,98 @@ func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
 		"action", "transferred",
 		"bytes", n,
 	)
+
+	return n
+}
+
+// copyStream copies src to dst with pooled buffer. ReadFrom of dst is used
+// only if it does not need a buffer of its own, i.e. splice or sendfile
+// between sockets and files, otherwise io.CopyBuffer would defer to
+// net.TCPConn ReadFrom or WriteTo that allocate a buffer per stream.
+func copyStream(dst io.Writer, src io.Reader) (int64, error) {
+	if rf := directReaderFrom(dst, src); rf != nil {
+		return rf.ReadFrom(src)
+	}
+
+	buf := copyBuffers.Get()
+	n, err := io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf)
+	copyBuffers.Put(buf)
+	return n, err
+}
+
+// directReaderFrom returns dst if it can read from src without copying to
+// intermediate buffer, otherwise nil.
+func directReaderFrom(dst io.Writer, src io.Reader) io.ReaderFrom {
+	switch d := dst.(type) {
+	case *halfCloseWriter:
+		return d
+	case *net.TCPConn:
+		switch src.(type) {
+		case *net.TCPConn, *os.File:
+			return d
+		}
+	}
+	return nil
+}
+
+// readerOnly hides io.WriterTo of Reader.
+type readerOnly struct {
+	io.Reader
+}
+
+// writerOnly hides io.ReaderFrom of Writer.
+type writerOnly struct {
+	io.Writer
+}
+
+// closeOnDone closes c when ctx is done, the returned function stops watching
+// ctx and must be called to release resources.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// cancelAfter calls cancel after d unless the returned stop function is called
+// first, stop reports whether cancel was called. If d is 0 cancel is never
+// called.
+func cancelAfter(cancel context.CancelFunc, d time.Duration) (stop func() bool) {
+	if d <= 0 {
+		return func() bool { return false }
+	}
+	t := time.AfterFunc(d, cancel)
+	return func() bool {
+		return !t.Stop()
+	}
+}
+
+// proxyError reports proxying error to the server, it must be called before
+// anything is written to w.
+func proxyError(w io.Writer, code string, err error) {
+	rw, ok := w.(http.ResponseWriter)
+	if !ok {
+		return
+	}
+	proto.WriteError(rw, &proto.Error{
+		Code:    code,
+		Message: err.Error(),
+	})
+}
+
+// dialErrorCode returns error code for dial error.
+func dialErrorCode(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return proto.ErrorCodeTimeout
+	}
+	return proto.ErrorCodeDialFailed
 }
 
 func setXForwardedFor(h http.Header, remoteAddr string) {
@@ -45,6 +170,16 @@ func setXForwardedFor(h http.Header, remoteAddr string) {
 	}
 }
 
+// lastXForwardedFor returns the last address from X-Forwarded-For header.
+func lastXForwardedFor(h http.Header) string {
+	prior := h["X-Forwarded-For"]
+	if len(prior) == 0 {
+		return ""
+	}
+	s := strings.Split(prior[len(prior)-1], ",")
+	return strings.TrimSpace(s[len(s)-1])
+}
+
 func cloneHeader(h http.Header) http.Header {
 	h2 := make(http.Header, len(h))
 	for k, vv := range h {
@@ -74,6 +209,56 @@ func (cw *countWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// limitedBody is like http.MaxBytesReader but it records if the limit was
+// exceeded.
+type limitedBody struct {
+	r    io.ReadCloser
+	n    int64
+	over int32
+}
+
+func (b *limitedBody) Read(p []byte) (n int, err error) {
+	if b.n < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err = b.r.Read(p)
+	if int64(n) <= b.n {
+		b.n -= int64(n)
+		return n, err
+	}
+
+	atomic.StoreInt32(&b.over, 1)
+	b.n = -1
+	return 0, errRequestBodyTooLarge
+}
+
+func (b *limitedBody) Close() error {
+	return b.r.Close()
+}
+
+func (b *limitedBody) exceeded() bool {
+	return atomic.LoadInt32(&b.over) == 1
+}
+
+// limitedResponseBody fails reads of response once request body exceeded the
+// limit, response may be sent by a streaming backend before it reads the
+// whole request body.
+type limitedResponseBody struct {
+	io.ReadCloser
+	body *limitedBody
+}
+
+func (r *limitedResponseBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.body.exceeded() {
+		return n, errRequestBodyTooLarge
+	}
+	return n, err
+}
+
 type flushWriter struct {
 	w io.Writer
 }
@@ -0,0 +1,182 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+)
+
+// HeaderWebhookSignature is the webhook request header holding HMAC-SHA256 of
+// the request body in form "sha256=<hex>".
+const HeaderWebhookSignature = "X-Tunnel-Signature"
+
+// DefaultWebhookQueueSize specifies how many messages may wait for delivery,
+// when the queue is full new messages are dropped.
+var DefaultWebhookQueueSize = 128
+
+// Webhook posts JSON encoded messages to URL in order, it's safe for concurrent
+// use.
+type Webhook struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	queue   chan []byte
+	closing chan struct{}
+	stopped chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	logger  log.Logger
+}
+
+// NewWebhook creates a new Webhook and starts delivering messages. If secret is
+// not empty messages are signed with HMAC-SHA256 and the signature is sent in
+// HeaderWebhookSignature.
+func NewWebhook(url, secret string, logger log.Logger) *Webhook {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	w := &Webhook{
+		url:     url,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: DefaultTimeout},
+		queue:   make(chan []byte, DefaultWebhookQueueSize),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+	go w.run()
+
+	return w
+}
+
+// Post queues v for delivery.
+func (w *Webhook) Post(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.logger.Log(
+			"level", 0,
+			"msg", "webhook marshal failed",
+			"url", w.url,
+			"err", err,
+		)
+		return
+	}
+
+	select {
+	case w.queue <- b:
+	default:
+		w.logger.Log(
+			"level", 0,
+			"msg", "webhook queue full, message dropped",
+			"url", w.url,
+		)
+	}
+}
+
+// PostEvent queues event for delivery, it can be used as ServerConfig.OnEvent.
+func (w *Webhook) PostEvent(e *Event) {
+	w.Post(e)
+}
+
+// Close delivers queued messages and stops, messages not delivered within
+// DefaultTimeout and messages posted after Close are dropped.
+func (w *Webhook) Close() {
+	w.once.Do(func() {
+		close(w.closing)
+		select {
+		case <-w.stopped:
+		case <-time.After(DefaultTimeout):
+			close(w.done)
+			<-w.stopped
+		}
+	})
+}
+
+func (w *Webhook) run() {
+	defer close(w.stopped)
+
+	for {
+		select {
+		case b := <-w.queue:
+			w.deliver(b)
+		case <-w.closing:
+			for {
+				select {
+				case b := <-w.queue:
+					w.deliver(b)
+				case <-w.done:
+					return
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *Webhook) deliver(b []byte) {
+	if err := w.send(b); err != nil {
+		w.logger.Log(
+			"level", 0,
+			"msg", "webhook delivery failed",
+			"url", w.url,
+			"err", err,
+		)
+	}
+}
+
+func (w *Webhook) send(b []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) != 0 {
+		req.Header.Set(HeaderWebhookSignature, "sha256="+SignWebhook(w.secret, b))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// SignWebhook returns hex encoded HMAC-SHA256 of webhook body, receivers
+// compare it with HeaderWebhookSignature value.
+func SignWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
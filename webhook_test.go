@@ -0,0 +1,96 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+
+	type delivery struct {
+		body      []byte
+		signature string
+	}
+	ch := make(chan delivery, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		ch <- delivery{b, r.Header.Get(HeaderWebhookSignature)}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		secret string
+	}{
+		{""},
+		{"secret"},
+	}
+
+	for i, tt := range tests {
+		w := NewWebhook(ts.URL, tt.secret, nil)
+
+		identifier := id.New([]byte("client"))
+		w.PostEvent(&Event{
+			Type:       EventTunnelRegistered,
+			Identifier: identifier,
+			Host:       "foo.com",
+		})
+
+		var d delivery
+		select {
+		case d = <-ch:
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("[%d] webhook not delivered", i)
+		}
+		w.Close()
+
+		var e Event
+		if err := json.Unmarshal(d.body, &e); err != nil {
+			t.Fatalf("[%d] unmarshal failed: %s", i, err)
+		}
+		if e.Type != EventTunnelRegistered || e.Host != "foo.com" || e.Identifier != identifier {
+			t.Errorf("[%d] unexpected event %+v", i, e)
+		}
+
+		expected := ""
+		if tt.secret != "" {
+			expected = "sha256=" + SignWebhook([]byte(tt.secret), d.body)
+		}
+		if d.signature != expected {
+			t.Errorf("[%d] expected signature %q got %q", i, expected, d.signature)
+		}
+	}
+}
+
+func TestWebhookCloseDeliversQueued(t *testing.T) {
+	t.Parallel()
+
+	const n = 3
+	ch := make(chan struct{}, n)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		ch <- struct{}{}
+	}))
+	defer ts.Close()
+
+	w := NewWebhook(ts.URL, "", nil)
+	for i := 0; i < n; i++ {
+		w.Post(i)
+	}
+	w.Close()
+
+	if len(ch) != n {
+		t.Fatalf("expected %d deliveries got %d", n, len(ch))
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client transports.
+const (
+	// TransportTCP connects to the server with TLS over TCP.
+	TransportTCP = "tcp"
+	// TransportWebSocket connects to the server with TLS carried over a
+	// WebSocket opened with HTTPS request to WebSocketPath.
+	TransportWebSocket = "ws"
+)
+
+// WebSocketPath is the path of WebSocket upgrade requests opening client
+// connections.
+const WebSocketPath = "/_tunnel/ws"
+
+// webSocketProtocol is WebSocket subprotocol of client connections, requests
+// without it are proxied as usual.
+const webSocketProtocol = "go-http-tunnel"
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var errWebSocketHandshake = errors.New("websocket handshake failed")
+
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// isWebSocketTunnel returns true if r opens a client connection.
+func isWebSocketTunnel(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		r.URL.Path == WebSocketPath &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerContains(r.Header, "Sec-WebSocket-Protocol", webSocketProtocol)
+}
+
+func headerContains(h http.Header, key, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket upgrades r to WebSocket and handles it as a client
+// connection.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, errWebSocketHandshake.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "websocket hijack failed",
+			"addr", r.RemoteAddr,
+			"err", err,
+		)
+		return
+	}
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n"+
+		"Sec-WebSocket-Protocol: %s\r\n\r\n", webSocketAccept(key), webSocketProtocol)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	s.logger.Log(
+		"level", 2,
+		"action", "websocket upgrade",
+		"addr", r.RemoteAddr,
+	)
+
+	go s.handleClient(tls.Server(newWebSocketConn(conn, rw.Reader, false), s.config.TLSConfig))
+}
+
+// dialWebSocket connects to the server over WebSocket, TLS connection with
+// config is established over WebSocket opened with HTTPS request to addr.
+func dialWebSocket(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout: DefaultTimeout,
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := keepAlive(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	outer := config.Clone()
+	outer.Certificates = nil
+	outer.GetClientCertificate = nil
+	outer.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, outer)
+	if err := handshake(ctx, tlsConn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws, err := webSocketHandshake(ctx, tlsConn, addr)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	inner := tls.Client(ws, config)
+	if err := handshake(ctx, inner); err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	return inner, nil
+}
+
+// webSocketHandshake sends WebSocket upgrade request over conn and returns
+// WebSocket connection.
+func webSocketHandshake(ctx context.Context, conn net.Conn, host string) (net.Conn, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(b[:])
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+host+WebSocketPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", webSocketProtocol)
+
+	deadline := time.Now().Add(DefaultTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%s: unexpected status %s", errWebSocketHandshake, resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, fmt.Errorf("%s: invalid Sec-WebSocket-Accept", errWebSocketHandshake)
+	}
+
+	return newWebSocketConn(conn, br, true), nil
+}
+
+// webSocketConn is a net.Conn sending data in binary WebSocket messages.
+type webSocketConn struct {
+	net.Conn
+	r *bufio.Reader
+	// client connections mask written frames
+	client bool
+
+	// remaining is the number of payload bytes left in the current frame
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	wmu sync.Mutex
+}
+
+func newWebSocketConn(conn net.Conn, r *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{
+		Conn:   conn,
+		r:      r,
+		client: client,
+	}
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		opcode, err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsContinuation, wsText, wsBinary:
+		case wsClose:
+			c.discard()
+			c.writeFrame(wsClose, nil)
+			return 0, io.EOF
+		case wsPing:
+			b, err := c.readControl()
+			if err != nil {
+				return 0, err
+			}
+			if err := c.writeFrame(wsPong, b); err != nil {
+				return 0, err
+			}
+		case wsPong:
+			if _, err := c.readControl(); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= int64(n)
+
+	return n, err
+}
+
+// nextFrame reads frame header.
+func (c *webSocketConn) nextFrame() (opcode byte, err error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return 0, err
+	}
+	opcode = h[0] & 0x0f
+	c.masked = h[1]&0x80 != 0
+
+	n := int64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return 0, err
+		}
+		n = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return 0, err
+		}
+		n = int64(binary.BigEndian.Uint64(b[:]))
+		if n < 0 {
+			return 0, errors.New("websocket: invalid frame length")
+		}
+	}
+
+	if c.masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return 0, err
+		}
+	}
+	c.maskPos = 0
+	c.remaining = n
+
+	return opcode, nil
+}
+
+func (c *webSocketConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// readControl reads payload of control frame.
+func (c *webSocketConn) readControl() ([]byte, error) {
+	if c.remaining > 125 {
+		return nil, errors.New("websocket: control frame too long")
+	}
+	b := make([]byte, c.remaining)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+	c.unmask(b)
+	c.remaining = 0
+
+	return b, nil
+}
+
+func (c *webSocketConn) discard() {
+	c.r.Discard(int(c.remaining))
+	c.remaining = 0
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes a single final frame.
+func (c *webSocketConn) writeFrame(opcode byte, p []byte) error {
+	b := make([]byte, 0, 14+len(p))
+	b = append(b, 0x80|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(p); {
+	case n <= 125:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xffff:
+		b = append(b, maskBit|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, maskBit|127)
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(n))
+		b = append(b, l[:]...)
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		b = append(b, mask[:]...)
+		for i, v := range p {
+			b = append(b, v^mask[i&3])
+		}
+	} else {
+		b = append(b, p...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := c.Conn.Write(b)
+	return err
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebSocketConn(t *testing.T) {
+	t.Parallel()
+
+	a, b := net.Pipe()
+	client := newWebSocketConn(a, bufio.NewReader(a), true)
+	server := newWebSocketConn(b, bufio.NewReader(b), false)
+	defer client.Close()
+	defer server.Close()
+
+	tests := []struct {
+		from, to *webSocketConn
+		size     int
+	}{
+		{client, server, 1},
+		{client, server, 125},
+		{client, server, 126},
+		{server, client, 0xffff},
+		{server, client, 0x10000},
+	}
+
+	for i, tt := range tests {
+		p := bytes.Repeat([]byte{byte(i + 1)}, tt.size)
+		go tt.from.Write(p)
+
+		buf := make([]byte, tt.size)
+		if _, err := io.ReadFull(tt.to, buf); err != nil {
+			t.Fatalf("[%d] read failed: %s", i, err)
+		}
+		if !bytes.Equal(buf, p) {
+			t.Errorf("[%d] payload mismatch", i)
+		}
+	}
+
+	// ping is answered with pong and skipped by reader
+	go func() {
+		client.writeFrame(wsPing, []byte("ping"))
+		client.Write([]byte("data"))
+	}()
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "data" {
+			t.Errorf("expected data got %q %v", buf, err)
+		}
+		close(done)
+	}()
+	var h [2]byte
+	if _, err := io.ReadFull(client.r, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != 0x80|wsPong || h[1] != 4 {
+		t.Errorf("expected pong got %x", h)
+	}
+	client.r.Discard(4)
+	<-done
+
+	// close
+	go func() {
+		client.writeFrame(wsClose, nil)
+		io.Copy(ioutil.Discard, client.r)
+	}()
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF got %v", err)
+	}
+}
+
+func TestIsWebSocketTunnel(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(http.MethodGet, "https://tunnel.com"+WebSocketPath, nil)
+	r.Header.Set("Upgrade", "WebSocket")
+	r.Header.Set("Sec-WebSocket-Protocol", "chat, "+webSocketProtocol)
+	if !isWebSocketTunnel(r) {
+		t.Error("expected tunnel request")
+	}
+
+	r.Header.Set("Sec-WebSocket-Protocol", "chat")
+	if isWebSocketTunnel(r) {
+		t.Error("expected regular request")
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	t.Parallel()
+
+	// example from RFC 6455
+	if a := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); a != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept %q", a)
+	}
+}